@@ -0,0 +1,161 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// ErrOverloaded is returned by Admit when a work pool sheds a job; the
+// request is answered 503 so clients retry later.
+var ErrOverloaded = errors.New("server overloaded, retry later")
+
+// WorkPool selects the pool a job is admitted to. Each pool has its own
+// slots and queue, so a storm of transcodes cannot starve origin downloads
+// or image resizes. Cache hits run no job and are never queued.
+type WorkPool string
+
+const (
+	// PoolPassthrough runs origin downloads while staging.
+	PoolPassthrough WorkPool = "passthrough"
+	// PoolImage runs image conversions and quick probes.
+	PoolImage WorkPool = "image"
+	// PoolHeavy runs video, audio and document conversions.
+	PoolHeavy WorkPool = "heavy"
+)
+
+// setting returns the MEDIAX.<Name>Concurrency key of the pool.
+func (p WorkPool) setting() string {
+	switch p {
+	case PoolPassthrough:
+		return "MEDIAX.PassthroughConcurrency"
+	case PoolImage:
+		return "MEDIAX.ImageConcurrency"
+	default:
+		return "MEDIAX.HeavyConcurrency"
+	}
+}
+
+// defaultConcurrency is the slot count of the pool when its setting is unset.
+func (p WorkPool) defaultConcurrency() int {
+	switch p {
+	case PoolPassthrough:
+		return 4 * runtime.NumCPU()
+	case PoolImage:
+		return runtime.NumCPU()
+	default:
+		return max(runtime.NumCPU()/2, 1)
+	}
+}
+
+// workPools holds the state of every pool by name.
+var workPools sync.Map
+
+type workPool struct {
+	mu      sync.Mutex
+	running int
+	waiting []chan struct{}
+}
+
+// admissionLimits reads the limits of pool: its slots (0 means unlimited),
+// the jobs that may wait for one and how long each may wait.
+func admissionLimits(pool WorkPool) (slots, queue int, timeout time.Duration) {
+	slots = settings.Get(pool.setting(), pool.defaultConcurrency()).Int()
+	queue = settings.Get("MEDIAX.QueueSize", 64).Int()
+	timeout, err := ParseDuration(settings.Get("MEDIAX.QueueTimeout", "30s").String())
+	if err != nil {
+		log.Warning("invalid MEDIAX.QueueTimeout, using 30s", "error", err)
+		timeout = 30 * time.Second
+	}
+	return slots, queue, timeout
+}
+
+// Admit waits for a slot in pool and returns the function releasing it.
+// Jobs queue in arrival order; when MEDIAX.QueueSize jobs are already
+// waiting, or no slot frees up within MEDIAX.QueueTimeout or before ctx is
+// done, the job is shed with ErrOverloaded.
+func Admit(ctx context.Context, pool WorkPool) (func(), error) {
+	slots, queue, timeout := admissionLimits(pool)
+	if slots <= 0 {
+		return func() {}, nil
+	}
+	v, _ := workPools.LoadOrStore(pool, &workPool{})
+	p := v.(*workPool)
+	release := func() { p.release(pool, slots) }
+
+	p.mu.Lock()
+	// Slots added by a settings change go to jobs already waiting.
+	for p.running < slots && len(p.waiting) > 0 {
+		p.running++
+		MetricWorkRunning.WithLabelValues(string(pool)).Inc()
+		close(p.waiting[0])
+		p.waiting = p.waiting[1:]
+	}
+	if p.running < slots {
+		p.running++
+		p.mu.Unlock()
+		MetricWorkRunning.WithLabelValues(string(pool)).Inc()
+		MetricWorkWaitSeconds.WithLabelValues(string(pool)).Observe(0)
+		return release, nil
+	}
+	if len(p.waiting) >= queue {
+		p.mu.Unlock()
+		MetricWorkShedTotal.WithLabelValues(string(pool), "queue_full").Inc()
+		return nil, ErrOverloaded
+	}
+	ready := make(chan struct{})
+	p.waiting = append(p.waiting, ready)
+	p.mu.Unlock()
+	MetricWorkQueued.WithLabelValues(string(pool)).Inc()
+	defer MetricWorkQueued.WithLabelValues(string(pool)).Dec()
+
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		MetricWorkWaitSeconds.WithLabelValues(string(pool)).Observe(time.Since(start).Seconds())
+		return release, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	if !p.dequeue(ready) {
+		// The slot was handed over while giving up; pass it on.
+		release()
+	}
+	MetricWorkShedTotal.WithLabelValues(string(pool), "timeout").Inc()
+	return nil, ErrOverloaded
+}
+
+// release hands the slot to the oldest waiting job, or frees it. Slots above
+// the current limit (lowered by a settings change) are freed, not handed on.
+func (p *workPool) release(pool WorkPool, slots int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.waiting) > 0 && p.running <= slots {
+		close(p.waiting[0])
+		p.waiting = p.waiting[1:]
+		return
+	}
+	p.running--
+	MetricWorkRunning.WithLabelValues(string(pool)).Dec()
+}
+
+// dequeue removes ready from the queue and reports whether it was waiting,
+// i.e. had not been handed a slot yet.
+func (p *workPool) dequeue(ready chan struct{}) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.waiting {
+		if c == ready {
+			p.waiting = append(p.waiting[:i], p.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package media
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/db/types"
+	"github.com/getevo/restify"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrQuotaExceeded is returned by APIKey.CheckQuota once a key has used up
+// its monthly bytes or transformations.
+var ErrQuotaExceeded = errors.New("monthly quota exceeded")
+
+// APIKey identifies a tenant on origins with require_api_key. Each key has
+// optional monthly quotas; usage is tracked per calendar month (UTC).
+type APIKey struct {
+	APIKeyID int    `gorm:"column:api_key_id;primaryKey;autoIncrement" json:"api_key_id"`
+	Tenant   string `gorm:"column:tenant;size:255" json:"tenant"`
+	Token    string `gorm:"column:token;size:255;uniqueIndex" json:"token"`
+	// ProjectID limits the key to one project; 0 allows every project.
+	ProjectID int  `gorm:"column:project_id" json:"project_id"`
+	Active    bool `gorm:"column:active" json:"active"`
+	// MonthlyBytes caps the bytes served per month (e.g. "500GB"); empty is unlimited.
+	MonthlyBytes string `gorm:"column:monthly_bytes;size:32" json:"monthly_bytes"`
+	// MonthlyTransformations caps processed requests per month; 0 is unlimited.
+	MonthlyTransformations int64 `gorm:"column:monthly_transformations" json:"monthly_transformations"`
+	types.CreatedAt
+	types.UpdatedAt
+	types.SoftDelete
+	restify.API
+}
+
+func (APIKey) TableName() string {
+	return "api_key"
+}
+
+// APIKeyUsage is the usage of one key in one month (YYYY-MM).
+type APIKeyUsage struct {
+	APIKeyID        int    `gorm:"column:api_key_id;primaryKey" json:"api_key_id"`
+	Month           string `gorm:"column:month;size:7;primaryKey" json:"month"`
+	Bytes           int64  `gorm:"column:bytes" json:"bytes"`
+	Transformations int64  `gorm:"column:transformations" json:"transformations"`
+}
+
+func (APIKeyUsage) TableName() string {
+	return "api_key_usage"
+}
+
+// CurrentMonth returns the usage period of now, e.g. "2026-10".
+func CurrentMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// usageTracker keeps the current month's usage: totals as last read from the
+// database (shared by every instance) plus this instance's unflushed deltas.
+type usageTracker struct {
+	mu      sync.Mutex
+	month   string
+	totals  map[int]APIKeyUsage
+	pending map[int]APIKeyUsage
+}
+
+var keyUsage = usageTracker{totals: map[int]APIKeyUsage{}, pending: map[int]APIKeyUsage{}}
+
+// rollover resets the counters when a new month starts. Callers hold mu.
+func (t *usageTracker) rollover() {
+	if month := CurrentMonth(); month != t.month {
+		t.month = month
+		t.totals = map[int]APIKeyUsage{}
+		t.pending = map[int]APIKeyUsage{}
+	}
+}
+
+// current returns the usage of keyID this month, including unflushed deltas.
+func (t *usageTracker) current(keyID int) APIKeyUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollover()
+	total, delta := t.totals[keyID], t.pending[keyID]
+	return APIKeyUsage{
+		APIKeyID:        keyID,
+		Month:           t.month,
+		Bytes:           total.Bytes + delta.Bytes,
+		Transformations: total.Transformations + delta.Transformations,
+	}
+}
+
+// CheckQuota returns ErrQuotaExceeded when k has used up a monthly quota.
+func (k *APIKey) CheckQuota() error {
+	usage := keyUsage.current(k.APIKeyID)
+	if maxBytes, _ := ParseCacheSize(k.MonthlyBytes); maxBytes > 0 && usage.Bytes >= maxBytes {
+		return ErrQuotaExceeded
+	}
+	if k.MonthlyTransformations > 0 && usage.Transformations >= k.MonthlyTransformations {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// RecordAPIKeyUsage adds served bytes and transformations to keyID's usage.
+func RecordAPIKeyUsage(keyID int, bytes, transformations int64) {
+	keyUsage.mu.Lock()
+	defer keyUsage.mu.Unlock()
+	keyUsage.rollover()
+	u := keyUsage.pending[keyID]
+	u.Bytes += bytes
+	u.Transformations += transformations
+	keyUsage.pending[keyID] = u
+}
+
+// APIKeyUsageThisMonth returns the current month's usage of every key that
+// has any, including unflushed deltas.
+func APIKeyUsageThisMonth() []APIKeyUsage {
+	keyUsage.mu.Lock()
+	ids := map[int]bool{}
+	for id := range keyUsage.totals {
+		ids[id] = true
+	}
+	for id := range keyUsage.pending {
+		ids[id] = true
+	}
+	keyUsage.mu.Unlock()
+	result := make([]APIKeyUsage, 0, len(ids))
+	for id := range ids {
+		result = append(result, keyUsage.current(id))
+	}
+	return result
+}
+
+// SyncAPIKeyUsage adds this instance's unflushed usage to the database and
+// reloads the month's totals, which include the usage of other instances.
+func SyncAPIKeyUsage() error {
+	keyUsage.mu.Lock()
+	keyUsage.rollover()
+	month, pending := keyUsage.month, keyUsage.pending
+	keyUsage.pending = map[int]APIKeyUsage{}
+	keyUsage.mu.Unlock()
+
+	for id, u := range pending {
+		row := APIKeyUsage{APIKeyID: id, Month: month, Bytes: u.Bytes, Transformations: u.Transformations}
+		err := db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "api_key_id"}, {Name: "month"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"bytes":           gorm.Expr("bytes + ?", u.Bytes),
+				"transformations": gorm.Expr("transformations + ?", u.Transformations),
+			}),
+		}).Create(&row).Error
+		if err != nil {
+			// Keep the unwritten deltas for the next attempt.
+			for id, u := range pending {
+				RecordAPIKeyUsage(id, u.Bytes, u.Transformations)
+			}
+			return err
+		}
+		delete(pending, id)
+	}
+
+	var rows []APIKeyUsage
+	if err := db.Where("month = ?", month).Find(&rows).Error; err != nil {
+		return err
+	}
+	totals := make(map[int]APIKeyUsage, len(rows))
+	for _, r := range rows {
+		totals[r.APIKeyID] = r
+	}
+	keyUsage.mu.Lock()
+	if keyUsage.month == month {
+		keyUsage.totals = totals
+	}
+	keyUsage.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,171 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/db/types"
+	"gorm.io/gorm"
+)
+
+// MaxAssetMetadataBytes is the largest metadata of one asset, as JSON.
+const MaxAssetMetadataBytes = 64 << 10
+
+// ErrInvalidAssetMetadata is returned for metadata ValidateAssetMetadata
+// rejects.
+var ErrInvalidAssetMetadata = errors.New("invalid asset metadata")
+
+// AssetMetadata holds arbitrary key/values about one asset of a project,
+// such as alt text, a title, a focal point or tags, for the applications
+// that display it. Path is relative to the storage, as staged.
+type AssetMetadata struct {
+	AssetMetadataID int    `gorm:"column:asset_metadata_id;primaryKey;autoIncrement" json:"asset_metadata_id"`
+	ProjectID       int    `gorm:"column:project_id;fk:project;uniqueIndex:asset_metadata_asset" json:"project_id"`
+	Path            string `gorm:"column:path;size:1024" json:"path"`
+	// PathHash keys the asset; paths are too long for a unique index.
+	PathHash string         `gorm:"column:path_hash;size:64;uniqueIndex:asset_metadata_asset" json:"-"`
+	Data     map[string]any `gorm:"column:data;type:text;serializer:json" json:"data"`
+	types.CreatedAt
+	types.UpdatedAt
+}
+
+func (AssetMetadata) TableName() string {
+	return "asset_metadata"
+}
+
+// CleanAssetPath returns p as assets are keyed: slash-separated, without
+// leading or trailing slashes.
+func CleanAssetPath(p string) string {
+	return strings.Trim(path.Clean("/"+strings.ReplaceAll(p, `\`, "/")), "/")
+}
+
+func assetPathHash(p string) string {
+	sum := sha256.Sum256([]byte(CleanAssetPath(p)))
+	return hex.EncodeToString(sum[:])
+}
+
+// BeforeSave keys the record by its path and rejects data that fails
+// ValidateAssetMetadata.
+func (m *AssetMetadata) BeforeSave(tx *gorm.DB) error {
+	if m.Path = CleanAssetPath(m.Path); m.Path == "" {
+		return errors.New("path is required")
+	}
+	m.PathHash = assetPathHash(m.Path)
+	return ValidateAssetMetadata(m.Data)
+}
+
+// ValidateAssetMetadata checks the size of data and the well-known keys:
+// alt and title are strings, tags a list of strings, and focal_point an
+// object of x and y between 0 and 1 (fractions of the width and height from
+// the top left). Other keys may hold any JSON value.
+func ValidateAssetMetadata(data map[string]any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAssetMetadata, err)
+	}
+	if len(encoded) > MaxAssetMetadataBytes {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrInvalidAssetMetadata, len(encoded), MaxAssetMetadataBytes)
+	}
+	for key, value := range data {
+		if key == "" || len(key) > 64 {
+			return fmt.Errorf("%w: key %q must be 1 to 64 characters", ErrInvalidAssetMetadata, key)
+		}
+		switch key {
+		case "alt", "title":
+			if _, ok := value.(string); !ok {
+				return fmt.Errorf("%w: %s must be a string", ErrInvalidAssetMetadata, key)
+			}
+		case "tags":
+			tags, ok := value.([]any)
+			for _, tag := range tags {
+				if _, isString := tag.(string); !isString {
+					ok = false
+				}
+			}
+			if !ok {
+				return fmt.Errorf("%w: tags must be a list of strings", ErrInvalidAssetMetadata)
+			}
+		case "focal_point":
+			point, _ := value.(map[string]any)
+			x, okX := point["x"].(float64)
+			y, okY := point["y"].(float64)
+			if !okX || !okY || len(point) != 2 || x < 0 || x > 1 || y < 0 || y > 1 {
+				return fmt.Errorf(`%w: focal_point must be {"x": 0-1, "y": 0-1}`, ErrInvalidAssetMetadata)
+			}
+		}
+	}
+	return nil
+}
+
+// FindAssetMetadata returns the metadata of the asset at p in the project,
+// or nil when none is stored.
+func FindAssetMetadata(projectID int, p string) (*AssetMetadata, error) {
+	var m AssetMetadata
+	err := db.Where("project_id = ? AND path_hash = ?", projectID, assetPathHash(p)).Take(&m).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ListAssetMetadata returns up to limit records of the project whose path
+// starts with prefix, by path.
+func ListAssetMetadata(projectID int, prefix string, limit int) ([]AssetMetadata, error) {
+	query := db.Where("project_id = ?", projectID)
+	if prefix = CleanAssetPath(prefix); prefix != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+		query = query.Where("path LIKE ?", escaped+"/%")
+	}
+	records := []AssetMetadata{}
+	err := query.Order("path").Limit(limit).Find(&records).Error
+	return records, err
+}
+
+// SetAssetMetadata stores data as the metadata of the asset at p, replacing
+// it or, with merge, adding its keys to the stored ones; a null value then
+// removes a key. It returns the stored record, or ErrInvalidAssetMetadata
+// when the result fails validation.
+func SetAssetMetadata(projectID int, p string, data map[string]any, merge bool) (*AssetMetadata, error) {
+	var m AssetMetadata
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("project_id = ? AND path_hash = ?", projectID, assetPathHash(p)).Take(&m).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if !merge || m.Data == nil {
+			m.Data = map[string]any{}
+		}
+		for k, v := range data {
+			if v == nil && merge {
+				delete(m.Data, k)
+			} else {
+				m.Data[k] = v
+			}
+		}
+		if err := ValidateAssetMetadata(m.Data); err != nil {
+			return err
+		}
+		m.ProjectID, m.Path = projectID, p
+		return tx.Save(&m).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// DeleteAssetMetadata removes the metadata of the asset at p and reports
+// whether there was any.
+func DeleteAssetMetadata(projectID int, p string) (bool, error) {
+	result := db.Where("project_id = ? AND path_hash = ?", projectID, assetPathHash(p)).Delete(&AssetMetadata{})
+	return result.RowsAffected > 0, result.Error
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
 )
 
 // ParseCacheSize converts a human-readable size string (e.g. "1 GB", "500MB", "10gb")
@@ -52,6 +53,17 @@ func ParseCacheSize(s string) (int64, error) {
 	return n, nil
 }
 
+// ParseCacheTTL converts a cache lifetime (e.g. "30m", "12h", "7d") to a
+// time.Duration, accepting the same forms as ParseDuration.
+// Returns 0, nil for empty or "0" input (meaning no expiry).
+func ParseCacheTTL(s string) (time.Duration, error) {
+	d, err := ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cache ttl %q", strings.TrimSpace(strings.ToLower(s)))
+	}
+	return d, nil
+}
+
 // DirSize returns the total size of all regular files under dir.
 func DirSize(dir string) (int64, error) {
 	var total int64
@@ -68,37 +80,104 @@ func DirSize(dir string) (int64, error) {
 	return total, err
 }
 
-// EvictCache removes the oldest files in dir until the total size is ≤ maxBytes.
-// Lock files (*.lock) and directories are never removed.
+// EvictionExclusions returns the cache subdirectories (relative to a project's
+// cache dir, comma-separated in MEDIAX.EvictionExclude) that eviction must not touch.
+func EvictionExclusions() []string {
+	var dirs []string
+	for _, d := range strings.Split(settings.Get("MEDIAX.EvictionExclude", "").String(), ",") {
+		if d = strings.Trim(filepath.ToSlash(strings.TrimSpace(d)), "/"); d != "" {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// isExcluded reports whether rel (slash-separated, relative to the cache dir)
+// lies inside one of the excluded directories.
+func isExcluded(rel string, exclude []string) bool {
+	for _, d := range exclude {
+		if rel == d || strings.HasPrefix(rel, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// EvictionWatermarks returns the high and low watermarks as fractions of a
+// project's cache size. Eviction starts once the cache exceeds the high mark
+// and removes files until it is back under the low mark.
+func EvictionWatermarks() (high, low float64) {
+	high = float64(settings.Get("MEDIAX.EvictionHighWatermark", 100).Int()) / 100
+	low = float64(settings.Get("MEDIAX.EvictionLowWatermark", 100).Int()) / 100
+	if high <= 0 {
+		high = 1
+	}
+	if low <= 0 || low > high {
+		low = high
+	}
+	return high, low
+}
+
+// EvictCache removes files in dir until the total size is ≤ maxBytes, lowest
+// policy priority first and oldest first within a priority.
+// Lock files (*.lock), in-progress downloads (*.part), directories, files in
+// use by a request (see AcquireCacheFile) and files the policy excludes or
+// pins are never removed; skipped files still count toward the total.
 // Returns the number of files removed and total bytes freed.
-func EvictCache(dir string, maxBytes int64) (removed int, freed int64, err error) {
+func EvictCache(dir string, maxBytes int64, policy EvictionPolicy) (removed int, freed int64, err error) {
+	return trimCache(dir, maxBytes, policy, func(path, _ string) error {
+		return os.Remove(path)
+	})
+}
+
+// trimCache selects files in dir the same way EvictCache does and hands them
+// to drop (path, slash-separated path relative to dir) until the total size
+// is ≤ maxBytes. drop must remove the file from dir.
+func trimCache(dir string, maxBytes int64, policy EvictionPolicy, drop func(path, rel string) error) (removed int, freed int64, err error) {
 	if maxBytes <= 0 {
 		return 0, 0, nil
 	}
 
 	type entry struct {
-		path string
-		size int64
-		mod  time.Time
+		path     string
+		rel      string
+		size     int64
+		mod      time.Time
+		priority int
 	}
 
 	var entries []entry
 	var total int64
+	protected := inUseSnapshot()
+	sources := cacheSources{}
 
 	walkErr := filepath.WalkDir(dir, func(p string, d fs.DirEntry, werr error) error {
 		if werr != nil || d.IsDir() {
 			return nil
 		}
-		// Never evict active lock files — they mark in-progress downloads.
-		if strings.HasSuffix(p, ".lock") {
+		// Never evict active lock files or partial downloads — they mark in-progress staging.
+		if strings.HasSuffix(p, ".lock") || strings.HasSuffix(p, ".part") {
 			return nil
 		}
 		info, infoErr := d.Info()
 		if infoErr != nil {
 			return nil
 		}
-		entries = append(entries, entry{path: p, size: info.Size(), mod: info.ModTime()})
 		total += info.Size()
+		rel, relErr := filepath.Rel(dir, p)
+		if relErr != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		var source string
+		if len(policy.Priorities) > 0 {
+			source = sources.of(p)
+		}
+		priority, evictable := policy.rank(rel, source)
+		if !evictable || protected[filepath.Clean(p)] {
+			return nil
+		}
+		entries = append(entries, entry{path: p, rel: rel, size: info.Size(), mod: lastUse(filepath.Clean(p), info.ModTime()), priority: priority})
 		return nil
 	})
 	if walkErr != nil {
@@ -109,8 +188,11 @@ func EvictCache(dir string, maxBytes int64) (removed int, freed int64, err error
 		return 0, 0, nil // already within limit
 	}
 
-	// Evict oldest files first.
+	// Evict low-priority files first, oldest first within a priority.
 	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].priority != entries[j].priority {
+			return entries[i].priority < entries[j].priority
+		}
 		return entries[i].mod.Before(entries[j].mod)
 	})
 
@@ -118,10 +200,11 @@ func EvictCache(dir string, maxBytes int64) (removed int, freed int64, err error
 		if total <= maxBytes {
 			break
 		}
-		if removeErr := os.Remove(e.path); removeErr != nil {
+		if removeErr := drop(e.path, e.rel); removeErr != nil {
 			log.Warning("cache eviction: failed to remove file", "path", e.path, "error", removeErr)
 			continue
 		}
+		forgetUse(filepath.Clean(e.path))
 		total -= e.size
 		freed += e.size
 		removed++
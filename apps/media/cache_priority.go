@@ -0,0 +1,114 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/db/types"
+	"github.com/getevo/restify"
+)
+
+// CachePriority ranks cache entries under a path prefix for eviction.
+// Prefixes are relative to the project cache dir: staged originals mirror the
+// origin path (e.g. "brand/logos/"), derived outputs live under their variant
+// directory (e.g. "profiles/"). A derived output also matches the prefixes of
+// its source path, read from the key's source sidecar (see
+// RecordCacheSource), so "brand/logos/" covers the thumbnails of the logos
+// too; outputs written before the sidecar existed match their variant
+// directory only. Entries with a lower priority are evicted first; pinned
+// entries are never evicted by the size limit.
+type CachePriority struct {
+	CachePriorityID int    `gorm:"column:cache_priority_id;primaryKey;autoIncrement" json:"cache_priority_id"`
+	ProjectID       int    `gorm:"column:project_id;fk:project" json:"project_id"`
+	Prefix          string `gorm:"column:prefix;size:255" json:"prefix"`
+	Priority        int    `gorm:"column:priority" json:"priority"`
+	Pinned          bool   `gorm:"column:pinned" json:"pinned"`
+	types.CreatedAt
+	types.UpdatedAt
+	types.SoftDelete
+	restify.API
+}
+
+func (CachePriority) TableName() string {
+	return "cache_priority"
+}
+
+// EvictionPolicy controls which cache files EvictCache may remove and in
+// which order.
+type EvictionPolicy struct {
+	Exclude    []string        // cache subdirectories never evicted
+	Priorities []CachePriority // prefix rules, longest matching prefix wins
+}
+
+// EvictionPolicy returns the policy for p's cache: the global exclusions plus
+// the project's priority rules.
+func (p *Project) EvictionPolicy() EvictionPolicy {
+	return EvictionPolicy{Exclude: EvictionExclusions(), Priorities: p.CachePriorities}
+}
+
+// rank returns the eviction priority of rel (slash-separated, relative to
+// the cache dir) and whether it may be evicted at all. source is the source
+// path of a derived output, "" for other files.
+func (ep EvictionPolicy) rank(rel, source string) (priority int, evictable bool) {
+	if isExcluded(rel, ep.Exclude) {
+		return 0, false
+	}
+	best := -1
+	for _, rule := range ep.Priorities {
+		prefix := strings.TrimLeft(filepath.ToSlash(rule.Prefix), "/")
+		matches := strings.HasPrefix(rel, prefix) || source != "" && strings.HasPrefix(source, prefix)
+		if matches && len(prefix) > best {
+			best = len(prefix)
+			priority, evictable = rule.Priority, !rule.Pinned
+		}
+	}
+	if best < 0 {
+		return 0, true
+	}
+	return priority, evictable
+}
+
+// sourceSuffix names the sidecar holding the source path of the derived
+// outputs of a cache key, next to them in their shard directory.
+const sourceSuffix = ".source"
+
+// RecordCacheSource writes the source sidecar of the derived output at
+// outputPath, if outputPath is a keyed file below the derived prefix of
+// cacheDir without one, so eviction can match priority rules against source
+// (see CachePriority).
+func RecordCacheSource(cacheDir, outputPath, source string) {
+	if cacheDir == "" || !strings.HasPrefix(filepath.Clean(outputPath), DerivedDir(filepath.Clean(cacheDir), "")+string(filepath.Separator)) {
+		return
+	}
+	name := filepath.Base(outputPath)
+	if !isHexKey(name) || strings.HasSuffix(name, sourceSuffix) {
+		return
+	}
+	sidecar := filepath.Join(filepath.Dir(outputPath), name[:32]+sourceSuffix)
+	if _, err := os.Stat(sidecar); err == nil {
+		return
+	}
+	os.WriteFile(sidecar, []byte(strings.TrimLeft(filepath.ToSlash(source), "/")), 0644) //nolint:errcheck
+}
+
+// cacheSources reads the source sidecars of derived outputs for one
+// eviction run, once per key.
+type cacheSources map[string]string
+
+// of returns the source path recorded for the keyed file at path, or "".
+func (c cacheSources) of(path string) string {
+	name := filepath.Base(path)
+	if !isHexKey(name) {
+		return ""
+	}
+	sidecar := filepath.Join(filepath.Dir(path), name[:32]+sourceSuffix)
+	source, ok := c[sidecar]
+	if !ok {
+		if data, err := os.ReadFile(sidecar); err == nil {
+			source = string(data)
+		}
+		c[sidecar] = source
+	}
+	return source
+}
@@ -0,0 +1,117 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrCacheQuotaExceeded is returned by EnsureCacheQuota when a project's cache
+// stays over its cache_size even after eviction.
+var ErrCacheQuotaExceeded = errors.New("project cache quota exceeded")
+
+// cacheUsage holds the bytes in each cache directory: measured by the
+// eviction loop (SetCacheUsage) and grown by every file requests write
+// since (RecordCacheWrite), so quotas hold between eviction runs.
+var cacheUsage sync.Map // cache dir → *atomic.Int64
+
+// quotaEvictions holds the cache dirs a request is evicting, so concurrent
+// requests over quota start one eviction.
+var quotaEvictions sync.Map
+
+// SetCacheUsage records the measured size of the cache directory dir.
+func SetCacheUsage(dir string, bytes int64) {
+	v, _ := cacheUsage.LoadOrStore(filepath.Clean(dir), new(atomic.Int64))
+	v.(*atomic.Int64).Store(bytes)
+}
+
+// RecordCacheWrite adds bytes written to path to the usage of the cache
+// directory holding it. Cache directories do not overlap (see
+// ValidateCacheDirs), so at most one holds path.
+func RecordCacheWrite(path string, bytes int64) {
+	path = filepath.Clean(path)
+	cacheUsage.Range(func(k, v any) bool {
+		if strings.HasPrefix(path, k.(string)+string(filepath.Separator)) {
+			v.(*atomic.Int64).Add(bytes)
+			return false
+		}
+		return true
+	})
+}
+
+// EnsureCacheQuota checks the project's cache against its cache_size before
+// a request writes to it. Over the limit, the request evicts the cache down
+// to the low watermark itself instead of waiting for the eviction loop;
+// requests arriving during that eviction proceed. ErrCacheQuotaExceeded is
+// returned when nothing more can be evicted (e.g. every file is pinned or
+// in use). Projects without a cache_size, or whose cache was not measured
+// yet, are not checked.
+func EnsureCacheQuota(project *Project) error {
+	maxBytes, err := ParseCacheSize(project.CacheSize)
+	if err != nil || maxBytes == 0 || project.CacheDir == "" {
+		return nil
+	}
+	dir := filepath.Clean(project.CacheDir)
+	v, ok := cacheUsage.Load(dir)
+	if !ok || v.(*atomic.Int64).Load() <= maxBytes {
+		return nil
+	}
+	if _, running := quotaEvictions.LoadOrStore(dir, true); running {
+		return nil
+	}
+	defer quotaEvictions.Delete(dir)
+	size, err := DirSize(dir)
+	if err != nil {
+		return nil
+	}
+	SetCacheUsage(dir, size)
+	if size <= maxBytes {
+		return nil
+	}
+	_, low := EvictionWatermarks()
+	project.trimCache(size, int64(float64(maxBytes)*low), "cache quota")
+	if used := v.(*atomic.Int64).Load(); used > maxBytes {
+		MetricCacheQuotaRejectedTotal.WithLabelValues(project.Name).Inc()
+		return fmt.Errorf("%w: %d bytes used, %d allowed", ErrCacheQuotaExceeded, used, maxBytes)
+	}
+	return nil
+}
+
+// PathsOverlap reports whether the directories a and b are the same, or one
+// is inside the other.
+func PathsOverlap(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
+
+// ValidateCacheDirs checks that the cache directories of p are absolute,
+// apart from each other and from those of the other projects, so no
+// project reads, evicts or counts the files of another.
+func (p *Project) ValidateCacheDirs(others []Project) error {
+	dirs := map[string]string{"cache_dir": p.CacheDir, "warm_cache_dir": p.WarmCacheDir}
+	for field, dir := range dirs {
+		if dir != "" && !filepath.IsAbs(dir) {
+			return fmt.Errorf("%s %q must be an absolute path", field, dir)
+		}
+	}
+	if p.CacheDir != "" && p.WarmCacheDir != "" && PathsOverlap(p.CacheDir, p.WarmCacheDir) {
+		return fmt.Errorf("warm_cache_dir %q overlaps cache_dir %q", p.WarmCacheDir, p.CacheDir)
+	}
+	for _, o := range others {
+		if o.ProjectID == p.ProjectID {
+			continue
+		}
+		for field, dir := range dirs {
+			for _, other := range []string{o.CacheDir, o.WarmCacheDir} {
+				if dir != "" && other != "" && PathsOverlap(dir, other) {
+					return fmt.Errorf("%s %q overlaps the cache of project %d (%s)", field, dir, o.ProjectID, o.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package media
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DerivedCachePrefix is the cache subdirectory holding every derived output.
+// Staged originals mirror origin paths at the cache root, so the prefix is
+// reserved: StagedPath refuses origin paths that start with it.
+const DerivedCachePrefix = ".derived"
+
+// DerivedCacheDirs lists the subdirectories of DerivedCachePrefix whose
+// entries are named by a hex cache key and therefore sharded by CachePath.
+var DerivedCacheDirs = []string{
+	"images",
+	"audio",
+	"previews",
+	"thumbnails",
+	"profiles",
+	"video_metadata",
+	"audio_metadata",
+	"audio_thumbnails",
+	"document_thumbnails",
+	"model_previews",
+	"documents",
+	"external",
+	"email",
+	"tiles",
+}
+
+// DerivedDir returns cacheDir/.derived/sub, the variant directory of sub.
+func DerivedDir(cacheDir, sub string) string {
+	return filepath.Join(cacheDir, DerivedCachePrefix, sub)
+}
+
+// shardDir returns the two-level shard directory for key (e.g. "ab/cd" for
+// "abcd1234…"). Keys shorter than four characters are not sharded.
+func shardDir(key string) string {
+	if len(key) < 4 {
+		return ""
+	}
+	return filepath.Join(key[:2], key[2:4])
+}
+
+// CacheShardDir returns and creates cacheDir/.derived/sub/ab/cd, the directory that
+// holds derived outputs (and their temporaries) keyed by key. Sharding keeps
+// directories small even with millions of cached variants. Outputs of key
+// that were demoted to the warm tier are promoted back first.
+func CacheShardDir(cacheDir, sub, key string) (string, error) {
+	dir := filepath.Join(DerivedDir(cacheDir, sub), shardDir(key))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s cache dir: %w", sub, err)
+	}
+	promoteKey(cacheDir, sub, key)
+	return dir, nil
+}
+
+// CachePath returns cacheDir/.derived/sub/ab/cd/name for a derived output keyed by
+// key, creating the shard directory.
+func CachePath(cacheDir, sub, key, name string) (string, error) {
+	dir, err := CacheShardDir(cacheDir, sub, key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// isHexKey reports whether name starts with a 32-character hex cache key.
+func isHexKey(name string) bool {
+	if len(name) < 32 {
+		return false
+	}
+	_, err := hex.DecodeString(name[:32])
+	return err == nil
+}
+
+// MigrateFlatCache moves unsharded derived files (cacheDir/.derived/sub/<key>…)
+// into their shard directories. Only DerivedCachePrefix is scanned, so staged
+// originals are never touched; entries that are not keyed files (temp dirs,
+// lock files) are left alone.
+func MigrateFlatCache(cacheDir string) (moved int, err error) {
+	for _, sub := range DerivedCacheDirs {
+		dir := DerivedDir(cacheDir, sub)
+		entries, readErr := os.ReadDir(dir)
+		if readErr != nil {
+			if os.IsNotExist(readErr) {
+				continue
+			}
+			return moved, readErr
+		}
+		for _, e := range entries {
+			if e.IsDir() || !isHexKey(e.Name()) {
+				continue
+			}
+			dst, pathErr := CachePath(cacheDir, sub, e.Name()[:32], e.Name())
+			if pathErr != nil {
+				return moved, pathErr
+			}
+			if renameErr := os.Rename(filepath.Join(dir, e.Name()), dst); renameErr != nil {
+				return moved, renameErr
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
@@ -0,0 +1,142 @@
+package media
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// Cache variant categories reported by CollectCacheStats.
+const (
+	VariantOriginals  = "originals"
+	VariantImages     = "images"
+	VariantPreviews   = "previews"
+	VariantThumbnails = "thumbnails"
+	VariantTranscodes = "transcodes"
+	VariantMetadata   = "metadata"
+	VariantInProgress = "in_progress"
+)
+
+// variantOfDir maps each derived variant directory to its category.
+var variantOfDir = map[string]string{
+	"images":              VariantImages,
+	"tiles":               VariantImages,
+	"previews":            VariantPreviews,
+	"thumbnails":          VariantThumbnails,
+	"audio_thumbnails":    VariantThumbnails,
+	"document_thumbnails": VariantThumbnails,
+	"model_previews":      VariantPreviews,
+	"profiles":            VariantTranscodes,
+	"audio":               VariantTranscodes,
+	"documents":           VariantTranscodes,
+	"external":            VariantTranscodes,
+	"email":               VariantTranscodes,
+	"video_metadata":      VariantMetadata,
+	"audio_metadata":      VariantMetadata,
+}
+
+// VariantStats is the number and total size of cached files of one category.
+type VariantStats struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// CollectCacheStats walks cacheDir and sums file counts and sizes per variant
+// category. Files outside the derived directories are staged originals, except
+// for sidecars (metadata, versions) and in-progress locks/downloads.
+// Files directly under DerivedCachePrefix or in unknown variant directories
+// count as metadata.
+func CollectCacheStats(cacheDir string) (map[string]*VariantStats, error) {
+	stats := map[string]*VariantStats{}
+	for _, v := range []string{VariantOriginals, VariantImages, VariantPreviews, VariantThumbnails, VariantTranscodes, VariantMetadata, VariantInProgress} {
+		stats[v] = &VariantStats{}
+	}
+	err := filepath.WalkDir(cacheDir, func(p string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		s := stats[classifyCacheFile(cacheDir, p)]
+		s.Files++
+		s.Bytes += info.Size()
+		return nil
+	})
+	return stats, err
+}
+
+// cacheStatsSnapshot is the last CollectCacheStats result for one cache dir.
+// mu is held while a walk is running so concurrent callers share it.
+type cacheStatsSnapshot struct {
+	mu    sync.Mutex
+	at    time.Time
+	stats map[string]*VariantStats
+	err   error
+}
+
+var cacheStatsSnapshots sync.Map // cacheDir → *cacheStatsSnapshot
+
+// CacheStats returns the per-variant stats of cacheDir and the time they were
+// collected. The stats come from a full walk of the directory, so the result
+// is reused for MEDIAX.CacheStatsTTL (default 5m) unless refresh is set; only
+// one walk per directory runs at a time.
+func CacheStats(cacheDir string, refresh bool) (map[string]*VariantStats, time.Time, error) {
+	v, _ := cacheStatsSnapshots.LoadOrStore(cacheDir, &cacheStatsSnapshot{})
+	snap := v.(*cacheStatsSnapshot)
+	requested := time.Now()
+
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	// A walk that started after this call arrived is fresh enough even for refresh.
+	if snap.stats != nil && (snap.at.After(requested) || !refresh && time.Since(snap.at) < cacheStatsTTL()) {
+		return cloneVariantStats(snap.stats), snap.at, snap.err
+	}
+	snap.at = time.Now()
+	snap.stats, snap.err = CollectCacheStats(cacheDir)
+	return cloneVariantStats(snap.stats), snap.at, snap.err
+}
+
+func cacheStatsTTL() time.Duration {
+	ttl, err := ParseDuration(settings.Get("MEDIAX.CacheStatsTTL", "5m").String())
+	if err != nil {
+		return 5 * time.Minute
+	}
+	return ttl
+}
+
+func cloneVariantStats(stats map[string]*VariantStats) map[string]*VariantStats {
+	out := make(map[string]*VariantStats, len(stats))
+	for k, v := range stats {
+		c := *v
+		out[k] = &c
+	}
+	return out
+}
+
+func classifyCacheFile(cacheDir, p string) string {
+	switch {
+	case strings.HasSuffix(p, ".lock"), strings.HasSuffix(p, ".part"):
+		return VariantInProgress
+	case strings.HasSuffix(p, versionSuffix), strings.HasSuffix(p, ".metadata.json"):
+		return VariantMetadata
+	}
+	rel, err := filepath.Rel(cacheDir, p)
+	if err != nil {
+		return VariantOriginals
+	}
+	top, rest, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	if top != DerivedCachePrefix {
+		return VariantOriginals
+	}
+	sub, _, _ := strings.Cut(rest, "/")
+	if v, ok := variantOfDir[sub]; ok {
+		return v
+	}
+	return VariantMetadata
+}
@@ -0,0 +1,186 @@
+package media
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxUses bounds the use times kept in memory; past it they are forgotten
+// and files rank by their modification time again.
+const maxUses = 100000
+
+// uses holds when files whose modification time does not reflect their use
+// were last used: files promoted back to the hot tier, whose time moveFile
+// keeps for the freshness of staged originals, and staged originals
+// hard-linked to a local origin, which share the origin's inode and so its
+// modification time. Eviction ranks such a file by its use time, so it is not
+// evicted or demoted as the oldest file while it is being served.
+var uses = struct {
+	mu sync.Mutex
+	at map[string]time.Time
+}{at: map[string]time.Time{}}
+
+func recordUse(path string) {
+	uses.mu.Lock()
+	defer uses.mu.Unlock()
+	if len(uses.at) >= maxUses {
+		uses.at = map[string]time.Time{}
+	}
+	uses.at[filepath.Clean(path)] = time.Now()
+}
+
+// lastUse returns the later of mod and the recorded use time of path, and
+// forgets a use the file has since been rewritten past.
+func lastUse(path string, mod time.Time) time.Time {
+	uses.mu.Lock()
+	defer uses.mu.Unlock()
+	at, ok := uses.at[path]
+	if !ok {
+		return mod
+	}
+	if !at.After(mod) {
+		delete(uses.at, path)
+		return mod
+	}
+	return at
+}
+
+func forgetUse(path string) {
+	uses.mu.Lock()
+	delete(uses.at, path)
+	uses.mu.Unlock()
+}
+
+// warmTiers maps a project's hot cache dir to its warm cache dir. Eviction
+// demotes the least recently used hot entries to the warm tier instead of
+// deleting them; an access to a demoted entry promotes it back.
+var warmTiers = struct {
+	mu   sync.RWMutex
+	dirs map[string]string
+}{dirs: map[string]string{}}
+
+// SetCacheTiers replaces the hot → warm cache dir mapping. Called on every
+// configuration (re)load.
+func SetCacheTiers(tiers map[string]string) {
+	cleaned := make(map[string]string, len(tiers))
+	for hot, warm := range tiers {
+		if hot != "" && warm != "" {
+			cleaned[filepath.Clean(hot)] = filepath.Clean(warm)
+		}
+	}
+	warmTiers.mu.Lock()
+	warmTiers.dirs = cleaned
+	warmTiers.mu.Unlock()
+}
+
+func warmDirFor(hotDir string) string {
+	warmTiers.mu.RLock()
+	defer warmTiers.mu.RUnlock()
+	return warmTiers.dirs[filepath.Clean(hotDir)]
+}
+
+// moveFile renames src to dst, falling back to copy and delete when they are
+// on different volumes (the usual case for NVMe/HDD tiers).
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Keep the modification time: staged originals use it for freshness.
+	os.Chtimes(tmp, info.ModTime(), info.ModTime()) //nolint:errcheck
+	if err = os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// promoteFile moves hotPath back from the warm tier of hotDir if it was
+// demoted, and records the access for eviction. Returns true when the file
+// was promoted.
+func promoteFile(hotDir, hotPath string) bool {
+	warmDir := warmDirFor(hotDir)
+	if warmDir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(hotDir, hotPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	warmPath := filepath.Join(warmDir, rel)
+	if _, err := os.Stat(warmPath); err != nil {
+		return false
+	}
+	if _, err := os.Stat(hotPath); err == nil {
+		return false
+	}
+	if err := moveFile(warmPath, hotPath); err != nil {
+		return false
+	}
+	recordUse(hotPath)
+	MetricCachePromotedFilesTotal.Inc()
+	return true
+}
+
+// promoteStaged promotes a demoted staged original together with its
+// version sidecar.
+func promoteStaged(hotDir, stagedPath string) {
+	if promoteFile(hotDir, stagedPath) {
+		promoteFile(hotDir, stagedPath+versionSuffix)
+	}
+}
+
+// promoteKey promotes every demoted derived file of key in the sub variant
+// directory, so encoders find their cached outputs in the hot tier again.
+func promoteKey(hotDir, sub, key string) {
+	warmDir := warmDirFor(hotDir)
+	if warmDir == "" {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(DerivedDir(warmDir, sub), shardDir(key), key+"*"))
+	for _, warmPath := range matches {
+		promoteFile(hotDir, filepath.Join(DerivedDir(hotDir, sub), shardDir(key), filepath.Base(warmPath)))
+	}
+}
+
+// DemoteCache moves the least valuable files of hotDir (same order as
+// EvictCache) into warmDir until hotDir is ≤ maxBytes. Modification times
+// are preserved, so staged originals keep their freshness across tiers.
+func DemoteCache(hotDir, warmDir string, maxBytes int64, policy EvictionPolicy) (moved int, bytes int64, err error) {
+	return trimCache(hotDir, maxBytes, policy, func(path, rel string) error {
+		if err := moveFile(path, filepath.Join(warmDir, filepath.FromSlash(rel))); err != nil {
+			return fmt.Errorf("demote %s: %w", rel, err)
+		}
+		return nil
+	})
+}
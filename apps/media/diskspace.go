@@ -0,0 +1,100 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// ErrInsufficientSpace is returned by EnsureFreeSpace when the cache volume
+// stays below the configured free-space threshold even after eviction.
+var ErrInsufficientSpace = errors.New("insufficient free space on cache volume")
+
+// freeSpaceEvictionInterval is how often at most the cache of a volume low
+// on space is evicted.
+const freeSpaceEvictionInterval = time.Minute
+
+// freeSpaceEvictions holds the cache dirs evicted for low disk space within
+// the last freeSpaceEvictionInterval, so requests seeing the volume low start
+// one eviction rather than one each.
+var freeSpaceEvictions sync.Map
+
+// EnsureFreeSpace checks that the volume holding cacheDir has at least
+// MEDIAX.MinFreeSpace bytes available. When it does not, the request gets
+// ErrInsufficientSpace and, when MEDIAX.FreeSpaceEvict is enabled, the
+// oldest cache files are evicted in the background to make room for the
+// next ones.
+func EnsureFreeSpace(project *Project) error {
+	minFree, err := ParseCacheSize(settings.Get("MEDIAX.MinFreeSpace", "1GB").String())
+	if err != nil || minFree == 0 || project.CacheDir == "" {
+		return nil
+	}
+	free, err := freeBytes(project.CacheDir)
+	if err != nil || free >= minFree {
+		// Unknown free space (unsupported platform, missing dir) is not fatal.
+		return nil
+	}
+
+	if settings.Get("MEDIAX.FreeSpaceEvict", true).Bool() {
+		project.evictForSpace(minFree - free)
+	}
+
+	MetricDiskSpaceRejectedTotal.WithLabelValues(project.Name).Inc()
+	return fmt.Errorf("%w: %d bytes free, %d required", ErrInsufficientSpace, free, minFree)
+}
+
+// evictForSpace evicts deficit bytes from the project's cache in the
+// background, unless its cache was evicted for space recently. A deficit
+// the cache cannot cover, e.g. when other data fills a shared volume, evicts
+// nothing: emptying the cache would not bring the volume back over the
+// threshold.
+func (p *Project) evictForSpace(deficit int64) {
+	dir := filepath.Clean(p.CacheDir)
+	if _, running := freeSpaceEvictions.LoadOrStore(dir, true); running {
+		return
+	}
+	go func() {
+		defer time.AfterFunc(freeSpaceEvictionInterval, func() { freeSpaceEvictions.Delete(dir) })
+		size, err := DirSize(dir)
+		if err != nil || size == 0 {
+			return
+		}
+		if deficit >= size {
+			log.Warning("cache volume low on space the cache cannot free", "project", p.Name, "cache_bytes", size, "deficit_bytes", deficit)
+			return
+		}
+		p.trimCache(size, size-deficit, "low disk space")
+	}()
+}
+
+// trimCache evicts the oldest files of the project's cache, which holds size
+// bytes, until it is ≤ target bytes, demoting them to the warm tier when
+// the project has one, and records the new size. reason is logged.
+func (p *Project) trimCache(size, target int64, reason string) {
+	trim, evicts := EvictCache, p.WarmCacheDir == ""
+	if !evicts {
+		// Moving entries to the warm tier frees the hot volume without losing them.
+		trim = func(dir string, maxBytes int64, policy EvictionPolicy) (int, int64, error) {
+			return DemoteCache(dir, p.WarmCacheDir, maxBytes, policy)
+		}
+	}
+	removed, freed, err := trim(p.CacheDir, target, p.EvictionPolicy())
+	if err != nil {
+		log.Error("forced cache eviction failed", "project", p.Name, "error", err)
+		return
+	}
+	SetCacheUsage(p.CacheDir, size-freed)
+	if removed > 0 {
+		log.Warning("forced cache eviction for "+reason, "project", p.Name, "files_removed", removed, "bytes_freed", freed)
+		MetricCacheEvictedFilesTotal.WithLabelValues(p.Name).Add(float64(removed))
+		MetricCacheEvictedBytesTotal.WithLabelValues(p.Name).Add(float64(freed))
+		if evicts {
+			Emit(Event{Type: EventCacheEvicted, Project: p.Name, Files: removed, Bytes: freed, Reason: reason})
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package media
+
+import "syscall"
+
+// freeBytes returns the number of bytes available to unprivileged users on
+// the volume containing dir.
+func freeBytes(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
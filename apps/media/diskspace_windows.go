@@ -0,0 +1,11 @@
+//go:build windows
+
+package media
+
+import "errors"
+
+// freeBytes is not implemented on Windows; EnsureFreeSpace treats the error
+// as "unknown" and lets the request through.
+func freeBytes(dir string) (int64, error) {
+	return 0, errors.New("free space check not supported on windows")
+}
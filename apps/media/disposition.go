@@ -0,0 +1,163 @@
+package media
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFilename is the longest filename= in bytes, the limit of most file
+// systems.
+const maxFilename = 255
+
+// ParseDelivery reads the options that shape how a response is delivered
+// rather than what is produced: download, disposition and filename. They
+// are not part of the cache key.
+func (o *Options) ParseDelivery(query QueryFunc) error {
+	o.Download = query("download").Bool()
+	switch d := strings.ToLower(query("disposition").String()); d {
+	case "":
+	case "inline", "attachment":
+		o.Disposition = d
+	default:
+		return fmt.Errorf("invalid disposition %q: expected inline or attachment", d)
+	}
+	if name := query("filename").String(); name != "" {
+		if len(name) > maxFilename || !utf8.ValidString(name) {
+			return fmt.Errorf("filename must be valid UTF-8 of at most %d bytes", maxFilename)
+		}
+		if strings.ContainsAny(name, `/\`) || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			return fmt.Errorf("filename must not contain slashes or control characters")
+		}
+		o.Filename = name
+	}
+	return nil
+}
+
+// SetContentDisposition sets the Content-Disposition of the response when
+// the options ask for one: attachment with download=true, inline with only
+// a filename, or the disposition given. The name is filename, or else the
+// DownloadName of filePath.
+func (r *Request) SetContentDisposition(filePath string) {
+	o := r.Options
+	disposition := o.Disposition
+	switch {
+	case disposition != "":
+	case o.Download:
+		disposition = "attachment"
+	case o.Filename != "":
+		disposition = "inline"
+	default:
+		return
+	}
+	name := o.Filename
+	if name == "" {
+		name = r.DownloadName(filePath)
+	}
+	r.Request.Set("Content-Disposition", ContentDisposition(disposition, name))
+}
+
+// DownloadName returns the name the file at filePath, served for r, is
+// offered as instead of its cache name: the base name of the original with
+// the extension of filePath and, for derived outputs, a suffix naming the
+// variant, as in photo-800x600.webp or talk-thumb-720p.jpg. Generated
+// images are named after the request path (qr.png).
+func (r *Request) DownloadName(filePath string) string {
+	source := r.OriginalFilePath
+	if source == "" && r.Url != nil {
+		source = r.Url.Path
+	}
+	if source == "" {
+		return filepath.Base(filePath)
+	}
+	name := filepath.Base(source)
+	if filePath == r.StagedFilePath {
+		return name
+	}
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if r.OriginalFilePath != "" && r.Options != nil {
+		if suffix := r.Options.variantSuffix(); suffix != "" {
+			name += "-" + suffix
+		}
+	}
+	return name + filepath.Ext(filePath)
+}
+
+// variantSuffix names the variant o asks for in a download name, or "" for
+// a plain conversion.
+func (o *Options) variantSuffix() string {
+	var parts []string
+	switch {
+	case o.Width > 0 && o.Height > 0:
+		parts = append(parts, fmt.Sprintf("%dx%d", o.Width, o.Height))
+	case o.Width > 0:
+		parts = append(parts, fmt.Sprintf("%dw", o.Width))
+	case o.Height > 0:
+		parts = append(parts, fmt.Sprintf("%dh", o.Height))
+	case o.Scale > 0:
+		parts = append(parts, fmt.Sprintf("%dpct", o.Scale))
+	}
+	if o.Thumbnail != "" {
+		parts = append(parts, "thumb-"+o.Thumbnail)
+	}
+	if o.Preview != "" {
+		parts = append(parts, "preview")
+	}
+	if o.Profile != "" {
+		parts = append(parts, o.Profile)
+	}
+	if o.Frame > 0 {
+		parts = append(parts, fmt.Sprintf("frame%d", o.Frame))
+	}
+	if o.Pages != "" {
+		parts = append(parts, "p"+o.Pages)
+	}
+	if o.Chapter > 0 {
+		parts = append(parts, fmt.Sprintf("chapter%d", o.Chapter))
+	}
+	if o.Attachment > 0 {
+		parts = append(parts, fmt.Sprintf("attachment%d", o.Attachment))
+	}
+	if o.Segment > 0 {
+		parts = append(parts, fmt.Sprintf("segment%d", o.Segment))
+	}
+	return strings.Join(parts, "-")
+}
+
+// ContentDisposition formats a Content-Disposition header. Names that are
+// not printable ASCII get an ASCII fallback, with '_' for other characters,
+// and the exact name in RFC 5987 encoding (filename*), which browsers
+// prefer.
+func ContentDisposition(disposition, name string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	header := fmt.Sprintf(`%s; filename="%s"`, disposition, fallback.String())
+	if fallback.String() == name {
+		return header
+	}
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return header + "; filename*=UTF-8''" + encoded.String()
+}
+
+// isAttrChar reports whether b may appear unencoded in an RFC 5987 value.
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
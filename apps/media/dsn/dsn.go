@@ -0,0 +1,280 @@
+// Package dsn parses storage config strings into typed option structs. It
+// wraps github.com/getevo/dsn, which fills the fields, and adds what the
+// storage backends need to reject bad configuration when it is saved:
+//
+//   - query parameters that match no field are reported instead of ignored
+//     (ParseDSN fails on them, ParseDSNLenient returns them to be logged);
+//   - bool, integer, duration and Size values that do not parse are errors;
+//   - fields tagged enum:"a|b|c" only accept those values (case-insensitive);
+//   - struct fields group options, set as Field.Option=value, with defaults
+//     from their default tags.
+//
+// A Params map[string]string field receives every parameter, as upstream; its
+// prefix tag lists parameter prefixes the backend reads from it, e.g.
+// prefix:"header[,query[".
+package dsn
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	upstream "github.com/getevo/dsn"
+)
+
+// Size is a byte count written as e.g. "16MB", "512KiB" or "1048576".
+type Size int64
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var sizeType = reflect.TypeOf(Size(0))
+
+// ParseDSN parses s into config, a pointer to an option struct with a dsn
+// tag (see github.com/getevo/dsn), and validates every parameter.
+func ParseDSN(s string, config any) error {
+	_, err := parse(s, config, true)
+	return err
+}
+
+// ParseDSNLenient parses s like ParseDSN but skips parameters that match no
+// field, returning one error per skipped parameter for the caller to log.
+// Backends use it when they start, so config strings saved before a
+// parameter was renamed or dropped keep working; ParseDSN is for saving.
+func ParseDSNLenient(s string, config any) (ignored []error, err error) {
+	return parse(s, config, false)
+}
+
+func parse(s string, config any, strict bool) (ignored []error, err error) {
+	if err := upstream.ParseDSN(s, config); err != nil {
+		return nil, err
+	}
+	val := reflect.ValueOf(config).Elem()
+	typ := val.Type()
+
+	var query string
+	if i := strings.LastIndex(s, "?"); i >= 0 {
+		query = s[i+1:]
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameters: %w", err)
+	}
+
+	// Nested option structs start from their defaults.
+	for i := 0; i < typ.NumField(); i++ {
+		if f := typ.Field(i); isGroup(f) {
+			if err := setDefaults(val.Field(i)); err != nil {
+				return nil, fmt.Errorf("%s.%w", f.Name, err)
+			}
+		}
+	}
+
+	var prefixes []string
+	if f, ok := typ.FieldByName("Params"); ok {
+		for _, p := range strings.Split(f.Tag.Get("prefix"), ",") {
+			if p != "" {
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := params[key][0]
+		group, option, nested := strings.Cut(key, ".")
+		f, ok := typ.FieldByName(group)
+		switch {
+		case hasPrefix(key, prefixes):
+			continue
+		case !ok || !f.IsExported() || f.Name == "Params" || f.Tag.Get("dsn") != "" || nested != isGroup(f):
+			if strict {
+				return nil, unknownParameter(key, typ)
+			}
+			ignored = append(ignored, unknownParameter(key, typ))
+		case nested:
+			sub, ok := f.Type.FieldByName(option)
+			if !ok || !sub.IsExported() {
+				if strict {
+					return nil, unknownParameter(key, typ)
+				}
+				ignored = append(ignored, unknownParameter(key, typ))
+				continue
+			}
+			if err := setValue(val.FieldByIndex(f.Index).FieldByIndex(sub.Index), sub, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+		default:
+			// Upstream already set the field, silently skipping bad values.
+			if err := setValue(val.FieldByIndex(f.Index), f, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	}
+
+	// Defaults and path components are checked against enums too.
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if err := checkEnum(val.Field(i), f); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if isGroup(f) {
+			for j := 0; j < f.Type.NumField(); j++ {
+				if err := checkEnum(val.Field(i).Field(j), f.Type.Field(j)); err != nil {
+					return nil, fmt.Errorf("%s.%s: %w", f.Name, f.Type.Field(j).Name, err)
+				}
+			}
+		}
+	}
+	return ignored, nil
+}
+
+// ParseSize parses a byte count with an optional B, KB, MB, GB or TB suffix
+// (powers of 1024; KiB-style suffixes are accepted too).
+func ParseSize(s string) (Size, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, u := range []struct {
+		suffix string
+		factor int64
+	}{{"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10}, {"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, multiplier = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return Size(n * multiplier), nil
+}
+
+func isGroup(f reflect.StructField) bool {
+	return f.Type.Kind() == reflect.Struct && f.Type.PkgPath() != "time"
+}
+
+func hasPrefix(key string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if len(key) >= len(p) && strings.EqualFold(key[:len(p)], p) {
+			return true
+		}
+	}
+	return false
+}
+
+func unknownParameter(key string, typ reflect.Type) error {
+	group, option, nested := strings.Cut(key, ".")
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !strings.EqualFold(f.Name, group) {
+			continue
+		}
+		if !nested {
+			return fmt.Errorf("unknown parameter %q, did you mean %q?", key, f.Name)
+		}
+		if isGroup(f) {
+			for j := 0; j < f.Type.NumField(); j++ {
+				if strings.EqualFold(f.Type.Field(j).Name, option) {
+					return fmt.Errorf("unknown parameter %q, did you mean %q?", key, f.Name+"."+f.Type.Field(j).Name)
+				}
+			}
+		}
+	}
+	return fmt.Errorf("unknown parameter %q", key)
+}
+
+func setDefaults(group reflect.Value) error {
+	typ := group.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if def, ok := f.Tag.Lookup("default"); ok && f.IsExported() {
+			if err := setValue(group.Field(i), f, def); err != nil {
+				return fmt.Errorf("%s: invalid default: %w", f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setValue parses value into field, reporting values of the wrong type.
+func setValue(field reflect.Value, f reflect.StructField, value string) error {
+	switch {
+	case f.Type == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		field.SetInt(int64(d))
+	case f.Type == sizeType:
+		n, err := ParseSize(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	default:
+		switch f.Type.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid boolean %q", value)
+			}
+			field.SetBool(b)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, f.Type.Bits())
+			if err != nil {
+				return fmt.Errorf("invalid integer %q", value)
+			}
+			field.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(value, 10, f.Type.Bits())
+			if err != nil {
+				return fmt.Errorf("invalid unsigned integer %q", value)
+			}
+			field.SetUint(n)
+		case reflect.Float32, reflect.Float64:
+			n, err := strconv.ParseFloat(value, f.Type.Bits())
+			if err != nil {
+				return fmt.Errorf("invalid number %q", value)
+			}
+			field.SetFloat(n)
+		case reflect.Slice:
+			if f.Type.Elem().Kind() != reflect.String {
+				return fmt.Errorf("unsupported option type %s", f.Type)
+			}
+			parts := strings.Split(value, ",")
+			for i := range parts {
+				parts[i] = strings.TrimSpace(parts[i])
+			}
+			field.Set(reflect.ValueOf(parts).Convert(f.Type))
+		default:
+			return fmt.Errorf("unsupported option type %s", f.Type)
+		}
+	}
+	return nil
+}
+
+// checkEnum validates a string field against its enum tag and normalizes
+// it to the listed spelling.
+func checkEnum(field reflect.Value, f reflect.StructField) error {
+	enum, ok := f.Tag.Lookup("enum")
+	if !ok || f.Type.Kind() != reflect.String {
+		return nil
+	}
+	allowed := strings.Split(enum, "|")
+	for _, a := range allowed {
+		if strings.EqualFold(field.String(), a) {
+			field.SetString(a)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %q, expected one of %s", field.String(), strings.Join(allowed, ", "))
+}
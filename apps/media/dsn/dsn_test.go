@@ -0,0 +1,127 @@
+package dsn
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	DSN     string `dsn:"test://$Host/$Path"`
+	Scheme  string
+	Host    string
+	Path    string
+	Mode    string        `enum:"fast|safe" default:"fast"`
+	Timeout time.Duration `default:"30s"`
+	Retries int           `default:"2"`
+	Debug   bool          `default:"false"`
+	Limit   Size
+	Tags    []string
+	Cache   testCacheOptions
+	Params  map[string]string `prefix:"header["`
+}
+
+type testCacheOptions struct {
+	Size   Size   `default:"1MB"`
+	Policy string `enum:"lru|lfu" default:"lru"`
+	TTL    time.Duration
+}
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		check func(c testConfig) bool
+		err   string
+	}{
+		{name: "defaults", check: func(c testConfig) bool {
+			return c.Host == "example.com" && c.Mode == "fast" && c.Timeout == 30*time.Second && c.Retries == 2 &&
+				!c.Debug && c.Cache.Size == 1<<20 && c.Cache.Policy == "lru" && c.Cache.TTL == 0
+		}},
+		{name: "enum normalized", query: "Mode=SAFE", check: func(c testConfig) bool { return c.Mode == "safe" }},
+		{name: "enum invalid", query: "Mode=slow", err: `Mode: invalid value "slow", expected one of fast, safe`},
+		{name: "duration", query: "Timeout=1m30s", check: func(c testConfig) bool { return c.Timeout == 90*time.Second }},
+		{name: "duration invalid", query: "Timeout=10", err: `Timeout: invalid duration "10"`},
+		{name: "integer invalid", query: "Retries=two", err: `Retries: invalid integer "two"`},
+		{name: "bool invalid", query: "Debug=yes", err: `Debug: invalid boolean "yes"`},
+		{name: "size bytes", query: "Limit=1048576", check: func(c testConfig) bool { return c.Limit == 1<<20 }},
+		{name: "size MB", query: "Limit=16MB", check: func(c testConfig) bool { return c.Limit == 16<<20 }},
+		{name: "size KiB", query: "Limit=512KiB", check: func(c testConfig) bool { return c.Limit == 512<<10 }},
+		{name: "size lower case", query: "Limit=2gb", check: func(c testConfig) bool { return c.Limit == 2<<30 }},
+		{name: "size invalid", query: "Limit=16XB", err: `Limit: invalid size`},
+		{name: "size negative", query: "Limit=-1", err: `Limit: invalid size`},
+		{name: "string list", query: "Tags=a,+b", check: func(c testConfig) bool { return reflect.DeepEqual(c.Tags, []string{"a", "b"}) }},
+		{name: "group option", query: "Cache.Size=4MB&Cache.Policy=LFU&Cache.TTL=1h", check: func(c testConfig) bool {
+			return c.Cache.Size == 4<<20 && c.Cache.Policy == "lfu" && c.Cache.TTL == time.Hour
+		}},
+		{name: "group option invalid", query: "Cache.Policy=fifo", err: `Cache.Policy: invalid value "fifo"`},
+		{name: "group without option", query: "Cache=1", err: `unknown parameter "Cache"`},
+		{name: "option of no group", query: "Mode.Name=x", err: `unknown parameter "Mode.Name"`},
+		{name: "prefixed params", query: "header[X-Key]=secret", check: func(c testConfig) bool { return c.Params["header[X-Key]"] == "secret" }},
+		{name: "unknown", query: "Colour=red", err: `unknown parameter "Colour"`},
+		{name: "misspelled", query: "timeout=1s", err: `unknown parameter "timeout", did you mean "Timeout"?`},
+		{name: "misspelled group option", query: "Cache.ttl=1s", err: `unknown parameter "Cache.ttl", did you mean "Cache.TTL"?`},
+		{name: "unexported", query: "params=1", err: `unknown parameter "params", did you mean "Params"?`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c testConfig
+			s := "test://example.com/base"
+			if tt.query != "" {
+				s += "?" + tt.query
+			}
+			err := ParseDSN(s, &c)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(c) {
+				t.Fatalf("unexpected config %+v", c)
+			}
+		})
+	}
+}
+
+func TestParseDSNLenient(t *testing.T) {
+	var c testConfig
+	ignored, err := ParseDSNLenient("test://example.com/base?timeout=1s&Retries=5&Cache.Colour=red", &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Retries != 5 || c.Timeout != 30*time.Second {
+		t.Fatalf("known options not applied: %+v", c)
+	}
+	var got []string
+	for _, e := range ignored {
+		got = append(got, e.Error())
+	}
+	want := []string{`unknown parameter "Cache.Colour"`, `unknown parameter "timeout", did you mean "Timeout"?`}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ignored %q, want %q", got, want)
+	}
+
+	// Bad values of known options still fail.
+	if _, err := ParseDSNLenient("test://example.com/base?Retries=many", &testConfig{}); err == nil {
+		t.Fatal("invalid value accepted")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]Size{"0": 0, "1B": 1, "1KB": 1 << 10, " 3 MB ": 3 << 20, "1TiB": 1 << 40}
+	for in, want := range tests {
+		if got, err := ParseSize(in); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "MB", "1.5MB", "1PB"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) accepted", in)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package media
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ParseDuration converts a duration setting (e.g. "30s", "5m", "7d") to a
+// time.Duration. In addition to the units understood by time.ParseDuration,
+// a "d" suffix is accepted for whole days. Empty or "0" input is 0; negative
+// values are rejected.
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		var n float64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(s, "d"), "%f", &n); err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
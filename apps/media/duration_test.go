@@ -0,0 +1,43 @@
+package media
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "30s", want: 30 * time.Second},
+		{in: " 5M ", want: 5 * time.Minute},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "7d", want: 7 * 24 * time.Hour},
+		{in: "0.5d", want: 12 * time.Hour},
+		{in: "-1h", err: true},
+		{in: "-2d", err: true},
+		{in: "daily", err: true},
+		{in: "24", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseDuration(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestProjectBeforeSaveRejectsInvalidHLSKeyRotation(t *testing.T) {
+	p := &Project{HLSKeyRotation: "weekly"}
+	if err := p.BeforeSave(nil); err == nil {
+		t.Fatal("BeforeSave accepted hls_key_rotation \"weekly\"")
+	}
+}
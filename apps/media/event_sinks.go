@@ -0,0 +1,274 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventSinkTimeout bounds connecting to the bus and publishing one batch.
+const eventSinkTimeout = 5 * time.Second
+
+// openEventSink connects to the bus at rawURL:
+//
+//	nats://[user:password@]host[:4222][/prefix]           NATS, subjects <prefix>.<type> (default prefix mediax)
+//	tls://[user:password@]host[:4222][/prefix]            NATS over TLS
+//	kafka+http://[user:password@]host[:8082][/base]/topic  Kafka, through a REST Proxy (v2 API)
+//	kafka+https://[user:password@]host[/base]/topic        the same over HTTPS
+func openEventSink(rawURL string) (eventSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MEDIAX.EventBus: %w", err)
+	}
+	var sink eventSink
+	switch u.Scheme {
+	case "nats", "tls":
+		sink, err = dialNATS(u)
+	case "kafka+http", "kafka+https":
+		sink, err = newKafkaRESTSink(u)
+	default:
+		err = fmt.Errorf("unsupported MEDIAX.EventBus scheme %q: expected nats, tls, kafka+http or kafka+https", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// redactEventBus returns the bus URL without its password, for logs.
+func redactEventBus(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "(invalid)"
+	}
+	return u.Redacted()
+}
+
+// natsSink publishes to a NATS server with the core text protocol: PUB only,
+// fire and forget.
+type natsSink struct {
+	prefix string
+	conn   net.Conn
+	mu     sync.Mutex // guards w and err
+	w      *bufio.Writer
+	err    error // set when the server reports an error or the connection fails
+}
+
+func dialNATS(u *url.URL) (*natsSink, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", addr, eventSinkTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(eventSinkTimeout)) //nolint:errcheck
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	info, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("not a NATS server: %q", strings.TrimSpace(line))
+	}
+	var server struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(info), &server); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid NATS INFO: %w", err)
+	}
+	if server.TLSRequired || u.Scheme == "tls" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn, r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	connect := map[string]any{"verbose": false, "pedantic": false, "name": "mediax", "lang": "go"}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			connect["user"], connect["pass"] = u.User.Username(), password
+		} else {
+			connect["auth_token"] = u.User.Username()
+		}
+	}
+	options, _ := json.Marshal(connect)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", options); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The server answers PONG once it accepted CONNECT, or -ERR.
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, errors.New("nats: " + line)
+		}
+	}
+	conn.SetDeadline(time.Time{}) //nolint:errcheck
+
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		prefix = "mediax"
+	}
+	s := &natsSink{prefix: strings.ReplaceAll(prefix, "/", "."), conn: conn, w: bufio.NewWriter(conn)}
+	go s.read(r)
+	return s, nil
+}
+
+// read answers the server's PINGs and records its errors until the
+// connection closes.
+func (s *natsSink) read(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			s.mu.Lock()
+			s.w.WriteString("PONG\r\n") //nolint:errcheck
+			s.w.Flush()                 //nolint:errcheck
+			s.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			s.fail(errors.New("nats: " + line))
+		}
+	}
+}
+
+func (s *natsSink) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+}
+
+func (s *natsSink) publish(events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(eventSinkTimeout)) //nolint:errcheck
+	for _, e := range events {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.w, "PUB %s.%s %d\r\n", s.prefix, e.Type, len(payload)) //nolint:errcheck
+		s.w.Write(payload)                                                   //nolint:errcheck
+		s.w.WriteString("\r\n")                                              //nolint:errcheck
+	}
+	return s.w.Flush()
+}
+
+func (s *natsSink) close() {
+	s.conn.Close()
+}
+
+// kafkaRESTSink produces to a Kafka topic through a Confluent REST Proxy,
+// or a proxy with the same v2 API such as Redpanda's, keyed by Event.Key.
+type kafkaRESTSink struct {
+	endpoint string
+	user     *url.Userinfo
+	client   *http.Client
+}
+
+func newKafkaRESTSink(u *url.URL) (*kafkaRESTSink, error) {
+	topic := path.Base(u.Path)
+	if topic == "/" || topic == "." {
+		return nil, errors.New("MEDIAX.EventBus: no Kafka topic in the URL path")
+	}
+	base := *u
+	base.Scheme = strings.TrimPrefix(u.Scheme, "kafka+")
+	base.User = nil
+	base.Path = strings.TrimSuffix(path.Dir(u.Path), "/") + "/topics/" + url.PathEscape(topic)
+	base.RawQuery = ""
+	return &kafkaRESTSink{
+		endpoint: base.String(),
+		user:     u.User,
+		client:   &http.Client{Timeout: eventSinkTimeout},
+	}, nil
+}
+
+func (s *kafkaRESTSink) publish(events []Event) error {
+	type record struct {
+		Key   string `json:"key"`
+		Value Event  `json:"value"`
+	}
+	records := make([]record, len(events))
+	for i, e := range events {
+		records[i] = record{Key: e.Key(), Value: e}
+	}
+	body, err := json.Marshal(map[string]any{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if s.user != nil {
+		password, _ := s.user.Password()
+		req.SetBasicAuth(s.user.Username(), password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kafka rest proxy: %s: %s", resp.Status, bytes.TrimSpace(reply))
+	}
+	// Records can fail one by one in a successful response.
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if json.Unmarshal(reply, &result) == nil {
+		for _, o := range result.Offsets {
+			if o.ErrorCode != nil {
+				return fmt.Errorf("kafka rest proxy: record failed: %s", o.Error)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *kafkaRESTSink) close() {
+	s.client.CloseIdleConnections()
+}
@@ -0,0 +1,191 @@
+package media
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// Event types published to MEDIAX.EventBus.
+const (
+	EventAssetServed      = "asset.served"
+	EventVariantGenerated = "variant.generated"
+	EventCacheEvicted     = "cache.evicted"
+	EventProcessingFailed = "processing.failed"
+)
+
+const (
+	eventQueueSize         = 10000
+	eventBatchSize         = 500
+	eventFlushInterval     = time.Second
+	eventFailureLogBackoff = time.Minute
+)
+
+// Event is a structured record of what happened to a project's media, for
+// analytics and recommendation pipelines. Path is the asset's path relative
+// to the project's storages, Options the query of the request without its
+// signature and API key. Fields that do not apply to the Type are empty.
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Project  string    `json:"project"`
+	Domain   string    `json:"domain,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Options  string    `json:"options,omitempty"`
+	TraceID  string    `json:"trace_id,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	Mime     string    `json:"mime,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Files    int       `json:"files,omitempty"`
+	Duration float64   `json:"duration,omitempty"` // seconds
+	Reason   string    `json:"reason,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Key returns the key events are partitioned by: the project and asset.
+func (e Event) Key() string {
+	if e.Path == "" {
+		return e.Project
+	}
+	return e.Project + "/" + e.Path
+}
+
+var (
+	eventQueue    = make(chan Event, eventQueueSize)
+	eventInstance string
+)
+
+func init() {
+	eventInstance, _ = os.Hostname()
+}
+
+// Emit queues e for the publisher started by StartEvents when MEDIAX.EventBus
+// is set and MEDIAX.EventTypes, if set, lists its type. It never blocks:
+// events are dropped while the queue is full, e.g. when the bus is down.
+func Emit(e Event) {
+	if settings.Get("MEDIAX.EventBus", "").String() == "" || !eventWanted(e.Type) {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.Instance = eventInstance
+	select {
+	case eventQueue <- e:
+	default:
+		MetricEventsTotal.WithLabelValues(e.Type, "dropped").Inc()
+	}
+}
+
+// eventWanted reports whether MEDIAX.EventTypes, a comma-separated list of
+// event types, is empty or lists typ.
+func eventWanted(typ string) bool {
+	types := settings.Get("MEDIAX.EventTypes", "").String()
+	if types == "" {
+		return true
+	}
+	for _, t := range strings.Split(types, ",") {
+		if strings.TrimSpace(t) == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// StartEvents publishes queued events to MEDIAX.EventBus in batches of up
+// to eventBatchSize, at least every eventFlushInterval. Delivery is at most
+// once: a batch the bus refuses is dropped and the connection reopened for
+// the next one. Changes to the setting apply from the next batch.
+func StartEvents() {
+	go func() {
+		var p eventPublisher
+		batch := make([]Event, 0, eventBatchSize)
+		ticker := time.NewTicker(eventFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case e := <-eventQueue:
+				if batch = append(batch, e); len(batch) < eventBatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			p.publish(batch)
+			batch = batch[:0]
+		}
+	}()
+}
+
+// eventSink is a message bus events are published to.
+type eventSink interface {
+	publish(events []Event) error
+	close()
+}
+
+// eventPublisher holds the sink of the current MEDIAX.EventBus.
+type eventPublisher struct {
+	bus      string
+	sink     eventSink
+	failing  bool
+	loggedAt time.Time
+	failed   int // events failed since loggedAt
+}
+
+func (p *eventPublisher) publish(batch []Event) {
+	bus := settings.Get("MEDIAX.EventBus", "").String()
+	if bus != p.bus && p.sink != nil {
+		p.sink.close()
+		p.sink = nil
+	}
+	p.bus = bus
+	if bus == "" {
+		// Disabled since the events were queued.
+		for _, e := range batch {
+			MetricEventsTotal.WithLabelValues(e.Type, "dropped").Inc()
+		}
+		return
+	}
+	var err error
+	if p.sink == nil {
+		p.sink, err = openEventSink(bus)
+	}
+	if err == nil {
+		if err = p.sink.publish(batch); err != nil {
+			p.sink.close()
+			p.sink = nil
+		}
+	}
+	result := "published"
+	if err != nil {
+		result = "failed"
+	}
+	for _, e := range batch {
+		MetricEventsTotal.WithLabelValues(e.Type, result).Inc()
+	}
+	p.report(err, len(batch))
+}
+
+// report logs when publishing starts failing, every eventFailureLogBackoff
+// while it keeps failing, and when it recovers.
+func (p *eventPublisher) report(err error, n int) {
+	switch {
+	case err != nil:
+		p.failed += n
+		if !p.failing || time.Since(p.loggedAt) >= eventFailureLogBackoff {
+			log.Error("cannot publish events", "bus", redactEventBus(p.bus), "events_lost", p.failed, "error", err)
+			p.loggedAt, p.failed = time.Now(), 0
+		}
+		p.failing = true
+	case p.failing:
+		log.Info("publishing events again", "bus", redactEventBus(p.bus))
+		p.failing, p.failed = false, 0
+	}
+}
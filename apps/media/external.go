@@ -0,0 +1,31 @@
+package media
+
+import (
+	"github.com/getevo/evo/v2/lib/db/types"
+	"github.com/getevo/restify"
+)
+
+// ExternalProcessor adds an output format to a source extension, produced by
+// an external command. Unknown extensions become new media types with Mime.
+//
+// Command is split on spaces (no shell is involved) and its placeholders are
+// replaced per argument: {input} (the staged source), {output} (the file to
+// write), {width}, {height}, {quality} and {format}.
+type ExternalProcessor struct {
+	ExternalProcessorID int    `gorm:"column:external_processor_id;primaryKey;autoIncrement" json:"external_processor_id"`
+	Extension           string `gorm:"column:extension;size:32" json:"extension"`
+	Mime                string `gorm:"column:mime;size:255" json:"mime"`
+	Format              string `gorm:"column:format;size:32" json:"format"`
+	OutputMime          string `gorm:"column:output_mime;size:255" json:"output_mime"`
+	Command             string `gorm:"column:command;size:1024" json:"command"`
+	// Timeout limits one run of Command (e.g. "2m"); empty is 60s.
+	Timeout string `gorm:"column:timeout;size:32" json:"timeout"`
+	types.CreatedAt
+	types.UpdatedAt
+	types.SoftDelete
+	restify.API
+}
+
+func (ExternalProcessor) TableName() string {
+	return "external_processor"
+}
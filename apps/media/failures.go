@@ -0,0 +1,284 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxPendingFailures bounds the failures an instance keeps between syncs;
+// further assets are counted under their category alone (empty path).
+const maxPendingFailures = 10000
+
+// CommandError is an external command (ffmpeg, convert, soffice, ...) that
+// failed. Reason is timeout, cpu, killed, crashed, start or error; ExitCode
+// is the status of the latter. Its message is that of Err.
+type CommandError struct {
+	Command  string
+	Reason   string
+	ExitCode int
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// ProcessingFailure counts the failures of one category for one asset of a
+// project on one day (YYYY-MM-DD, UTC), with the last error seen.
+type ProcessingFailure struct {
+	ProjectID int    `gorm:"column:project_id;primaryKey" json:"project_id"`
+	Day       string `gorm:"column:day;size:10;primaryKey" json:"day"`
+	Category  string `gorm:"column:category;size:64;primaryKey" json:"category"`
+	// PathHash keys the asset; paths are too long for a primary key.
+	PathHash  string    `gorm:"column:path_hash;size:64;primaryKey" json:"-"`
+	Path      string    `gorm:"column:path;size:1024" json:"path"`
+	Count     int64     `gorm:"column:failure_count" json:"count"`
+	LastError string    `gorm:"column:last_error;size:1024" json:"last_error"`
+	LastSeen  time.Time `gorm:"column:last_seen" json:"last_seen"`
+}
+
+func (ProcessingFailure) TableName() string {
+	return "processing_failure"
+}
+
+type failureKey struct {
+	projectID int
+	day       string
+	category  string
+	path      string
+}
+
+// failures holds this instance's failures not yet written to the database.
+var failures = struct {
+	mu      sync.Mutex
+	pending map[failureKey]ProcessingFailure
+}{pending: map[failureKey]ProcessingFailure{}}
+
+// RecordProcessingFailure counts err, the failure of an encoder on the
+// asset at path, for the project's error report.
+func RecordProcessingFailure(project *Project, path string, err error) {
+	recordFailure(project, path, processingCategory(err), err)
+}
+
+// RecordStagingFailure counts err, the failure to fetch the asset at path
+// from the project's storages, for the project's error report. Missing
+// files are not failures.
+func RecordStagingFailure(project *Project, path string, err error) {
+	if isNotFound(err) || errors.Is(err, ErrNotFoundCached) || errors.Is(err, ErrSourceTooLarge) || errors.Is(err, ErrOverloaded) {
+		return
+	}
+	category := "upstream: error"
+	switch {
+	case isTimeout(err):
+		category = "upstream: timeout"
+	case errors.Is(err, ErrStorageUnavailable):
+		category = "upstream: unavailable"
+	}
+	recordFailure(project, path, category, err)
+}
+
+// processingCategory names the kind of an encoder failure: the command and
+// how it failed ("ffmpeg: exit 1", "convert: timeout"), or "encoder: timeout"
+// and "encoder: error" for failures outside external commands.
+func processingCategory(err error) string {
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		if cmdErr.Reason == "error" {
+			return cmdErr.Command + ": exit " + strconv.Itoa(cmdErr.ExitCode)
+		}
+		return cmdErr.Command + ": " + cmdErr.Reason
+	}
+	if isTimeout(err) {
+		return "encoder: timeout"
+	}
+	return "encoder: error"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func recordFailure(project *Project, path, category string, err error) {
+	if project == nil {
+		return
+	}
+	MetricProcessingFailuresTotal.WithLabelValues(project.Name, category).Inc()
+	now := time.Now().UTC()
+	key := failureKey{projectID: project.ProjectID, day: now.Format(time.DateOnly), category: category, path: CleanAssetPath(path)}
+	failures.mu.Lock()
+	defer failures.mu.Unlock()
+	if _, ok := failures.pending[key]; !ok && len(failures.pending) >= maxPendingFailures {
+		key.path = ""
+	}
+	f := failures.pending[key]
+	f.ProjectID, f.Day, f.Category, f.Path = key.projectID, key.day, key.category, key.path
+	f.Count++
+	f.LastError = truncate(err.Error(), 1024)
+	f.LastSeen = now
+	failures.pending[key] = f
+}
+
+// truncate returns s cut to at most n bytes, on a rune boundary.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && s[n]&0xc0 == 0x80 {
+		n--
+	}
+	return s[:n]
+}
+
+// SyncProcessingFailures adds this instance's unwritten failures to the
+// database.
+func SyncProcessingFailures() error {
+	failures.mu.Lock()
+	pending := failures.pending
+	failures.pending = map[failureKey]ProcessingFailure{}
+	failures.mu.Unlock()
+
+	for key, f := range pending {
+		row := f
+		row.PathHash = assetPathHash(f.Path)
+		err := db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "project_id"}, {Name: "day"}, {Name: "category"}, {Name: "path_hash"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"failure_count": gorm.Expr("failure_count + ?", f.Count),
+				"last_error":    f.LastError,
+				"last_seen":     f.LastSeen,
+			}),
+		}).Create(&row).Error
+		if err != nil {
+			// Keep the unwritten failures for the next attempt.
+			failures.mu.Lock()
+			for key, f := range pending {
+				p := failures.pending[key]
+				f.Count += p.Count
+				if p.LastSeen.After(f.LastSeen) {
+					f.LastError, f.LastSeen = p.LastError, p.LastSeen
+				}
+				failures.pending[key] = f
+			}
+			failures.mu.Unlock()
+			return err
+		}
+		delete(pending, key)
+	}
+	return nil
+}
+
+// FailureCategory is the number of failures of one category in a report.
+type FailureCategory struct {
+	Category string `json:"category"`
+	Count    int64  `json:"count"`
+}
+
+// FailureReport summarizes the failures of one project on one day: by
+// category, and the assets that failed most.
+type FailureReport struct {
+	ProjectID  int                 `json:"project_id"`
+	Project    string              `json:"project"`
+	Day        string              `json:"day"`
+	Failures   int64               `json:"failures"`
+	Categories []FailureCategory   `json:"categories"`
+	Assets     []ProcessingFailure `json:"assets"`
+}
+
+// FailureReports returns the reports of day for the projects with failures,
+// or only of projectID when it is not 0, listing up to maxAssets assets
+// each, by count.
+func FailureReports(day string, projectID, maxAssets int) ([]FailureReport, error) {
+	query := db.Where("day = ?", day)
+	if projectID > 0 {
+		query = query.Where("project_id = ?", projectID)
+	}
+	var rows []ProcessingFailure
+	if err := query.Order("project_id, failure_count DESC, last_seen DESC").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	var names []struct {
+		ProjectID int
+		Name      string
+	}
+	if err := db.Model(&Project{}).Select("project_id, name").Scan(&names).Error; err != nil {
+		return nil, err
+	}
+	projectNames := map[int]string{}
+	for _, n := range names {
+		projectNames[n.ProjectID] = n.Name
+	}
+
+	reports := []FailureReport{}
+	var categories map[string]int64
+	// Rows are ordered by project, so each report is complete when the
+	// next project starts.
+	flush := func() {
+		if len(reports) == 0 {
+			return
+		}
+		r := &reports[len(reports)-1]
+		for category, count := range categories {
+			r.Categories = append(r.Categories, FailureCategory{Category: category, Count: count})
+		}
+		sort.Slice(r.Categories, func(i, j int) bool {
+			if r.Categories[i].Count != r.Categories[j].Count {
+				return r.Categories[i].Count > r.Categories[j].Count
+			}
+			return r.Categories[i].Category < r.Categories[j].Category
+		})
+	}
+	for _, row := range rows {
+		if len(reports) == 0 || reports[len(reports)-1].ProjectID != row.ProjectID {
+			flush()
+			reports = append(reports, FailureReport{ProjectID: row.ProjectID, Project: projectNames[row.ProjectID], Day: day, Categories: []FailureCategory{}, Assets: []ProcessingFailure{}})
+			categories = map[string]int64{}
+		}
+		r := &reports[len(reports)-1]
+		r.Failures += row.Count
+		categories[row.Category] += row.Count
+		if row.Path != "" && len(r.Assets) < maxAssets {
+			r.Assets = append(r.Assets, row)
+		}
+	}
+	flush()
+	return reports, nil
+}
+
+// FailureReportDelivery records that the failure reports of a day were
+// sent, so only one instance sends them.
+type FailureReportDelivery struct {
+	Day      string    `gorm:"column:day;size:10;primaryKey" json:"day"`
+	Instance string    `gorm:"column:instance;size:255" json:"instance"`
+	SentAt   time.Time `gorm:"column:sent_at" json:"sent_at"`
+}
+
+func (FailureReportDelivery) TableName() string {
+	return "failure_report_delivery"
+}
+
+// ClaimFailureReport reports whether this instance is the first to claim
+// sending the reports of day. A claim whose delivery failed is released
+// with ReleaseFailureReport so it is retried.
+func ClaimFailureReport(day string) (bool, error) {
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&FailureReportDelivery{Day: day, Instance: eventInstance, SentAt: time.Now()})
+	return result.RowsAffected == 1, result.Error
+}
+
+// ReleaseFailureReport drops the claim on the reports of day.
+func ReleaseFailureReport(day string) error {
+	return db.Where("day = ?", day).Delete(&FailureReportDelivery{}).Error
+}
@@ -0,0 +1,95 @@
+package media
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/log"
+)
+
+// ErrHLSKeyExpired is returned by HLSKey for epochs that are neither the
+// current nor the previous one.
+var ErrHLSKeyExpired = errors.New("hls key expired")
+
+// NewHLSKeySecret returns a random secret for Project.HLSKeySecret.
+func NewHLSKeySecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// HLSKeyRotationPeriod returns how long each HLS encryption key is used.
+// Zero means keys never rotate. BeforeSave refuses invalid values; one that
+// still reaches here (e.g. written to the database directly) also disables
+// rotation, and is logged once.
+func (p *Project) HLSKeyRotationPeriod() time.Duration {
+	period, err := ParseDuration(p.HLSKeyRotation)
+	if err != nil {
+		if _, warned := invalidHLSKeyRotations.LoadOrStore(p.HLSKeyRotation, true); !warned {
+			log.Warning("invalid hls_key_rotation, keys will not rotate", "project", p.Name, "value", p.HLSKeyRotation, "error", err)
+		}
+		return 0
+	}
+	return period
+}
+
+// invalidHLSKeyRotations holds the hls_key_rotation values already logged
+// as invalid.
+var invalidHLSKeyRotations sync.Map
+
+// HLSKeyEpoch returns the number of the key period at t; playlists served
+// at t encrypt their segments with the key of that epoch.
+func (p *Project) HLSKeyEpoch(t time.Time) int64 {
+	seconds := int64(p.HLSKeyRotationPeriod() / time.Second)
+	if seconds <= 0 {
+		return 0
+	}
+	return t.Unix() / seconds
+}
+
+// HLSKey returns the AES-128 key of epoch, derived from the project's
+// HLSKeySecret. Only the current and the previous epoch have a key, so a
+// playlist can be played for at least one rotation period after it was
+// served and no longer than two.
+func (p *Project) HLSKey(epoch int64) ([]byte, error) {
+	if p.HLSKeySecret == "" {
+		return nil, errors.New("project has no hls_key_secret")
+	}
+	if current := p.HLSKeyEpoch(time.Now()); epoch != current && epoch != current-1 {
+		return nil, ErrHLSKeyExpired
+	}
+	mac := hmac.New(sha256.New, []byte(p.HLSKeySecret))
+	mac.Write([]byte("hls-key|" + strconv.Itoa(p.ProjectID) + "|" + strconv.FormatInt(epoch, 10)))
+	return mac.Sum(nil)[:16], nil
+}
+
+// EncryptHLSSegment encrypts an MPEG-TS segment with AES-128-CBC and PKCS#7
+// padding, as HLS METHOD=AES-128 expects. The IV is the media sequence
+// number of the segment, which players use when the playlist gives none.
+func EncryptHLSSegment(data, key []byte, sequence int) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, len(data)+padding)
+	copy(out, data)
+	for i := len(data); i < len(out); i++ {
+		out[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out, nil
+}
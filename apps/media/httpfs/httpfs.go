@@ -0,0 +1,410 @@
+package httpfs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"mediax/apps/media/dsn"
+)
+
+// errReadOnly is returned by every mutating operation: HTTP origins are read-only.
+var errReadOnly = fmt.Errorf("http storage is read-only")
+
+// FileSystem implements filesystem.Interface on top of a plain HTTP(S) origin.
+// Only read operations are supported: Exists/IsFile/Stat are answered with a
+// HEAD request, Read and StorageToDisk with a GET. Downloads remember the
+// origin's ETag so later refreshes can be made conditional.
+//
+// DSN format:
+//
+//	https://HOST/BASE/PATH?Token=...&header[X-Api-Key]=...&query[download]=true
+//
+// Notable DSN params:
+//
+//	Username, Password – HTTP basic auth credentials
+//	Token              – bearer token sent as "Authorization: Bearer <Token>"
+//	Timeout            – deadline for HEAD and in-memory reads (default: 30s)
+//	DownloadTimeout    – deadline for a full download to disk (default: 10m)
+//	MaxRedirects       – redirects followed before failing (default: 10)
+//	Retries            – extra attempts on network errors, 429 and 5xx (default: 2)
+//	UserAgent          – User-Agent header (default: mediax)
+//	IgnoreSSL          – skip TLS verification (default: false)
+//	header[NAME]       – extra request header
+//	query[NAME]        – extra query string parameter
+type FileSystem struct {
+	DSN             string `dsn:"http(s)://$Host/$Path"`
+	Scheme          string
+	Host            string
+	Path            string
+	Username        string            `default:""`
+	Password        string            `default:""`
+	Token           string            `default:""`
+	Timeout         time.Duration     `default:"30s"`
+	DownloadTimeout time.Duration     `default:"10m"`
+	MaxRedirects    int               `default:"10"`
+	Retries         int               `default:"2"`
+	UserAgent       string            `default:"mediax"`
+	IgnoreSSL       bool              `default:"false"`
+	Debug           bool              `default:"false"`
+	Params          map[string]string `prefix:"header[,query["`
+
+	headers http.Header
+	query   url.Values
+	client  *http.Client
+
+	// etags remembers the last ETag seen per object for conditional GETs.
+	etags sync.Map
+}
+
+// New creates and initialises a FileSystem from a DSN string.
+func New(configString string) (*FileSystem, error) {
+	f := &FileSystem{}
+	if err := f.Setup(configString); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Validate parses configString like Setup, so a bad config is reported when
+// it is saved. Unlike Setup it also refuses parameters that match no option.
+func Validate(configString string) error {
+	if err := dsn.ParseDSN(configString, &FileSystem{}); err != nil {
+		return fmt.Errorf("failed to parse HTTP DSN: %w", err)
+	}
+	return nil
+}
+
+// Setup parses confString and prepares the client. Parameters that match no
+// option are logged and ignored, so configs saved by older versions load.
+func (l *FileSystem) Setup(confString string) error {
+	ignored, err := dsn.ParseDSNLenient(confString, l)
+	if err != nil {
+		return fmt.Errorf("failed to parse HTTP DSN: %w", err)
+	}
+	for _, err := range ignored {
+		log.Warning("http storage config ignored", "error", err)
+	}
+	l.Path = "/" + strings.Trim(l.Path, "/")
+	l.headers = http.Header{}
+	l.query = url.Values{}
+
+	for k, v := range l.Params {
+		kind, name, ok := parseParam(k)
+		if !ok {
+			continue
+		}
+		switch kind {
+		case "header":
+			l.headers.Set(name, v)
+		case "query":
+			l.query.Set(name, v)
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if l.IgnoreSSL {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	}
+	l.client = &http.Client{
+		Transport: transport,
+		// Origins may 302 to short-lived signed URLs; follow them up to the
+		// configured limit and fail loudly instead of saving the redirect body.
+		// net/http drops the Authorization header on cross-host redirects.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > l.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", l.MaxRedirects)
+			}
+			return nil
+		},
+	}
+	return nil
+}
+
+// paramPattern captures DSN params of the form type[name].
+var paramPattern = regexp.MustCompile(`^([^\[\]=]+)\[([^\[\]=]+)\]$`)
+
+func parseParam(input string) (kind, name string, ok bool) {
+	matches := paramPattern.FindStringSubmatch(input)
+	if len(matches) != 3 {
+		return "", "", false
+	}
+	return strings.ToLower(matches[1]), matches[2], true
+}
+
+// objectURL builds the absolute URL of p on the origin, including any
+// configured extra query parameters.
+func (l *FileSystem) objectURL(p string) (string, error) {
+	u, err := url.Parse(l.Scheme + "://" + l.Host)
+	if err != nil {
+		return "", err
+	}
+	u = u.JoinPath(l.Path, p)
+	if len(l.query) > 0 {
+		u.RawQuery = l.query.Encode()
+	}
+	return u.String(), nil
+}
+
+// newRequest builds a request for p carrying auth and configured headers.
+func (l *FileSystem) newRequest(ctx context.Context, method, p string) (*http.Request, error) {
+	target, err := l.objectURL(p)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range l.headers {
+		req.Header[k] = v
+	}
+	if l.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", l.UserAgent)
+	}
+	if l.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+l.Token)
+	} else if l.Username != "" {
+		req.SetBasicAuth(l.Username, l.Password)
+	}
+	if l.Debug {
+		log.Debug("http storage request", "method", method, "url", target)
+	}
+	return req, nil
+}
+
+// newCtx returns a context with the Timeout deadline for a single metadata request.
+func (l *FileSystem) newCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), l.Timeout)
+}
+
+// retryable reports whether a response status is worth another attempt.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// do sends method p, retrying network errors, 429 and 5xx responses up to
+// Retries extra times with linear backoff. prepare may add per-request headers.
+func (l *FileSystem) do(ctx context.Context, method, p string, prepare func(*http.Request)) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt <= l.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%s %s: %w (last error: %v)", method, p, ctx.Err(), lastErr)
+			case <-time.After(time.Duration(attempt) * 500 * time.Millisecond):
+			}
+		}
+		req, err := l.newRequest(ctx, method, p)
+		if err != nil {
+			return nil, err
+		}
+		if prepare != nil {
+			prepare(req)
+		}
+		resp, err := l.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if retryable(resp.StatusCode) && attempt < l.Retries {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("status code %d", resp.StatusCode)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// head issues a HEAD request for p and returns the response with its body closed.
+func (l *FileSystem) head(p string) (*http.Response, error) {
+	ctx, cancel := l.newCtx()
+	defer cancel()
+	resp, err := l.do(ctx, http.MethodHead, p, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// ── filesystem.Interface implementation ──────────────────────────────────────
+
+func (l *FileSystem) Touch(p string) error                    { return errReadOnly }
+func (l *FileSystem) Delete(p string) error                   { return errReadOnly }
+func (l *FileSystem) Mkdir(p string) error                    { return errReadOnly }
+func (l *FileSystem) Write(p string, data []byte) error       { return errReadOnly }
+func (l *FileSystem) WriteBuffer(p string, r io.Reader) error { return errReadOnly }
+func (l *FileSystem) Copy(src, dst string) error              { return errReadOnly }
+func (l *FileSystem) Move(src, dst string) error              { return errReadOnly }
+func (l *FileSystem) DiskToStorage(src, dst string) error     { return errReadOnly }
+
+func (l *FileSystem) List(p string) ([]string, error) {
+	return nil, fmt.Errorf("http storage does not support listing")
+}
+
+func (l *FileSystem) Walk(p string, fn func(path string, info fs.FileInfo, err error) error) error {
+	return fmt.Errorf("http storage does not support listing")
+}
+
+// IsDir always reports false: plain HTTP has no notion of directories.
+func (l *FileSystem) IsDir(p string) (bool, error) {
+	return false, nil
+}
+
+func (l *FileSystem) IsFile(p string) (bool, error) {
+	return l.Exists(p)
+}
+
+func (l *FileSystem) Exists(p string) (bool, error) {
+	resp, err := l.head(p)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return false, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unexpected status code %d for HEAD %s", resp.StatusCode, p)
+	}
+}
+
+// SourceURL returns the URL of p and the headers (authentication and
+// configured header[...] params) a client must send to read it.
+func (l *FileSystem) SourceURL(p string, _ time.Duration) (string, http.Header, error) {
+	req, err := l.newRequest(context.Background(), http.MethodGet, p)
+	if err != nil {
+		return "", nil, err
+	}
+	return req.URL.String(), req.Header, nil
+}
+
+func (l *FileSystem) Stat(p string) (fs.FileInfo, error) {
+	resp, err := l.head(p)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, fs.ErrNotExist
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status code %d for HEAD %s", resp.StatusCode, p)
+	}
+	return newFileInfo(p, resp), nil
+}
+
+func (l *FileSystem) Read(p string) ([]byte, error) {
+	ctx, cancel := l.newCtx()
+	defer cancel()
+	resp, err := l.do(ctx, http.MethodGet, p, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get file, status code: %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (l *FileSystem) StorageToDisk(src, dst string) error {
+	_, err := l.StorageToDiskIfModified(src, dst, time.Time{})
+	return err
+}
+
+// StorageToDiskIfModified downloads src to dst unless the origin reports it
+// unchanged since the given time (If-Modified-Since) or since the last ETag
+// seen for src (If-None-Match). It returns false, nil on 304 Not Modified, in
+// which case dst is left untouched. A zero since forces an unconditional GET.
+func (l *FileSystem) StorageToDiskIfModified(src, dst string, since time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.DownloadTimeout)
+	defer cancel()
+	resp, err := l.do(ctx, http.MethodGet, src, func(req *http.Request) {
+		if !since.IsZero() {
+			req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+			if etag, ok := l.etags.Load(src); ok {
+				req.Header.Set("If-None-Match", etag.(string))
+			}
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && !since.IsZero() {
+		return false, nil
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return false, fmt.Errorf("failed to get %s: %w", src, fs.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("failed to get file, status code: %d", resp.StatusCode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		l.etags.Store(src, etag)
+	} else {
+		l.etags.Delete(src)
+	}
+	return true, nil
+}
+
+// ── fs.FileInfo implementation ────────────────────────────────────────────────
+
+type fileInfo struct {
+	name string
+	size int64
+	mod  time.Time
+	etag string
+}
+
+func newFileInfo(p string, resp *http.Response) *fileInfo {
+	fi := &fileInfo{name: path.Base(p), size: resp.ContentLength, etag: resp.Header.Get("ETag")}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		if t, err := http.ParseTime(lm); err == nil {
+			fi.mod = t
+		}
+	}
+	return fi
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return 0444 }
+func (fi *fileInfo) ModTime() time.Time { return fi.mod }
+func (fi *fileInfo) IsDir() bool        { return false }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// ETag returns the entity tag reported by the origin, if any.
+func (fi *fileInfo) ETag() string { return fi.etag }
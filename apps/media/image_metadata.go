@@ -0,0 +1,65 @@
+package media
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// XMPNamespaces maps the XMP prefixes allowed in Project.ImageMetadata to
+// their namespace URIs: Dublin Core, XMP basic and rights, Photoshop and
+// IPTC Core, which together carry the IPTC photo metadata fields.
+var XMPNamespaces = map[string]string{
+	"dc":           "http://purl.org/dc/elements/1.1/",
+	"xmp":          "http://ns.adobe.com/xap/1.0/",
+	"xmpRights":    "http://ns.adobe.com/xap/1.0/rights/",
+	"photoshop":    "http://ns.adobe.com/photoshop/1.0/",
+	"Iptc4xmpCore": "http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/",
+}
+
+// xmpPropertyName matches the local name of an XMP property.
+var xmpPropertyName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`)
+
+// MetadataField is an XMP property embedded in encoded images, named
+// "prefix:Name" with a prefix of XMPNamespaces.
+type MetadataField struct {
+	Name  string
+	Value string
+}
+
+// ImageMetadataFields returns the XMP properties embedded in the images of
+// p: Copyright as dc:rights, marking the image as copyrighted, Artist as
+// dc:creator, then the ImageMetadata lines in order. Blank lines are
+// skipped; a property may be set once.
+func (p *Project) ImageMetadataFields() ([]MetadataField, error) {
+	var fields []MetadataField
+	if p.Copyright != "" {
+		fields = append(fields, MetadataField{"dc:rights", p.Copyright}, MetadataField{"xmpRights:Marked", "True"})
+	}
+	if p.Artist != "" {
+		fields = append(fields, MetadataField{"dc:creator", p.Artist})
+	}
+	for _, line := range strings.Split(p.ImageMetadata, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid image_metadata line %q: expected prefix:Name=value", line)
+		}
+		name = strings.TrimSpace(name)
+		prefix, local, _ := strings.Cut(name, ":")
+		if _, known := XMPNamespaces[prefix]; !known || !xmpPropertyName.MatchString(local) {
+			return nil, fmt.Errorf("invalid image_metadata property %q: expected prefix:Name with a prefix of dc, xmp, xmpRights, photoshop or Iptc4xmpCore", name)
+		}
+		fields = append(fields, MetadataField{name, strings.TrimSpace(value)})
+	}
+	seen := map[string]bool{}
+	for _, f := range fields {
+		if seen[f.Name] {
+			return nil, fmt.Errorf("image metadata property %s is set twice", f.Name)
+		}
+		seen[f.Name] = true
+	}
+	return fields, nil
+}
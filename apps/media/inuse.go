@@ -0,0 +1,71 @@
+package media
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// inUse tracks cache files currently read by a request (staged originals fed
+// to an encoder, files being served) so eviction does not delete them midway.
+// Released files stay protected for MEDIAX.EvictionGrace after their last use.
+var inUse = struct {
+	mu       sync.Mutex
+	refs     map[string]int
+	lastUsed map[string]time.Time
+}{refs: map[string]int{}, lastUsed: map[string]time.Time{}}
+
+// AcquireCacheFile marks path as in use and returns the function that
+// releases it. Safe to call with an empty path.
+func AcquireCacheFile(path string) (release func()) {
+	if path == "" || path == STAGING {
+		return func() {}
+	}
+	path = filepath.Clean(path)
+	inUse.mu.Lock()
+	inUse.refs[path]++
+	inUse.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inUse.mu.Lock()
+			defer inUse.mu.Unlock()
+			if inUse.refs[path]--; inUse.refs[path] <= 0 {
+				delete(inUse.refs, path)
+			}
+			inUse.lastUsed[path] = time.Now()
+		})
+	}
+}
+
+// evictionGrace returns how long a released file remains protected.
+func evictionGrace() time.Duration {
+	grace, err := ParseDuration(settings.Get("MEDIAX.EvictionGrace", "1m").String())
+	if err != nil {
+		return time.Minute
+	}
+	return grace
+}
+
+// inUseSnapshot returns the set of files eviction must skip right now and
+// forgets releases older than the grace window.
+func inUseSnapshot() map[string]bool {
+	cutoff := time.Now().Add(-evictionGrace())
+	inUse.mu.Lock()
+	defer inUse.mu.Unlock()
+	protected := make(map[string]bool, len(inUse.refs)+len(inUse.lastUsed))
+	for p := range inUse.refs {
+		protected[p] = true
+	}
+	for p, t := range inUse.lastUsed {
+		if t.Before(cutoff) {
+			delete(inUse.lastUsed, p)
+			continue
+		}
+		protected[p] = true
+	}
+	return protected
+}
@@ -0,0 +1,284 @@
+// Package localfs is the local directory storage backend. It replaces
+// github.com/getevo/filesystem/localfs, which MediaX does not import: that
+// copy resolves only the source of Copy and Move, treats the disk side of
+// DiskToStorage as a storage path, and falls back to the root directory for
+// keys escaping it. Keys are slash-separated and relative to Path.
+package localfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"mediax/apps/media/dsn"
+)
+
+// errOutsideRoot is returned for keys that resolve outside Path, e.g.
+// "../etc/passwd".
+var errOutsideRoot = errors.New("path is outside the storage directory")
+
+// FileSystem implements filesystem.Interface on a local directory.
+//
+// DSN format:
+//
+//	fs:///srv/media
+type FileSystem struct {
+	DSN    string `dsn:"fs://$Path"`
+	Scheme string
+	Path   string
+	Debug  bool `default:"false"`
+	Params map[string]string
+}
+
+// New creates and initialises a FileSystem from a DSN string.
+func New(configString string) (*FileSystem, error) {
+	f := &FileSystem{}
+	if err := f.Setup(configString); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Validate parses configString like Setup, so a bad config is reported when
+// it is saved. Unlike Setup it also refuses parameters that match no option.
+func Validate(configString string) error {
+	if err := dsn.ParseDSN(configString, &FileSystem{}); err != nil {
+		return fmt.Errorf("failed to parse local DSN: %w", err)
+	}
+	return nil
+}
+
+// Setup parses confString. Path is always absolute: "fs://srv/media" and
+// "fs:///srv/media" both name /srv/media. Parameters that match no option
+// are logged and ignored, so configs saved by older versions load.
+func (l *FileSystem) Setup(confString string) error {
+	ignored, err := dsn.ParseDSNLenient(confString, l)
+	if err != nil {
+		return fmt.Errorf("failed to parse local DSN: %w", err)
+	}
+	for _, err := range ignored {
+		log.Warning("local storage config ignored", "error", err)
+	}
+	l.Path = "/" + strings.Trim(l.Path, "/")
+	return nil
+}
+
+// resolve returns the file of key below Path.
+func (l *FileSystem) resolve(key string) (string, error) {
+	root := filepath.Clean(l.Path)
+	file := filepath.Join(root, filepath.FromSlash(key))
+	if file != root && !strings.HasPrefix(file, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", errOutsideRoot, key)
+	}
+	if l.Debug {
+		log.Debug("local storage access", "key", key, "file", file)
+	}
+	return file, nil
+}
+
+func (l *FileSystem) Touch(key string) error {
+	file, err := l.resolve(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(file, now, now)
+}
+
+func (l *FileSystem) Delete(key string) error {
+	file, err := l.resolve(key)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(file)
+}
+
+func (l *FileSystem) List(key string) ([]string, error) {
+	dir, err := l.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// Walk walks the tree below key, passing keys relative to Path to fn.
+func (l *FileSystem) Walk(key string, fn func(path string, info fs.FileInfo, err error) error) error {
+	dir, err := l.resolve(key)
+	if err != nil {
+		return err
+	}
+	root := filepath.Clean(l.Path)
+	return filepath.Walk(dir, func(p string, info fs.FileInfo, err error) error {
+		rel, _ := filepath.Rel(root, p)
+		return fn(filepath.ToSlash(rel), info, err)
+	})
+}
+
+func (l *FileSystem) Read(key string) ([]byte, error) {
+	file, err := l.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(file)
+}
+
+func (l *FileSystem) IsDir(key string) (bool, error) {
+	info, err := l.Stat(key)
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+func (l *FileSystem) IsFile(key string) (bool, error) {
+	info, err := l.Stat(key)
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+func (l *FileSystem) Mkdir(key string) error {
+	dir, err := l.resolve(key)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+func (l *FileSystem) Write(key string, data []byte) error {
+	file, err := l.resolve(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+func (l *FileSystem) WriteBuffer(key string, r io.Reader) error {
+	file, err := l.resolve(key)
+	if err != nil {
+		return err
+	}
+	return writeFile(file, r)
+}
+
+func (l *FileSystem) Exists(key string) (bool, error) {
+	_, err := l.Stat(key)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (l *FileSystem) Stat(key string) (fs.FileInfo, error) {
+	file, err := l.resolve(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(file)
+}
+
+// Copy copies the object src to the object dst.
+func (l *FileSystem) Copy(src, dst string) error {
+	srcFile, err := l.resolve(src)
+	if err != nil {
+		return err
+	}
+	dstFile, err := l.resolve(dst)
+	if err != nil {
+		return err
+	}
+	return copyFile(srcFile, dstFile)
+}
+
+// Move renames the object src to dst.
+func (l *FileSystem) Move(src, dst string) error {
+	srcFile, err := l.resolve(src)
+	if err != nil {
+		return err
+	}
+	dstFile, err := l.resolve(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstFile), 0755); err != nil {
+		return err
+	}
+	return os.Rename(srcFile, dstFile)
+}
+
+// DiskToStorage copies the local file src to the object dst.
+func (l *FileSystem) DiskToStorage(src, dst string) error {
+	dstFile, err := l.resolve(dst)
+	if err != nil {
+		return err
+	}
+	return copyFile(src, dstFile)
+}
+
+// StorageToDisk copies the object src to the local file dst.
+func (l *FileSystem) StorageToDisk(src, dst string) error {
+	srcFile, err := l.resolve(src)
+	if err != nil {
+		return err
+	}
+	return copyFile(srcFile, dst)
+}
+
+func copyFile(src, dst string) error {
+	if filepath.Clean(src) == filepath.Clean(dst) {
+		return errors.New("source and destination paths cannot be the same")
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeFile(dst, in)
+}
+
+// writeFile writes r to file, creating its directory.
+func writeFile(file string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -1,23 +1,36 @@
 package media
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/getevo/evo/v2"
 	"github.com/getevo/evo/v2/lib/db/types"
-	"github.com/getevo/evo/v2/lib/gpath"
+	"github.com/getevo/evo/v2/lib/generic"
 	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
 	"github.com/getevo/filesystem"
-	"github.com/getevo/filesystem/http"
-	"github.com/getevo/filesystem/localfs"
-	localS3 "mediax/apps/media/s3"
 	"github.com/getevo/restify"
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 	"io"
 	"math"
+	"mediax/apps/media/httpfs"
+	"mediax/apps/media/localfs"
+	localS3 "mediax/apps/media/s3"
+	"mediax/mediaurl"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,74 +40,416 @@ type Type struct {
 	Extension string
 	Mime      string
 	Encoders  map[string]*Encoder
+	// Direct serves the source unchanged. Types without one get an encoder
+	// of Mime without a processor.
+	Direct *Encoder
 }
+
+// DirectEncoder returns the encoder that serves the source of t unchanged.
+func (t *Type) DirectEncoder() *Encoder {
+	if t.Direct != nil {
+		return t.Direct
+	}
+	return &Encoder{Mime: t.Mime}
+}
+
 type Options struct {
 	Width           int
 	Height          int
 	KeepAspectRatio bool
-	Quality         int
-	CropDirection   string
-	OutputFormat    string
-	Profile         string
-	Download        bool
-	Encoder         *Encoder
+	// AspectRatio ("16:9") derives the missing one of Width and Height.
+	AspectRatio string
+	// Pad letterboxes images into Width x Height instead of cropping them.
+	Pad bool
+	// Scale resizes to a percentage of the source dimensions. Encoders
+	// replace it with absolute pixels (ResolveScale) once they know them.
+	Scale         int
+	Quality       int
+	CropDirection string
+	OutputFormat  string
+	Profile       string
+	Download      bool
+	Encoder       *Encoder
+	// Disposition ("inline" or "attachment") and Filename set the
+	// Content-Disposition of the response; see SetContentDisposition.
+	Disposition string
+	Filename    string
 	// Video-specific options
 	Preview      string        // "true", "480p", "720p", "1080p", "4k","wxy"
 	Thumbnail    string        // "480p", "720p", "1080p", "4k"
 	SS           int           // timestamp in seconds for thumbnail
 	VideoProfile *VideoProfile // resolved profile when profile= is set
 	// Audio-specific options
-	Detail bool // return JSON metadata when true
+	Detail   bool // return JSON metadata when true
+	Loudness bool // measure EBU R128 loudness for Detail
+	// PHash returns the perceptual hash of an image or video as JSON.
+	PHash bool
+	// OCR returns the text of an image or PDF with its bounding boxes as
+	// JSON, recognized in the Tesseract languages Lang.
+	OCR  bool
+	Lang string
+	// Deep-zoom options (images)
+	DZI  bool   // return the Deep Zoom descriptor
+	Tile string // "level/col_row" of a Deep Zoom tile
+	// Frame selects one frame (1-based) of an animated image; 0 keeps all.
+	Frame int
+	// Strip removes EXIF, XMP, ICC comments and other metadata from images.
+	Strip bool
+	// DPI sets the resolution metadata of image output, and the resolution
+	// PDF pages are rasterized at.
+	DPI int
+	// MaxBytes caps the size of a lossy image output: the quality is
+	// lowered until the file fits.
+	MaxBytes int64
+	// Trim removes uniform borders from images before resizing.
+	Trim bool
+	// BgRemove makes the background of this colour transparent; Fuzz is
+	// the colour distance in percent for Trim and BgRemove, 0 for the
+	// default.
+	BgRemove string
+	Fuzz     int
+	// RemoveBackground cuts the subject out of an image with the
+	// background removal service (bg=remove).
+	RemoveBackground bool
+	// Document options: Flatten renders annotations and form fields into
+	// the page content of a PDF.
+	Flatten bool
+	// Attachment selects one attachment (1-based) of an email message.
+	Attachment int
+	// Pages selects the pages ("1-3,5", 1-based) of a PDF or multi-page
+	// TIFF converted to TIFF or PDF, and Compression the TIFF compression
+	// (g4, lzw or none) of the result.
+	Pages       string
+	Compression string
+	// Chapter selects one chapter (1-based) of an audiobook or other audio
+	// with chapter marks.
+	Chapter int
+	// VideoBitrate and AudioBitrate (bits per second) override those of the
+	// video profile, and TwoPass its two-pass setting; see
+	// TranscodeSettings.
+	VideoBitrate int
+	AudioBitrate int
+	TwoPass      bool
+	// HLS segments audio for HTTP Live Streaming: the playlist, or with
+	// Segment the segment of that number (1-based).
+	HLS     bool
+	Segment int
+	// Pipeline names the encoder alternative a canary request runs; its
+	// outputs are cached apart from those of the encoder.
+	Pipeline string
+}
+
+// Bounds of vb and ab, in bits per second.
+const (
+	minVideoBitrate = 100_000
+	maxVideoBitrate = 100_000_000
+	minAudioBitrate = 8_000
+	maxAudioBitrate = 512_000
+)
+
+// ParseBitrate converts a bitrate such as "2500k", "2.5M" or "128000" to
+// bits per second. k and M are decimal, as for ffmpeg.
+func ParseBitrate(s string) (int, error) {
+	if !mediaurl.BitratePattern.MatchString(s) {
+		return 0, fmt.Errorf("invalid bitrate %q: expected a number with an optional k or M suffix, such as 2500k", s)
+	}
+	mult := 1.0
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		mult, s = 1e3, s[:len(s)-1]
+	case 'm', 'M':
+		mult, s = 1e6, s[:len(s)-1]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bitrate %q", s)
+	}
+	return int(math.Round(f * mult)), nil
+}
+
+// TranscodeSettings returns the video and audio bitrates (0 when unset) and
+// the two-pass setting of a profile transcode: the vb, ab and twopass
+// options, or else the values of VideoProfile. Two passes need a video
+// bitrate to aim at.
+func (o *Options) TranscodeSettings() (videoBitrate, audioBitrate int, twoPass bool, err error) {
+	videoBitrate, audioBitrate, twoPass = o.VideoBitrate, o.AudioBitrate, o.TwoPass
+	if vp := o.VideoProfile; vp != nil {
+		if videoBitrate == 0 && vp.VideoBitrate != "" {
+			if videoBitrate, err = ParseBitrate(vp.VideoBitrate); err != nil {
+				return 0, 0, false, fmt.Errorf("video profile %s: %w", vp.Profile, err)
+			}
+		}
+		if audioBitrate == 0 && vp.AudioBitrate != "" {
+			if audioBitrate, err = ParseBitrate(vp.AudioBitrate); err != nil {
+				return 0, 0, false, fmt.Errorf("video profile %s: %w", vp.Profile, err)
+			}
+		}
+		twoPass = twoPass || vp.TwoPass
+	}
+	if twoPass && videoBitrate == 0 {
+		return 0, 0, false, errors.New("two-pass encoding needs a video bitrate: vb= or the video_bitrate of the profile")
+	}
+	return videoBitrate, audioBitrate, twoPass, nil
+}
+
+// Canonical returns a stable textual form of every option that influences
+// the produced output. Options that only affect delivery (Download,
+// Disposition, Filename) are excluded. Detail, phash and ocr requests
+// depend on nothing but the source (and the OCR language), so they
+// collapse to a single form regardless of other parameters.
+func (o *Options) Canonical() string {
+	if o.PHash {
+		return "phash"
+	}
+	if o.OCR {
+		return "ocr;lang=" + o.Lang
+	}
+	if o.Detail {
+		if o.Loudness {
+			return "detail;loudness"
+		}
+		return "detail"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "w=%d;h=%d;ar=%t;q=%d;dir=%s;f=%s",
+		o.Width, o.Height, o.KeepAspectRatio, o.Quality, strings.ToLower(o.CropDirection), strings.ToLower(o.OutputFormat))
+	fmt.Fprintf(&b, ";preview=%s;thumbnail=%s;ss=%d", o.Preview, o.Thumbnail, o.SS)
+	if o.DZI || o.Tile != "" {
+		fmt.Fprintf(&b, ";dzi=%t;tile=%s", o.DZI, o.Tile)
+	}
+	if o.Frame > 0 {
+		fmt.Fprintf(&b, ";frame=%d", o.Frame)
+	}
+	if o.Strip {
+		b.WriteString(";strip")
+	}
+	if o.DPI > 0 {
+		fmt.Fprintf(&b, ";dpi=%d", o.DPI)
+	}
+	if o.MaxBytes > 0 {
+		fmt.Fprintf(&b, ";maxbytes=%d", o.MaxBytes)
+	}
+	if o.Trim {
+		b.WriteString(";trim")
+	}
+	if o.BgRemove != "" {
+		fmt.Fprintf(&b, ";bg_remove=%s", strings.ToLower(o.BgRemove))
+	}
+	if o.Fuzz > 0 {
+		fmt.Fprintf(&b, ";fuzz=%d", o.Fuzz)
+	}
+	if o.RemoveBackground {
+		b.WriteString(";bg=remove")
+	}
+	if o.Pad {
+		b.WriteString(";pad")
+	}
+	if o.Scale > 0 {
+		fmt.Fprintf(&b, ";scale=%d", o.Scale)
+	}
+	if o.Flatten {
+		b.WriteString(";flatten")
+	}
+	if o.Attachment > 0 {
+		fmt.Fprintf(&b, ";attachment=%d", o.Attachment)
+	}
+	if o.Pages != "" {
+		fmt.Fprintf(&b, ";pages=%s", o.Pages)
+	}
+	if o.Compression != "" {
+		fmt.Fprintf(&b, ";compression=%s", o.Compression)
+	}
+	if o.Chapter > 0 {
+		fmt.Fprintf(&b, ";chapter=%d", o.Chapter)
+	}
+	if vp := o.VideoProfile; vp != nil {
+		fmt.Fprintf(&b, ";profile=%s:%dx%d:q%d:%s", vp.Profile, vp.Width, vp.Height, vp.Quality, vp.Codec)
+		if vp.VideoBitrate != "" || vp.AudioBitrate != "" || vp.TwoPass {
+			fmt.Fprintf(&b, ":vb%s:ab%s:2pass%t", vp.VideoBitrate, vp.AudioBitrate, vp.TwoPass)
+		}
+	} else if o.Profile != "" {
+		fmt.Fprintf(&b, ";profile=%s", o.Profile)
+	}
+	if o.VideoBitrate > 0 || o.AudioBitrate > 0 || o.TwoPass {
+		fmt.Fprintf(&b, ";vb=%d;ab=%d;twopass=%t", o.VideoBitrate, o.AudioBitrate, o.TwoPass)
+	}
+	if o.HLS {
+		fmt.Fprintf(&b, ";hls;segment=%d", o.Segment)
+	}
+	if o.Pipeline != "" {
+		fmt.Fprintf(&b, ";pipeline=%s", o.Pipeline)
+	}
+	return b.String()
+}
+
+// Passthrough reports whether o asks for the unmodified source file of
+// extension (no resize, quality or format change), so serving it needs no
+// encoder.
+func (o *Options) Passthrough(extension string) bool {
+	return o.Width == 0 && o.Height == 0 && o.Quality == 0 && o.Profile == "" &&
+		o.Preview == "" && o.Thumbnail == "" && o.SS == 0 && !o.Detail && !o.PHash && !o.OCR && !o.DZI && o.Tile == "" && o.Frame == 0 && !o.Strip && o.DPI == 0 && o.MaxBytes == 0 && !o.Trim && o.BgRemove == "" && !o.RemoveBackground && !o.Pad && o.Scale == 0 && !o.Flatten && o.Attachment == 0 && o.Pages == "" && o.Compression == "" && o.Chapter == 0 && !o.HLS &&
+		sameFormat(o.OutputFormat, extension)
+}
+
+// sameFormat reports whether the formats or extensions a and b name the same
+// format, e.g. jpg and JPEG.
+func sameFormat(a, b string) bool {
+	format := func(f string) string {
+		if f = strings.ToLower(f); f == "jpeg" {
+			return "jpg"
+		}
+		return f
+	}
+	return format(a) == format(b)
 }
 
-func (o Options) ToString() string {
-	return fmt.Sprintf("%dx%da%tq%dd%sp%s", o.Width, o.Height, o.KeepAspectRatio, o.Quality, o.CropDirection, o.Profile)
+// CacheKey returns the hex cache key of the variant of source described by
+// o. Two requests share a cached output exactly when their keys match.
+func (o *Options) CacheKey(source string) string {
+	sum := md5.Sum([]byte(source + "|" + o.Canonical()))
+	return hex.EncodeToString(sum[:])
 }
 
 // queryFirst returns the first non-empty value among the given query param names.
-func queryFirst(request *evo.Request, names ...string) string {
+func queryFirst(query QueryFunc, names ...string) string {
 	for _, name := range names {
-		if v := request.Query(name).String(); v != "" {
+		if v := query(name).String(); v != "" {
 			return v
 		}
 	}
 	return ""
 }
 
-// maxDimension is the largest width or height that a client may request.
-// Prevents runaway ImageMagick memory allocations on malicious inputs (#9).
-const maxDimension = 7680 // 8K UHD
+// QueryFunc returns the value of a query parameter, like evo.Request.Query.
+type QueryFunc func(name string) generic.Value
 
-func (t *Type) ParseOptions(request *evo.Request) (*Options, error) {
+// QueryValues adapts url.Values to a QueryFunc, for callers outside an HTTP
+// request such as the CLI.
+func QueryValues(values url.Values) QueryFunc {
+	return func(name string) generic.Value {
+		return generic.Parse(values.Get(name))
+	}
+}
+
+// ErrFormatNotAllowed is returned by ParseOptions for source extensions and
+// output formats the origin does not allow.
+var ErrFormatNotAllowed = errors.New("format not allowed")
+
+// ParseOptions parses the options of query, merged with the default and
+// forced options of origin, and checks the source extension and output
+// format against the allow and deny lists of origin.
+func (t *Type) ParseOptions(query QueryFunc, origin *Origin) (*Options, error) {
+	if !origin.AllowsExtension(t.Extension) {
+		return nil, fmt.Errorf("%w: source extension %s", ErrFormatNotAllowed, t.Extension)
+	}
+	options, err := t.ParseQuery(origin.optionQuery(query))
+	if err != nil {
+		return nil, err
+	}
+	if !origin.AllowsFormat(options.OutputFormat) {
+		return nil, fmt.Errorf("%w: output format %s", ErrFormatNotAllowed, options.OutputFormat)
+	}
+	if limit := origin.MaxQuality; limit > 0 && (options.Quality > limit || options.Quality == 0 && !options.Passthrough(t.Extension)) {
+		options.Quality = mediaurl.Snap(limit, mediaurl.Qualities)
+	}
+	return options, nil
+}
+
+// transparentFormat reports whether the output format has an alpha channel.
+func transparentFormat(format string) bool {
+	switch strings.ToLower(format) {
+	case "png", "webp", "avif", "gif":
+		return true
+	}
+	return false
+}
+
+// rasterizedDocuments are the document sources whose pages are rendered
+// with pdftoppm, so dpi sets their resolution.
+var rasterizedDocuments = map[string]bool{
+	"pdf": true, "docx": true, "doc": true, "odt": true, "xlsx": true,
+	"xls": true, "ods": true, "pptx": true, "ppt": true, "odp": true,
+}
+
+// pagedConversion reports whether converting a source of extension to
+// format keeps its pages: pdf to tiff, and tiff to tiff or pdf.
+func pagedConversion(extension, format string) bool {
+	tiff := func(f string) bool { return f == "tif" || f == "tiff" }
+	format = strings.ToLower(format)
+	switch {
+	case extension == "pdf":
+		return tiff(format)
+	case tiff(extension):
+		return tiff(format) || format == "pdf"
+	}
+	return false
+}
+
+// PageRanges parses a page selection such as "1-3,5" into inclusive,
+// 1-based ranges.
+func PageRanges(pages string) ([][2]int, error) {
+	if !mediaurl.PagesPattern.MatchString(pages) {
+		return nil, fmt.Errorf("invalid pages %q: expected pages and ranges such as 1-3,5", pages)
+	}
+	var ranges [][2]int
+	for _, part := range strings.Split(pages, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, _ := strconv.Atoi(first)
+		to := from
+		if isRange {
+			to, _ = strconv.Atoi(last)
+		}
+		if from < 1 || to < from {
+			return nil, fmt.Errorf("invalid pages %q: pages are numbered from 1 and ranges go upwards", pages)
+		}
+		ranges = append(ranges, [2]int{from, to})
+	}
+	return ranges, nil
+}
+
+// lossyFormat reports whether the quality of format trades size for
+// fidelity, so maxbytes can lower it.
+func lossyFormat(format string) bool {
+	switch strings.ToLower(format) {
+	case "jpg", "jpeg", "webp", "avif":
+		return true
+	}
+	return false
+}
+
+// ParseQuery parses transformation options from query parameters.
+func (t *Type) ParseQuery(query QueryFunc) (*Options, error) {
 	options := &Options{}
 
 	// Accept both long form (width/height/format) and short aliases (w/h/f).
-	if v := queryFirst(request, "width", "w"); v != "" {
+	if v := queryFirst(query, "width", "w"); v != "" {
 		n, err := strconv.Atoi(v)
 		if err != nil || n < 0 {
 			return nil, fmt.Errorf("invalid width value: %q", v)
 		}
-		if n > maxDimension {
-			return nil, fmt.Errorf("width %d exceeds maximum allowed dimension %d", n, maxDimension)
+		if n > mediaurl.MaxDimension {
+			return nil, fmt.Errorf("width %d exceeds maximum allowed dimension %d", n, mediaurl.MaxDimension)
 		}
 		options.Width = n
 	}
-	if v := queryFirst(request, "height", "h"); v != "" {
+	if v := queryFirst(query, "height", "h"); v != "" {
 		n, err := strconv.Atoi(v)
 		if err != nil || n < 0 {
 			return nil, fmt.Errorf("invalid height value: %q", v)
 		}
-		if n > maxDimension {
-			return nil, fmt.Errorf("height %d exceeds maximum allowed dimension %d", n, maxDimension)
+		if n > mediaurl.MaxDimension {
+			return nil, fmt.Errorf("height %d exceeds maximum allowed dimension %d", n, mediaurl.MaxDimension)
 		}
 		options.Height = n
 	}
-	if request.Query("q").String() != "" {
-		options.Quality = request.Query("q").Int()
+	if query("q").String() != "" {
+		options.Quality = query("q").Int()
 	}
-	options.Download = request.Query("download").Bool()
-	options.KeepAspectRatio = request.Query("crop").String() == ""
-	if size := request.Query("size").String(); size != "" {
+	if err := options.ParseDelivery(query); err != nil {
+		return nil, err
+	}
+	options.KeepAspectRatio = query("crop").String() == ""
+	if size := query("size").String(); size != "" {
 		parts := strings.Split(size, "x")
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("invalid size format %q: expected WxH", size)
@@ -104,31 +459,203 @@ func (t *Type) ParseOptions(request *evo.Request) (*Options, error) {
 		if err1 != nil || err2 != nil || w < 0 || h < 0 {
 			return nil, fmt.Errorf("invalid size value %q: width and height must be non-negative integers", size)
 		}
-		if w > maxDimension || h > maxDimension {
-			return nil, fmt.Errorf("size %q exceeds maximum allowed dimension %d", size, maxDimension)
+		if w > mediaurl.MaxDimension || h > mediaurl.MaxDimension {
+			return nil, fmt.Errorf("size %q exceeds maximum allowed dimension %d", size, mediaurl.MaxDimension)
 		}
 		options.Width = w
 		options.Height = h
 	}
-	options.CropDirection = request.Query("dir").String()
-	if options.Width > 0 && options.Height > 0 {
+	options.CropDirection = query("dir").String()
+	options.AspectRatio = query("ar").String()
+	options.Pad = query("pad").Bool()
+	if v := query("scale").String(); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("invalid scale value %q: must be a percentage between 1 and 100", v)
+		}
+		if options.Width > 0 || options.Height > 0 || options.AspectRatio != "" {
+			return nil, fmt.Errorf("scale cannot be combined with w, h, size or ar")
+		}
+		options.Scale = n
+	}
+	// Both sides crop to the box, unless fit asks to keep the aspect ratio
+	// inside it.
+	if fit := query("fit").Bool(); fit && (query("crop").String() != "" || options.Pad) {
+		return nil, fmt.Errorf("fit cannot be combined with crop or pad")
+	} else if options.Width > 0 && options.Height > 0 && !fit {
 		options.KeepAspectRatio = false
 	}
 	// Accept both long form (format) and short alias (f).
-	options.OutputFormat = queryFirst(request, "format", "f")
+	options.OutputFormat = queryFirst(query, "format", "f")
 	if options.OutputFormat == "" {
 		options.OutputFormat = t.Extension
 	}
 
 	// Parse video-specific options
-	options.Preview = request.Query("preview").String()
-	options.Thumbnail = request.Query("thumbnail").String()
-	if request.Query("ss").String() != "" {
-		options.SS = request.Query("ss").Int()
+	options.Preview = query("preview").String()
+	options.Thumbnail = query("thumbnail").String()
+	if query("ss").String() != "" {
+		options.SS = query("ss").Int()
+	}
+	options.Profile = query("profile").String()
+	if v := query("vb").String(); v != "" {
+		n, err := ParseBitrate(v)
+		if err != nil || n < minVideoBitrate || n > maxVideoBitrate {
+			return nil, fmt.Errorf("invalid vb value %q: expected a video bitrate between 100k and 100M, such as 2500k", v)
+		}
+		options.VideoBitrate = n
+	}
+	if v := query("ab").String(); v != "" {
+		n, err := ParseBitrate(v)
+		if err != nil || n < minAudioBitrate || n > maxAudioBitrate {
+			return nil, fmt.Errorf("invalid ab value %q: expected an audio bitrate between 8k and 512k, such as 128k", v)
+		}
+		options.AudioBitrate = n
+	}
+	options.TwoPass = query("twopass").Bool()
+	if (options.VideoBitrate > 0 || options.AudioBitrate > 0 || options.TwoPass) && (options.Profile == "" || !strings.HasPrefix(t.Mime, "video/")) {
+		return nil, fmt.Errorf("vb, ab and twopass need a video transcoded with profile=")
 	}
 
 	// Parse audio-specific options
-	options.Detail = request.Query("detail").Bool()
+	options.Detail = query("detail").Bool()
+	options.Loudness = query("loudness").Bool()
+	if options.PHash = query("phash").Bool(); options.PHash && !strings.HasPrefix(t.Mime, "image/") && !strings.HasPrefix(t.Mime, "video/") {
+		return nil, fmt.Errorf("phash is only supported for images and videos")
+	}
+	if options.OCR = query("ocr").Bool(); options.OCR {
+		if !strings.HasPrefix(t.Mime, "image/") && t.Extension != "pdf" {
+			return nil, fmt.Errorf("ocr is only supported for images and pdf")
+		}
+		options.Lang = query("lang").String()
+		if options.Lang == "" {
+			options.Lang = settings.Get("MEDIAX.OCRLanguage", "eng").String()
+		}
+		if !mediaurl.LangPattern.MatchString(options.Lang) {
+			return nil, fmt.Errorf("invalid lang %q: expected Tesseract languages such as eng or eng+deu", options.Lang)
+		}
+	}
+
+	// Parse deep-zoom options
+	options.DZI = query("dzi").Bool()
+	if tile := query("tile").String(); tile != "" {
+		if !mediaurl.TilePattern.MatchString(tile) {
+			return nil, fmt.Errorf("invalid tile %q: expected level/col_row", tile)
+		}
+		options.Tile = tile
+	}
+
+	options.Strip = query("strip").Bool()
+	if v := query("dpi").String(); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < mediaurl.MinDPI || n > mediaurl.MaxDPI {
+			return nil, fmt.Errorf("invalid dpi value %q: must be between %d and %d", v, mediaurl.MinDPI, mediaurl.MaxDPI)
+		}
+		if !strings.HasPrefix(t.Mime, "image/") {
+			if !rasterizedDocuments[t.Extension] {
+				return nil, fmt.Errorf("dpi is only supported for images, pdf and office documents")
+			}
+			if !transparentFormat(options.OutputFormat) && !lossyFormat(options.OutputFormat) && !pagedConversion(t.Extension, options.OutputFormat) {
+				return nil, fmt.Errorf("dpi on a document needs an image output format (jpg, png, webp, avif or tiff), not %s", options.OutputFormat)
+			}
+		}
+		options.DPI = n
+	}
+	if v := query("maxbytes").String(); v != "" {
+		n, err := ParseCacheSize(v)
+		if err != nil || n < 1024 {
+			return nil, fmt.Errorf("invalid maxbytes value %q: expected a size of at least 1KB, such as 200KB", v)
+		}
+		if !strings.HasPrefix(t.Mime, "image/") || !lossyFormat(options.OutputFormat) {
+			return nil, fmt.Errorf("maxbytes needs an image with a lossy output format (jpg, webp or avif), not %s", options.OutputFormat)
+		}
+		options.MaxBytes = n
+	}
+	options.Trim = query("trim").Bool()
+	if c := query("bg_remove").String(); c != "" {
+		if !mediaurl.ColorPattern.MatchString(c) {
+			return nil, fmt.Errorf("invalid bg_remove colour %q: expected a colour name or hex value", c)
+		}
+		if !transparentFormat(options.OutputFormat) {
+			return nil, fmt.Errorf("bg_remove needs an output format with transparency (png, webp, avif or gif), not %s", options.OutputFormat)
+		}
+		options.BgRemove = c
+	}
+	if bg := query("bg").String(); bg != "" {
+		if bg != "remove" {
+			return nil, fmt.Errorf("invalid bg value %q: expected remove", bg)
+		}
+		if !transparentFormat(options.OutputFormat) {
+			return nil, fmt.Errorf("bg=remove needs an output format with transparency (png, webp, avif or gif), not %s", options.OutputFormat)
+		}
+		options.RemoveBackground = true
+	}
+	if v := query("fuzz").String(); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			return nil, fmt.Errorf("invalid fuzz value %q: must be a percentage between 0 and 100", v)
+		}
+		options.Fuzz = n
+	}
+	options.Flatten = query("flatten").Bool()
+	if v := query("attachment").String(); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid attachment value %q: attachments are numbered from 1", v)
+		}
+		options.Attachment = n
+	}
+
+	if v := query("pages").String(); v != "" {
+		if _, err := PageRanges(v); err != nil {
+			return nil, err
+		}
+		options.Pages = v
+	}
+	if v := strings.ToLower(query("compression").String()); v != "" {
+		if !mediaurl.TiffCompressions[v] {
+			return nil, fmt.Errorf("invalid compression %q: expected g4, lzw or none", v)
+		}
+		options.Compression = v
+	}
+	if (options.Pages != "" || options.Compression != "") && !pagedConversion(t.Extension, options.OutputFormat) {
+		return nil, fmt.Errorf("pages and compression need a pdf or tiff source converted to tiff, or a tiff source converted to pdf")
+	}
+
+	if v := query("frame").String(); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid frame value %q: frames are numbered from 1", v)
+		}
+		options.Frame = n
+	}
+
+	if v := query("chapter").String(); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid chapter value %q: chapters are numbered from 1", v)
+		}
+		options.Chapter = n
+	}
+
+	if options.HLS = query("hls").Bool(); options.HLS {
+		if !strings.HasPrefix(t.Mime, "audio/") {
+			return nil, fmt.Errorf("hls is only supported for audio")
+		}
+		if options.Detail || options.Thumbnail != "" || options.Chapter > 0 {
+			return nil, fmt.Errorf("hls cannot be combined with detail, thumbnail or chapter")
+		}
+	}
+	if v := query("segment").String(); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid segment value %q: segments are numbered from 1", v)
+		}
+		if !options.HLS {
+			return nil, fmt.Errorf("segment needs hls=true")
+		}
+		options.Segment = n
+	}
 
 	var ok bool
 	if options.Encoder, ok = t.Encoders[options.OutputFormat]; !ok {
@@ -137,43 +664,51 @@ func (t *Type) ParseOptions(request *evo.Request) (*Options, error) {
 	options.Encoder = t.Encoders[options.OutputFormat]
 
 	if options.Width > 0 {
-		options.Width = FindClosest(options.Width, ImageSizes)
+		options.Width = mediaurl.Snap(options.Width, mediaurl.Sizes)
 	}
 
 	if options.Height > 0 {
-		options.Height = FindClosest(options.Height, ImageSizes)
+		options.Height = mediaurl.Snap(options.Height, mediaurl.Sizes)
+	}
+
+	// The derived side follows the snapped one exactly, so it is not snapped.
+	if options.AspectRatio != "" {
+		if err := options.applyAspectRatio(); err != nil {
+			return nil, err
+		}
 	}
 
 	if options.Quality > 0 {
 		if options.Quality > 100 {
 			return nil, fmt.Errorf("invalid quality value %d: must be between 1 and 100", options.Quality)
 		}
-		options.Quality = FindClosest(options.Quality, ImageQuality)
+		options.Quality = mediaurl.Snap(options.Quality, mediaurl.Qualities)
 	}
 
 	return options, nil
 }
 
-// FindClosest returns the largest value in sizes that is ≤ in.
-// sizes must be sorted descending (largest first).
-// Values larger than sizes[0] are clamped to sizes[0].
-// Values smaller than sizes[len-1] are clamped to sizes[len-1].
-func FindClosest(in int, sizes []int) int {
-	if len(sizes) == 0 {
-		return in
-	}
-	for _, size := range sizes {
-		if in >= size {
-			return size
-		}
-	}
-	return sizes[len(sizes)-1]
-}
-
 type Encoder struct {
 	Mime       string
 	Parameters string
 	Processor  func(input *Request) error
+	// Input is the family (image, video, audio, model or document) of the
+	// sources Processor reads; empty accepts any source.
+	Input string
+	// Remote marks processors that can read the source from Request.SourceURL
+	// instead of a staged copy (see Request.StageRemote).
+	Remote bool
+	// Alternatives are other implementations of Processor by name, which
+	// canary requests run instead (MEDIAX.CanaryEncoder).
+	Alternatives map[string]EncoderAlternative
+}
+
+// EncoderAlternative is another implementation of an encoder, e.g. libvips
+// instead of ImageMagick. Supports reports whether it implements the
+// options of a request; requests it does not run the encoder's Processor.
+type EncoderAlternative struct {
+	Processor func(input *Request) error
+	Supports  func(input *Request) bool
 }
 
 type Request struct {
@@ -190,9 +725,33 @@ type Request struct {
 	Encoder           *Encoder
 	OriginalFilePath  string
 	StagedFilePath    string
+	SourceVersion     string      // origin ETag or size/mtime of the staged original
+	SourceURL         string      // set instead of StagedFilePath when the source is read remotely
+	SourceHeaders     http.Header // headers requests to SourceURL must send
 	ProcessedFilePath string
 	ProcessedMimeType string                 // MIME type of the processed file (e.g., for thumbnails)
 	Metadata          map[string]interface{} `json:"metadata,omitempty"` // Metadata extracted from the file
+	Deadline          time.Time              // client budget from X-Request-Budget; zero means none
+	// Stream lets encoders set ProcessedStream, the output read while it is
+	// still being encoded, instead of finishing ProcessedFilePath first.
+	Stream          bool
+	ProcessedStream io.ReadCloser
+}
+
+// ErrBudgetExceeded is returned when processing is stopped because the
+// request's Deadline passed.
+var ErrBudgetExceeded = errors.New("request budget exceeded")
+
+// CacheKey returns the cache key of the variant requested by r. Every
+// encoder derives its output paths from this key. The source version is part
+// of the key, so replacing the origin file yields fresh variants.
+func (r *Request) CacheKey() string {
+	return r.Options.CacheKey(r.SourceID())
+}
+
+// SourceID identifies the staged original: its path plus origin version.
+func (r *Request) SourceID() string {
+	return r.OriginalFilePath + "@" + r.SourceVersion
 }
 
 // StageFile stages the file in a temp path for processing. it is necessary when a file is stored on a remote storage.
@@ -206,15 +765,37 @@ func (r *Request) StageFile() error {
 		r.Request.Set("X-Debug-Cache-Dir", r.Origin.Project.CacheDir)
 	}
 
+	var negativeTTL = r.Origin.Project.NegativeCacheTTL()
+	var negKey = negativeKey(r.Origin.ProjectID, r.OriginalFilePath)
+	if negativeTTL > 0 && notFound.hit(negKey) {
+		MetricNegativeCacheHitsTotal.WithLabelValues(r.Origin.Project.Name).Inc()
+		if r.Debug {
+			r.Request.Set("X-Debug-Negative-Cache", "hit")
+		}
+		return ErrNotFoundCached
+	}
+
+	var ttl = r.Origin.Project.StagingTTL()
+	var check = r.sourceSizeCheck()
+	var missing = true
 	for i, storage := range r.Origin.Storages {
+		if storage.FS == nil {
+			lastError = fmt.Errorf("storage %d: %w", storage.StorageID, ErrStorageUnavailable)
+			missing = false
+			continue
+		}
 		if r.Debug {
 			log.Debug("Trying storage", "trace_id", r.TraceID, "storage_index", i, "storage_type", storage.Type, "base_path", storage.BasePath)
 			r.Request.Set(fmt.Sprintf("X-Debug-Storage-%d-Type", i), storage.Type)
 			r.Request.Set(fmt.Sprintf("X-Debug-Storage-%d-BasePath", i), storage.BasePath)
 		}
 
-		r.StagedFilePath, err = storage.StageFile(r.OriginalFilePath, r.Origin.Project.CacheDir)
+		r.StagedFilePath, err = storage.StageFile(r.OriginalFilePath, r.Origin.Project.CacheDir, ttl, check)
+		if r.StagedFilePath == STAGING {
+			return err
+		}
 		if err == nil {
+			r.SourceVersion = SourceVersion(r.StagedFilePath)
 			if r.Debug {
 				log.Debug("File staged successfully", "trace_id", r.TraceID, "storage_index", i, "staged_path", r.StagedFilePath)
 				r.Request.Set("X-Debug-Storage-Success", fmt.Sprintf("storage-%d", i))
@@ -224,10 +805,32 @@ func (r *Request) StageFile() error {
 		}
 
 		lastError = err
+		missing = missing && isNotFound(err)
 		if r.Debug {
 			log.Debug("Storage failed", "trace_id", r.TraceID, "storage_index", i, "error", err.Error())
 			r.Request.Set(fmt.Sprintf("X-Debug-Storage-%d-Error", i), err.Error())
 		}
+		// Shed downloads are not a storage failure; do not load the next one.
+		if errors.Is(err, ErrOverloaded) {
+			break
+		}
+	}
+
+	// Every storage failed to refresh the file. If an expired copy is still
+	// inside the project's stale-if-error window, serve it rather than 404;
+	// a file every storage reports gone is deleted, not unavailable.
+	if stalePath, ok := r.staleStagedFile(ttl); ok && !missing {
+		log.Warning("serving stale staged file after storage error", "trace_id", r.TraceID, "path", r.OriginalFilePath, "error", lastError)
+		MetricStaleServedTotal.WithLabelValues(r.Origin.Project.Name).Inc()
+		r.Request.Set("Warning", `111 - "Revalidation Failed"`)
+		r.StagedFilePath = stalePath
+		r.SourceVersion = SourceVersion(stalePath)
+		return nil
+	}
+
+	// Only remember definite misses; a storage outage must not be cached as 404.
+	if negativeTTL > 0 && missing && lastError != nil {
+		notFound.add(negKey, negativeTTL)
 	}
 
 	if r.Debug {
@@ -235,15 +838,43 @@ func (r *Request) StageFile() error {
 		r.Request.Set("X-Debug-Storage-Final-Error", lastError.Error())
 	}
 
-	return fmt.Errorf("failed to stage file: %v", lastError)
+	return fmt.Errorf("failed to stage file: %w", lastError)
+}
+
+// staleStagedFile returns the path of an expired staged copy of the requested
+// file when it is still within the project's StaleIfError window.
+func (r *Request) staleStagedFile(ttl time.Duration) (string, bool) {
+	window := r.Origin.Project.StaleIfErrorWindow()
+	if ttl <= 0 || window <= 0 {
+		return "", false
+	}
+	stagedPath, err := StagedPath(r.Origin.Project.CacheDir, r.OriginalFilePath)
+	if err != nil {
+		return "", false
+	}
+	info, err := os.Stat(stagedPath)
+	if err != nil || info.IsDir() {
+		return "", false
+	}
+	if info.ModTime().Add(ttl + window).Before(time.Now()) {
+		return "", false
+	}
+	return stagedPath, true
 }
 
 func (r *Request) ServeFile(mime string, filePath string) error {
 	r.Request.Set("Content-Type", mime)
-	file, err := os.Open(filePath)
-
-	var c = r.Request.Context
+	// Derived outputs never change under the same path, so small ones can be
+	// served from memory; staged originals may be refreshed in place.
+	cacheable := filePath != r.StagedFilePath
+	if cacheable {
+		if entry, ok := memCacheGet(filePath); ok {
+			return r.serveContent(filePath, bytes.NewReader(entry.data), int64(len(entry.data)), entry.modTime)
+		}
+	}
 
+	defer AcquireCacheFile(filePath)()
+	file, err := os.Open(filePath)
 	if err != nil {
 		log.Error("failed to open file for serving", "path", filePath, "error", err)
 		if r.Debug {
@@ -257,16 +888,55 @@ func (r *Request) ServeFile(mime string, filePath string) error {
 	if err != nil {
 		return fiber.ErrInternalServerError
 	}
-	fileSize := fi.Size()
+	if cacheable {
+		if entry, ok := memCacheLoad(filePath, file, fi.Size(), fi.ModTime()); ok {
+			return r.serveContent(filePath, bytes.NewReader(entry.data), int64(len(entry.data)), entry.modTime)
+		}
+	}
+	return r.serveContent(filePath, file, fi.Size(), fi.ModTime())
+}
+
+// ServeBytes answers with data, an output of the request derived in memory
+// at modTime, like ServeFile would with a file.
+func (r *Request) ServeBytes(mime, name string, data []byte, modTime time.Time) error {
+	r.Request.Set("Content-Type", mime)
+	return r.serveContent(name, bytes.NewReader(data), int64(len(data)), modTime)
+}
+
+// ServePrivate answers with data, an output made for this request alone
+// (e.g. watermarked for it): it is kept neither in the memory cache nor by
+// shared caches. name is the file name it is saved as.
+func (r *Request) ServePrivate(mime, name string, data []byte) error {
+	var c = r.Request.Context
+	// No two responses are alike, so neither ranges of two responses nor
+	// revalidation can be combined.
+	c.Request().Header.Del("Range")
+	c.Request().Header.Del("If-None-Match")
+	c.Request().Header.Del("If-Modified-Since")
+	if err := r.ServeBytes(mime, name, data, time.Now()); err != nil {
+		return err
+	}
+	c.Set("Cache-Control", "private, no-store")
+	c.Set("Accept-Ranges", "none")
+	c.Response().Header.Del("ETag")
+	c.Response().Header.Del("Last-Modified")
+	return nil
+}
+
+// serveContent writes content (fileSize bytes, last modified at modTime) as
+// the response, honouring conditional and range requests.
+func (r *Request) serveContent(filePath string, content io.ReadSeeker, fileSize int64, modTime time.Time) error {
+	var c = r.Request.Context
 
 	// Cache headers — use size+mtime as a lightweight ETag so browsers and
 	// CDNs can revalidate without re-downloading the full file.
-	etag := fmt.Sprintf(`"%x-%x"`, fi.ModTime().Unix(), fi.Size())
-	lastMod := fi.ModTime().UTC().Format(time.RFC1123)
+	etag := fmt.Sprintf(`"%x-%x"`, modTime.Unix(), fileSize)
+	lastMod := modTime.UTC().Format(time.RFC1123)
 	c.Set("ETag", etag)
 	c.Set("Last-Modified", lastMod)
 	c.Set("Cache-Control", "public, max-age=86400")
 	c.Set("Accept-Ranges", "bytes")
+	r.SetContentDisposition(filePath)
 
 	// Conditional request: If-None-Match
 	if c.Get("If-None-Match") == etag {
@@ -275,7 +945,7 @@ func (r *Request) ServeFile(mime string, filePath string) error {
 	}
 	// Conditional request: If-Modified-Since
 	if ims := c.Get("If-Modified-Since"); ims != "" {
-		if t, err := time.Parse(time.RFC1123, ims); err == nil && !fi.ModTime().After(t) {
+		if t, err := time.Parse(time.RFC1123, ims); err == nil && !modTime.After(t) {
 			c.Status(fiber.StatusNotModified)
 			return nil
 		}
@@ -284,11 +954,8 @@ func (r *Request) ServeFile(mime string, filePath string) error {
 	rangeHeader := c.Get("Range")
 	if rangeHeader == "" {
 		c.Set("Content-Length", fmt.Sprintf("%d", fileSize))
-		if r.Options.Download {
-			c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filepath.Base(filePath)))
-		}
 		c.Status(fiber.StatusOK)
-		_, err := io.Copy(c, file)
+		_, err := io.Copy(c, content)
 		return err
 	}
 
@@ -367,7 +1034,7 @@ func (r *Request) ServeFile(mime string, filePath string) error {
 	}
 
 	length := end - start + 1
-	if _, err = file.Seek(start, io.SeekStart); err != nil {
+	if _, err := content.Seek(start, io.SeekStart); err != nil {
 		return fiber.ErrInternalServerError
 	}
 
@@ -375,20 +1042,75 @@ func (r *Request) ServeFile(mime string, filePath string) error {
 	c.Set("Accept-Ranges", "bytes")
 	c.Set("Content-Length", fmt.Sprintf("%d", length))
 	c.Status(fiber.StatusPartialContent)
-	_, err = io.CopyN(c, file, length)
+	_, err := io.CopyN(c, content, length)
 	return err
 }
 
 type Project struct {
-	ProjectID   int       `gorm:"column:project_id;primaryKey;autoIncrement" json:"project_id"`
-	Name        string    `gorm:"column:name;size:255" json:"name"`
-	Description string    `gorm:"column:description;size:255" json:"description"`
-	Active      bool      `json:"column:active" json:"active"`
-	CacheDir    string    `gorm:"column:cache_dir;size:255" json:"cache_dir"`
-	CacheSize   string    `gorm:"column:cache_size;size:255" json:"cache_size"`
-	CacheTTL    string    `gorm:"column:cache_ttl" json:"cache_ttl"`
-	Storages    []Storage `gorm:"foreignKey:ProjectID"`
-	Origins     []Origin  `gorm:"foreignKey:ProjectID"`
+	ProjectID   int    `gorm:"column:project_id;primaryKey;autoIncrement" json:"project_id"`
+	Name        string `gorm:"column:name;size:255" json:"name"`
+	Description string `gorm:"column:description;size:255" json:"description"`
+	Active      bool   `json:"column:active" json:"active"`
+	CacheDir    string `gorm:"column:cache_dir;size:255" json:"cache_dir"`
+	CacheSize   string `gorm:"column:cache_size;size:255" json:"cache_size"`
+	CacheTTL    string `gorm:"column:cache_ttl" json:"cache_ttl"`
+	// StaleIfError is how long past CacheTTL an expired staged file may still
+	// be served when every storage fails to refresh it (e.g. "1h", "7d"); not
+	// when every storage reports it gone.
+	StaleIfError string `gorm:"column:stale_if_error;size:255" json:"stale_if_error"`
+	// StaleWhileRevalidate is how long after a changed source is staged the
+	// variants made of its previous version may still be served while they
+	// are regenerated in the background (e.g. "10m"). Empty disables it.
+	StaleWhileRevalidate string `gorm:"column:stale_while_revalidate;size:255" json:"stale_while_revalidate"`
+	// NotFoundTTL is how long a file missing on every storage is remembered
+	// as missing before the storages are asked again (e.g. "30s"). Empty disables it.
+	NotFoundTTL string `gorm:"column:not_found_ttl;size:255" json:"not_found_ttl"`
+	// WarmCacheDir is an optional second, larger and slower cache tier. Entries
+	// over CacheSize are demoted there instead of deleted, and promoted back
+	// to CacheDir when requested again. WarmCacheSize limits the warm tier.
+	WarmCacheDir  string `gorm:"column:warm_cache_dir;size:255" json:"warm_cache_dir"`
+	WarmCacheSize string `gorm:"column:warm_cache_size;size:255" json:"warm_cache_size"`
+	// DisabledEncoders is a comma-separated list of encoder families (see
+	// EncoderFamilies) the project may not use, e.g. "video,document".
+	DisabledEncoders string `gorm:"column:disabled_encoders;size:255" json:"disabled_encoders"`
+	// VariantPatterns are comma-separated paths of pre-generated variants,
+	// e.g. "{name}_{w}x{h}.{f}", served instead of encoding the source when
+	// they exist in storage. See Request.VariantPaths.
+	VariantPatterns string `gorm:"column:variant_patterns;size:1024" json:"variant_patterns"`
+	// ModerationPolicy is what happens to images and videos the moderator
+	// scores at or above ModerationThreshold (0 means 0.8): "block" refuses
+	// them, "flag" serves them marked with X-Moderation: flagged, "log"
+	// only logs them. Empty disables moderation for the project.
+	ModerationPolicy    string  `gorm:"column:moderation_policy;size:16" json:"moderation_policy"`
+	ModerationThreshold float64 `gorm:"column:moderation_threshold" json:"moderation_threshold"`
+	// AudioCover is what album art thumbnails of audio without artwork show:
+	// "generated" (or empty) draws the artist and title on a colour derived
+	// from them, "none" answers 404, any other value is the path of a default
+	// cover image on the project's storages.
+	AudioCover string `gorm:"column:audio_cover;size:1024" json:"audio_cover"`
+	// Copyright and Artist are embedded in every image the project encodes,
+	// as the XMP copyright notice (dc:rights) and creator (dc:creator).
+	// ImageMetadata adds further XMP properties, one "prefix:Name=value" per
+	// line, e.g. "photoshop:Credit=Acme"; see ImageMetadataFields.
+	Copyright     string `gorm:"column:copyright;size:255" json:"copyright"`
+	Artist        string `gorm:"column:artist;size:255" json:"artist"`
+	ImageMetadata string `gorm:"column:image_metadata;size:2048" json:"image_metadata"`
+	// ForensicWatermark hides an invisible, per-request watermark in every
+	// image output, recorded as a Watermark, to trace leaked copies. Raw
+	// originals are refused.
+	ForensicWatermark bool `gorm:"column:forensic_watermark" json:"forensic_watermark"`
+	// HLSEncryption encrypts HLS segments with AES-128, under a key derived
+	// from HLSKeySecret (generated when empty) that changes every
+	// HLSKeyRotation (e.g. "24h"; empty never rotates). See HLSKey.
+	HLSEncryption  bool   `gorm:"column:hls_encryption" json:"hls_encryption"`
+	HLSKeyRotation string `gorm:"column:hls_key_rotation;size:255" json:"hls_key_rotation"`
+	HLSKeySecret   string `gorm:"column:hls_key_secret;size:255" json:"hls_key_secret"`
+	// DetailAssetMetadata adds the AssetMetadata of a file, when it has any,
+	// to its detail=true responses as "asset_metadata".
+	DetailAssetMetadata bool            `gorm:"column:detail_asset_metadata" json:"detail_asset_metadata"`
+	Storages            []Storage       `gorm:"foreignKey:ProjectID"`
+	Origins             []Origin        `gorm:"foreignKey:ProjectID"`
+	CachePriorities     []CachePriority `gorm:"foreignKey:ProjectID" json:"cache_priorities,omitempty"`
 	types.CreatedAt
 	types.UpdatedAt
 	types.SoftDelete
@@ -398,6 +1120,103 @@ func (Project) TableName() string {
 	return "project"
 }
 
+// EncoderFamilies are the encoder families that can be disabled, named after
+// the category of the source file.
+var EncoderFamilies = []string{"image", "video", "audio", "model", "document"}
+
+// EncoderDisabled reports whether family is disabled for p, either in
+// DisabledEncoders or for every project in MEDIAX.DisabledEncoders.
+func (p *Project) EncoderDisabled(family string) bool {
+	for _, list := range []string{p.DisabledEncoders, settings.Get("MEDIAX.DisabledEncoders", "").String()} {
+		for _, f := range strings.Split(list, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), family) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ModerationPolicies are the valid values of Project.ModerationPolicy.
+var ModerationPolicies = []string{"block", "flag", "log"}
+
+// ModerationCutoff returns the score from which moderated content counts
+// as unsafe.
+func (p *Project) ModerationCutoff() float64 {
+	if p.ModerationThreshold <= 0 {
+		return 0.8
+	}
+	return p.ModerationThreshold
+}
+
+// StagingTTL returns how long a staged original is considered fresh.
+// Zero means staged files never expire.
+func (p *Project) StagingTTL() time.Duration {
+	ttl, err := ParseCacheTTL(p.CacheTTL)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
+// StaleIfErrorWindow returns how long past StagingTTL a staged file may be
+// served when the origin cannot be reached.
+func (p *Project) StaleIfErrorWindow() time.Duration {
+	window, err := ParseCacheTTL(p.StaleIfError)
+	if err != nil {
+		return 0
+	}
+	return window
+}
+
+// StaleWhileRevalidateWindow returns how long after a changed source is
+// staged the variants of its previous version may be served.
+func (p *Project) StaleWhileRevalidateWindow() time.Duration {
+	window, err := ParseCacheTTL(p.StaleWhileRevalidate)
+	if err != nil {
+		return 0
+	}
+	return window
+}
+
+// BeforeSave rejects projects whose image metadata fails
+// ImageMetadataFields or whose cache directories fail ValidateCacheDirs
+// against the other live projects, and generates the HLSKeySecret of
+// projects turning HLS encryption on.
+func (p *Project) BeforeSave(tx *gorm.DB) error {
+	if _, err := p.ImageMetadataFields(); err != nil {
+		return err
+	}
+	if _, err := ParseDuration(p.HLSKeyRotation); err != nil {
+		return fmt.Errorf("invalid hls_key_rotation: %w", err)
+	}
+	if p.HLSEncryption && p.HLSKeySecret == "" {
+		secret, err := NewHLSKeySecret()
+		if err != nil {
+			return err
+		}
+		p.HLSKeySecret = secret
+	}
+	if p.CacheDir == "" && p.WarmCacheDir == "" {
+		return nil // partial update of other columns
+	}
+	var others []Project
+	if err := tx.Session(&gorm.Session{NewDB: true}).Where("deleted_at IS NULL").Find(&others).Error; err != nil {
+		return err
+	}
+	return p.ValidateCacheDirs(others)
+}
+
+// NegativeCacheTTL returns how long not-found results are cached.
+// Zero disables negative caching.
+func (p *Project) NegativeCacheTTL() time.Duration {
+	ttl, err := ParseCacheTTL(p.NotFoundTTL)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
 type Storage struct {
 	StorageID    int                  `gorm:"column:storage_id;primaryKey;autoIncrement" json:"storage_id"`
 	ProjectID    int                  `gorm:"column:project_id;fk:project" json:"project_id"`
@@ -407,6 +1226,10 @@ type Storage struct {
 	ConfigString string               `gorm:"column:config_string;size:255" json:"config_string"`
 	Priority     int                  `gorm:"column:priority" json:"priority"`
 	FS           filesystem.Interface `gorm:"-"`
+	// Health is "ok" or "unhealthy" for storages this instance initialized,
+	// with InitError giving the reason; see AfterFind.
+	Health    string `gorm:"-" json:"health,omitempty"`
+	InitError string `gorm:"-" json:"init_error,omitempty"`
 	types.CreatedAt
 	types.UpdatedAt
 	types.SoftDelete
@@ -417,27 +1240,53 @@ func (Storage) TableName() string {
 	return "storage"
 }
 
-func (s Storage) StageFile(path, cacheDir string) (string, error) {
-
-	var filePath = filepath.Join(s.BasePath, path)
+// StagedPath returns the location of path inside cacheDir, refusing paths that
+// would escape the cache root or land in the reserved derived output prefix.
+func StagedPath(cacheDir, path string) (string, error) {
 	var stagedPath = filepath.Join(cacheDir, path)
-
-	// Guard against path traversal: the resolved paths must remain inside
-	// their respective roots. filepath.Join cleans ".." sequences, so a
-	// crafted path like "../../etc/passwd" would escape the base directory.
-	// Only check when BasePath is set (S3/GCS storages have empty BasePath).
-	if s.BasePath != "" {
-		absBase := filepath.Clean(s.BasePath)
-		if !strings.HasPrefix(filepath.Clean(filePath), absBase+string(filepath.Separator)) {
-			return "", fmt.Errorf("path traversal detected: %q escapes storage root", path)
-		}
-	}
 	absCache := filepath.Clean(cacheDir)
 	if !strings.HasPrefix(filepath.Clean(stagedPath), absCache+string(filepath.Separator)) {
 		return "", fmt.Errorf("path traversal detected: %q escapes cache root", path)
 	}
+	if derived := DerivedDir(absCache, ""); stagedPath == derived || strings.HasPrefix(stagedPath, derived+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is in the reserved %s cache prefix", path, DerivedCachePrefix)
+	}
+	return stagedPath, nil
+}
+
+// isFresh reports whether a staged file exists and has not outlived ttl.
+// A ttl of zero means staged files never expire.
+func isFresh(stagedPath string, ttl time.Duration) bool {
+	info, err := os.Stat(stagedPath)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	return ttl <= 0 || info.ModTime().Add(ttl).After(time.Now())
+}
+
+// StageFile copies path into cacheDir unless a fresh copy is already there.
+// Before downloading, check is called with the size the storage reports for
+// the object; it may refuse the download or return errStageAsync to have it
+// run in the background while the caller is told to retry.
+func (s Storage) StageFile(path, cacheDir string, ttl time.Duration, check func(size int64) error) (string, error) {
 
-	if gpath.IsFileExist(stagedPath) {
+	filePath, err := s.objectPath(path)
+	if err != nil {
+		return "", err
+	}
+	stagedPath, err := StagedPath(cacheDir, path)
+	if err != nil {
+		return "", err
+	}
+
+	promoteStaged(cacheDir, stagedPath)
+	if s.isLinked(filePath, stagedPath) {
+		// A linked copy keeps the origin's modification time; track its use
+		// for eviction separately.
+		recordUse(stagedPath)
+		return stagedPath, nil
+	}
+	if isFresh(stagedPath, ttl) {
 		return stagedPath, nil
 	}
 
@@ -445,6 +1294,35 @@ func (s Storage) StageFile(path, cacheDir string) (string, error) {
 		return "", fmt.Errorf("failed to create cache directory: %w", err)
 	}
 
+	if check != nil {
+		info, err := s.FS.Stat(filePath)
+		if err != nil {
+			return "", err
+		}
+		if err := check(info.Size()); err == errStageAsync {
+			if _, running := backgroundStages.LoadOrStore(stagedPath, true); !running {
+				go func() {
+					defer backgroundStages.Delete(stagedPath)
+					if _, err := s.download(filePath, stagedPath, ttl); err != nil {
+						log.Error("background staging failed", "path", path, "error", err)
+					}
+				}()
+			}
+			return STAGING, fmt.Errorf("staging %s in the background", path)
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return s.download(filePath, stagedPath, ttl)
+}
+
+// backgroundStages holds the staged paths being downloaded in the background,
+// so retries do not start a second download or wait on its lock.
+var backgroundStages sync.Map
+
+// download fetches filePath into stagedPath under the staging lock, holding
+// a slot of the pass-through work pool while it transfers.
+func (s Storage) download(filePath, stagedPath string, ttl time.Duration) (string, error) {
 	// Atomically acquire the lock using O_CREATE|O_EXCL — the kernel guarantees
 	// that exactly one goroutine/process succeeds even under concurrent access,
 	// eliminating the TOCTOU race of the previous Stat+Write approach.
@@ -476,46 +1354,256 @@ func (s Storage) StageFile(path, cacheDir string) (string, error) {
 		time.Sleep(time.Second)
 	}
 	defer os.Remove(lockPath)
-	// Download the file
-	if err := s.FS.StorageToDisk(filePath, stagedPath); err != nil {
+
+	// Another writer may have refreshed the file while we waited for the lock.
+	if isFresh(stagedPath, ttl) {
+		return stagedPath, nil
+	}
+
+	// Download into a temporary file and rename it into place, so a failed
+	// refresh never clobbers an existing (possibly stale) staged copy.
+	release, err := Admit(context.Background(), PoolPassthrough)
+	if err != nil {
 		return "", err
 	}
+	partPath := stagedPath + ".part"
+	modified, err := s.fetch(filePath, stagedPath, partPath)
+	release()
+	if err != nil {
+		os.Remove(partPath)
+		return "", err
+	}
+	if !modified {
+		// The origin confirmed the expired copy is still current; restart its TTL.
+		now := time.Now()
+		os.Chtimes(stagedPath, now, now)
+		return stagedPath, nil
+	}
+	// Count the download against the project's cache quota, net of the copy
+	// it replaces.
+	var written int64
+	if info, err := os.Stat(partPath); err == nil {
+		written = info.Size()
+	}
+	if info, err := os.Stat(stagedPath); err == nil {
+		written -= info.Size()
+	}
+	if err := os.Rename(partPath, stagedPath); err != nil {
+		os.Remove(partPath)
+		return "", fmt.Errorf("failed to move staged file into place: %w", err)
+	}
+	RecordCacheWrite(stagedPath, written)
+	if s.isLinked(filePath, stagedPath) {
+		// A hard link tracks the origin itself; its own stat is the version.
+		writeSourceVersion(stagedPath, "")
+		recordUse(stagedPath)
+	} else {
+		writeSourceVersion(stagedPath, s.originVersion(filePath))
+	}
 
 	return stagedPath, nil
 }
 
-func (s *Storage) Init() {
-	var err error
+// objectPath returns the location of path on the storage, below BasePath.
+func (s Storage) objectPath(path string) (string, error) {
+	var filePath = filepath.Join(s.BasePath, path)
+
+	// Guard against path traversal: the resolved paths must remain inside
+	// their respective roots. filepath.Join cleans ".." sequences, so a
+	// crafted path like "../../etc/passwd" would escape the base directory.
+	// Only check when BasePath is set (S3/GCS storages have empty BasePath).
+	if s.BasePath != "" {
+		absBase := filepath.Clean(s.BasePath)
+		if !strings.HasPrefix(filepath.Clean(filePath), absBase+string(filepath.Separator)) {
+			return "", fmt.Errorf("path traversal detected: %q escapes storage root", path)
+		}
+	}
+	return filePath, nil
+}
+
+// conditionalFetcher is implemented by storages that can revalidate an
+// existing staged copy instead of downloading it again (e.g. HTTP 304).
+type conditionalFetcher interface {
+	StorageToDiskIfModified(src, dst string, since time.Time) (bool, error)
+}
+
+// localSource returns the absolute on-disk path of filePath when the storage
+// is a local filesystem, so it can be hard-linked instead of copied.
+func (s Storage) localSource(filePath string) (string, bool) {
+	lfs, ok := s.FS.(*localfs.FileSystem)
+	if !ok || !settings.Get("MEDIAX.StageHardLink", true).Bool() {
+		return "", false
+	}
+	src := filepath.Join(lfs.Path, filePath)
+	if !strings.HasPrefix(src, filepath.Clean(lfs.Path)+string(filepath.Separator)) {
+		return "", false
+	}
+	return src, true
+}
+
+// isLinked reports whether stagedPath is a hard link to the local source of
+// filePath. A linked copy is the origin itself, so it never goes stale.
+func (s Storage) isLinked(filePath, stagedPath string) bool {
+	src, ok := s.localSource(filePath)
+	if !ok {
+		return false
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+	stagedInfo, err := os.Stat(stagedPath)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(srcInfo, stagedInfo)
+}
+
+// fetch downloads filePath into partPath. When an expired staged copy exists
+// and the storage supports conditional requests, it returns false without
+// writing partPath if the origin reports the object unchanged.
+// Local storages on the same volume as the cache are hard-linked, falling back
+// to a byte copy when linking fails (e.g. across devices).
+func (s Storage) fetch(filePath, stagedPath, partPath string) (bool, error) {
+	if src, ok := s.localSource(filePath); ok {
+		if err := os.Link(src, partPath); err == nil {
+			MetricStageLinkedTotal.Inc()
+			return true, nil
+		}
+	}
+	if cf, ok := s.FS.(conditionalFetcher); ok {
+		var since time.Time
+		if info, err := os.Stat(stagedPath); err == nil {
+			since = info.ModTime()
+		}
+		return cf.StorageToDiskIfModified(filePath, partPath, since)
+	}
+	return true, s.FS.StorageToDisk(filePath, partPath)
+}
+
+// ValidateConfig reports config_string mistakes (unknown parameters, bad
+// values) of s without connecting to the backend.
+func (s *Storage) ValidateConfig() error {
+	switch s.Type {
+	case "http":
+		return httpfs.Validate(s.ConfigString)
+	case "s3":
+		return localS3.Validate(s.ConfigString)
+	case "fs":
+		if s.ConfigString == "" {
+			return fmt.Errorf("config_string is empty")
+		}
+		return localfs.Validate(s.ConfigString)
+	default:
+		return fmt.Errorf("filesystem %s is not supported yet", s.Type)
+	}
+}
+
+// BeforeSave rejects storages whose config_string would fail on first use.
+func (s *Storage) BeforeSave(tx *gorm.DB) error {
+	if s.Type == "" && s.ConfigString == "" {
+		return nil // partial update of other columns
+	}
+	if err := s.ValidateConfig(); err != nil {
+		return fmt.Errorf("invalid %s storage config: %w", s.Type, err)
+	}
+	return nil
+}
+
+// OnBeforeSave rejects storages saved through the admin API whose backend
+// fails to initialize, so a broken config_string never reaches a reload.
+func (s *Storage) OnBeforeSave(c *restify.Context) error {
+	if _, err := s.connect(); err != nil {
+		return fmt.Errorf("storage cannot be initialized: %w", err)
+	}
+	return nil
+}
+
+// Init connects the storage backend. On failure FS stays nil, the storage is
+// recorded as unhealthy (see StorageHealth) and staging skips it.
+func (s *Storage) Init() error {
 	s.BasePath = strings.Trim(s.BasePath, `\/`)
+	var err error
+	s.FS, err = s.connect()
+	setStorageHealth(s.StorageID, err)
+	return err
+}
+
+// connect returns the filesystem of the storage backend.
+func (s *Storage) connect() (filesystem.Interface, error) {
 	switch s.Type {
 	case "http":
-		s.FS, err = httpfs.New(s.ConfigString)
+		fs, err := httpfs.New(s.ConfigString)
 		if err != nil {
-			log.Error(err)
+			return nil, err
 		}
+		return fs, nil
 	case "fs":
-		s.FS, err = localfs.New(s.ConfigString)
+		fs, err := localfs.New(s.ConfigString)
 		if err != nil {
-			log.Error(err)
+			return nil, err
 		}
+		return fs, nil
 	case "s3":
-		s.FS, err = localS3.New(s.ConfigString)
+		fs, err := localS3.New(s.ConfigString)
 		if err != nil {
-			log.Error(err)
+			return nil, err
 		}
+		return fs, nil
 	default:
-		log.Panic("filesystem %s is not supported yet", s.Type)
+		return nil, fmt.Errorf("filesystem %s is not supported yet", s.Type)
 	}
-
 }
 
 type Origin struct {
-	OriginID   int        `gorm:"column:origin_id;primaryKey;autoIncrement" json:"origin_id"`
-	ProjectID  int        `gorm:"column:project_id;fk:project" json:"project_id"`
-	Project    *Project   `gorm:"foreignKey:ProjectID;references:ProjectID"`
-	Domain     string     `gorm:"column:domain;size:255" json:"domain"`
-	PrefixPath string     `gorm:"column:prefix_path;size:255" json:"prefix_path"`
-	Storages   []*Storage `gorm:"-" json:"storages"`
+	OriginID   int      `gorm:"column:origin_id;primaryKey;autoIncrement" json:"origin_id"`
+	ProjectID  int      `gorm:"column:project_id;fk:project" json:"project_id"`
+	Project    *Project `gorm:"foreignKey:ProjectID;references:ProjectID"`
+	Domain     string   `gorm:"column:domain;size:255" json:"domain"`
+	PrefixPath string   `gorm:"column:prefix_path;size:255" json:"prefix_path"`
+	// URLDialect makes the origin accept a foreign URL syntax ("imgproxy" or
+	// "thumbor") instead of native MediaX URLs. DialectKey/DialectSalt verify
+	// signed URLs; without a key signatures are not checked.
+	URLDialect  string `gorm:"column:url_dialect;size:32" json:"url_dialect"`
+	DialectKey  string `gorm:"column:dialect_key;size:255" json:"dialect_key"`
+	DialectSalt string `gorm:"column:dialect_salt;size:255" json:"dialect_salt"`
+	// SigningKey requires native URLs to carry a valid s= signature.
+	SigningKey string `gorm:"column:signing_key;size:255" json:"signing_key"`
+	// RequireAPIKey only serves requests carrying an active API key.
+	RequireAPIKey bool `gorm:"column:require_api_key" json:"require_api_key"`
+	// AllowedExtensions and DeniedExtensions are comma-separated source
+	// extensions (e.g. "jpg,png"); AllowedFormats and DeniedFormats restrict
+	// output formats the same way. An empty allow list allows everything not
+	// denied.
+	AllowedExtensions string `gorm:"column:allowed_extensions;size:255" json:"allowed_extensions"`
+	DeniedExtensions  string `gorm:"column:denied_extensions;size:255" json:"denied_extensions"`
+	AllowedFormats    string `gorm:"column:allowed_formats;size:255" json:"allowed_formats"`
+	DeniedFormats     string `gorm:"column:denied_formats;size:255" json:"denied_formats"`
+	// DefaultOptions are query parameters (e.g. "w=800&q=80&f=webp") used
+	// when the request omits them; ForcedOptions (e.g. "strip=true")
+	// replace the request's values. MaxQuality caps q, and sets it for
+	// re-encoded outputs without one; 0 leaves quality alone.
+	DefaultOptions string     `gorm:"column:default_options;size:512" json:"default_options"`
+	ForcedOptions  string     `gorm:"column:forced_options;size:512" json:"forced_options"`
+	MaxQuality     int        `gorm:"column:max_quality" json:"max_quality"`
+	Storages       []*Storage `gorm:"-" json:"storages"`
+	// PreloadHints is a comma-separated list of companion assets announced
+	// in Link: rel=preload headers: "poster" (a frame of a video) and "lqip"
+	// (a tiny placeholder of an image). CDNs that support it send them as
+	// 103 Early Hints.
+	PreloadHints string `gorm:"column:preload_hints;size:255" json:"preload_hints"`
+	// AllowedCountries and DeniedCountries are comma-separated ISO 3166-1
+	// codes (e.g. "US,CA") of the countries, located with the GeoIP
+	// database, the origin serves; others are answered 451. AllowedIPs and
+	// DeniedIPs are comma-separated addresses and CIDRs, others answered
+	// 403. Empty allow lists allow everything not denied.
+	AllowedCountries string `gorm:"column:allowed_countries;size:1024" json:"allowed_countries"`
+	DeniedCountries  string `gorm:"column:denied_countries;size:1024" json:"denied_countries"`
+	AllowedIPs       string `gorm:"column:allowed_ips;size:2048" json:"allowed_ips"`
+	DeniedIPs        string `gorm:"column:denied_ips;size:2048" json:"denied_ips"`
+	// DirectoryListing serves JSON listings of the origin's folders at
+	// /list, for gallery frontends. Not available with a URLDialect.
+	DirectoryListing bool `gorm:"column:directory_listing" json:"directory_listing"`
 	types.CreatedAt
 	types.UpdatedAt
 	types.SoftDelete
@@ -526,12 +1614,200 @@ func (Origin) TableName() string {
 	return "origin"
 }
 
+// allows reports whether value is in allow (or allow is empty) and not in deny.
+func (o *Origin) allows(allow, deny, value string) bool {
+	inList := func(list string) bool {
+		for _, v := range strings.Split(list, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), value) {
+				return true
+			}
+		}
+		return false
+	}
+	return (strings.TrimSpace(allow) == "" || inList(allow)) && !inList(deny)
+}
+
+// AllowsExtension reports whether the origin serves sources with extension
+// ext.
+func (o *Origin) AllowsExtension(ext string) bool {
+	return o.allows(o.AllowedExtensions, o.DeniedExtensions, ext)
+}
+
+// AllowsFormat reports whether the origin produces output format f.
+func (o *Origin) AllowsFormat(f string) bool {
+	return o.allows(o.AllowedFormats, o.DeniedFormats, f)
+}
+
+// AllowsCountry reports whether the origin serves clients in country, an
+// ISO 3166-1 code or "" when unknown. Unknown countries are refused by
+// allow lists only.
+func (o *Origin) AllowsCountry(country string) bool {
+	if country == "" {
+		return strings.TrimSpace(o.AllowedCountries) == ""
+	}
+	return o.allows(o.AllowedCountries, o.DeniedCountries, country)
+}
+
+// AllowsIP reports whether the origin serves clients at ip.
+func (o *Origin) AllowsIP(ip net.IP) bool {
+	allow, _ := ParseIPNets(o.AllowedIPs)
+	deny, _ := ParseIPNets(o.DeniedIPs)
+	return (len(allow) == 0 || containsIP(allow, ip)) && !containsIP(deny, ip)
+}
+
+// GeoRestricted reports whether the origin has country rules, which need
+// the GeoIP database.
+func (o *Origin) GeoRestricted() bool {
+	return strings.TrimSpace(o.AllowedCountries) != "" || strings.TrimSpace(o.DeniedCountries) != ""
+}
+
+// ParseIPNets parses a comma-separated list of CIDRs and addresses, the
+// latter as single-address networks.
+func ParseIPNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// BeforeSave rejects origins whose options fail ValidateOptions.
+func (o *Origin) BeforeSave(tx *gorm.DB) error {
+	return o.ValidateOptions()
+}
+
+// ValidateOptions checks that the default and forced options are query
+// strings, MaxQuality is a quality, PreloadHints lists known assets, the
+// country and IP lists are well formed and DirectoryListing has native URLs.
+func (o *Origin) ValidateOptions() error {
+	if _, err := url.ParseQuery(o.DefaultOptions); err != nil {
+		return fmt.Errorf("invalid default_options: %w", err)
+	}
+	if _, err := url.ParseQuery(o.ForcedOptions); err != nil {
+		return fmt.Errorf("invalid forced_options: %w", err)
+	}
+	if o.MaxQuality < 0 || o.MaxQuality > 100 {
+		return fmt.Errorf("invalid max_quality %d: must be between 0 and 100", o.MaxQuality)
+	}
+	for _, hint := range o.Preloads() {
+		if hint != "poster" && hint != "lqip" {
+			return fmt.Errorf("invalid preload_hints %q: expected poster or lqip", hint)
+		}
+	}
+	for _, f := range [][2]string{{"allowed_countries", o.AllowedCountries}, {"denied_countries", o.DeniedCountries}} {
+		for _, code := range strings.Split(f[1], ",") {
+			if code = strings.TrimSpace(code); code != "" && !validCountryCode(code) {
+				return fmt.Errorf("invalid %s: %q is not a two-letter country code", f[0], code)
+			}
+		}
+	}
+	for _, f := range [][2]string{{"allowed_ips", o.AllowedIPs}, {"denied_ips", o.DeniedIPs}} {
+		if _, err := ParseIPNets(f[1]); err != nil {
+			return fmt.Errorf("invalid %s: %w", f[0], err)
+		}
+	}
+	if o.DirectoryListing && o.URLDialect != "" {
+		return errors.New("directory_listing cannot be combined with url_dialect")
+	}
+	return nil
+}
+
+// validCountryCode reports whether code is two letters, as ISO 3166-1
+// alpha-2 codes and the codes GeoIP databases add (e.g. EU) are.
+func validCountryCode(code string) bool {
+	return len(code) == 2 && strings.Trim(strings.ToUpper(code), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == ""
+}
+
+// Preloads returns the companion assets listed in PreloadHints.
+func (o *Origin) Preloads() []string {
+	var hints []string
+	for _, v := range strings.Split(o.PreloadHints, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			hints = append(hints, v)
+		}
+	}
+	return hints
+}
+
+// optionAliases maps query parameters to the other names ParseQuery accepts
+// for them, so a default or forced w also stands for width.
+var optionAliases = map[string]string{"w": "width", "width": "w", "h": "height", "height": "h", "f": "format", "format": "f"}
+
+// optionQuery wraps query with the origin's forced and default options:
+// forced values win over the request's, defaults fill parameters the request
+// (under either alias) does not give.
+func (o *Origin) optionQuery(query QueryFunc) QueryFunc {
+	if o.DefaultOptions == "" && o.ForcedOptions == "" {
+		return query
+	}
+	defaults, _ := url.ParseQuery(o.DefaultOptions)
+	forced, _ := url.ParseQuery(o.ForcedOptions)
+	lookup := func(values url.Values, name string) (string, bool) {
+		if values.Has(name) {
+			return values.Get(name), true
+		}
+		if alias, ok := optionAliases[name]; ok && values.Has(alias) {
+			return values.Get(alias), true
+		}
+		return "", false
+	}
+	return func(name string) generic.Value {
+		if v, ok := lookup(forced, name); ok {
+			return generic.Parse(v)
+		}
+		if value := query(name); value.String() != "" {
+			return value
+		}
+		if alias, ok := optionAliases[name]; ok && query(alias).String() != "" {
+			return generic.Parse("")
+		}
+		if v, ok := lookup(defaults, name); ok {
+			return generic.Parse(v)
+		}
+		return query(name)
+	}
+}
+
 type VideoProfile struct {
 	Profile string `gorm:"column:profile;size:255;primaryKey" json:"profile"`
 	Width   int    `gorm:"column:width" json:"width"`
 	Height  int    `gorm:"column:height" json:"height"`
 	Quality int    `gorm:"column:quality" json:"quality"`
 	Codec   string `gorm:"column:codec;size:255" json:"codec"`
+	// VideoBitrate and AudioBitrate ("2500k") replace the quality with a
+	// bitrate target; TwoPass encodes in two passes for an even bitrate.
+	VideoBitrate string `gorm:"column:video_bitrate;size:32" json:"video_bitrate"`
+	AudioBitrate string `gorm:"column:audio_bitrate;size:32" json:"audio_bitrate"`
+	TwoPass      bool   `gorm:"column:two_pass" json:"two_pass"`
 	restify.API
 }
 
@@ -539,6 +1815,37 @@ func (VideoProfile) TableName() string {
 	return "video_profile"
 }
 
+// VideoCodecs are the valid values of VideoProfile.Codec; empty means
+// libx264.
+var VideoCodecs = []string{"libx264", "libx265", "libvpx-vp9", "libaom-av1", "libsvtav1"}
+
+// Validate reports the first problem of the profile: a name that is not
+// letters, digits, '-' and '_' (it names cache files), a size or quality out
+// of range, an unknown codec or invalid bitrates.
+func (vp *VideoProfile) Validate() error {
+	if vp.Profile == "" || len(vp.Profile) > 64 || strings.IndexFunc(vp.Profile, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}) >= 0 {
+		return fmt.Errorf("invalid video profile name %q: expected up to 64 letters, digits, '-' and '_'", vp.Profile)
+	}
+	if vp.Width <= 0 || vp.Width > mediaurl.MaxDimension || vp.Height <= 0 || vp.Height > mediaurl.MaxDimension {
+		return fmt.Errorf("video profile %s: size %dx%d out of range 1-%d", vp.Profile, vp.Width, vp.Height, mediaurl.MaxDimension)
+	}
+	if vp.Quality < 0 || vp.Quality > 100 {
+		return fmt.Errorf("video profile %s: quality %d out of range 0-100", vp.Profile, vp.Quality)
+	}
+	if vp.Codec != "" && !slices.Contains(VideoCodecs, vp.Codec) {
+		return fmt.Errorf("video profile %s: unknown codec %q", vp.Profile, vp.Codec)
+	}
+	_, _, _, err := (&Options{VideoProfile: vp}).TranscodeSettings()
+	return err
+}
+
+// BeforeSave rejects profiles that fail Validate.
+func (vp *VideoProfile) BeforeSave(tx *gorm.DB) error {
+	return vp.Validate()
+}
+
 type Aspect struct {
 	Name   string
 	Width  float64
@@ -559,6 +1866,59 @@ var commonRatios = []Aspect{
 	{"32:9", 32, 9},
 }
 
+// ParseAspect returns the ratio named name in commonRatios, or its portrait
+// counterpart ("9:16" for "16:9").
+func ParseAspect(name string) (Aspect, bool) {
+	for _, aspect := range commonRatios {
+		if aspect.Name == name {
+			return aspect, true
+		}
+		if w, h, _ := strings.Cut(aspect.Name, ":"); h+":"+w == name {
+			return Aspect{Name: name, Width: aspect.Height, Height: aspect.Width}, true
+		}
+	}
+	return Aspect{}, false
+}
+
+// ResolveScale replaces Scale by the pixel size it gives for a source of
+// width x height, set like an explicit w and h, so the cache key holds
+// absolute pixels and such requests share one variant.
+func (o *Options) ResolveScale(width, height int) {
+	if o.Scale == 0 {
+		return
+	}
+	o.Width = max(int(math.Round(float64(width)*float64(o.Scale)/100)), 1)
+	o.Height = max(int(math.Round(float64(height)*float64(o.Scale)/100)), 1)
+	o.KeepAspectRatio = false
+	o.Scale = 0
+}
+
+// applyAspectRatio sets the one of Width and Height that was not given from
+// AspectRatio; the output is then cropped (or padded) to that size.
+func (o *Options) applyAspectRatio() error {
+	aspect, ok := ParseAspect(o.AspectRatio)
+	if !ok {
+		names := make([]string, len(commonRatios))
+		for i, a := range commonRatios {
+			names[i] = a.Name
+		}
+		return fmt.Errorf("invalid ar value %q: expected one of %s or their portrait forms", o.AspectRatio, strings.Join(names, ", "))
+	}
+	switch {
+	case o.Width > 0 && o.Height == 0:
+		o.Height = int(math.Round(float64(o.Width) * aspect.Height / aspect.Width))
+	case o.Height > 0 && o.Width == 0:
+		o.Width = int(math.Round(float64(o.Height) * aspect.Width / aspect.Height))
+	default:
+		return fmt.Errorf("ar needs exactly one of w and h")
+	}
+	if o.Width > mediaurl.MaxDimension || o.Height > mediaurl.MaxDimension {
+		return fmt.Errorf("ar %s gives %dx%d, over the maximum allowed dimension %d", o.AspectRatio, o.Width, o.Height, mediaurl.MaxDimension)
+	}
+	o.KeepAspectRatio = false
+	return nil
+}
+
 func GetAspectRatioName(width, height float64) string {
 	if width == 0 || height == 0 {
 		return "Invalid"
@@ -0,0 +1,100 @@
+package media
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// memCache keeps small derived outputs (icons, thumbnails, tiles) in memory
+// so hits are served without opening the file. Derived paths embed the cache
+// key, which includes the source version, so a path's content never changes
+// and entries need no revalidation. Staged originals are never cached here.
+// MEDIAX.MemoryCacheSize caps the total size (0 disables the cache) and
+// MEDIAX.MemoryCacheMaxObject the size of a single entry.
+var memCache = struct {
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+}{lru: list.New(), entries: map[string]*list.Element{}}
+
+type memCacheEntry struct {
+	path    string
+	data    []byte
+	modTime time.Time
+}
+
+// memCacheLimits returns the configured total and per-object limits.
+func memCacheLimits() (total, object int64) {
+	total, err := ParseCacheSize(settings.Get("MEDIAX.MemoryCacheSize", "0").String())
+	if err != nil || total <= 0 {
+		return 0, 0
+	}
+	object, err = ParseCacheSize(settings.Get("MEDIAX.MemoryCacheMaxObject", "256KB").String())
+	if err != nil || object <= 0 {
+		object = 256 << 10
+	}
+	return total, min(object, total)
+}
+
+// memCacheGet returns the cached content of path.
+func memCacheGet(path string) (*memCacheEntry, bool) {
+	if total, _ := memCacheLimits(); total == 0 {
+		return nil, false
+	}
+	memCache.mu.Lock()
+	defer memCache.mu.Unlock()
+	el, ok := memCache.entries[path]
+	if !ok {
+		MetricMemoryCacheRequestsTotal.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	memCache.lru.MoveToFront(el)
+	MetricMemoryCacheRequestsTotal.WithLabelValues("hit").Inc()
+	return el.Value.(*memCacheEntry), true
+}
+
+// memCacheLoad reads the size bytes of r into the cache under path when it
+// is small enough, evicting the least recently used entries to make room.
+func memCacheLoad(path string, r io.ReaderAt, size int64, modTime time.Time) (*memCacheEntry, bool) {
+	total, object := memCacheLimits()
+	if size > object {
+		return nil, false
+	}
+	data := make([]byte, size)
+	if n, _ := r.ReadAt(data, 0); int64(n) != size {
+		return nil, false
+	}
+	entry := &memCacheEntry{path: path, data: data, modTime: modTime}
+
+	memCache.mu.Lock()
+	defer memCache.mu.Unlock()
+	if el, ok := memCache.entries[path]; ok {
+		memCache.size -= int64(len(el.Value.(*memCacheEntry).data))
+		memCache.lru.Remove(el)
+	}
+	memCache.entries[path] = memCache.lru.PushFront(entry)
+	memCache.size += size
+	for memCache.size > total {
+		oldest := memCache.lru.Back()
+		e := memCache.lru.Remove(oldest).(*memCacheEntry)
+		delete(memCache.entries, e.path)
+		memCache.size -= int64(len(e.data))
+	}
+	MetricMemoryCacheSizeBytes.Set(float64(memCache.size))
+	return entry, true
+}
+
+// PurgeMemoryCache drops every entry of the in-memory cache.
+func PurgeMemoryCache() {
+	memCache.mu.Lock()
+	defer memCache.mu.Unlock()
+	memCache.lru.Init()
+	memCache.entries = map[string]*list.Element{}
+	memCache.size = 0
+	MetricMemoryCacheSizeBytes.Set(0)
+}
@@ -27,4 +27,191 @@ var (
 		Name:      "cache_evicted_bytes_total",
 		Help:      "Total bytes freed by cache eviction.",
 	}, []string{"project"})
+
+	// MetricStaleServedTotal counts requests answered from an expired staged
+	// copy because every storage failed (stale-if-error).
+	MetricStaleServedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "stale_served_total",
+		Help:      "Total number of requests served from a stale staged file after a storage error.",
+	}, []string{"project"})
+
+	// MetricStaleVariantsServedTotal counts requests answered with the
+	// variant of an earlier source version while it is regenerated
+	// (stale-while-revalidate).
+	MetricStaleVariantsServedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "stale_variants_served_total",
+		Help:      "Total number of requests served a variant of a changed source while it is regenerated.",
+	}, []string{"project"})
+
+	// MetricLargeSourcesTotal counts source files over MEDIAX.MaxSourceSize
+	// (refused) or MEDIAX.MaxSyncSourceSize (staged in the background).
+	MetricLargeSourcesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "large_sources_total",
+		Help:      "Total number of source files refused or staged in the background because of their size.",
+	}, []string{"project", "action"})
+
+	// MetricStorageUnhealthy is 1 for storages whose backend failed to
+	// initialize and are skipped when staging.
+	MetricStorageUnhealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mediax",
+		Name:      "storage_unhealthy",
+		Help:      "Whether a storage failed to initialize (1) or is usable (0).",
+	}, []string{"storage_id"})
+
+	// MetricCommandFailuresTotal counts failed external commands (ffmpeg,
+	// convert, soffice, ...) by reason: timeout, cpu, killed, crashed, start
+	// or error.
+	MetricCommandFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "command_failures_total",
+		Help:      "Total number of failed external commands by command and failure reason.",
+	}, []string{"command", "reason"})
+
+	// MetricRemoteSourcesTotal counts requests whose encoder read the source
+	// over HTTP instead of staging it.
+	MetricRemoteSourcesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "remote_sources_total",
+		Help:      "Total number of requests processed from a remote source URL without staging.",
+	}, []string{"project"})
+
+	// MetricPregeneratedServedTotal counts requests answered with a
+	// pre-generated variant found in storage instead of encoding one.
+	MetricPregeneratedServedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "pregenerated_served_total",
+		Help:      "Total number of requests served from a pre-generated variant in storage.",
+	}, []string{"project"})
+
+	// MetricStageLinkedTotal counts staged files that were hard-linked from a
+	// local storage instead of copied.
+	MetricStageLinkedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "stage_linked_total",
+		Help:      "Total number of files staged by hard-linking a local storage file.",
+	})
+
+	// MetricDiskSpaceRejectedTotal counts requests refused because the cache
+	// volume was below the configured free-space threshold.
+	MetricDiskSpaceRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "disk_space_rejected_total",
+		Help:      "Total number of requests rejected due to low free space on the cache volume.",
+	}, []string{"project"})
+
+	// MetricCacheQuotaRejectedTotal counts requests refused because the
+	// project cache stayed over its cache_size after eviction.
+	MetricCacheQuotaRejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "cache_quota_rejected_total",
+		Help:      "Total number of requests rejected because the project cache is over its quota.",
+	}, []string{"project"})
+
+	// MetricWarmCacheSizeBytes reports the warm cache tier size per project.
+	MetricWarmCacheSizeBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mediax",
+		Name:      "warm_cache_size_bytes",
+		Help:      "Current warm cache tier size in bytes.",
+	}, []string{"project"})
+
+	// MetricCacheDemotedFilesTotal counts files moved from the hot to the warm cache tier.
+	MetricCacheDemotedFilesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "cache_demoted_files_total",
+		Help:      "Total number of files demoted from the hot to the warm cache tier.",
+	}, []string{"project"})
+
+	// MetricCachePromotedFilesTotal counts files moved back from the warm to the hot cache tier.
+	MetricCachePromotedFilesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "cache_promoted_files_total",
+		Help:      "Total number of files promoted from the warm to the hot cache tier.",
+	})
+
+	// MetricNegativeCacheHitsTotal counts requests answered 404 from the
+	// negative cache without querying any storage.
+	MetricNegativeCacheHitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "negative_cache_hits_total",
+		Help:      "Total number of not-found responses served from the negative cache.",
+	}, []string{"project"})
+
+	// MetricServedBytesTotal counts response bytes of successful media requests.
+	MetricServedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "served_bytes_total",
+		Help:      "Total response bytes of successful media requests.",
+	}, []string{"project", "origin"})
+
+	// MetricTransformationsTotal counts media requests an encoder processed.
+	MetricTransformationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "transformations_total",
+		Help:      "Total number of media requests processed by an encoder.",
+	}, []string{"project", "origin"})
+
+	// MetricMemoryCacheRequestsTotal counts lookups of the in-memory cache by
+	// result ("hit" or "miss"); only derived outputs are looked up.
+	MetricMemoryCacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "memory_cache_requests_total",
+		Help:      "Total number of in-memory cache lookups by result.",
+	}, []string{"result"})
+
+	// MetricMemoryCacheSizeBytes reports the size of the in-memory cache.
+	MetricMemoryCacheSizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mediax",
+		Name:      "memory_cache_size_bytes",
+		Help:      "Current size of the in-memory cache in bytes.",
+	})
+
+	// MetricWorkRunning reports the jobs running in each work pool (see Admit).
+	MetricWorkRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mediax",
+		Name:      "work_running",
+		Help:      "Current number of running jobs by work pool.",
+	}, []string{"pool"})
+
+	// MetricWorkQueued reports the jobs waiting for a slot in each work pool.
+	MetricWorkQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "mediax",
+		Name:      "work_queued",
+		Help:      "Current number of jobs waiting for a slot by work pool.",
+	}, []string{"pool"})
+
+	// MetricWorkWaitSeconds observes how long admitted jobs waited for a slot.
+	MetricWorkWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mediax",
+		Name:      "work_wait_seconds",
+		Help:      "Time admitted jobs waited for a slot by work pool.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"pool"})
+
+	// MetricWorkShedTotal counts jobs refused by admission control, by pool
+	// and reason ("queue_full" or "timeout").
+	MetricWorkShedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "work_shed_total",
+		Help:      "Total number of jobs refused by admission control.",
+	}, []string{"pool", "reason"})
+
+	// MetricProcessingFailuresTotal counts failures recorded for the error
+	// report by project and category, e.g. "ffmpeg: exit 1" or
+	// "upstream: timeout".
+	MetricProcessingFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "processing_failures_total",
+		Help:      "Total number of processing and upstream failures by project and category.",
+	}, []string{"project", "category"})
+
+	// MetricEventsTotal counts events for MEDIAX.EventBus by type and result:
+	// published, failed (the bus refused the batch) or dropped (queue full).
+	MetricEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "events_total",
+		Help:      "Total number of events for the event bus by type and result.",
+	}, []string{"type", "result"})
 )
@@ -0,0 +1,95 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFoundCached is returned by Request.StageFile when the file was
+// recently confirmed missing on every storage and the result is still cached.
+var ErrNotFoundCached = errors.New("file not found (cached)")
+
+// maxNegativeEntries bounds the negative cache so a scan of random paths
+// cannot grow it without limit.
+const maxNegativeEntries = 100000
+
+type negativeCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time // key → expiry
+}
+
+var notFound = negativeCache{entries: map[string]time.Time{}}
+
+func negativeKey(projectID int, path string) string {
+	return fmt.Sprintf("%d:%s", projectID, path)
+}
+
+// hit reports whether key is cached as missing, dropping it once expired.
+func (c *negativeCache) hit(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiry, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(c.entries, key)
+		return false
+	}
+	return true
+}
+
+func (c *negativeCache) add(key string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxNegativeEntries {
+		now := time.Now()
+		for k, expiry := range c.entries {
+			if now.After(expiry) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxNegativeEntries {
+			return
+		}
+	}
+	c.entries[key] = time.Now().Add(ttl)
+}
+
+// PurgeNegativeCache forgets cached not-found results. A projectID of 0
+// purges every project; an empty path purges the whole project.
+// Returns the number of entries removed.
+func PurgeNegativeCache(projectID int, path string) int {
+	notFound.mu.Lock()
+	defer notFound.mu.Unlock()
+	var removed int
+	if projectID != 0 && path != "" {
+		key := negativeKey(projectID, strings.Trim(path, `\/`))
+		if _, ok := notFound.entries[key]; ok {
+			delete(notFound.entries, key)
+			removed++
+		}
+		return removed
+	}
+	prefix := ""
+	if projectID != 0 {
+		prefix = negativeKey(projectID, "")
+	}
+	for k := range notFound.entries {
+		if strings.HasPrefix(k, prefix) {
+			delete(notFound.entries, k)
+			removed++
+		}
+	}
+	return removed
+}
+
+// isNotFound reports whether a storage error means the file does not exist,
+// as opposed to the storage being unreachable or misconfigured.
+func isNotFound(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
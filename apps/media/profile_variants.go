@@ -0,0 +1,146 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/db"
+	"gorm.io/gorm/clause"
+)
+
+// maxPendingProfileVariants bounds the variants an instance keeps between
+// syncs; further variants are recorded when they are served again.
+const maxPendingProfileVariants = 10000
+
+// ProfileVariant is a cached output made with a video profile: the request
+// that produced it, so it can be regenerated when the profile changes, and
+// the file it was written to, so it can be invalidated. Path is the asset's
+// path relative to the project's storages, Options the query of the request
+// without its signature and API key.
+type ProfileVariant struct {
+	Profile   string `gorm:"column:profile;size:64;primaryKey" json:"profile"`
+	ProjectID int    `gorm:"column:project_id;primaryKey" json:"project_id"`
+	// VariantHash keys the request; its fields are too long for a primary
+	// key.
+	VariantHash string    `gorm:"column:variant_hash;size:64;primaryKey" json:"-"`
+	Domain      string    `gorm:"column:domain;size:255" json:"domain"`
+	Path        string    `gorm:"column:path;size:1024" json:"path"`
+	Options     string    `gorm:"column:options;size:1024" json:"options"`
+	OutputPath  string    `gorm:"column:output_path;size:1024" json:"output_path"`
+	LastServed  time.Time `gorm:"column:last_served" json:"last_served"`
+}
+
+func (ProfileVariant) TableName() string {
+	return "profile_variant"
+}
+
+type profileVariantKey struct {
+	profile   string
+	projectID int
+	hash      string
+}
+
+// profileVariants holds this instance's variants not yet written to the
+// database.
+var profileVariants = struct {
+	mu      sync.Mutex
+	pending map[profileVariantKey]ProfileVariant
+}{pending: map[profileVariantKey]ProfileVariant{}}
+
+// RecordProfileVariant records that the output at outputPath was served for
+// the request of domain, path and options made with profile.
+func RecordProfileVariant(project *Project, profile, domain, path, options, outputPath string) {
+	if project == nil || profile == "" || outputPath == "" {
+		return
+	}
+	sum := sha256.Sum256([]byte(domain + "|" + CleanAssetPath(path) + "|" + options))
+	v := ProfileVariant{
+		Profile:     profile,
+		ProjectID:   project.ProjectID,
+		VariantHash: hex.EncodeToString(sum[:]),
+		Domain:      domain,
+		Path:        CleanAssetPath(path),
+		Options:     options,
+		OutputPath:  outputPath,
+		LastServed:  time.Now(),
+	}
+	key := profileVariantKey{profile: profile, projectID: project.ProjectID, hash: v.VariantHash}
+	profileVariants.mu.Lock()
+	defer profileVariants.mu.Unlock()
+	if _, ok := profileVariants.pending[key]; !ok && len(profileVariants.pending) >= maxPendingProfileVariants {
+		return
+	}
+	profileVariants.pending[key] = v
+}
+
+// SyncProfileVariants writes this instance's recorded variants to the
+// database.
+func SyncProfileVariants() error {
+	profileVariants.mu.Lock()
+	pending := profileVariants.pending
+	profileVariants.pending = map[profileVariantKey]ProfileVariant{}
+	profileVariants.mu.Unlock()
+
+	for key, v := range pending {
+		row := v
+		err := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "profile"}, {Name: "project_id"}, {Name: "variant_hash"}},
+			DoUpdates: clause.AssignmentColumns([]string{"output_path", "last_served"}),
+		}).Create(&row).Error
+		if err != nil {
+			// Keep the unwritten variants for the next attempt, unless they
+			// were served again meanwhile.
+			profileVariants.mu.Lock()
+			for key, v := range pending {
+				if _, ok := profileVariants.pending[key]; !ok {
+					profileVariants.pending[key] = v
+				}
+			}
+			profileVariants.mu.Unlock()
+			return err
+		}
+		delete(pending, key)
+	}
+	return nil
+}
+
+// ProfileVariants returns the recorded variants of profile, by project and
+// path.
+func ProfileVariants(profile string) ([]ProfileVariant, error) {
+	var variants []ProfileVariant
+	err := db.Where("profile = ?", profile).Order("project_id, path, options").Find(&variants).Error
+	return variants, err
+}
+
+// InvalidateProfileVariant removes the output of v from the project's cache
+// and reports whether it was there. Outputs outside the cache directories
+// of the project are left alone.
+func InvalidateProfileVariant(project *Project, v ProfileVariant) (bool, error) {
+	output := filepath.Clean(v.OutputPath)
+	inCache := false
+	for _, dir := range []string{project.CacheDir, project.WarmCacheDir} {
+		if dir != "" && strings.HasPrefix(output, filepath.Clean(dir)+string(filepath.Separator)) {
+			inCache = true
+		}
+	}
+	if !inCache {
+		return false, nil
+	}
+	info, err := os.Stat(output)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := os.Remove(output); err != nil {
+		return false, err
+	}
+	RecordCacheWrite(output, -info.Size())
+	return true, nil
+}
@@ -0,0 +1,24 @@
+package media
+
+import "os"
+
+// PurgeStaged removes the staged original of path (relative to the origin
+// prefix) together with its sidecars and forgets any cached not-found result,
+// so the next request fetches the file from storage again. Derived variants
+// of the old version are keyed by it and age out through eviction.
+// Returns the number of cache entries removed.
+func PurgeStaged(project *Project, path string) (int, error) {
+	removed := PurgeNegativeCache(project.ProjectID, path)
+	stagedPath, err := StagedPath(project.CacheDir, path)
+	if err != nil {
+		return removed, err
+	}
+	for _, p := range []string{stagedPath, stagedPath + versionSuffix, MetadataSidecar(stagedPath)} {
+		if err := os.Remove(p); err == nil {
+			removed++
+		} else if !os.IsNotExist(err) {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
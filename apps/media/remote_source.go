@@ -0,0 +1,77 @@
+package media
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// remoteSourceExpiry bounds how long a URL handed to an encoder stays valid.
+const remoteSourceExpiry = 15 * time.Minute
+
+// remoteSource is implemented by storages whose objects encoders can read
+// over HTTP, fetching only the byte ranges they need (e.g. S3 presigned URLs).
+type remoteSource interface {
+	SourceURL(path string, expiry time.Duration) (string, http.Header, error)
+}
+
+// SourceInput returns where encoders read the source from: SourceURL when
+// the request was staged remotely, otherwise the staged file.
+func (r *Request) SourceInput() string {
+	if r.SourceURL != "" {
+		return r.SourceURL
+	}
+	return r.StagedFilePath
+}
+
+// StageRemote points the request at a URL of the source instead of staging
+// it, when its encoder is Remote (single video frames) and no fresh staged
+// copy exists. It returns false, leaving the request to StageFile, when the
+// storages cannot serve URLs or the object could not be found on them.
+// MEDIAX.RemoteSources=false disables it.
+func (r *Request) StageRemote() bool {
+	if r.Options == nil || r.Options.Encoder == nil || !r.Options.Encoder.Remote || r.Options.Detail {
+		return false
+	}
+	if !settings.Get("MEDIAX.RemoteSources", true).Bool() {
+		return false
+	}
+	if ttl := r.Origin.Project.NegativeCacheTTL(); ttl > 0 && notFound.hit(negativeKey(r.Origin.ProjectID, r.OriginalFilePath)) {
+		return false
+	}
+	stagedPath, err := StagedPath(r.Origin.Project.CacheDir, r.OriginalFilePath)
+	if err != nil || isFresh(stagedPath, r.Origin.Project.StagingTTL()) {
+		return false
+	}
+
+	for i, storage := range r.Origin.Storages {
+		rs, ok := storage.FS.(remoteSource)
+		if !ok {
+			return false
+		}
+		filePath, err := storage.objectPath(r.OriginalFilePath)
+		if err != nil {
+			return false
+		}
+		version := storage.originVersion(filePath)
+		if version == "" {
+			continue // missing here, or the storage is unreachable
+		}
+		url, headers, err := rs.SourceURL(filePath, remoteSourceExpiry)
+		if err != nil {
+			log.Warning("remote source unavailable, staging instead", "trace_id", r.TraceID, "path", r.OriginalFilePath, "error", err)
+			return false
+		}
+		r.SourceURL, r.SourceHeaders, r.SourceVersion = url, headers, version
+		MetricRemoteSourcesTotal.WithLabelValues(r.Origin.Project.Name).Inc()
+		if r.Debug {
+			r.Request.Set("X-Debug-Remote-Source", storage.Type)
+			r.Request.Set("X-Debug-Storage-Success", fmt.Sprintf("storage-%d", i))
+		}
+		return true
+	}
+	return false
+}
@@ -1,3 +1,7 @@
+// Package s3 is the S3 storage backend. It replaces the AWS SDK based
+// github.com/getevo/filesystem/s3, which MediaX does not import, so storage
+// fixes belong here. Object keys are always joined with path.Join: keys use
+// "/" on every platform.
 package s3
 
 import (
@@ -6,15 +10,18 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/getevo/dsn"
+	"github.com/getevo/evo/v2/lib/log"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"mediax/apps/media/dsn"
 )
 
 // s3Timeout is the default deadline for every S3 API call.
@@ -33,8 +40,12 @@ const s3Timeout = 30 * time.Second
 //
 // Notable DSN params:
 //
-//	Region    – signing region (default: us-east-1; use "auto" for GCS/R2)
-//	IgnoreSSL – skip TLS verification (default: false)
+//	Region       – signing region (default: us-east-1; use "auto" for GCS/R2)
+//	IgnoreSSL    – skip TLS verification (default: false)
+//	PathStyle    – path-style bucket lookup on AWS (default: false)
+//	PartSize     – multipart upload part size, at least 5MB (default: automatic)
+//	SSE.Mode     – server-side encryption of written objects: none, s3 or kms
+//	SSE.KMSKeyID – KMS key for SSE.Mode=kms
 type FileSystem struct {
 	DSN       string `dsn:"s3://$AccessKey:$SecretKey@$Endpoint/$Bucket"`
 	Scheme    string
@@ -46,9 +57,28 @@ type FileSystem struct {
 	BasePath  string `default:""`
 	IgnoreSSL bool   `default:"false"`
 	PathStyle bool   `default:"false"`
+	PartSize  dsn.Size
+	SSE       SSEOptions
 	Params    map[string]string
 
 	client *minio.Client
+	sse    encrypt.ServerSide
+}
+
+// SSEOptions configures server-side encryption of written objects.
+type SSEOptions struct {
+	Mode     string `enum:"none|s3|kms" default:"none"`
+	KMSKeyID string
+}
+
+// minPartSize is the smallest multipart part S3 accepts.
+const minPartSize = 5 << 20
+
+// Validate parses configString like Setup without connecting, so a bad
+// config is reported when it is saved. Unlike Setup it also refuses
+// parameters that match no option.
+func Validate(configString string) error {
+	return (&FileSystem{}).parse(configString, true)
 }
 
 // New creates and initialises a FileSystem from a DSN string.
@@ -60,9 +90,48 @@ func New(configString string) (*FileSystem, error) {
 	return f, nil
 }
 
+// parse reads confString into l and checks the option combinations.
+// Unknown parameters fail when strict and are logged and ignored otherwise.
+func (l *FileSystem) parse(confString string, strict bool) error {
+	if strict {
+		if err := dsn.ParseDSN(confString, l); err != nil {
+			return fmt.Errorf("failed to parse S3 DSN: %w", err)
+		}
+	} else {
+		ignored, err := dsn.ParseDSNLenient(confString, l)
+		if err != nil {
+			return fmt.Errorf("failed to parse S3 DSN: %w", err)
+		}
+		for _, err := range ignored {
+			log.Warning("s3 storage config ignored", "error", err)
+		}
+	}
+	if l.PartSize != 0 && l.PartSize < minPartSize {
+		return fmt.Errorf("PartSize must be at least 5MB")
+	}
+	switch l.SSE.Mode {
+	case "s3":
+		l.sse = encrypt.NewSSE()
+	case "kms":
+		if l.SSE.KMSKeyID == "" {
+			return fmt.Errorf("SSE.Mode=kms needs SSE.KMSKeyID")
+		}
+		var err error
+		if l.sse, err = encrypt.NewSSEKMS(l.SSE.KMSKeyID, nil); err != nil {
+			return fmt.Errorf("invalid SSE.KMSKeyID: %w", err)
+		}
+	}
+	return nil
+}
+
+// putOptions returns the options of every object write.
+func (l *FileSystem) putOptions() minio.PutObjectOptions {
+	return minio.PutObjectOptions{ServerSideEncryption: l.sse, PartSize: uint64(l.PartSize)}
+}
+
 func (l *FileSystem) Setup(confString string) error {
-	if err := dsn.ParseDSN(confString, l); err != nil {
-		return fmt.Errorf("failed to parse S3 DSN: %w", err)
+	if err := l.parse(confString, false); err != nil {
+		return err
 	}
 
 	region := l.Region
@@ -125,7 +194,7 @@ func (l *FileSystem) Touch(p string) error {
 	ctx, cancel := l.newCtx()
 	defer cancel()
 	_, err := l.client.PutObject(ctx, l.Bucket, l.joinKey(p),
-		bytes.NewReader([]byte{}), 0, minio.PutObjectOptions{})
+		bytes.NewReader([]byte{}), 0, l.putOptions())
 	return err
 }
 
@@ -136,29 +205,89 @@ func (l *FileSystem) Delete(p string) error {
 }
 
 func (l *FileSystem) List(p string) ([]string, error) {
-	prefix := l.joinKey(p)
-	if prefix != "" && !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
-	}
 	ctx, cancel := l.newCtx()
 	defer cancel()
-	var result []string
-	for obj := range l.client.ListObjects(ctx, l.Bucket, minio.ListObjectsOptions{Prefix: prefix}) {
-		if obj.Err != nil {
-			return nil, obj.Err
-		}
-		result = append(result, strings.TrimPrefix(obj.Key, prefix))
+	entries, _, err := l.ListContext(ctx, p, ListOptions{Delimiter: true})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, len(entries))
+	for i, e := range entries {
+		result[i] = e.Name
 	}
 	return result, nil
 }
 
 func (l *FileSystem) Walk(p string, fn func(path string, info fs.FileInfo, err error) error) error {
-	prefix := l.joinKey(p)
-	if prefix != "" && !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
-	}
 	ctx, cancel := l.newCtx()
 	defer cancel()
+	return l.WalkContext(ctx, p, fn)
+}
+
+// ListOptions configures ListContext.
+type ListOptions struct {
+	// Delimiter lists one level below the prefix: deeper keys are folded
+	// into directory entries ending in "/", as in a directory listing.
+	Delimiter bool
+	// MaxResults stops the listing after that many entries (0 = no limit).
+	MaxResults int
+	// StartAfter resumes a listing after this name, as returned by the
+	// previous ListContext call.
+	StartAfter string
+}
+
+// Entry is an object or, with ListOptions.Delimiter, a directory.
+type Entry struct {
+	// Name is relative to the listed prefix; directories end in "/".
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// IsDir reports whether e is a directory of a delimited listing.
+func (e Entry) IsDir() bool { return strings.HasSuffix(e.Name, "/") }
+
+// ListContext lists the objects below p in key order. When the listing
+// stops at MaxResults it also returns the name to pass as StartAfter for the
+// next page; an empty next means the listing is complete. Cancelling ctx
+// stops the listing between pages.
+func (l *FileSystem) ListContext(ctx context.Context, p string, opts ListOptions) (entries []Entry, next string, err error) {
+	prefix := l.listPrefix(p)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops minio's background pagination on early return
+	listOpts := minio.ListObjectsOptions{Prefix: prefix, Recursive: !opts.Delimiter}
+	if opts.StartAfter != "" {
+		listOpts.StartAfter = prefix + opts.StartAfter
+	}
+	if opts.MaxResults > 0 && opts.MaxResults <= 1000 {
+		listOpts.MaxKeys = opts.MaxResults
+	}
+	for obj := range l.client.ListObjects(ctx, l.Bucket, listOpts) {
+		if obj.Err != nil {
+			return nil, "", obj.Err
+		}
+		name := strings.TrimPrefix(obj.Key, prefix)
+		// Keys below a StartAfter directory fold into that directory again.
+		if opts.StartAfter != "" && name == opts.StartAfter {
+			continue
+		}
+		if opts.MaxResults > 0 && len(entries) == opts.MaxResults {
+			return entries, entries[len(entries)-1].Name, nil
+		}
+		entries = append(entries, Entry{Name: name, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	return entries, "", nil
+}
+
+// WalkContext calls fn for every object below p, like Walk. fn may return
+// fs.SkipAll to stop early; cancelling ctx stops the walk with ctx.Err().
+func (l *FileSystem) WalkContext(ctx context.Context, p string, fn func(path string, info fs.FileInfo, err error) error) error {
+	prefix := l.listPrefix(p)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	for obj := range l.client.ListObjects(ctx, l.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
 		if obj.Err != nil {
 			return fn("", nil, obj.Err)
@@ -166,10 +295,22 @@ func (l *FileSystem) Walk(p string, fn func(path string, info fs.FileInfo, err e
 		fi := &fileInfo{key: obj.Key, size: obj.Size, mod: obj.LastModified}
 		relPath := strings.TrimPrefix(obj.Key, prefix)
 		if err := fn(relPath, fi, nil); err != nil {
+			if err == fs.SkipAll {
+				return nil
+			}
 			return err
 		}
 	}
-	return nil
+	return ctx.Err()
+}
+
+// listPrefix returns the key prefix of the directory p.
+func (l *FileSystem) listPrefix(p string) string {
+	prefix := l.joinKey(p)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
 }
 
 func (l *FileSystem) Read(p string) ([]byte, error) {
@@ -220,7 +361,7 @@ func (l *FileSystem) Mkdir(p string) error {
 	ctx, cancel := l.newCtx()
 	defer cancel()
 	_, err := l.client.PutObject(ctx, l.Bucket, key,
-		bytes.NewReader([]byte{}), 0, minio.PutObjectOptions{})
+		bytes.NewReader([]byte{}), 0, l.putOptions())
 	return err
 }
 
@@ -228,7 +369,7 @@ func (l *FileSystem) Write(p string, data []byte) error {
 	ctx, cancel := l.newCtx()
 	defer cancel()
 	_, err := l.client.PutObject(ctx, l.Bucket, l.joinKey(p),
-		bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+		bytes.NewReader(data), int64(len(data)), l.putOptions())
 	return err
 }
 
@@ -236,7 +377,7 @@ func (l *FileSystem) WriteBuffer(p string, reader io.Reader) error {
 	ctx, cancel := l.newCtx()
 	defer cancel()
 	_, err := l.client.PutObject(ctx, l.Bucket, l.joinKey(p),
-		reader, -1, minio.PutObjectOptions{})
+		reader, -1, l.putOptions())
 	return err
 }
 
@@ -258,10 +399,25 @@ func (l *FileSystem) Stat(p string) (fs.FileInfo, error) {
 	ctx, cancel := l.newCtx()
 	defer cancel()
 	info, err := l.client.StatObject(ctx, l.Bucket, key, minio.StatObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, fmt.Errorf("failed to stat %s: %w", p, fs.ErrNotExist)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &fileInfo{key: key, size: info.Size, mod: info.LastModified}, nil
+	return &fileInfo{key: key, size: info.Size, mod: info.LastModified, etag: info.ETag}, nil
+}
+
+// SourceURL returns a presigned GET URL of p valid for expiry, so encoders
+// such as ffmpeg can read the byte ranges they need without a download.
+func (l *FileSystem) SourceURL(p string, expiry time.Duration) (string, http.Header, error) {
+	ctx, cancel := l.newCtx()
+	defer cancel()
+	u, err := l.client.PresignedGetObject(ctx, l.Bucket, l.joinKey(p), expiry, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return u.String(), nil, nil
 }
 
 func (l *FileSystem) Copy(src, dst string) error {
@@ -270,7 +426,7 @@ func (l *FileSystem) Copy(src, dst string) error {
 	srcKey := l.joinKey(src)
 	dstKey := l.joinKey(dst)
 	_, err := l.client.CopyObject(ctx,
-		minio.CopyDestOptions{Bucket: l.Bucket, Object: dstKey},
+		minio.CopyDestOptions{Bucket: l.Bucket, Object: dstKey, Encryption: l.sse},
 		minio.CopySrcOptions{Bucket: l.Bucket, Object: srcKey},
 	)
 	return err
@@ -286,7 +442,7 @@ func (l *FileSystem) Move(src, dst string) error {
 func (l *FileSystem) DiskToStorage(src, dst string) error {
 	ctx, cancel := l.newCtx()
 	defer cancel()
-	_, err := l.client.FPutObject(ctx, l.Bucket, l.joinKey(dst), src, minio.PutObjectOptions{})
+	_, err := l.client.FPutObject(ctx, l.Bucket, l.joinKey(dst), src, l.putOptions())
 	return err
 }
 
@@ -296,7 +452,11 @@ func (l *FileSystem) StorageToDisk(src, dst string) error {
 	}
 	ctx, cancel := l.newCtx()
 	defer cancel()
-	return l.client.FGetObject(ctx, l.Bucket, l.joinKey(src), dst, minio.GetObjectOptions{})
+	err := l.client.FGetObject(ctx, l.Bucket, l.joinKey(src), dst, minio.GetObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("failed to get %s: %w", src, fs.ErrNotExist)
+	}
+	return err
 }
 
 // ── fs.FileInfo implementation ────────────────────────────────────────────────
@@ -305,6 +465,7 @@ type fileInfo struct {
 	key  string
 	size int64
 	mod  time.Time
+	etag string
 }
 
 func (fi *fileInfo) Name() string       { return path.Base(fi.key) }
@@ -313,3 +474,6 @@ func (fi *fileInfo) Mode() fs.FileMode  { return 0444 }
 func (fi *fileInfo) ModTime() time.Time { return fi.mod }
 func (fi *fileInfo) IsDir() bool        { return strings.HasSuffix(fi.key, "/") }
 func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// ETag returns the object's entity tag, if known.
+func (fi *fileInfo) ETag() string { return fi.etag }
@@ -0,0 +1,56 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// ErrSourceTooLarge is returned by Request.StageFile for files above
+// MEDIAX.MaxSourceSize.
+var ErrSourceTooLarge = errors.New("source file too large")
+
+// errStageAsync asks Storage.StageFile to download in the background.
+var errStageAsync = errors.New("stage in background")
+
+// sourceSizeLimits returns MEDIAX.MaxSourceSize, above which files are
+// refused, and MEDIAX.MaxSyncSourceSize, above which they are staged in the
+// background. Zero disables a limit.
+func sourceSizeLimits() (maxSize, maxSync int64) {
+	maxSize, err := ParseCacheSize(settings.Get("MEDIAX.MaxSourceSize", "0").String())
+	if err != nil {
+		log.Warning("invalid MEDIAX.MaxSourceSize, ignoring", "error", err)
+	}
+	maxSync, err = ParseCacheSize(settings.Get("MEDIAX.MaxSyncSourceSize", "0").String())
+	if err != nil {
+		log.Warning("invalid MEDIAX.MaxSyncSourceSize, ignoring", "error", err)
+	}
+	return maxSize, maxSync
+}
+
+// sourceSizeCheck returns the check Storage.StageFile runs against the size
+// of the object before downloading it, or nil when neither a size limit nor
+// debug output needs that extra HEAD.
+func (r *Request) sourceSizeCheck() func(size int64) error {
+	maxSize, maxSync := sourceSizeLimits()
+	if maxSize <= 0 && maxSync <= 0 && !r.Debug {
+		return nil
+	}
+	return func(size int64) error {
+		if r.Debug {
+			r.Request.Set("X-Debug-Origin-Content-Length", strconv.FormatInt(size, 10))
+		}
+		if maxSize > 0 && size > maxSize {
+			MetricLargeSourcesTotal.WithLabelValues(r.Origin.Project.Name, "refused").Inc()
+			return fmt.Errorf("%w: %d bytes exceeds %d", ErrSourceTooLarge, size, maxSize)
+		}
+		if maxSync > 0 && size > maxSync {
+			MetricLargeSourcesTotal.WithLabelValues(r.Origin.Project.Name, "background").Inc()
+			return errStageAsync
+		}
+		return nil
+	}
+}
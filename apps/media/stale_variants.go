@@ -0,0 +1,81 @@
+package media
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxServedVariants bounds the variants remembered for
+// stale-while-revalidate.
+const maxServedVariants = 100000
+
+// servedVariant is the output last served for a variant of a source.
+type servedVariant struct {
+	key  string // Request.CacheKey, which changes with the source version
+	path string
+	mime string
+}
+
+var servedVariants = struct {
+	mu      sync.Mutex
+	entries map[string]servedVariant
+}{entries: map[string]servedVariant{}}
+
+// variantSlot identifies the variant requested by r across versions of its
+// source.
+func (r *Request) variantSlot() string {
+	return fmt.Sprintf("%d:%s", r.Origin.ProjectID, r.Options.CacheKey(r.OriginalFilePath))
+}
+
+// RememberVariant records filePath, of type mime, as the output served for
+// r, so a request after the source changed can be served it by
+// StaleVariant. Only projects with a stale_while_revalidate window keep
+// them, in memory.
+func (r *Request) RememberVariant(filePath, mime string) {
+	if r.Origin.Project.StaleWhileRevalidateWindow() <= 0 || filePath == r.StagedFilePath {
+		return
+	}
+	slot := r.variantSlot()
+	servedVariants.mu.Lock()
+	defer servedVariants.mu.Unlock()
+	if _, ok := servedVariants.entries[slot]; !ok && len(servedVariants.entries) >= maxServedVariants {
+		return
+	}
+	servedVariants.entries[slot] = servedVariant{key: r.CacheKey(), path: filePath, mime: mime}
+}
+
+// StaleVariant returns the output last served for the variant r asks for
+// when it was made of an earlier version of the source, and the current
+// version was staged no longer than the project's stale_while_revalidate
+// window ago. It reports false when the variant is current, unknown or
+// evicted, or the window has passed.
+func (r *Request) StaleVariant() (path, mime string, ok bool) {
+	window := r.Origin.Project.StaleWhileRevalidateWindow()
+	if window <= 0 || r.StagedFilePath == "" {
+		return "", "", false
+	}
+	servedVariants.mu.Lock()
+	v, found := servedVariants.entries[r.variantSlot()]
+	servedVariants.mu.Unlock()
+	if !found || v.key == r.CacheKey() {
+		return "", "", false
+	}
+	staged, err := os.Stat(r.StagedFilePath)
+	if err != nil || staged.ModTime().Add(window).Before(time.Now()) {
+		return "", "", false
+	}
+	if _, err := os.Stat(v.path); err != nil {
+		return "", "", false
+	}
+	return v.path, v.mime, true
+}
+
+// ForgetVariant drops the output remembered for the variant r asks for, so
+// it is no longer served stale, e.g. after regenerating it failed.
+func (r *Request) ForgetVariant() {
+	servedVariants.mu.Lock()
+	defer servedVariants.mu.Unlock()
+	delete(servedVariants.entries, r.variantSlot())
+}
@@ -0,0 +1,65 @@
+package media
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"gorm.io/gorm"
+)
+
+// ErrStorageUnavailable is reported for storages whose Init failed.
+var ErrStorageUnavailable = errors.New("storage unavailable")
+
+// storageHealth records the last Init error of each storage by ID; nil
+// means the storage initialized fine.
+var storageHealth sync.Map
+
+func setStorageHealth(id int, err error) {
+	if err != nil {
+		log.Error("storage init failed", "storage_id", id, "error", err)
+		MetricStorageUnhealthy.WithLabelValues(strconv.Itoa(id)).Set(1)
+		storageHealth.Store(id, err)
+		return
+	}
+	MetricStorageUnhealthy.WithLabelValues(strconv.Itoa(id)).Set(0)
+	storageHealth.Store(id, nil)
+}
+
+// PruneStorageHealth forgets the health of storages keep rejects, so
+// storages removed by a reload are no longer reported.
+func PruneStorageHealth(keep func(id int) bool) {
+	storageHealth.Range(func(k, _ any) bool {
+		if id := k.(int); !keep(id) {
+			storageHealth.Delete(id)
+			MetricStorageUnhealthy.DeleteLabelValues(strconv.Itoa(id))
+		}
+		return true
+	})
+}
+
+// StorageHealth returns the Init error of every storage that failed to
+// initialize, by storage ID.
+func StorageHealth() map[int]error {
+	unhealthy := map[int]error{}
+	storageHealth.Range(func(k, v any) bool {
+		if err, ok := v.(error); ok && err != nil {
+			unhealthy[k.(int)] = err
+		}
+		return true
+	})
+	return unhealthy
+}
+
+// AfterFind reports the health of storages this instance initialized, so
+// /admin/storages shows which ones are unusable and why.
+func (s *Storage) AfterFind(tx *gorm.DB) error {
+	if v, ok := storageHealth.Load(s.StorageID); ok {
+		s.Health = "ok"
+		if err, _ := v.(error); err != nil {
+			s.Health, s.InitError = "unhealthy", err.Error()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"mediax/apps/media/localfs"
+	localS3 "mediax/apps/media/s3"
+)
+
+// listDirPage is the number of keys ListDir reads from S3 per request.
+const listDirPage = 1000
+
+// errNotListable is returned by ListDir for storages without directories.
+var errNotListable = errors.New("storage does not support listing")
+
+// DirEntry is a file or directory directly below a directory ListDir lists.
+type DirEntry struct {
+	Name string
+	Size int64
+	Dir  bool
+}
+
+// Key returns the name of e in listing order: directories end in "/", as
+// S3 common prefixes do.
+func (e DirEntry) Key() string {
+	if e.Dir {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// WalkFiles calls fn with every file below prefix of the storage, as the
+// path a request would stage it by (relative to BasePath) and its size.
+// Walking stops at the first error fn returns or when ctx ends. HTTP
+// storages cannot be listed and return an error.
+func (s Storage) WalkFiles(ctx context.Context, prefix string, fn func(path string, size int64) error) error {
+	if s.FS == nil {
+		return ErrStorageUnavailable
+	}
+	prefix = strings.Trim(path.Clean("/"+filepath.ToSlash(prefix)), "/")
+	dir := s.BasePath
+	if prefix != "" {
+		var err error
+		if dir, err = s.objectPath(prefix); err != nil {
+			return err
+		}
+	}
+
+	// The S3 backend reports keys relative to the walked prefix, the local
+	// one paths relative to its root, which includes BasePath.
+	if s3fs, ok := s.FS.(*localS3.FileSystem); ok {
+		return s3fs.WalkContext(ctx, dir, func(p string, info fs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.HasSuffix(p, "/") {
+				return nil
+			}
+			return fn(path.Join(prefix, p), info.Size())
+		})
+	}
+	base := filepath.ToSlash(s.BasePath)
+	return s.FS.Walk(dir, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if info.IsDir() {
+			return nil
+		}
+		p = filepath.ToSlash(p)
+		if base != "" {
+			p = strings.TrimPrefix(p, base+"/")
+		}
+		return fn(p, info.Size())
+	})
+}
+
+// StatFile returns the size of the file at path on the storage, the path a
+// request would stage it by. A missing file returns an error wrapping
+// fs.ErrNotExist; HTTP storages are asked with a HEAD request.
+func (s Storage) StatFile(path string) (int64, error) {
+	if s.FS == nil {
+		return 0, ErrStorageUnavailable
+	}
+	filePath, err := s.objectPath(path)
+	if err != nil {
+		return 0, err
+	}
+	info, err := s.FS.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// ListDir calls fn with the entries directly below prefix of the storage in
+// key order (see DirEntry.Key), starting after the key after, until fn
+// returns false or the entries run out. S3 storages are listed a page at a
+// time with a delimiter, so only the keys up to where fn stops are read;
+// local directories are read one level deep. HTTP storages cannot be listed
+// and return an error.
+func (s Storage) ListDir(ctx context.Context, prefix, after string, fn func(DirEntry) bool) error {
+	if s.FS == nil {
+		return ErrStorageUnavailable
+	}
+	prefix = strings.Trim(path.Clean("/"+filepath.ToSlash(prefix)), "/")
+	dir := s.BasePath
+	if prefix != "" {
+		var err error
+		if dir, err = s.objectPath(prefix); err != nil {
+			return err
+		}
+	}
+
+	switch fsys := s.FS.(type) {
+	case *localS3.FileSystem:
+		for {
+			// A page is one S3 response; it reports objects before common
+			// prefixes, so it is sorted before use.
+			page, next, err := fsys.ListContext(ctx, dir, localS3.ListOptions{Delimiter: true, MaxResults: listDirPage, StartAfter: after})
+			if err != nil {
+				return err
+			}
+			entries := make([]DirEntry, len(page))
+			for i, e := range page {
+				entries[i] = DirEntry{Name: strings.TrimSuffix(e.Name, "/"), Size: e.Size, Dir: e.IsDir()}
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Key() < entries[j].Key() })
+			for _, e := range entries {
+				if !fn(e) {
+					return nil
+				}
+			}
+			if next == "" || len(entries) == 0 {
+				return nil
+			}
+			after = entries[len(entries)-1].Key()
+		}
+	case *localfs.FileSystem:
+		files, err := os.ReadDir(filepath.Join(fsys.Path, dir))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entries := make([]DirEntry, 0, len(files))
+		for _, f := range files {
+			if e := (DirEntry{Name: f.Name(), Dir: f.IsDir()}); e.Key() > after {
+				entries = append(entries, e)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key() < entries[j].Key() })
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !e.Dir {
+				info, err := os.Stat(filepath.Join(fsys.Path, dir, e.Name))
+				if err != nil {
+					continue
+				}
+				e.Size = info.Size()
+			}
+			if !fn(e) {
+				return nil
+			}
+		}
+		return nil
+	default:
+		return errNotListable
+	}
+}
@@ -0,0 +1,90 @@
+package media
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OriginUsage is the bytes served and transformations performed by one
+// origin on one day (YYYY-MM-DD, UTC).
+type OriginUsage struct {
+	OriginID        int    `gorm:"column:origin_id;primaryKey" json:"origin_id"`
+	Day             string `gorm:"column:day;size:10;primaryKey" json:"day"`
+	ProjectID       int    `gorm:"column:project_id;index" json:"project_id"`
+	Bytes           int64  `gorm:"column:bytes" json:"bytes"`
+	Transformations int64  `gorm:"column:transformations" json:"transformations"`
+}
+
+func (OriginUsage) TableName() string {
+	return "origin_usage"
+}
+
+type originUsageKey struct {
+	originID int
+	day      string
+}
+
+// originUsage holds this instance's usage not yet written to the database.
+var originUsage = struct {
+	mu      sync.Mutex
+	pending map[originUsageKey]OriginUsage
+}{pending: map[originUsageKey]OriginUsage{}}
+
+// RecordOriginUsage adds served bytes and transformations to the usage of
+// origin and to the mediax_served_bytes_total and mediax_transformations_total
+// metrics.
+func RecordOriginUsage(origin *Origin, bytes, transformations int64) {
+	project := ""
+	if origin.Project != nil {
+		project = origin.Project.Name
+	}
+	MetricServedBytesTotal.WithLabelValues(project, origin.Domain).Add(float64(bytes))
+	MetricTransformationsTotal.WithLabelValues(project, origin.Domain).Add(float64(transformations))
+
+	key := originUsageKey{originID: origin.OriginID, day: time.Now().UTC().Format(time.DateOnly)}
+	originUsage.mu.Lock()
+	defer originUsage.mu.Unlock()
+	u := originUsage.pending[key]
+	u.OriginID, u.Day, u.ProjectID = key.originID, key.day, origin.ProjectID
+	u.Bytes += bytes
+	u.Transformations += transformations
+	originUsage.pending[key] = u
+}
+
+// SyncOriginUsage adds this instance's unwritten origin usage to the database.
+func SyncOriginUsage() error {
+	originUsage.mu.Lock()
+	pending := originUsage.pending
+	originUsage.pending = map[originUsageKey]OriginUsage{}
+	originUsage.mu.Unlock()
+
+	for key, u := range pending {
+		row := u
+		err := db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "origin_id"}, {Name: "day"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"bytes":           gorm.Expr("bytes + ?", u.Bytes),
+				"transformations": gorm.Expr("transformations + ?", u.Transformations),
+			}),
+		}).Create(&row).Error
+		if err != nil {
+			// Keep the unwritten usage for the next attempt.
+			originUsage.mu.Lock()
+			for key, u := range pending {
+				p := originUsage.pending[key]
+				p.OriginID, p.Day, p.ProjectID = u.OriginID, u.Day, u.ProjectID
+				p.Bytes += u.Bytes
+				p.Transformations += u.Transformations
+				originUsage.pending[key] = p
+			}
+			originUsage.mu.Unlock()
+			return err
+		}
+		delete(pending, key)
+	}
+	return nil
+}
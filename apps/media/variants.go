@@ -0,0 +1,96 @@
+package media
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// VariantPaths returns where pre-generated variants of the requested output
+// may exist in storage, expanded from the project's VariantPatterns. Only
+// requests limited to w, h, q and f (plus crop and download) qualify, and a
+// pattern is skipped when it names a value the request does not set or its
+// extension is not the output format.
+func (r *Request) VariantPaths() []string {
+	if r.Origin == nil || r.Origin.Project == nil || r.Origin.Project.VariantPatterns == "" || r.Options == nil {
+		return nil
+	}
+	o := *r.Options
+	ext := strings.TrimPrefix(path.Ext(r.OriginalFilePath), ".")
+	format := strings.ToLower(o.OutputFormat)
+	o.Width, o.Height, o.Quality, o.OutputFormat = 0, 0, 0, ext
+	if !o.Passthrough(ext) || r.Options.Passthrough(ext) {
+		return nil
+	}
+
+	dir, file := path.Split(r.OriginalFilePath)
+	values := map[string]string{
+		"{name}": strings.TrimSuffix(file, path.Ext(file)),
+		"{ext}":  ext,
+		"{f}":    format,
+	}
+	for k, v := range map[string]int{"{w}": r.Options.Width, "{h}": r.Options.Height, "{q}": r.Options.Quality} {
+		if v > 0 {
+			values[k] = strconv.Itoa(v)
+		}
+	}
+
+	var paths []string
+	for _, pattern := range strings.Split(r.Origin.Project.VariantPatterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		p := pattern
+		for _, k := range []string{"{name}", "{ext}", "{f}", "{w}", "{h}", "{q}"} {
+			if strings.Contains(p, k) {
+				v, ok := values[k]
+				if !ok {
+					p = ""
+					break
+				}
+				p = strings.ReplaceAll(p, k, v)
+			}
+		}
+		// A variant is served with the MIME type of the requested format, so
+		// it must be in that format.
+		if p == "" || strings.Contains(p, "{") || !sameFormat(strings.TrimPrefix(path.Ext(p), "."), format) {
+			continue
+		}
+		// Patterns are relative to the source's directory unless they start
+		// with "/", which is the origin root.
+		if !strings.HasPrefix(p, "/") {
+			p = dir + p
+		}
+		if p = path.Clean("/" + p); p != path.Clean("/"+r.OriginalFilePath) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// StagePregenerated stages the first pre-generated variant of the request
+// found in storage. On success StagedFilePath is the variant, which is served
+// as is. Misses are remembered like other not-found files when the project
+// has a NotFoundTTL. A variant that is still being staged by another request
+// is reported like StageFile reports it.
+func (r *Request) StagePregenerated() (bool, error) {
+	for _, p := range r.VariantPaths() {
+		variant := *r
+		variant.OriginalFilePath = p
+		err := variant.StageFile()
+		if err == nil {
+			r.StagedFilePath, r.SourceVersion = variant.StagedFilePath, variant.SourceVersion
+			MetricPregeneratedServedTotal.WithLabelValues(r.Origin.Project.Name).Inc()
+			if r.Debug {
+				r.Request.Set("X-Debug-Pregenerated", p)
+			}
+			return true, nil
+		}
+		if variant.StagedFilePath == STAGING {
+			r.StagedFilePath = STAGING
+			return false, err
+		}
+	}
+	return false, nil
+}
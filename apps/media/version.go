@@ -0,0 +1,61 @@
+package media
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// versionSuffix names the sidecar file that records which origin version a
+// staged file was downloaded from.
+const versionSuffix = ".version"
+
+// MetadataSidecar returns the path of the cached image metadata (detail=true)
+// stored next to a staged original.
+func MetadataSidecar(stagedPath string) string {
+	return strings.TrimSuffix(stagedPath, filepath.Ext(stagedPath)) + ".metadata.json"
+}
+
+// etagger is implemented by fs.FileInfo values that carry the origin ETag.
+type etagger interface {
+	ETag() string
+}
+
+// originVersion describes the current version of filePath on the storage:
+// its ETag when the backend reports one, otherwise size and modification time.
+// Returns "" when the storage cannot stat the object.
+func (s Storage) originVersion(filePath string) string {
+	info, err := s.FS.Stat(filePath)
+	if err != nil || info == nil {
+		return ""
+	}
+	if e, ok := info.(etagger); ok && e.ETag() != "" {
+		return "etag:" + strings.Trim(e.ETag(), `"`)
+	}
+	return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+}
+
+// writeSourceVersion records version next to stagedPath. An empty version
+// removes the sidecar so SourceVersion falls back to the staged file itself.
+func writeSourceVersion(stagedPath, version string) {
+	if version == "" {
+		os.Remove(stagedPath + versionSuffix)
+		return
+	}
+	os.WriteFile(stagedPath+versionSuffix, []byte(version), 0644) //nolint:errcheck
+}
+
+// SourceVersion returns the origin version a staged file was fetched from.
+// Without a sidecar (hard-linked or legacy staged files) the staged file's own
+// size and modification time are used, which track the origin for links.
+func SourceVersion(stagedPath string) string {
+	if b, err := os.ReadFile(stagedPath + versionSuffix); err == nil && len(b) > 0 {
+		return string(b)
+	}
+	info, err := os.Stat(stagedPath)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+}
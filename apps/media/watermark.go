@@ -0,0 +1,74 @@
+package media
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/db/types"
+	"gorm.io/gorm"
+)
+
+// Watermark records an output served with a forensic watermark. Its
+// WatermarkID is the payload hidden in the output, so a leaked copy leads
+// back to the request that served it and the user it was served to.
+type Watermark struct {
+	WatermarkID int64  `gorm:"column:watermark_id;primaryKey;autoIncrement:false" json:"watermark_id"`
+	ProjectID   int    `gorm:"column:project_id;index" json:"project_id"`
+	Path        string `gorm:"column:path;size:1024" json:"path"`
+	// UserID is the uid the request was signed for, APIKeyID the key it
+	// carried; either may be empty.
+	UserID   string `gorm:"column:user_id;size:255;index" json:"user_id"`
+	APIKeyID int    `gorm:"column:api_key_id" json:"api_key_id"`
+	TraceID  string `gorm:"column:trace_id;size:64" json:"trace_id"`
+	ClientIP string `gorm:"column:client_ip;size:64" json:"client_ip"`
+	types.CreatedAt
+}
+
+func (Watermark) TableName() string {
+	return "watermark"
+}
+
+// ErrUnknownWatermark is returned by FindWatermark for payloads no
+// watermark was recorded for.
+var ErrUnknownWatermark = errors.New("unknown watermark")
+
+// NewWatermark records a watermark for the output r serves to user, with
+// the API key apiKeyID (0 for none), and returns its 8-byte payload.
+func (r *Request) NewWatermark(user string, apiKeyID int) ([]byte, error) {
+	payload := make([]byte, 8)
+	if _, err := rand.Read(payload); err != nil {
+		return nil, err
+	}
+	payload[0] &= 0x7f // a positive int64
+	w := Watermark{
+		WatermarkID: int64(binary.BigEndian.Uint64(payload)),
+		ProjectID:   r.Origin.ProjectID,
+		Path:        r.OriginalFilePath,
+		UserID:      user,
+		APIKeyID:    apiKeyID,
+		TraceID:     r.TraceID,
+		ClientIP:    r.Request.IP(),
+	}
+	if err := db.Create(&w).Error; err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// FindWatermark returns the watermark recorded for payload.
+func FindWatermark(payload []byte) (*Watermark, error) {
+	if len(payload) != 8 {
+		return nil, ErrUnknownWatermark
+	}
+	var w Watermark
+	err := db.Where("watermark_id = ?", int64(binary.BigEndian.Uint64(payload))).Take(&w).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUnknownWatermark
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
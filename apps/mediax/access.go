@@ -0,0 +1,53 @@
+package mediax
+
+import (
+	"strings"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"mediax/apps/media"
+)
+
+// checkAccess applies the IP and country rules of the request's origin to
+// the client (see clientIP): denied addresses are answered 403, clients in
+// countries the origin may not serve 451 Unavailable For Legal Reasons.
+// Country rules fail closed, with 503, when the GeoIP database cannot be
+// read. Internal requests pass. A non-nil response refuses the request.
+func checkAccess(req *media.Request) any {
+	origin := req.Origin
+	ipRules := strings.TrimSpace(origin.AllowedIPs) != "" || strings.TrimSpace(origin.DeniedIPs) != ""
+	if (!ipRules && !origin.GeoRestricted()) || isInternal(req) {
+		return nil
+	}
+	project := ""
+	if origin.Project != nil {
+		project = origin.Project.Name
+	}
+	ip := clientIP(req.Request)
+	if !origin.AllowsIP(ip) {
+		metricAccessDenied.WithLabelValues(project, "ip").Inc()
+		return accessDenied(req, evo.StatusForbidden, "access denied")
+	}
+	if !origin.GeoRestricted() {
+		return nil
+	}
+	country, err := countryOf(ip)
+	if err != nil {
+		log.Error("geoip lookup failed", "trace_id", req.TraceID, "ip", ip.String(), "error", err)
+		metricAccessDenied.WithLabelValues(project, "geoip_error").Inc()
+		return accessDenied(req, evo.StatusServiceUnavailable, "geoip lookup failed")
+	}
+	if !origin.AllowsCountry(country) {
+		metricAccessDenied.WithLabelValues(project, "country").Inc()
+		return accessDenied(req, evo.StatusUnavailableForLegalReasons, "not available in your country")
+	}
+	return nil
+}
+
+// accessDenied answers a refused client; shared caches must not hand the
+// refusal to clients the rules allow.
+func accessDenied(req *media.Request, status int, message string) any {
+	req.Request.Set("Cache-Control", "private, no-store")
+	return outcome.Text(message).Status(status)
+}
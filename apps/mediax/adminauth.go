@@ -0,0 +1,33 @@
+package mediax
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"github.com/gofiber/fiber/v2"
+)
+
+// checkAdminToken guards every /admin route, including the restify CRUD
+// APIs, with MEDIAX.AdminToken sent as "Authorization: Bearer <token>".
+// Without a token the admin API is left open, as before the setting existed,
+// so deployments that protect /admin at the proxy keep working.
+func checkAdminToken(request *evo.Request) error {
+	token := settings.Get("MEDIAX.AdminToken", "").String()
+	if token != "" {
+		sent := strings.TrimPrefix(request.Header("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid or missing admin token")
+		}
+	}
+	return request.Next()
+}
+
+// warnOpenAdmin logs when the admin API accepts unauthenticated requests.
+func warnOpenAdmin() {
+	if settings.Get("MEDIAX.AdminToken", "").String() == "" {
+		log.Warning("admin api is unauthenticated: set MEDIAX.AdminToken or protect /admin at the proxy")
+	}
+}
@@ -0,0 +1,50 @@
+package mediax
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"github.com/getevo/evo/v2"
+	"github.com/google/uuid"
+	"mediax/apps/media"
+)
+
+// internalToken marks requests that serveInternal runs on behalf of
+// prewarm, ZIP downloads and the CLI. They are trusted and not charged to an API key.
+var internalToken = uuid.New().String()
+
+// isInternal reports whether req was made by serveInternal.
+func isInternal(req *media.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(req.Request.Header("X-Mediax-Internal")), []byte(internalToken)) == 1
+}
+
+// authorizeAPIKey resolves the API key of a request to an origin with
+// require_api_key, from the X-API-Key header or the api_key query parameter.
+// It returns a nil key for origins without the requirement and for internal
+// requests, and an HTTP status with the error when the request is refused.
+func authorizeAPIKey(req *media.Request) (*media.APIKey, int, error) {
+	if !req.Origin.RequireAPIKey {
+		return nil, 0, nil
+	}
+	if isInternal(req) {
+		return nil, 0, nil
+	}
+	token := req.Request.Header("X-API-Key")
+	if token == "" {
+		token = req.Request.Query("api_key").String()
+	}
+	if token == "" {
+		return nil, evo.StatusUnauthorized, errors.New("api key required")
+	}
+	key, ok := lookupAPIKey(token)
+	if !ok {
+		return nil, evo.StatusUnauthorized, errors.New("invalid api key")
+	}
+	if key.ProjectID != 0 && key.ProjectID != req.Origin.ProjectID {
+		return nil, evo.StatusForbidden, errors.New("api key is not valid for this domain")
+	}
+	if err := key.CheckQuota(); err != nil {
+		return nil, evo.StatusTooManyRequests, err
+	}
+	return key, 0, nil
+}
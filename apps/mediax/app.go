@@ -6,29 +6,73 @@ import (
 	"github.com/getevo/evo/v2/lib/db"
 	"github.com/getevo/restify"
 	"mediax/apps/media"
+	"mediax/mediaurl"
 )
 
 type App struct {
 }
 
 func (a App) Register() error {
+	if err := validateMediaTypes(MediaTypes); err != nil {
+		return err
+	}
 	restify.SetPrefix("/admin")
-	db.UseModel(media.Project{}, media.Storage{}, media.Origin{}, media.VideoProfile{})
+	registerConfigHooks()
+	db.UseModel(media.Project{}, media.Storage{}, media.Origin{}, media.VideoProfile{}, media.CachePriority{}, media.APIKey{}, media.APIKeyUsage{}, media.OriginUsage{}, media.ExternalProcessor{}, media.Watermark{}, media.AssetMetadata{}, media.ProcessingFailure{}, media.FailureReportDelivery{}, media.ProfileVariant{})
 	return nil
 }
 
 func (a App) Router() error {
 	var controller Controller
+	// Registered before the admin routes, and before restify's which are
+	// set up after this app.
+	evo.Use("/admin", checkAdminToken)
 	evo.Get("/health", controller.Health)
 	evo.Post("/admin/reload", controller.Reload)
+	evo.Get("/admin/cache/stats", controller.CacheStats)
+	evo.Post("/admin/cache/negative/purge", controller.PurgeNegativeCache)
+	evo.Post("/admin/cache/purge", controller.PurgeMedia)
+	evo.Post("/admin/cache/prewarm", controller.Prewarm)
+	evo.Get("/admin/transcodes", controller.Transcodes)
+	evo.Post("/admin/transcodes/cancel", controller.CancelTranscode)
+	evo.Post("/admin/duplicates", controller.StartDuplicateScan)
+	evo.Get("/admin/duplicates", controller.DuplicateScans)
+	evo.Post("/admin/duplicates/cancel", controller.CancelDuplicateScan)
+	evo.Post("/admin/dead-assets", controller.StartDeadAssetScan)
+	evo.Get("/admin/dead-assets", controller.DeadAssetScans)
+	evo.Post("/admin/dead-assets/cancel", controller.CancelDeadAssetScan)
+	evo.Post("/admin/profiles/regenerate", controller.StartProfileRegeneration)
+	evo.Get("/admin/profiles/regenerate", controller.ProfileRegenerations)
+	evo.Post("/admin/profiles/regenerate/cancel", controller.CancelProfileRegeneration)
+	evo.Get("/admin/api-keys/usage", controller.APIKeyUsage)
+	evo.Get("/admin/usage", controller.Usage)
+	evo.Get("/admin/errors/report", controller.FailureReport)
+	evo.Post("/admin/watermarks/detect", controller.DetectWatermark)
+	evo.Get("/admin/assets/metadata", controller.GetAssetMetadata)
+	evo.Put("/admin/assets/metadata", controller.SetAssetMetadata)
+	evo.Patch("/admin/assets/metadata", controller.SetAssetMetadata)
+	evo.Delete("/admin/assets/metadata", controller.DeleteAssetMetadata)
 	evo.Get("/prometheus/metrics", controller.PrometheusMetrics)
-	evo.Get("/*", controller.ServeMedia)
+	evo.Get("/openapi.json", controller.OpenAPI)
+	evo.Get("/generate/qr", recoverPanics(controller.GenerateQR))
+	evo.Get("/placeholder/:size", recoverPanics(controller.Placeholder))
+	evo.Post(mediaurl.ZipPath, recoverPanics(controller.ServeZip))
+	evo.Get(mediaurl.ListPath, recoverPanics(controller.ListFolder))
+	evo.Get("/*", recoverPanics(controller.ServeMedia))
 	return nil
 }
 
 func (a App) WhenReady() error {
 	InitializeConfig()
+	go migrateCacheLayout()
 	startEvictionLoop()
+	startCacheCleanup()
+	startGRPCServer()
+	checkS3Gateway()
+	warnOpenAdmin()
+	startUsageSync()
+	media.StartEvents()
+	startFailureReports()
 	return nil
 }
 
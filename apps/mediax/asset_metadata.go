@@ -0,0 +1,118 @@
+package mediax
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"mediax/apps/media"
+)
+
+// assetMetadataQuery reads the ?project_id and ?path of an asset metadata
+// request.
+func assetMetadataQuery(request *evo.Request) (int, string, any) {
+	projectID := request.Query("project_id").Int()
+	if projectID <= 0 {
+		return 0, "", outcome.Text("project_id is required").Status(evo.StatusBadRequest)
+	}
+	p := media.CleanAssetPath(request.Query("path").String())
+	if p == "" {
+		return 0, "", outcome.Text("path is required").Status(evo.StatusBadRequest)
+	}
+	return projectID, p, nil
+}
+
+// GetAssetMetadata answers the AssetMetadata of ?path, relative to the
+// project's storages, or with ?prefix= instead the records of every asset
+// below it, at most ?limit (default 100, up to 1000).
+func (c Controller) GetAssetMetadata(request *evo.Request) any {
+	if request.Query("path").String() == "" && request.Query("prefix").String() != "" {
+		projectID := request.Query("project_id").Int()
+		if projectID <= 0 {
+			return outcome.Text("project_id is required").Status(evo.StatusBadRequest)
+		}
+		limit := request.Query("limit").Int()
+		if limit <= 0 || limit > listingMaxLimit {
+			limit = listingDefaultLimit
+		}
+		records, err := media.ListAssetMetadata(projectID, request.Query("prefix").String(), limit)
+		if err != nil {
+			return err
+		}
+		return outcome.Json(records)
+	}
+	projectID, p, refused := assetMetadataQuery(request)
+	if refused != nil {
+		return refused
+	}
+	m, err := media.FindAssetMetadata(projectID, p)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return outcome.Text("no metadata for " + p).Status(evo.StatusNotFound)
+	}
+	return outcome.Json(m)
+}
+
+// SetAssetMetadata stores the JSON object in the body as the metadata of
+// ?path: PUT replaces it, PATCH merges it with the stored keys, removing
+// those set to null.
+func (c Controller) SetAssetMetadata(request *evo.Request) any {
+	projectID, p, refused := assetMetadataQuery(request)
+	if refused != nil {
+		return refused
+	}
+	var data map[string]any
+	if err := json.Unmarshal([]byte(request.Body()), &data); err != nil || data == nil {
+		return outcome.Text("the body must be a JSON object").Status(evo.StatusBadRequest)
+	}
+	m, err := media.SetAssetMetadata(projectID, p, data, request.Method() == "PATCH")
+	if errors.Is(err, media.ErrInvalidAssetMetadata) {
+		return outcome.Text(err.Error()).Status(evo.StatusBadRequest)
+	}
+	if err != nil {
+		return err
+	}
+	return outcome.Json(m)
+}
+
+// DeleteAssetMetadata removes the metadata of ?path.
+func (c Controller) DeleteAssetMetadata(request *evo.Request) any {
+	projectID, p, refused := assetMetadataQuery(request)
+	if refused != nil {
+		return refused
+	}
+	found, err := media.DeleteAssetMetadata(projectID, p)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return outcome.Text("no metadata for " + p).Status(evo.StatusNotFound)
+	}
+	return outcome.Text("deleted")
+}
+
+// withAssetMetadata returns the detail response of req: its Metadata and,
+// on projects with DetailAssetMetadata, the file's AssetMetadata. The
+// metadata is still served when the store cannot be read.
+func withAssetMetadata(req *media.Request) map[string]any {
+	if !req.Origin.Project.DetailAssetMetadata {
+		return req.Metadata
+	}
+	m, err := media.FindAssetMetadata(req.Origin.ProjectID, req.OriginalFilePath)
+	if err != nil {
+		log.Error("cannot read asset metadata", "trace_id", req.TraceID, "path", req.OriginalFilePath, "error", err)
+		return req.Metadata
+	}
+	if m == nil {
+		return req.Metadata
+	}
+	// Metadata may be shared with the memory cache.
+	detail := maps.Clone(req.Metadata)
+	detail["asset_metadata"] = m.Data
+	return detail
+}
@@ -0,0 +1,46 @@
+package mediax
+
+import (
+	"math/rand/v2"
+
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// canaryHeader puts a request on the canary pipeline (1) or keeps it off
+// (0), whatever MEDIAX.CanaryPercent draws.
+const canaryHeader = "X-Mediax-Canary"
+
+// routeCanary runs req through the encoder alternative MEDIAX.CanaryEncoder
+// names, if its encoder has one supporting the request, for
+// MEDIAX.CanaryPercent of such requests or when canaryHeader asks for it.
+// It returns the pipeline req runs for the comparison metrics: the
+// alternative's name, "primary", or "" when there is nothing to compare.
+func routeCanary(req *media.Request) string {
+	name := settings.Get("MEDIAX.CanaryEncoder", "").String()
+	encoder := req.Options.Encoder
+	if name == "" || encoder == nil || encoder.Processor == nil {
+		return ""
+	}
+	alternative, ok := encoder.Alternatives[name]
+	if !ok || !alternative.Supports(req) {
+		return ""
+	}
+	var canary bool
+	switch req.Request.Header(canaryHeader) {
+	case "1", "true":
+		canary = true
+	case "0", "false":
+	default:
+		canary = rand.Float64()*100 < settings.Get("MEDIAX.CanaryPercent", 0).Float()
+	}
+	if !canary {
+		return "primary"
+	}
+	e := *encoder
+	e.Processor = alternative.Processor
+	req.Options.Encoder = &e
+	req.Options.Pipeline = name
+	req.Request.Set("X-Mediax-Pipeline", name)
+	return name
+}
@@ -0,0 +1,109 @@
+package mediax
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+	"mediax/apps/media/localfs"
+)
+
+// startCacheCleanup launches a background goroutine that removes the cache
+// directories of deleted projects every MEDIAX.CleanupInterval, starting
+// once at startup.
+func startCacheCleanup() {
+	interval, err := media.ParseDuration(settings.Get("MEDIAX.CleanupInterval", "1h").String())
+	if err != nil || interval <= 0 {
+		log.Warning("invalid MEDIAX.CleanupInterval, using default", "error", err)
+		interval = time.Hour
+	}
+	go func() {
+		cleanupDeletedProjects()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			cleanupDeletedProjects()
+		}
+	}()
+}
+
+// cleanupDeletedProjects removes the cache and warm cache directories of
+// projects deleted more than MEDIAX.DeletedProjectRetention ago. Directories
+// that overlap a directory still in use (the cache of a live project or a
+// local storage) are kept, so a cache_dir shared between projects, or
+// pointing at originals by mistake, is never removed.
+func cleanupDeletedProjects() {
+	retention, err := media.ParseDuration(settings.Get("MEDIAX.DeletedProjectRetention", "7d").String())
+	if err != nil {
+		log.Warning("invalid MEDIAX.DeletedProjectRetention, using default", "error", err)
+		retention = 7 * 24 * time.Hour
+	}
+	var deleted, live []media.Project
+	if err := db.Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-retention)).Find(&deleted).Error; err != nil {
+		log.Error("deleted project cleanup failed", "error", err)
+		return
+	}
+	if len(deleted) == 0 {
+		return
+	}
+	if err := db.Where("deleted_at IS NULL").Find(&live).Error; err != nil {
+		log.Error("deleted project cleanup failed", "error", err)
+		return
+	}
+	var storages []media.Storage
+	if err := db.Where("deleted_at IS NULL AND type = ?", "fs").Find(&storages).Error; err != nil {
+		log.Error("deleted project cleanup failed", "error", err)
+		return
+	}
+
+	var inUse []string
+	for _, p := range live {
+		inUse = append(inUse, p.CacheDir, p.WarmCacheDir)
+	}
+	for _, s := range storages {
+		if fs, err := localfs.New(s.ConfigString); err == nil {
+			inUse = append(inUse, fs.Path)
+		}
+	}
+	for _, p := range deleted {
+		for _, dir := range []string{p.CacheDir, p.WarmCacheDir} {
+			if dir == "" || !filepath.IsAbs(dir) || filepath.Dir(filepath.Clean(dir)) == filepath.Clean(dir) {
+				continue
+			}
+			if overlapsAny(dir, inUse) {
+				log.Warning("keeping cache directory of deleted project still in use", "project", p.Name, "dir", dir)
+				continue
+			}
+			if _, err := os.Stat(dir); err != nil {
+				continue
+			}
+			size, _ := media.DirSize(dir)
+			if err := os.RemoveAll(dir); err != nil {
+				log.Error("removing cache directory of deleted project failed", "project", p.Name, "dir", dir, "error", err)
+				continue
+			}
+			log.Info("removed cache directory of deleted project", "project", p.Name, "dir", dir, "bytes", size)
+		}
+	}
+}
+
+// overlapsAny reports whether dir is one of dirs, or inside or above one of
+// them.
+func overlapsAny(dir string, dirs []string) bool {
+	for _, d := range dirs {
+		if d == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(d); err == nil {
+			d = abs
+		}
+		if media.PathsOverlap(dir, d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,392 @@
+package mediax
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// commands are the CLI subcommands. They reuse the encoders and storage
+// backends without starting the HTTP server.
+var commands = map[string]struct {
+	usage string
+	run   func(ctx context.Context, args []string) error
+}{
+	"convert":         {"convert <input> <output> [w=800&f=webp...]", runConvert},
+	"prewarm":         {"prewarm <host> <path> <query>...", runPrewarm},
+	"purge":           {"purge <host> <path>...", runPurge},
+	"validate-config": {"validate-config", runValidateConfig},
+}
+
+// IsCommand reports whether name is a CLI subcommand.
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// RunCommand runs the CLI subcommand args[0] and returns the process exit
+// code. Commands other than convert need the database, so evo.Setup must
+// have run.
+func RunCommand(args []string) int {
+	cmd := commands[args[0]]
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	// evo flags such as --migration-do are not command arguments.
+	var rest []string
+	for _, a := range args[1:] {
+		if !strings.HasPrefix(a, "--") {
+			rest = append(rest, a)
+		}
+	}
+	if err := cmd.run(ctx, rest); err != nil {
+		fmt.Fprintf(os.Stderr, "mediax %s: %v\n", args[0], err)
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: mediax %s\n", cmd.usage)
+		}
+		return 1
+	}
+	return 0
+}
+
+var errUsage = fmt.Errorf("invalid arguments")
+
+// runConvert processes a local file with the encoder the server would use
+// for the same request and writes the result to output ("-" for stdout).
+func runConvert(_ context.Context, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errUsage
+	}
+	input, output := args[0], args[1]
+	var query neturl.Values
+	if len(args) == 3 {
+		var err error
+		if query, err = neturl.ParseQuery(args[2]); err != nil {
+			return fmt.Errorf("invalid options: %w", err)
+		}
+	}
+	extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(input), "."))
+	mediaType, ok := lookupMediaType(extension)
+	if !ok {
+		return fmt.Errorf("unsupported media type: %s", extension)
+	}
+	options, err := mediaType.ParseQuery(media.QueryValues(query))
+	if err != nil {
+		return err
+	}
+	if options.Profile != "" {
+		return fmt.Errorf("profile needs the database; use prewarm instead")
+	}
+
+	// Encoders write next to the staged file, so work on a private copy.
+	workDir, err := os.MkdirTemp("", "mediax-convert")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+	staged := filepath.Join(workDir, "source"+filepath.Ext(input))
+	if err := copyLocalFile(input, staged); err != nil {
+		return err
+	}
+	project := &media.Project{Name: "cli", CacheDir: workDir}
+	req := media.Request{
+		Origin:           &media.Origin{Project: project},
+		Extension:        extension,
+		MediaType:        mediaType,
+		Options:          options,
+		OriginalFilePath: filepath.Base(input),
+		StagedFilePath:   staged,
+		SourceVersion:    media.SourceVersion(staged),
+	}
+	result := staged
+	if options.Encoder.Processor != nil {
+		if err := runProcessor(options.Encoder, &req); err != nil {
+			return err
+		}
+		if options.Detail && len(req.Metadata) > 0 {
+			data, err := json.MarshalIndent(req.Metadata, "", "  ")
+			if err != nil {
+				return err
+			}
+			return writeOutput(output, strings.NewReader(string(data)+"\n"))
+		}
+		if req.ProcessedFilePath != "" {
+			result = req.ProcessedFilePath
+		}
+	}
+	f, err := os.Open(result)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeOutput(output, f)
+}
+
+// runPrewarm generates variants of a file into the project cache; each
+// query argument is one variant, e.g. "w=300&f=webp".
+func runPrewarm(ctx context.Context, args []string) error {
+	if len(args) < 3 {
+		return errUsage
+	}
+	variants := make([]map[string]string, 0, len(args)-2)
+	for _, q := range args[2:] {
+		values, err := neturl.ParseQuery(q)
+		if err != nil {
+			return fmt.Errorf("invalid variant %q: %w", q, err)
+		}
+		variant := map[string]string{}
+		for k := range values {
+			variant[k] = values.Get(k)
+		}
+		variants = append(variants, variant)
+	}
+	loadConfig()
+	generated, failures := prewarmMedia(ctx, args[0], args[1], variants)
+	fmt.Printf("generated %d of %d variants\n", generated, len(variants))
+	for _, f := range failures {
+		fmt.Println(f)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d variants failed", len(failures))
+	}
+	return nil
+}
+
+// runPurge drops the staged originals of the given paths on host.
+func runPurge(_ context.Context, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	loadConfig()
+	for _, path := range args[1:] {
+		removed, err := purgeMedia(args[0], path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		fmt.Printf("%s: removed %d cache entries\n", path, removed)
+	}
+	return nil
+}
+
+// runValidateConfig checks the origins, projects, storages and video
+// profiles in the database and reports every problem found.
+func runValidateConfig(_ context.Context, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	var problems []string
+	report := func(format string, a ...any) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	var origins []media.Origin
+	if err := db.Preload("Project", "deleted_at IS NULL").Where("deleted_at IS NULL").Find(&origins).Error; err != nil {
+		return err
+	}
+	projects := map[int]*media.Project{}
+	domains := map[string]bool{}
+	for _, o := range origins {
+		domain := strings.ToLower(o.Domain)
+		if domains[domain] {
+			report("origin %d: duplicate domain %q", o.OriginID, o.Domain)
+		}
+		domains[domain] = true
+		if o.Project == nil {
+			report("origin %d (%s): project %d does not exist or is deleted", o.OriginID, o.Domain, o.ProjectID)
+			continue
+		}
+		if _, ok := dialects[o.URLDialect]; o.URLDialect != "" && !ok {
+			report("origin %d (%s): unknown url_dialect %q", o.OriginID, o.Domain, o.URLDialect)
+		}
+		if err := o.ValidateOptions(); err != nil {
+			report("origin %d (%s): %v", o.OriginID, o.Domain, err)
+		}
+		if o.GeoRestricted() && settings.Get("MEDIAX.GeoIPDatabase", "").String() == "" {
+			report("origin %d (%s): country rules need MEDIAX.GeoIPDatabase", o.OriginID, o.Domain)
+		}
+		projects[o.ProjectID] = o.Project
+	}
+
+	var all []media.Project
+	for _, p := range projects {
+		all = append(all, *p)
+	}
+	for _, p := range projects {
+		for _, problem := range validateProject(p, all) {
+			report("project %d (%s): %s", p.ProjectID, p.Name, problem)
+		}
+	}
+
+	var storages []media.Storage
+	if err := db.Where("deleted_at IS NULL").Find(&storages).Error; err != nil {
+		return err
+	}
+	withStorage := map[int]bool{}
+	for i := range storages {
+		s := &storages[i]
+		withStorage[s.ProjectID] = true
+		if err := initStorage(s); err != nil {
+			report("storage %d (%s): %v", s.StorageID, s.Type, err)
+		}
+	}
+	for _, p := range projects {
+		if !withStorage[p.ProjectID] {
+			report("project %d (%s): no storages configured", p.ProjectID, p.Name)
+		}
+	}
+
+	var profiles []media.VideoProfile
+	if err := db.Find(&profiles).Error; err != nil {
+		return err
+	}
+	for _, vp := range profiles {
+		if err := vp.Validate(); err != nil {
+			report("%s", err)
+		}
+	}
+
+	var processors []media.ExternalProcessor
+	if err := db.Where("deleted_at IS NULL").Order("external_processor_id ASC").Find(&processors).Error; err != nil {
+		return err
+	}
+	mu.RLock()
+	err := validateMediaTypes(buildMediaTypes(processors))
+	mu.RUnlock()
+	if err != nil {
+		problems = append(problems, strings.Split(err.Error(), "\n")...)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Printf("configuration ok: %d origins, %d projects, %d storages, %d video profiles\n",
+		len(origins), len(projects), len(storages), len(profiles))
+	return nil
+}
+
+// validateProject returns the configuration problems of p, whose cache
+// directories must not overlap those of the others.
+func validateProject(p *media.Project, others []media.Project) []string {
+	var problems []string
+	for _, f := range [][2]string{{"cache_ttl", p.CacheTTL}, {"stale_if_error", p.StaleIfError}, {"stale_while_revalidate", p.StaleWhileRevalidate}, {"not_found_ttl", p.NotFoundTTL}} {
+		if _, err := media.ParseCacheTTL(f[1]); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s %q", f[0], f[1]))
+		}
+	}
+	if _, err := media.ParseDuration(p.HLSKeyRotation); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid hls_key_rotation %q", p.HLSKeyRotation))
+	}
+	for _, f := range [][2]string{{"cache_size", p.CacheSize}, {"warm_cache_size", p.WarmCacheSize}} {
+		if _, err := media.ParseCacheSize(f[1]); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s %q", f[0], f[1]))
+		}
+	}
+	for _, f := range strings.Split(p.DisabledEncoders, ",") {
+		if f = strings.TrimSpace(f); f != "" && !slices.Contains(media.EncoderFamilies, strings.ToLower(f)) {
+			problems = append(problems, fmt.Sprintf("unknown encoder family %q in disabled_encoders", f))
+		}
+	}
+	if p.ModerationPolicy != "" && !slices.Contains(media.ModerationPolicies, p.ModerationPolicy) {
+		problems = append(problems, fmt.Sprintf("unknown moderation_policy %q", p.ModerationPolicy))
+	}
+	if p.ModerationThreshold < 0 || p.ModerationThreshold > 1 {
+		problems = append(problems, fmt.Sprintf("invalid moderation_threshold %g: must be between 0 and 1", p.ModerationThreshold))
+	}
+	if _, err := p.ImageMetadataFields(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if p.HLSEncryption && p.HLSKeySecret == "" {
+		problems = append(problems, "hls_encryption is on but hls_key_secret is empty")
+	}
+	if p.CacheDir == "" {
+		problems = append(problems, "cache_dir is empty")
+	}
+	if err := p.ValidateCacheDirs(others); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, f := range [][2]string{{"cache_dir", p.CacheDir}, {"warm_cache_dir", p.WarmCacheDir}} {
+		if f[1] == "" {
+			continue
+		}
+		if err := checkWritable(f[1]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s is not writable: %v", f[0], f[1], err))
+		}
+	}
+	return problems
+}
+
+// initStorage validates the config string of s and initializes it.
+func initStorage(s *media.Storage) error {
+	if err := s.ValidateConfig(); err != nil {
+		return err
+	}
+	return s.Init()
+}
+
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".mediax-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// loadConfig loads origins and registers the media routes without starting
+// the HTTP server, so commands can run requests through the same pipeline.
+func loadConfig() {
+	InitializeConfig()
+	App{}.Router() //nolint:errcheck
+}
+
+func copyLocalFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func writeOutput(output string, r io.Reader) error {
+	if output == "-" {
+		_, err := io.Copy(os.Stdout, r)
+		return err
+	}
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
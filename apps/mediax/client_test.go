@@ -0,0 +1,187 @@
+package mediax
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+	"mediax/apps/media/localfs"
+	"mediax/client"
+)
+
+// The tests in this file check mediax/client against the mediax router,
+// served on a local listener with one signed origin over a directory.
+
+const (
+	contractKey  = "contract-signing-key"
+	contractFile = "not really a jpeg"
+)
+
+// contractHost is the host:port of the test server and of its origin.
+var contractHost string
+
+func TestMain(m *testing.M) {
+	os.Exit(runContractServer(m))
+}
+
+func runContractServer(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "mediax-client")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	settings.ConfigPath = filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(settings.ConfigPath, []byte("HTTP:\n  Host: 127.0.0.1\n  DisableStartupMessage: true\n"), 0o644); err != nil {
+		panic(err)
+	}
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "images"), 0o755); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "images", "cat.jpg"), []byte(contractFile), 0o644); err != nil {
+		panic(err)
+	}
+
+	evo.Setup()
+	if err := (App{}).Router(); err != nil {
+		panic(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	contractHost = listener.Addr().String()
+	project := &media.Project{ProjectID: 1, Name: "contract", CacheDir: filepath.Join(dir, "cache")}
+	Origins = map[string]*media.Origin{contractHost: {
+		ProjectID:  1,
+		Project:    project,
+		Domain:     contractHost,
+		SigningKey: contractKey,
+		Storages:   []*media.Storage{{Type: "fs", FS: &localfs.FileSystem{Path: root}}},
+	}}
+	readyOnce.Do(func() { close(ready) })
+	go evo.GetFiber().Listener(listener) //nolint:errcheck
+	defer evo.GetFiber().Shutdown()      //nolint:errcheck
+	return m.Run()
+}
+
+func newContractClient(t *testing.T, cfg client.Config) *client.Client {
+	t.Helper()
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "http://" + contractHost
+	}
+	c, err := client.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// requireStatus fails unless err is a *client.Error with the given status.
+func requireStatus(t *testing.T, err error, status int) {
+	t.Helper()
+	var e *client.Error
+	if !errors.As(err, &e) || e.StatusCode != status {
+		t.Fatalf("got error %v, want status %d", err, status)
+	}
+}
+
+func fetch(t *testing.T, src string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestClientSignedURL(t *testing.T) {
+	signed := newContractClient(t, client.Config{SigningKey: contractKey})
+	src, err := signed.URL("/images/cat.jpg", client.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := fetch(t, src); status != http.StatusOK || body != contractFile {
+		t.Fatalf("signed url: got %d %q", status, body)
+	}
+
+	unsigned := newContractClient(t, client.Config{})
+	src, err = unsigned.URL("/images/cat.jpg", client.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := fetch(t, src); status != http.StatusForbidden {
+		t.Fatalf("unsigned url: got %d, want 403", status)
+	}
+	_, err = unsigned.Metadata(context.Background(), "/images/cat.jpg")
+	requireStatus(t, err, http.StatusForbidden)
+}
+
+func TestClientCacheAdmin(t *testing.T) {
+	ctx := context.Background()
+	c := newContractClient(t, client.Config{SigningKey: contractKey})
+
+	result, err := c.Prewarm(ctx, "/images/cat.jpg", client.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Generated != 1 || len(result.Errors) != 0 {
+		t.Fatalf("prewarm: got %+v", result)
+	}
+
+	stats, err := c.CacheStats(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].ProjectID != 1 || stats[0].Project != "contract" {
+		t.Fatalf("cache stats: got %+v", stats)
+	}
+	if stats[0].TotalFiles != 1 || stats[0].TotalBytes != int64(len(contractFile)) {
+		t.Fatalf("cache stats: prewarmed original not counted: %+v", stats[0])
+	}
+
+	removed, err := c.Purge(ctx, "/images/cat.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed == 0 {
+		t.Fatal("purge: prewarmed original not removed")
+	}
+	if _, err := c.PurgeNegativeCache(ctx, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientUnknownHost(t *testing.T) {
+	c := newContractClient(t, client.Config{BaseURL: "http://" + strings.Replace(contractHost, "127.0.0.1", "localhost", 1)})
+	_, err := c.Purge(context.Background(), "/images/cat.jpg")
+	requireStatus(t, err, http.StatusForbidden)
+}
+
+func TestClientAdminToken(t *testing.T) {
+	settings.Set("MEDIAX.AdminToken", "admin-secret")           //nolint:errcheck
+	t.Cleanup(func() { settings.Set("MEDIAX.AdminToken", "") }) //nolint:errcheck
+	ctx := context.Background()
+
+	_, err := newContractClient(t, client.Config{}).CacheStats(ctx, 0)
+	requireStatus(t, err, http.StatusUnauthorized)
+	_, err = newContractClient(t, client.Config{AdminToken: "wrong"}).CacheStats(ctx, 0)
+	requireStatus(t, err, http.StatusUnauthorized)
+	if _, err := newContractClient(t, client.Config{AdminToken: "admin-secret"}).CacheStats(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+}
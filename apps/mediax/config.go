@@ -36,56 +36,76 @@ var MediaTypes = map[string]*media.Type{
 		Mime:      "image/avif",
 		Encoders:  map[string]*media.Encoder{"jpg": &encoders.Jpeg, "png": &encoders.Png, "gif": &encoders.Gif, "webp": &encoders.Webp, "avif": &encoders.Avif},
 	},
+	"tif": {
+		Extension: "tif",
+		Mime:      "image/tiff",
+		Encoders:  map[string]*media.Encoder{"tif": &encoders.Tiff, "tiff": &encoders.Tiff, "pdf": &encoders.TiffPdf, "jpg": &encoders.Jpeg, "png": &encoders.Png, "gif": &encoders.Gif, "webp": &encoders.Webp, "avif": &encoders.Avif},
+	},
+	"tiff": {
+		Extension: "tiff",
+		Mime:      "image/tiff",
+		Encoders:  map[string]*media.Encoder{"tif": &encoders.Tiff, "tiff": &encoders.Tiff, "pdf": &encoders.TiffPdf, "jpg": &encoders.Jpeg, "png": &encoders.Png, "gif": &encoders.Gif, "webp": &encoders.Webp, "avif": &encoders.Avif},
+	},
 	// Video formats
 	"mp4": {
 		Extension: "mp4",
 		Mime:      "video/mp4",
-		Encoders:  map[string]*media.Encoder{"mp4": &encoders.Mp4, "jpg": &encoders.Mp4, "png": &encoders.Mp4, "webp": &encoders.Mp4, "avif": &encoders.Mp4},
+		Encoders:  map[string]*media.Encoder{"mp4": &encoders.Mp4, "jpg": &encoders.VideoFrame, "png": &encoders.VideoFrame, "webp": &encoders.VideoFrame, "avif": &encoders.VideoFrame},
+		Direct:    &encoders.Mp4Direct,
 	},
 	"webm": {
 		Extension: "webm",
 		Mime:      "video/webm",
-		Encoders:  map[string]*media.Encoder{"webm": &encoders.Webm, "jpg": &encoders.Webm, "png": &encoders.Webm, "webp": &encoders.Webm, "avif": &encoders.Webm},
+		Encoders:  map[string]*media.Encoder{"webm": &encoders.Webm, "jpg": &encoders.VideoFrame, "png": &encoders.VideoFrame, "webp": &encoders.VideoFrame, "avif": &encoders.VideoFrame},
+		Direct:    &encoders.WebmDirect,
 	},
 	"avi": {
 		Extension: "avi",
 		Mime:      "video/x-msvideo",
-		Encoders:  map[string]*media.Encoder{"avi": &encoders.Avi, "jpg": &encoders.Avi, "png": &encoders.Avi, "webp": &encoders.Avi, "avif": &encoders.Avi},
+		Encoders:  map[string]*media.Encoder{"avi": &encoders.Avi, "jpg": &encoders.VideoFrame, "png": &encoders.VideoFrame, "webp": &encoders.VideoFrame, "avif": &encoders.VideoFrame},
+		Direct:    &encoders.AviDirect,
 	},
 	"mov": {
 		Extension: "mov",
 		Mime:      "video/quicktime",
-		Encoders:  map[string]*media.Encoder{"mov": &encoders.Mov, "jpg": &encoders.Mov, "png": &encoders.Mov, "webp": &encoders.Mov, "avif": &encoders.Mov},
+		Encoders:  map[string]*media.Encoder{"mov": &encoders.Mov, "jpg": &encoders.VideoFrame, "png": &encoders.VideoFrame, "webp": &encoders.VideoFrame, "avif": &encoders.VideoFrame},
+		Direct:    &encoders.MovDirect,
 	},
 	"mkv": {
 		Extension: "mkv",
 		Mime:      "video/x-matroska",
-		Encoders:  map[string]*media.Encoder{"mkv": &encoders.Mkv, "jpg": &encoders.Mkv, "png": &encoders.Mkv, "webp": &encoders.Mkv, "avif": &encoders.Mkv},
+		Encoders:  map[string]*media.Encoder{"mkv": &encoders.Mkv, "jpg": &encoders.VideoFrame, "png": &encoders.VideoFrame, "webp": &encoders.VideoFrame, "avif": &encoders.VideoFrame},
+		Direct:    &encoders.MkvDirect,
 	},
 	"flv": {
 		Extension: "flv",
 		Mime:      "video/x-flv",
-		Encoders:  map[string]*media.Encoder{"flv": &encoders.Flv, "jpg": &encoders.Flv, "png": &encoders.Flv, "webp": &encoders.Flv, "avif": &encoders.Flv},
+		Encoders:  map[string]*media.Encoder{"flv": &encoders.Flv, "jpg": &encoders.VideoFrame, "png": &encoders.VideoFrame, "webp": &encoders.VideoFrame, "avif": &encoders.VideoFrame},
+		Direct:    &encoders.FlvDirect,
 	},
 	"wmv": {
 		Extension: "wmv",
 		Mime:      "video/x-ms-wmv",
-		Encoders:  map[string]*media.Encoder{"wmv": &encoders.Wmv, "jpg": &encoders.Wmv, "png": &encoders.Wmv, "webp": &encoders.Wmv, "avif": &encoders.Wmv},
+		Encoders:  map[string]*media.Encoder{"wmv": &encoders.Wmv, "jpg": &encoders.VideoFrame, "png": &encoders.VideoFrame, "webp": &encoders.VideoFrame, "avif": &encoders.VideoFrame},
+		Direct:    &encoders.WmvDirect,
 	},
 	"m4v": {
 		Extension: "m4v",
 		Mime:      "video/x-m4v",
-		Encoders:  map[string]*media.Encoder{"m4v": &encoders.M4v, "jpg": &encoders.M4v, "png": &encoders.M4v, "webp": &encoders.M4v, "avif": &encoders.M4v},
+		Encoders:  map[string]*media.Encoder{"m4v": &encoders.M4v, "jpg": &encoders.VideoFrame, "png": &encoders.VideoFrame, "webp": &encoders.VideoFrame, "avif": &encoders.VideoFrame},
+		Direct:    &encoders.M4vDirect,
 	},
 	"3gp": {
 		Extension: "3gp",
 		Mime:      "video/3gpp",
-		Encoders:  map[string]*media.Encoder{"3gp": &encoders.ThreeGp, "jpg": &encoders.ThreeGp, "png": &encoders.ThreeGp, "webp": &encoders.ThreeGp, "avif": &encoders.ThreeGp},
+		Encoders:  map[string]*media.Encoder{"3gp": &encoders.ThreeGp, "jpg": &encoders.VideoFrame, "png": &encoders.VideoFrame, "webp": &encoders.VideoFrame, "avif": &encoders.VideoFrame},
+		Direct:    &encoders.ThreeGpDirect,
 	},
 	"ogv": {
 		Extension: "ogv",
 		Mime:      "video/ogg",
-		Encoders:  map[string]*media.Encoder{"ogv": &encoders.Ogv, "jpg": &encoders.Ogv, "png": &encoders.Ogv, "webp": &encoders.Ogv, "avif": &encoders.Ogv},
+		Encoders:  map[string]*media.Encoder{"ogv": &encoders.Ogv, "jpg": &encoders.VideoFrame, "png": &encoders.VideoFrame, "webp": &encoders.VideoFrame, "avif": &encoders.VideoFrame},
+		Direct:    &encoders.OgvDirect,
 	},
 	// Audio formats with conversion support
 	"mp3": {
@@ -118,6 +138,11 @@ var MediaTypes = map[string]*media.Type{
 		Mime:      "audio/mp4",
 		Encoders:  map[string]*media.Encoder{"mp3": &encoders.Mp3, "wav": &encoders.Wav, "flac": &encoders.Flac, "aac": &encoders.Aac, "ogg": &encoders.Ogg, "m4a": &encoders.M4a, "wma": &encoders.Wma, "opus": &encoders.Opus, "jpg": &encoders.M4a, "png": &encoders.M4a, "webp": &encoders.M4a, "avif": &encoders.M4a},
 	},
+	"m4b": {
+		Extension: "m4b",
+		Mime:      "audio/mp4",
+		Encoders:  map[string]*media.Encoder{"mp3": &encoders.Mp3, "wav": &encoders.Wav, "flac": &encoders.Flac, "aac": &encoders.Aac, "ogg": &encoders.Ogg, "m4a": &encoders.M4a, "m4b": &encoders.M4b, "wma": &encoders.Wma, "opus": &encoders.Opus, "jpg": &encoders.M4b, "png": &encoders.M4b, "webp": &encoders.M4b, "avif": &encoders.M4b},
+	},
 	"wma": {
 		Extension: "wma",
 		Mime:      "audio/x-ms-wma",
@@ -132,7 +157,7 @@ var MediaTypes = map[string]*media.Type{
 	"pdf": {
 		Extension: "pdf",
 		Mime:      "application/pdf",
-		Encoders:  map[string]*media.Encoder{"pdf": &encoders.Pdf, "jpg": &encoders.Pdf, "png": &encoders.Pdf, "webp": &encoders.Pdf, "avif": &encoders.Pdf},
+		Encoders:  map[string]*media.Encoder{"pdf": &encoders.Pdf, "pdfa": &encoders.PdfA, "tif": &encoders.PdfTiff, "tiff": &encoders.PdfTiff, "jpg": &encoders.Pdf, "png": &encoders.Pdf, "webp": &encoders.Pdf, "avif": &encoders.Pdf},
 	},
 	// Microsoft Office formats
 	"docx": {
@@ -207,6 +232,69 @@ var MediaTypes = map[string]*media.Type{
 	"xml": {
 		Extension: "xml",
 		Mime:      "application/xml",
-		Encoders:  map[string]*media.Encoder{"xml": &encoders.Xml, "jpg": &encoders.Jpeg, "png": &encoders.Png, "webp": &encoders.Png, "avif": &encoders.Png},
-	},
+		Encoders:  map[string]*media.Encoder{"xml": &encoders.Xml, "jpg": &encoders.Xml, "png": &encoders.Xml, "webp": &encoders.Xml, "avif": &encoders.Xml},
+	},
+	// 3D models
+	"glb": {
+		Extension: "glb",
+		Mime:      "model/gltf-binary",
+		Encoders:  map[string]*media.Encoder{"glb": &encoders.Glb, "jpg": &encoders.Glb, "png": &encoders.Glb, "webp": &encoders.Glb, "gif": &encoders.Glb},
+	},
+	"gltf": {
+		Extension: "gltf",
+		Mime:      "model/gltf+json",
+		Encoders:  map[string]*media.Encoder{"gltf": &encoders.Gltf, "jpg": &encoders.Gltf, "png": &encoders.Gltf, "webp": &encoders.Gltf, "gif": &encoders.Gltf},
+	},
+	"obj": {
+		Extension: "obj",
+		Mime:      "model/obj",
+		Encoders:  map[string]*media.Encoder{"obj": &encoders.Obj, "jpg": &encoders.Obj, "png": &encoders.Obj, "webp": &encoders.Obj, "gif": &encoders.Obj},
+	},
+	"stl": {
+		Extension: "stl",
+		Mime:      "model/stl",
+		Encoders:  map[string]*media.Encoder{"stl": &encoders.Stl, "jpg": &encoders.Stl, "png": &encoders.Stl, "webp": &encoders.Stl, "gif": &encoders.Stl},
+	},
+	// Email
+	"eml": {
+		Extension: "eml",
+		Mime:      "message/rfc822",
+		Encoders:  map[string]*media.Encoder{"eml": &encoders.Eml, "pdf": &encoders.Eml, "jpg": &encoders.Eml, "png": &encoders.Eml, "webp": &encoders.Eml},
+	},
+	"msg": {
+		Extension: "msg",
+		Mime:      "application/vnd.ms-outlook",
+		Encoders:  map[string]*media.Encoder{"msg": &encoders.Msg, "pdf": &encoders.Msg, "jpg": &encoders.Msg, "png": &encoders.Msg, "webp": &encoders.Msg},
+	},
+	// Markdown and source code
+	"md":       sourceType("md", "text/markdown", &encoders.Markdown),
+	"markdown": sourceType("markdown", "text/markdown", &encoders.Markdown),
+	"go":       sourceType("go", "text/x-go", &encoders.Code),
+	"py":       sourceType("py", "text/x-python", &encoders.Code),
+	"js":       sourceType("js", "text/javascript", &encoders.Code),
+	"java":     sourceType("java", "text/x-java", &encoders.Code),
+	"c":        sourceType("c", "text/x-c", &encoders.Code),
+	"h":        sourceType("h", "text/x-c", &encoders.Code),
+	"cpp":      sourceType("cpp", "text/x-c++", &encoders.Code),
+	"rs":       sourceType("rs", "text/x-rust", &encoders.Code),
+	"rb":       sourceType("rb", "text/x-ruby", &encoders.Code),
+	"php":      sourceType("php", "application/x-httpd-php", &encoders.Code),
+	"sh":       sourceType("sh", "application/x-sh", &encoders.Code),
+	"sql":      sourceType("sql", "application/sql", &encoders.Code),
+	"css":      sourceType("css", "text/css", &encoders.Code),
+	"yaml":     sourceType("yaml", "application/yaml", &encoders.Code),
+	"yml":      sourceType("yml", "application/yaml", &encoders.Code),
+}
+
+// sourceType is a markdown or source file served as is, or rendered to
+// highlighted html, pdf or an image.
+func sourceType(ext, mime string, source *media.Encoder) *media.Type {
+	return &media.Type{
+		Extension: ext,
+		Mime:      mime,
+		Encoders: map[string]*media.Encoder{
+			ext: source, "html": &encoders.Html, "pdf": source,
+			"jpg": source, "png": source, "webp": source,
+		},
+	}
 }
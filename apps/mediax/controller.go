@@ -2,8 +2,10 @@ package mediax
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/db"
 	"github.com/getevo/evo/v2/lib/log"
 	"github.com/getevo/evo/v2/lib/outcome"
 	"github.com/getevo/evo/v2/lib/text"
@@ -12,8 +14,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/expfmt"
 	"mediax/apps/media"
+	"mediax/encoders"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -26,7 +31,10 @@ func (c Controller) ServeMedia(request *evo.Request) any {
 	// Fiber's /* wildcard catches all GET requests including specific routes.
 	// Handle known non-media paths before blocking on ready.
 	if url.Path == "/health" {
-		return outcome.Json(map[string]string{"status": "ok"})
+		return c.Health(request)
+	}
+	if url.Path == "/openapi.json" {
+		return c.OpenAPI(request)
 	}
 
 	// Pass admin paths through to restify routes.
@@ -38,6 +46,11 @@ func (c Controller) ServeMedia(request *evo.Request) any {
 	// is permanently closed so this is a no-op for every subsequent request.
 	<-ready
 
+	url.Host = requestHost(request)
+	if isS3GatewayHost(url.Host) {
+		return serveS3Gateway(request)
+	}
+
 	var req media.Request
 
 	// Generate trace ID for this request
@@ -61,10 +74,21 @@ func (c Controller) ServeMedia(request *evo.Request) any {
 			Extension: strings.ToLower(filepath.Ext(url.Path)),
 			Debug:     debugEnabled,
 			TraceID:   traceID,
+			Stream:    true,
 		}
 		if len(req.Origin.Storages) == 0 {
 			return outcome.Text("no storages configured for this domain").Status(evo.StatusInternalServerError)
 		}
+		err := verifyURLSignature(&req)
+		if err == nil {
+			err = applyDialect(&req)
+		}
+		if err != nil {
+			if errors.Is(err, errBadSignature) {
+				return outcome.Text(err.Error()).Status(evo.StatusForbidden)
+			}
+			return outcome.Text(err.Error()).Status(evo.StatusBadRequest)
+		}
 		extension, err := GetURLExtension(req.Url.Path)
 		if req.Debug {
 			log.Debug("URL extension parsed", "trace_id", traceID, "extension", extension)
@@ -82,22 +106,34 @@ func (c Controller) ServeMedia(request *evo.Request) any {
 		return outcome.Text("forbidden domain").Status(evo.StatusForbidden)
 	}
 
+	if refused := checkAccess(&req); refused != nil {
+		return refused
+	}
+	apiKey, status, err := authorizeAPIKey(&req)
+	if err != nil {
+		return outcome.Text(err.Error()).Status(status)
+	}
+	defer func() {
+		recordUsage(apiKey, &req)
+		emitServed(apiKey, &req)
+	}()
+	if request.Query("raw").Bool() {
+		return serveRaw(&req)
+	}
+
 	var ok bool
-	if req.MediaType, ok = MediaTypes[req.Extension]; !ok {
+	if req.MediaType, ok = lookupMediaType(req.Extension); !ok {
 		return outcome.Text("unsupported media type").Status(evo.StatusUnsupportedMediaType)
 	}
 
-	options, err := req.MediaType.ParseOptions(request)
+	options, err := ParseOptions(req.MediaType, request.Query, req.Origin)
+	var refused *optionsError
+	if errors.As(err, &refused) {
+		return outcome.Text(refused.Error()).Status(refused.status)
+	}
 	if err != nil {
 		return err
 	}
-	if options.Profile != "" {
-		if vp, ok := lookupVideoProfile(options.Profile); ok {
-			options.VideoProfile = vp
-		} else {
-			return outcome.Text("unknown video profile: " + options.Profile).Status(evo.StatusBadRequest)
-		}
-	}
 	req.Options = options
 	if req.Debug {
 		log.Debug("Media processing details", "trace_id", traceID, "media_type", text.ToJSON(req.MediaType), "options", text.ToJSON(req.Options))
@@ -105,34 +141,92 @@ func (c Controller) ServeMedia(request *evo.Request) any {
 		request.Set("X-Debug-Options", text.ToJSON(req.Options))
 	}
 	req.OriginalFilePath = TrimPrefix(req.Url.Path, req.Origin.PrefixPath)
+	// Keys of encrypted HLS need no source; they share its URL for the
+	// checks above.
+	if options.HLS && request.Query("hls_key").String() != "" {
+		return serveHLSKey(&req)
+	}
+	if budget := request.Header("X-Request-Budget"); budget != "" {
+		d, err := media.ParseDuration(budget)
+		if err != nil || d <= 0 {
+			return outcome.Text("invalid X-Request-Budget: " + budget).Status(evo.StatusBadRequest)
+		}
+		req.Deadline = time.Now().Add(d)
+	}
 
-	//stage the file
-	err = req.StageFile()
+	// Refuse early rather than failing mid-ffmpeg with cryptic write errors.
+	if err = media.EnsureFreeSpace(req.Origin.Project); err != nil {
+		log.Error("cache volume low on space", "trace_id", traceID, "error", err)
+		metricRequests.WithLabelValues(req.Extension, "rejected").Inc()
+		return outcome.Text("insufficient storage space").Status(evo.StatusServiceUnavailable)
+	}
+	if err = media.EnsureCacheQuota(req.Origin.Project); err != nil {
+		log.Error("project cache over quota", "trace_id", traceID, "error", err)
+		metricRequests.WithLabelValues(req.Extension, "rejected").Inc()
+		return outcome.Text("project cache quota exceeded").Status(evo.StatusServiceUnavailable)
+	}
+
+	//stage the file, or a pre-generated variant of the requested output;
+	//single frames read remote sources without staging them
+	pregenerated, err := req.StagePregenerated()
+	if err == nil && !pregenerated && !req.StageRemote() {
+		err = req.StageFile()
+	}
 	if err != nil {
-		if req.StagedFilePath == media.STAGING {
-			req.Request.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-			req.Request.Set("Expires", "0")
-			req.Request.Set("Pragma", "no-cache")
-			req.Request.Set("Location", req.Url.Path+"?"+req.Request.QueryString())
-			req.Request.Status(evo.StatusTemporaryRedirect)
-			return outcome.Response{}
-		}
-		req.Request.Status(evo.StatusNotFound)
-		return fmt.Errorf("file not found: %w", err)
+		return stagingFailed(&req, err)
 	}
+	// Keep eviction away from the original while encoders read it.
+	defer media.AcquireCacheFile(req.StagedFilePath)()
 	if req.Debug {
 		request.Set("X-Debug-Post-Stage", "ok")
 	}
+	if refused := moderate(&req); refused != nil {
+		return refused
+	}
+	if pregenerated {
+		options.Encoder = &media.Encoder{Mime: options.Encoder.Mime}
+	}
+	pipeline := routeCanary(&req)
 	var encoder = options.Encoder
 	if req.Debug {
 		request.Set("X-Debug-Encoder-Processor", fmt.Sprintf("%v", encoder.Processor != nil))
 	}
+	if encoder.Processor != nil && serveStaleVariant(&req) {
+		metricRequests.WithLabelValues(req.Extension, "ok").Inc()
+		return nil
+	}
 	if encoder.Processor != nil {
 		procStart := time.Now()
-		err = encoder.Processor(&req)
+		err = runProcessor(encoder, &req)
 		metricProcessingDuration.WithLabelValues(req.Extension).Observe(time.Since(procStart).Seconds())
+		recordOutput(&req, procStart, pipeline)
+		if errors.Is(err, media.ErrOverloaded) {
+			return overloaded(&req)
+		}
+		if errors.Is(err, encoders.ErrCutoutPending) {
+			request.Set("Retry-After", "5")
+			request.Set("Cache-Control", "no-store")
+			return outcome.Text(err.Error()).Status(evo.StatusAccepted)
+		}
+		if errors.Is(err, encoders.ErrCutoutDisabled) {
+			metricRequests.WithLabelValues(req.Extension, "rejected").Inc()
+			return outcome.Text(err.Error()).Status(evo.StatusNotImplemented)
+		}
+		if errors.Is(err, encoders.ErrMaxBytesUnreachable) {
+			metricRequests.WithLabelValues(req.Extension, "rejected").Inc()
+			return outcome.Text(err.Error()).Status(evo.StatusUnprocessableEntity)
+		}
+		if errors.Is(err, encoders.ErrNoArtwork) {
+			metricRequests.WithLabelValues(req.Extension, "error").Inc()
+			return outcome.Text(err.Error()).Status(evo.StatusNotFound)
+		}
+		if errors.Is(err, media.ErrBudgetExceeded) {
+			metricRequests.WithLabelValues(req.Extension, "rejected").Inc()
+			return outcome.Text(err.Error()).Status(evo.StatusGatewayTimeout)
+		}
 		if err != nil {
 			metricRequests.WithLabelValues(req.Extension, "error").Inc()
+			processingFailed(&req, err)
 			return err
 		}
 
@@ -142,7 +236,7 @@ func (c Controller) ServeMedia(request *evo.Request) any {
 			request.Set("Content-Type", "application/json")
 			request.Status(fiber.StatusOK)
 			metricRequests.WithLabelValues(req.Extension, "ok").Inc()
-			return req.Metadata
+			return withAssetMetadata(&req)
 		}
 
 		// Use ProcessedMimeType if available (e.g., for thumbnails), otherwise use encoder's MIME type
@@ -150,6 +244,20 @@ func (c Controller) ServeMedia(request *evo.Request) any {
 		if req.ProcessedMimeType != "" {
 			mimeType = req.ProcessedMimeType
 		}
+		preload(&req, mimeType)
+
+		// Output still being encoded is sent as it is written: without a
+		// length, ranges or validators, and not for shared caches to keep in
+		// case the encoding fails halfway. Later requests get the cached file.
+		if req.ProcessedStream != nil {
+			request.Set("Content-Type", mimeType)
+			request.Set("Cache-Control", "no-store")
+			req.SetContentDisposition(req.ProcessedFilePath)
+			request.Context.Context().SetBodyStream(req.ProcessedStream, -1)
+			req.RememberVariant(req.ProcessedFilePath, mimeType)
+			metricRequests.WithLabelValues(req.Extension, "ok").Inc()
+			return nil
+		}
 
 		// Resolve the file to serve: fall back to the staged file when the
 		// processor returns nil without setting ProcessedFilePath (e.g. video
@@ -163,21 +271,39 @@ func (c Controller) ServeMedia(request *evo.Request) any {
 			serveFilePath = req.StagedFilePath
 		} else if _, statErr := os.Stat(serveFilePath); statErr != nil {
 			metricRequests.WithLabelValues(req.Extension, "error").Inc()
-			return fmt.Errorf("processor did not produce output file: %w", statErr)
+			err = fmt.Errorf("processor did not produce output file: %w", statErr)
+			processingFailed(&req, err)
+			return err
 		}
 		if req.Debug {
 			request.Set("X-Debug-Final-Serve-Path", serveFilePath)
 			request.Set("X-Debug-Mime-Type", mimeType)
 		}
 
-		err = req.ServeFile(mimeType, serveFilePath)
+		if options.HLS && options.Segment == 0 {
+			err = serveHLSPlaylist(&req, serveFilePath)
+		} else if encryptsHLS(&req) {
+			err = serveEncryptedSegment(&req, serveFilePath)
+		} else if watermarks(&req, mimeType) {
+			err = serveWatermarked(&req, mimeType, serveFilePath, apiKey)
+		} else {
+			err = req.ServeFile(mimeType, serveFilePath)
+		}
 		if err != nil {
 			metricRequests.WithLabelValues(req.Extension, "error").Inc()
 			return err
 		}
+		if !options.HLS {
+			req.RememberVariant(serveFilePath, mimeType)
+		}
 
 	} else {
-		err = req.ServeFile(encoder.Mime, req.StagedFilePath)
+		preload(&req, encoder.Mime)
+		if watermarks(&req, encoder.Mime) {
+			err = serveWatermarked(&req, encoder.Mime, req.StagedFilePath, apiKey)
+		} else {
+			err = req.ServeFile(encoder.Mime, req.StagedFilePath)
+		}
 		if err != nil {
 			metricRequests.WithLabelValues(req.Extension, "error").Inc()
 			return err
@@ -187,6 +313,70 @@ func (c Controller) ServeMedia(request *evo.Request) any {
 	return nil
 }
 
+// stagingFailed answers a request whose source could not be staged: a
+// redirect to retry while it is staged in the background, 413, 503 or 404.
+func stagingFailed(req *media.Request, err error) any {
+	if req.StagedFilePath == media.STAGING {
+		req.Request.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+		req.Request.Set("Expires", "0")
+		req.Request.Set("Pragma", "no-cache")
+		req.Request.Set("Location", req.Request.OriginalURL())
+		req.Request.Status(evo.StatusTemporaryRedirect)
+		return outcome.Response{}
+	}
+	if errors.Is(err, media.ErrSourceTooLarge) {
+		metricRequests.WithLabelValues(req.Extension, "rejected").Inc()
+		return outcome.Text(err.Error()).Status(evo.StatusRequestEntityTooLarge)
+	}
+	if errors.Is(err, media.ErrOverloaded) {
+		return overloaded(req)
+	}
+	media.RecordStagingFailure(req.Origin.Project, req.OriginalFilePath, err)
+	req.Request.Status(evo.StatusNotFound)
+	return fmt.Errorf("file not found: %w", err)
+}
+
+// recordOutput counts the file the processor wrote for req, if it wrote one
+// since start, against the project's cache quota and publishes it as a
+// variant.generated event. Outputs served from the cache are older than
+// start and were counted when written. New outputs of requests in a canary
+// comparison are measured by pipeline (see routeCanary). Outputs of video
+// profiles, new or not, are recorded for regeneration when the profile
+// changes.
+func recordOutput(req *media.Request, start time.Time, pipeline string) {
+	if req.ProcessedFilePath == "" {
+		return
+	}
+	info, err := os.Stat(req.ProcessedFilePath)
+	if err == nil && req.Options.VideoProfile != nil && req.Url != nil {
+		media.RecordProfileVariant(req.Origin.Project, req.Options.VideoProfile.Profile, req.Domain, req.OriginalFilePath, eventOptions(req.Url.QueryString), req.ProcessedFilePath)
+	}
+	if err == nil && !info.ModTime().Before(start.Truncate(time.Second)) {
+		media.RecordCacheWrite(req.ProcessedFilePath, info.Size())
+		media.RecordCacheSource(req.Origin.Project.CacheDir, req.ProcessedFilePath, req.OriginalFilePath)
+		e := requestEvent(media.EventVariantGenerated, req)
+		e.Mime = req.ProcessedMimeType
+		if e.Mime == "" && req.Options != nil && req.Options.Encoder != nil {
+			e.Mime = req.Options.Encoder.Mime
+		}
+		e.Bytes = info.Size()
+		e.Duration = time.Since(start).Seconds()
+		media.Emit(e)
+		if pipeline != "" {
+			format := strings.ToLower(req.Options.OutputFormat)
+			metricPipelineDuration.WithLabelValues(pipeline, format).Observe(e.Duration)
+			metricPipelineOutputBytes.WithLabelValues(pipeline, format).Observe(float64(e.Bytes))
+		}
+	}
+}
+
+// overloaded answers a request whose work was shed by admission control.
+func overloaded(req *media.Request) any {
+	metricRequests.WithLabelValues(req.Extension, "rejected").Inc()
+	req.Request.Set("Retry-After", "5")
+	return outcome.Text(media.ErrOverloaded.Error()).Status(evo.StatusServiceUnavailable)
+}
+
 // PrometheusMetrics serves Prometheus-format metrics at /prometheus/metrics.
 func (c Controller) PrometheusMetrics(request *evo.Request) any {
 	mfs, err := prometheus.DefaultGatherer.Gather()
@@ -205,15 +395,170 @@ func (c Controller) PrometheusMetrics(request *evo.Request) any {
 	return nil
 }
 
+// Health reports "ok", or "degraded" with the storages whose backend failed
+// to initialize. Degraded instances still serve from their other storages.
 func (c Controller) Health(request *evo.Request) any {
-	return outcome.Json(map[string]string{"status": "ok"})
+	unhealthy := media.StorageHealth()
+	if len(unhealthy) == 0 {
+		return outcome.Json(map[string]string{"status": "ok"})
+	}
+	storages := make(map[string]string, len(unhealthy))
+	for id, err := range unhealthy {
+		storages[strconv.Itoa(id)] = err.Error()
+	}
+	return outcome.Json(map[string]any{"status": "degraded", "unhealthy_storages": storages})
 }
 
 func (c Controller) Reload(request *evo.Request) any {
+	// Storages may have changed, so previously missing files may now exist.
+	media.PurgeNegativeCache(0, "")
+	media.PurgeMemoryCache()
 	go InitializeConfig()
 	return outcome.Json(map[string]string{"status": "reloading"})
 }
 
+// projectCacheStats is one project's entry in the /admin/cache/stats response.
+type projectCacheStats struct {
+	ProjectID  int                            `json:"project_id"`
+	Project    string                         `json:"project"`
+	CacheDir   string                         `json:"cache_dir"`
+	TotalFiles int64                          `json:"total_files"`
+	TotalBytes int64                          `json:"total_bytes"`
+	Variants   map[string]*media.VariantStats `json:"variants"`
+	// CollectedAt is when the cache dir was last walked for these numbers.
+	CollectedAt time.Time `json:"collected_at"`
+}
+
+// CacheStats reports per-project cache usage broken down by variant type.
+// Use ?project_id= to limit the report to a single project and ?refresh=true
+// to walk the cache now instead of reusing a recent result.
+func (c Controller) CacheStats(request *evo.Request) any {
+	<-ready
+	filter := request.Query("project_id").Int()
+	refresh := request.Query("refresh").Bool()
+
+	var projects []*media.Project
+	for _, p := range loadedProjects() {
+		if filter == 0 || p.ProjectID == filter {
+			projects = append(projects, p)
+		}
+	}
+
+	var result = make([]projectCacheStats, 0, len(projects))
+	for _, p := range projects {
+		variants, collectedAt, err := media.CacheStats(p.CacheDir, refresh)
+		if err != nil {
+			log.Warning("cache stats walk failed", "project", p.Name, "cache_dir", p.CacheDir, "error", err)
+		}
+		entry := projectCacheStats{ProjectID: p.ProjectID, Project: p.Name, CacheDir: p.CacheDir, Variants: variants, CollectedAt: collectedAt}
+		for _, v := range variants {
+			entry.TotalFiles += v.Files
+			entry.TotalBytes += v.Bytes
+		}
+		result = append(result, entry)
+	}
+	return outcome.Json(result)
+}
+
+// PurgeNegativeCache drops cached not-found results, optionally limited to
+// ?project_id= and ?path= (path relative to the origin prefix).
+func (c Controller) PurgeNegativeCache(request *evo.Request) any {
+	projectID := request.Query("project_id").Int()
+	path := request.Query("path").String()
+	if path != "" && projectID == 0 {
+		return outcome.Text("project_id is required with path").Status(evo.StatusBadRequest)
+	}
+	removed := media.PurgeNegativeCache(projectID, path)
+	return outcome.Json(map[string]int{"purged": removed})
+}
+
+// PurgeMedia drops the staged original of ?path= on ?host= so the next
+// request fetches it from storage again.
+func (c Controller) PurgeMedia(request *evo.Request) any {
+	host := request.Query("host").String()
+	path := request.Query("path").String()
+	if host == "" || path == "" {
+		return outcome.Text("host and path are required").Status(evo.StatusBadRequest)
+	}
+	removed, err := purgeMedia(host, path)
+	if errors.Is(err, errForbiddenDomain) {
+		return outcome.Text(err.Error()).Status(evo.StatusForbidden)
+	}
+	if err != nil {
+		return err
+	}
+	return outcome.Json(map[string]int{"removed": removed})
+}
+
+// prewarmRequest is the body of POST /admin/cache/prewarm. Each variant
+// holds query parameters as accepted by the media URLs.
+type prewarmRequest struct {
+	Host     string              `json:"host"`
+	Path     string              `json:"path"`
+	Variants []map[string]string `json:"variants"`
+}
+
+// Transcodes lists the running ffmpeg transcodes with their progress.
+func (c Controller) Transcodes(request *evo.Request) any {
+	return outcome.Json(encoders.Transcodes())
+}
+
+// CancelTranscode kills the running transcode ?id=.
+func (c Controller) CancelTranscode(request *evo.Request) any {
+	if !encoders.CancelTranscode(request.Query("id").String()) {
+		return outcome.Text("transcode not running").Status(evo.StatusNotFound)
+	}
+	return outcome.Json(map[string]bool{"canceled": true})
+}
+
+// Prewarm generates the listed variants of a file into the cache.
+func (c Controller) Prewarm(request *evo.Request) any {
+	var body prewarmRequest
+	if err := request.BodyParser(&body); err != nil {
+		return outcome.Text("invalid request body").Status(evo.StatusBadRequest)
+	}
+	if body.Host == "" || body.Path == "" || len(body.Variants) == 0 {
+		return outcome.Text("host, path and variants are required").Status(evo.StatusBadRequest)
+	}
+	generated, failures := prewarmMedia(request.Context.Context(), body.Host, body.Path, body.Variants)
+	return outcome.Json(map[string]any{"generated": generated, "errors": failures})
+}
+
+// apiKeyUsage is one key's entry in the /admin/api-keys/usage response.
+type apiKeyUsage struct {
+	media.APIKeyUsage
+	Tenant                 string `json:"tenant"`
+	MonthlyBytes           string `json:"monthly_bytes"`
+	MonthlyTransformations int64  `json:"monthly_transformations"`
+}
+
+// APIKeyUsage reports per-key usage and quotas for ?month=YYYY-MM (default:
+// the current month, including usage not yet written to the database).
+func (c Controller) APIKeyUsage(request *evo.Request) any {
+	month := request.Query("month").String()
+	var usage []media.APIKeyUsage
+	if month == "" || month == media.CurrentMonth() {
+		usage = media.APIKeyUsageThisMonth()
+	} else if err := db.Where("month = ?", month).Find(&usage).Error; err != nil {
+		return err
+	}
+	var keys []media.APIKey
+	if err := db.Where("deleted_at IS NULL").Find(&keys).Error; err != nil {
+		return err
+	}
+	byID := make(map[int]media.APIKey, len(keys))
+	for _, k := range keys {
+		byID[k.APIKeyID] = k
+	}
+	result := make([]apiKeyUsage, 0, len(usage))
+	for _, u := range usage {
+		k := byID[u.APIKeyID]
+		result = append(result, apiKeyUsage{APIKeyUsage: u, Tenant: k.Tenant, MonthlyBytes: k.MonthlyBytes, MonthlyTransformations: k.MonthlyTransformations})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].APIKeyID < result[j].APIKeyID })
+	return outcome.Json(result)
+}
+
 func TrimPrefix(url, prefix string) string {
 	return strings.Trim(strings.TrimPrefix(url, prefix), `\/`)
 }
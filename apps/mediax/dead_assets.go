@@ -0,0 +1,438 @@
+package mediax
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"mediax/apps/media"
+)
+
+const (
+	// deadAssetScanWorkers is the number of assets a scan checks at once.
+	deadAssetScanWorkers = 4
+	// deadAssetScanRetention is how long finished scans stay listed.
+	deadAssetScanRetention = 24 * time.Hour
+	// maxDeadAssetScanErrors caps the errors a scan reports.
+	maxDeadAssetScanErrors = 100
+	// maxDeadAssets caps the assets a scan lists; the counts stay exact.
+	maxDeadAssets = 10000
+)
+
+// Problems of the assets a DeadAssetScan reports.
+const (
+	deadAssetMissing      = "missing"
+	deadAssetCorrupt      = "corrupt"
+	deadAssetUnreferenced = "unreferenced"
+)
+
+// DeadAssetScan is a check of the assets of an origin: that the files a
+// manifest references exist on its storages and, optionally, decode.
+type DeadAssetScan struct {
+	ID           string      `json:"id"`
+	Host         string      `json:"host"`
+	Prefix       string      `json:"prefix"`
+	Probe        bool        `json:"probe"`
+	Status       string      `json:"status"` // running, done, failed or canceled
+	Error        string      `json:"error,omitempty"`
+	StartedAt    time.Time   `json:"started_at"`
+	FinishedAt   *time.Time  `json:"finished_at,omitempty"`
+	Files        int         `json:"files"`      // files found below the prefix
+	Referenced   int         `json:"referenced"` // assets to check: the manifest, or else the files
+	Checked      int         `json:"checked"`
+	Missing      int         `json:"missing"`
+	Corrupt      int         `json:"corrupt"`
+	Unreferenced int         `json:"unreferenced"` // files below the prefix the manifest does not list
+	Failed       int         `json:"failed"`       // assets that could not be checked
+	Errors       []string    `json:"errors,omitempty"`
+	Assets       []DeadAsset `json:"assets"`
+}
+
+// DeadAsset is an asset a DeadAssetScan found missing, corrupt or
+// unreferenced. Path is relative to the storages' base path; Ref is the
+// manifest entry naming it.
+type DeadAsset struct {
+	Path    string `json:"path"`
+	Ref     string `json:"ref,omitempty"`
+	Problem string `json:"problem"`
+	Size    int64  `json:"size,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// runningDeadAssetScan is a DeadAssetScan and the function stopping it.
+type runningDeadAssetScan struct {
+	mu     sync.Mutex
+	info   DeadAssetScan
+	cancel context.CancelFunc
+}
+
+// deadAssetScans holds the running and recently finished scans by ID.
+var deadAssetScans sync.Map
+
+// deadAssetScanRequest is the body of POST /admin/dead-assets.
+type deadAssetScanRequest struct {
+	Host     string            `json:"host"`
+	Prefix   string            `json:"prefix"`
+	Probe    bool              `json:"probe"`
+	Manifest []deadAssetRecord `json:"manifest"`
+}
+
+// deadAssetRecord is a manifest entry: the path or URL of an asset as the
+// database references it and, when known, its size.
+type deadAssetRecord struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// UnmarshalJSON accepts an entry given as a plain string as well.
+func (r *deadAssetRecord) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &r.Path)
+	}
+	type record deadAssetRecord
+	return json.Unmarshal(data, (*record)(r))
+}
+
+// referencedAsset is an asset a scan checks.
+type referencedAsset struct {
+	path  string
+	ref   string
+	size  int64 // expected size, 0 when unknown
+	found bool  // listed below the prefix
+	// foundSize is the size of the file on the storages.
+	foundSize int64
+}
+
+// StartDeadAssetScan checks the assets of an origin, e.g. after a storage
+// migration: the storages are walked below a prefix, every asset of the
+// manifest (or, without one, every file found) is looked up on them and,
+// with probe, decoded. The scan runs in the background; its progress and
+// result are read from GET /admin/dead-assets?id=.
+func (c Controller) StartDeadAssetScan(request *evo.Request) any {
+	<-ready
+	var body deadAssetScanRequest
+	if err := request.BodyParser(&body); err != nil {
+		return outcome.Text("invalid request body").Status(evo.StatusBadRequest)
+	}
+	if body.Host == "" {
+		return outcome.Text("host is required").Status(evo.StatusBadRequest)
+	}
+	origin, ok := lookupOrigin(strings.ToLower(body.Host))
+	if !ok {
+		return outcome.Text(errForbiddenDomain.Error()).Status(evo.StatusForbidden)
+	}
+	var manifest []referencedAsset
+	if body.Manifest != nil {
+		var err error
+		if manifest, err = manifestAssets(origin, body.Manifest); err != nil {
+			return outcome.Text(err.Error()).Status(evo.StatusBadRequest)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	scan := &runningDeadAssetScan{cancel: cancel, info: DeadAssetScan{
+		ID:        uuid.New().String(),
+		Host:      strings.ToLower(body.Host),
+		Prefix:    strings.Trim(body.Prefix, "/"),
+		Probe:     body.Probe,
+		Status:    "running",
+		StartedAt: time.Now(),
+		Assets:    []DeadAsset{},
+	}}
+	deadAssetScans.Store(scan.info.ID, scan)
+	go scan.run(ctx, origin, manifest, body.Manifest != nil)
+	return outcome.Json(scan.snapshot()).Status(evo.StatusAccepted)
+}
+
+// DeadAssetScans lists the scans, newest first, or returns scan ?id=.
+func (c Controller) DeadAssetScans(request *evo.Request) any {
+	if id := request.Query("id").String(); id != "" {
+		v, ok := deadAssetScans.Load(id)
+		if !ok {
+			return outcome.Text("scan not found").Status(evo.StatusNotFound)
+		}
+		return outcome.Json(v.(*runningDeadAssetScan).snapshot())
+	}
+	list := []DeadAssetScan{}
+	deadAssetScans.Range(func(_, v any) bool {
+		list = append(list, v.(*runningDeadAssetScan).snapshot())
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return outcome.Json(list)
+}
+
+// CancelDeadAssetScan stops the running scan ?id=.
+func (c Controller) CancelDeadAssetScan(request *evo.Request) any {
+	v, ok := deadAssetScans.Load(request.Query("id").String())
+	if !ok {
+		return outcome.Text("scan not found").Status(evo.StatusNotFound)
+	}
+	v.(*runningDeadAssetScan).cancel()
+	return outcome.Json(map[string]bool{"canceled": true})
+}
+
+func (s *runningDeadAssetScan) snapshot() DeadAssetScan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := s.info
+	info.Errors = append([]string(nil), s.info.Errors...)
+	info.Assets = append([]DeadAsset{}, s.info.Assets...)
+	return info
+}
+
+// manifestAssets returns the assets of the manifest entries by their path
+// on the storages: URLs and request paths lose the origin's prefix path as
+// requests do. An asset listed twice is checked once.
+func manifestAssets(origin *media.Origin, records []deadAssetRecord) ([]referencedAsset, error) {
+	seen := map[string]bool{}
+	assets := make([]referencedAsset, 0, len(records))
+	for _, r := range records {
+		u, err := url.Parse(r.Path)
+		if err != nil || r.Size < 0 {
+			return nil, fmt.Errorf("invalid manifest entry %q", r.Path)
+		}
+		p := media.CleanAssetPath(TrimPrefix(u.Path, origin.PrefixPath))
+		if p == "" {
+			return nil, fmt.Errorf("invalid manifest entry %q", r.Path)
+		}
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		assets = append(assets, referencedAsset{path: p, ref: r.Path, size: r.Size})
+	}
+	return assets, nil
+}
+
+// run lists the files below the prefix, checks the referenced assets and,
+// with a manifest, reports the files it does not list.
+func (s *runningDeadAssetScan) run(ctx context.Context, origin *media.Origin, manifest []referencedAsset, withManifest bool) {
+	defer s.cancel()
+	files, err := s.list(ctx, origin)
+	if err == nil {
+		assets := manifest
+		if !withManifest {
+			assets = make([]referencedAsset, 0, len(files))
+			for p := range files {
+				assets = append(assets, referencedAsset{path: p})
+			}
+		}
+		for i := range assets {
+			assets[i].foundSize, assets[i].found = files[assets[i].path]
+		}
+		s.mu.Lock()
+		s.info.Referenced = len(assets)
+		s.mu.Unlock()
+		s.check(ctx, origin, assets)
+		if withManifest {
+			s.unreferenced(files, manifest)
+		}
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.info.FinishedAt = &now
+	switch {
+	case errors.Is(err, context.Canceled):
+		s.info.Status = "canceled"
+	case err != nil:
+		s.info.Status = "failed"
+		s.info.Error = err.Error()
+		log.Error("dead asset scan failed", "id", s.info.ID, "host", s.info.Host, "prefix", s.info.Prefix, "error", err)
+	default:
+		s.info.Status = "done"
+	}
+	sort.Slice(s.info.Assets, func(i, j int) bool {
+		a, b := s.info.Assets[i], s.info.Assets[j]
+		if a.Problem != b.Problem {
+			return a.Problem < b.Problem
+		}
+		return a.Path < b.Path
+	})
+	id := s.info.ID
+	time.AfterFunc(deadAssetScanRetention, func() { deadAssetScans.Delete(id) })
+}
+
+// list returns the sizes of the files below the scan's prefix by path, as
+// staging finds them: from the first storage holding them. Storages that
+// cannot be listed, such as HTTP ones, are skipped; their assets are looked
+// up one by one.
+func (s *runningDeadAssetScan) list(ctx context.Context, origin *media.Origin) (map[string]int64, error) {
+	files := map[string]int64{}
+	for _, storage := range origin.Storages {
+		if storage.Type == "http" {
+			continue
+		}
+		err := storage.WalkFiles(ctx, s.info.Prefix, func(p string, size int64) error {
+			if _, ok := files[p]; !ok {
+				files[p] = size
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("storage %d: %w", storage.StorageID, err)
+		}
+	}
+	s.mu.Lock()
+	s.info.Files = len(files)
+	s.mu.Unlock()
+	return files, nil
+}
+
+// check looks up the assets that were not listed on the storages, compares
+// sizes and, with probe, requests each image and video through the regular
+// pipeline.
+func (s *runningDeadAssetScan) check(ctx context.Context, origin *media.Origin, assets []referencedAsset) {
+	jobs := make(chan referencedAsset)
+	var wg sync.WaitGroup
+	for range deadAssetScanWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range jobs {
+				problem, err := s.checkAsset(ctx, origin, &a)
+				if ctx.Err() != nil {
+					continue
+				}
+				s.record(a, problem, err)
+			}
+		}()
+	}
+	for _, a := range assets {
+		select {
+		case jobs <- a:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// checkAsset returns the problem of the asset, if any, with its reason, or
+// only an error when the asset could not be checked. Assets that were not
+// listed get their size from the storages.
+func (s *runningDeadAssetScan) checkAsset(ctx context.Context, origin *media.Origin, a *referencedAsset) (string, error) {
+	if !a.found {
+		size, err := statAsset(origin, a.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return deadAssetMissing, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		a.foundSize = size
+	}
+	if a.foundSize == 0 {
+		return deadAssetCorrupt, errors.New("empty file")
+	}
+	if a.size > 0 && a.foundSize != a.size {
+		return deadAssetCorrupt, fmt.Errorf("size %d, expected %d", a.foundSize, a.size)
+	}
+	if !s.info.Probe {
+		return "", nil
+	}
+	t, ok := lookupMediaType(strings.TrimPrefix(strings.ToLower(path.Ext(a.path)), "."))
+	if !ok || (mediaCategory(t.Mime) != "image" && mediaCategory(t.Mime) != "video") {
+		return "", nil
+	}
+	// Hashing decodes the image, or the keyframes of the video.
+	_, err := fetchPHash(ctx, s.info.Host, path.Join("/", origin.PrefixPath, a.path))
+	switch status.Code(err) {
+	case codes.OK:
+		return "", nil
+	case codes.NotFound:
+		return deadAssetMissing, nil
+	case codes.Internal:
+		return deadAssetCorrupt, errors.New(status.Convert(err).Message())
+	default:
+		return "", errors.New(status.Convert(err).Message())
+	}
+}
+
+// statAsset returns the size of the file at p on the first storage holding
+// it. It returns fs.ErrNotExist only when every storage answered that the
+// file does not exist.
+func statAsset(origin *media.Origin, p string) (int64, error) {
+	var errs []error
+	for _, storage := range origin.Storages {
+		size, err := storage.StatFile(p)
+		if err == nil {
+			return size, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("storage %d: %w", storage.StorageID, err))
+		}
+	}
+	if len(errs) > 0 {
+		return 0, errors.Join(errs...)
+	}
+	return 0, fs.ErrNotExist
+}
+
+// record counts the result of checking a.
+func (s *runningDeadAssetScan) record(a referencedAsset, problem string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info.Checked++
+	switch problem {
+	case deadAssetMissing:
+		s.info.Missing++
+	case deadAssetCorrupt:
+		s.info.Corrupt++
+	case "":
+		if err != nil {
+			s.info.Failed++
+			if len(s.info.Errors) < maxDeadAssetScanErrors {
+				s.info.Errors = append(s.info.Errors, a.path+": "+err.Error())
+			}
+		}
+		return
+	}
+	if len(s.info.Assets) < maxDeadAssets {
+		asset := DeadAsset{Path: a.path, Ref: a.ref, Problem: problem, Size: a.foundSize}
+		if err != nil {
+			asset.Error = err.Error()
+		}
+		s.info.Assets = append(s.info.Assets, asset)
+	}
+}
+
+// unreferenced reports the files below the prefix the manifest does not
+// list.
+func (s *runningDeadAssetScan) unreferenced(files map[string]int64, manifest []referencedAsset) {
+	listed := make(map[string]bool, len(manifest))
+	for _, a := range manifest {
+		listed[a.path] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p, size := range files {
+		if listed[p] {
+			continue
+		}
+		s.info.Unreferenced++
+		if len(s.info.Assets) < maxDeadAssets {
+			s.info.Assets = append(s.info.Assets, DeadAsset{Path: p, Problem: deadAssetUnreferenced, Size: size})
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package mediax
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"mediax/apps/media"
+)
+
+// errBadSignature is returned when a signed dialect URL fails verification.
+var errBadSignature = errors.New("invalid url signature")
+
+// dialectParser translates the part of a URL after the origin prefix into a
+// source path (relative to the prefix) and MediaX query options.
+type dialectParser func(origin *media.Origin, rest string) (source string, query map[string]string, err error)
+
+// dialects lists the foreign URL syntaxes an origin can opt into with
+// url_dialect, so stored imgproxy/Thumbor URLs keep working after migration.
+var dialects = map[string]dialectParser{
+	"imgproxy": parseImgproxyURL,
+	"thumbor":  parseThumborURL,
+}
+
+// applyDialect rewrites req.Url.Path and the request query in place when the
+// origin uses a URL dialect, or when a native URL carries its options in
+// t_ path segments.
+func applyDialect(req *media.Request) error {
+	rest := TrimPrefix(req.Url.Path, req.Origin.PrefixPath)
+	var source string
+	var query map[string]string
+	if parser, ok := dialects[req.Origin.URLDialect]; ok {
+		var err error
+		if source, query, err = parser(req.Origin, rest); err != nil {
+			return err
+		}
+	} else if source, query, ok = parsePathTransforms(rest); !ok {
+		return nil
+	}
+	req.Url.Path = strings.TrimRight(req.Origin.PrefixPath, "/") + "/" + source
+	args := req.Request.Context.Request().URI().QueryArgs()
+	for k, v := range query {
+		args.Set(k, v)
+	}
+	return nil
+}
+
+// sourcePath reduces a dialect source reference (a plain path or a URL such
+// as local:///a.jpg, s3://bucket/a.jpg, https://host/a.jpg) to the path that
+// is looked up in the origin's storages.
+func sourcePath(ref string) string {
+	if strings.Contains(ref, "://") {
+		if u, err := neturl.Parse(ref); err == nil {
+			ref = u.Path
+		}
+	}
+	return strings.Trim(path.Clean("/"+ref), "/")
+}
+
+// gravityDirection maps imgproxy gravity / Thumbor alignment names onto the
+// crop directions understood by the image encoder.
+func gravityDirection(g string) string {
+	switch {
+	case strings.HasPrefix(g, "no"), g == "top":
+		return "top"
+	case strings.HasPrefix(g, "so"), g == "bottom":
+		return "bottom"
+	case g == "we", g == "west", g == "left":
+		return "left"
+	case g == "ea", g == "east", g == "right":
+		return "right"
+	default:
+		return ""
+	}
+}
+
+// ── path transformations ─────────────────────────────────────────────────────
+
+// pathTransformKeys maps the keys accepted in t_ path segments onto MediaX
+// query parameters. Values are passed through unchanged.
+var pathTransformKeys = map[string]string{
+	"w":  "w",
+	"h":  "h",
+	"q":  "q",
+	"f":  "f",
+	"c":  "crop",
+	"ar": "ar",
+	"g":  "dir",
+	"so": "ss",
+	"p":  "profile",
+	"th": "thumbnail",
+	"pv": "preview",
+	"dl": "download",
+}
+
+// parsePathTransforms extracts Cloudinary-style options from leading path
+// segments such as t_w_300,h_200,c_fill,q_80, so options survive CDNs that
+// strip or reorder query strings. Several t_ segments may be chained. A
+// segment with an unknown key is treated as part of the file path.
+func parsePathTransforms(rest string) (string, map[string]string, bool) {
+	segments := strings.Split(rest, "/")
+	query := map[string]string{}
+	n := 0
+	for ; n < len(segments)-1; n++ {
+		spec, ok := strings.CutPrefix(segments[n], "t_")
+		if !ok || !parseTransformSpec(spec, query) {
+			break
+		}
+	}
+	if n == 0 {
+		return "", nil, false
+	}
+	return strings.Join(segments[n:], "/"), query, true
+}
+
+// parseTransformSpec adds the comma-separated key_value pairs of spec to
+// query. It reports false, leaving query untouched, if any pair is invalid.
+func parseTransformSpec(spec string, query map[string]string) bool {
+	parsed := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(pair, "_")
+		name, known := pathTransformKeys[key]
+		if !ok || !known || value == "" {
+			return false
+		}
+		switch key {
+		case "g":
+			value = gravityDirection(value)
+		case "c":
+			// Scaling modes fit inside w x h, keeping the aspect ratio; pad
+			// letterboxes; everything else crops.
+			switch value {
+			case "fit", "scale", "limit":
+				name, value = "fit", "true"
+			case "pad":
+				name, value = "pad", "true"
+			}
+		}
+		parsed[name] = value
+	}
+	for k, v := range parsed {
+		query[k] = v
+	}
+	return true
+}
+
+// ── imgproxy ─────────────────────────────────────────────────────────────────
+
+// parseImgproxyURL handles /%signature/%options/plain/%source[@%ext] and
+// /%signature/%options/%base64_source[.%ext]. Signatures are HMAC-SHA256 over
+// salt + path, keyed and salted with the hex-encoded DialectKey/DialectSalt.
+func parseImgproxyURL(origin *media.Origin, rest string) (string, map[string]string, error) {
+	signature, body, ok := strings.Cut(rest, "/")
+	if !ok || body == "" {
+		return "", nil, fmt.Errorf("malformed imgproxy url")
+	}
+	if origin.DialectKey != "" {
+		if err := verifyImgproxySignature(origin, signature, "/"+body); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var query = map[string]string{}
+	var dpr float64
+	var resizing string
+	segments := strings.Split(body, "/")
+	for i, seg := range segments {
+		if seg == "plain" {
+			source, err := neturl.PathUnescape(strings.Join(segments[i+1:], "/"))
+			if err != nil {
+				return "", nil, fmt.Errorf("malformed imgproxy source: %w", err)
+			}
+			if at := strings.LastIndex(source, "@"); at >= 0 {
+				query["f"] = source[at+1:]
+				source = source[:at]
+			}
+			applyDPR(query, dpr)
+			if err := applyImgproxyResizing(query, resizing); err != nil {
+				return "", nil, err
+			}
+			return sourcePath(source), query, nil
+		}
+		name, args, isOption := strings.Cut(seg, ":")
+		if !isOption {
+			encoded := strings.Join(segments[i:], "")
+			if dot := strings.LastIndex(encoded, "."); dot >= 0 {
+				query["f"] = encoded[dot+1:]
+				encoded = encoded[:dot]
+			}
+			source, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+			if err != nil {
+				return "", nil, fmt.Errorf("malformed imgproxy source: %w", err)
+			}
+			applyDPR(query, dpr)
+			if err := applyImgproxyResizing(query, resizing); err != nil {
+				return "", nil, err
+			}
+			return sourcePath(string(source)), query, nil
+		}
+		params := strings.Split(args, ":")
+		param := func(n int) string {
+			if n < len(params) && params[n] != "0" {
+				return params[n]
+			}
+			return ""
+		}
+		switch name {
+		case "resize", "rs":
+			resizing = params[0]
+			setIf(query, "w", param(1))
+			setIf(query, "h", param(2))
+		case "resizing_type", "rt":
+			resizing = params[0]
+		case "size", "s":
+			setIf(query, "w", param(0))
+			setIf(query, "h", param(1))
+		case "width", "w":
+			setIf(query, "w", param(0))
+		case "height", "h":
+			setIf(query, "h", param(0))
+		case "quality", "q":
+			setIf(query, "q", param(0))
+		case "format", "f", "ext":
+			setIf(query, "f", param(0))
+		case "gravity", "g":
+			setIf(query, "dir", gravityDirection(param(0)))
+		case "dpr":
+			dpr, _ = strconv.ParseFloat(param(0), 64)
+		}
+		// Unsupported options are ignored so existing URLs keep resolving.
+	}
+	return "", nil, fmt.Errorf("imgproxy url has no source")
+}
+
+func verifyImgproxySignature(origin *media.Origin, signature, signedPath string) error {
+	key, err := hex.DecodeString(origin.DialectKey)
+	if err != nil {
+		return fmt.Errorf("invalid imgproxy key for origin %s: %w", origin.Domain, err)
+	}
+	salt, err := hex.DecodeString(origin.DialectSalt)
+	if err != nil {
+		return fmt.Errorf("invalid imgproxy salt for origin %s: %w", origin.Domain, err)
+	}
+	given, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || len(given) < 8 {
+		return errBadSignature
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(signedPath))
+	expected := mac.Sum(nil)
+	// imgproxy may be configured to truncate signatures; compare the prefix.
+	if len(given) > len(expected) || !hmac.Equal(given, expected[:len(given)]) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// applyImgproxyResizing maps an imgproxy resizing type onto the crop mode:
+// fit, the default, keeps the aspect ratio inside w x h; fill and force crop
+// to it. Types without an equivalent (auto, fill-down) are refused rather
+// than served with another meaning.
+func applyImgproxyResizing(query map[string]string, resizing string) error {
+	switch resizing {
+	case "", "fit":
+		if query["w"] != "" && query["h"] != "" {
+			query["fit"] = "true"
+		}
+	case "fill", "force":
+	default:
+		return fmt.Errorf("unsupported imgproxy resizing type %q", resizing)
+	}
+	return nil
+}
+
+// applyDPR scales the requested dimensions by an imgproxy device pixel ratio.
+func applyDPR(query map[string]string, dpr float64) {
+	if dpr <= 0 || dpr == 1 {
+		return
+	}
+	for _, k := range []string{"w", "h"} {
+		if n, err := strconv.Atoi(query[k]); err == nil {
+			query[k] = strconv.Itoa(int(float64(n) * dpr))
+		}
+	}
+}
+
+// ── Thumbor ──────────────────────────────────────────────────────────────────
+
+var (
+	thumborSize   = regexp.MustCompile(`^-?(\d*)x-?(\d*)$`)
+	thumborCrop   = regexp.MustCompile(`^\d+x\d+:\d+x\d+$`)
+	thumborFilter = regexp.MustCompile(`(\w+)\(([^)]*)\)`)
+)
+
+// parseThumborURL handles /%signature/[trim/][AxB:CxD/][fit-in/][WxH/]
+// [halign/][valign/][smart/][filters:.../]%image. Signatures are URL-safe
+// base64 HMAC-SHA1 over everything after the signature, keyed with DialectKey.
+func parseThumborURL(origin *media.Origin, rest string) (string, map[string]string, error) {
+	signature, body, ok := strings.Cut(rest, "/")
+	if !ok || body == "" {
+		return "", nil, fmt.Errorf("malformed thumbor url")
+	}
+	if origin.DialectKey != "" {
+		mac := hmac.New(sha1.New, []byte(origin.DialectKey))
+		mac.Write([]byte(body))
+		expected := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			return "", nil, errBadSignature
+		}
+	}
+
+	var query = map[string]string{}
+	var fit bool
+	segments := strings.Split(body, "/")
+	i := 0
+options:
+	for ; i < len(segments)-1; i++ {
+		seg := segments[i]
+		switch {
+		case seg == "meta", seg == "smart", strings.HasPrefix(seg, "trim"), thumborCrop.MatchString(seg),
+			seg == "middle", seg == "center":
+			// Accepted for compatibility; MediaX has no equivalent.
+		case seg == "fit-in":
+			fit = true
+		case seg == "full-fit-in", seg == "adaptive-fit-in":
+			// Fitting by the other side or orientation would change the size.
+			return "", nil, fmt.Errorf("unsupported thumbor option %q", seg)
+		case thumborSize.MatchString(seg):
+			m := thumborSize.FindStringSubmatch(seg)
+			setIf(query, "w", strings.TrimLeft(m[1], "0"))
+			setIf(query, "h", strings.TrimLeft(m[2], "0"))
+		case seg == "left", seg == "right":
+			if query["dir"] == "" {
+				query["dir"] = seg
+			}
+		case seg == "top", seg == "bottom":
+			query["dir"] = seg
+		case strings.HasPrefix(seg, "filters:"):
+			for _, f := range thumborFilter.FindAllStringSubmatch(seg, -1) {
+				switch f[1] {
+				case "quality":
+					setIf(query, "q", f[2])
+				case "format":
+					setIf(query, "f", strings.ToLower(f[2]))
+				}
+			}
+		default:
+			// First segment that is not an option starts the image path.
+			break options
+		}
+	}
+	source, err := neturl.PathUnescape(strings.Join(segments[i:], "/"))
+	if err != nil || source == "" {
+		return "", nil, fmt.Errorf("malformed thumbor image path")
+	}
+	// Without fit-in, Thumbor crops to the size like MediaX does.
+	if fit && query["w"] != "" && query["h"] != "" {
+		query["fit"] = "true"
+	}
+	return sourcePath(source), query, nil
+}
+
+func setIf(query map[string]string, key, value string) {
+	if value != "" {
+		query[key] = value
+	}
+}
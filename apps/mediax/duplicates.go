@@ -0,0 +1,361 @@
+package mediax
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/status"
+	"mediax/apps/media"
+	"mediax/encoders"
+)
+
+const (
+	// duplicateScanWorkers is the number of files a scan hashes at once.
+	duplicateScanWorkers = 4
+	// duplicateScanRetention is how long finished scans stay listed.
+	duplicateScanRetention = 24 * time.Hour
+	// maxDuplicateScanErrors caps the errors a scan reports.
+	maxDuplicateScanErrors = 100
+	// defaultDuplicateThreshold is the Hamming distance up to which two
+	// hashes count as the same picture when the request gives none.
+	defaultDuplicateThreshold = 8
+)
+
+// DuplicateScan is a scan of a storage prefix for perceptual duplicates.
+type DuplicateScan struct {
+	ID         string           `json:"id"`
+	Host       string           `json:"host"`
+	Prefix     string           `json:"prefix"`
+	Threshold  int              `json:"threshold"`
+	Status     string           `json:"status"` // running, done, failed or canceled
+	Error      string           `json:"error,omitempty"`
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Files      int              `json:"files"`  // images and videos found
+	Hashed     int              `json:"hashed"` // files hashed so far
+	Failed     int              `json:"failed"`
+	Errors     []string         `json:"errors,omitempty"`
+	Groups     []DuplicateGroup `json:"groups"`
+}
+
+// DuplicateGroup is a set of files whose hashes are within the scan's
+// threshold of each other, directly or through other members.
+type DuplicateGroup struct {
+	Files []DuplicateFile `json:"files"`
+}
+
+// DuplicateFile is a member of a DuplicateGroup.
+type DuplicateFile struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	PHash string `json:"phash"`
+}
+
+// runningScan is a DuplicateScan and the function stopping it.
+type runningScan struct {
+	mu     sync.Mutex
+	info   DuplicateScan
+	cancel context.CancelFunc
+}
+
+// duplicateScans holds the running and recently finished scans by ID.
+var duplicateScans sync.Map
+
+// duplicateScanRequest is the body of POST /admin/duplicates.
+type duplicateScanRequest struct {
+	Host      string `json:"host"`
+	Prefix    string `json:"prefix"`
+	Threshold int    `json:"threshold"`
+}
+
+// StartDuplicateScan scans the storages of an origin below a prefix for
+// images and videos that look alike. The scan runs in the background; its
+// progress and result are read from GET /admin/duplicates?id=.
+func (c Controller) StartDuplicateScan(request *evo.Request) any {
+	<-ready
+	var body duplicateScanRequest
+	if err := request.BodyParser(&body); err != nil {
+		return outcome.Text("invalid request body").Status(evo.StatusBadRequest)
+	}
+	if body.Host == "" {
+		return outcome.Text("host is required").Status(evo.StatusBadRequest)
+	}
+	if body.Threshold == 0 {
+		body.Threshold = defaultDuplicateThreshold
+	}
+	if body.Threshold < 0 || body.Threshold > 32 {
+		return outcome.Text("threshold must be between 1 and 32").Status(evo.StatusBadRequest)
+	}
+	origin, ok := lookupOrigin(strings.ToLower(body.Host))
+	if !ok {
+		return outcome.Text(errForbiddenDomain.Error()).Status(evo.StatusForbidden)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	scan := &runningScan{cancel: cancel, info: DuplicateScan{
+		ID:        uuid.New().String(),
+		Host:      strings.ToLower(body.Host),
+		Prefix:    strings.Trim(body.Prefix, "/"),
+		Threshold: body.Threshold,
+		Status:    "running",
+		StartedAt: time.Now(),
+		Groups:    []DuplicateGroup{},
+	}}
+	duplicateScans.Store(scan.info.ID, scan)
+	go scan.run(ctx, origin)
+	return outcome.Json(scan.snapshot()).Status(evo.StatusAccepted)
+}
+
+// DuplicateScans lists the scans, newest first, or returns scan ?id=.
+func (c Controller) DuplicateScans(request *evo.Request) any {
+	if id := request.Query("id").String(); id != "" {
+		v, ok := duplicateScans.Load(id)
+		if !ok {
+			return outcome.Text("scan not found").Status(evo.StatusNotFound)
+		}
+		return outcome.Json(v.(*runningScan).snapshot())
+	}
+	list := []DuplicateScan{}
+	duplicateScans.Range(func(_, v any) bool {
+		list = append(list, v.(*runningScan).snapshot())
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return outcome.Json(list)
+}
+
+// CancelDuplicateScan stops the running scan ?id=.
+func (c Controller) CancelDuplicateScan(request *evo.Request) any {
+	v, ok := duplicateScans.Load(request.Query("id").String())
+	if !ok {
+		return outcome.Text("scan not found").Status(evo.StatusNotFound)
+	}
+	v.(*runningScan).cancel()
+	return outcome.Json(map[string]bool{"canceled": true})
+}
+
+func (s *runningScan) snapshot() DuplicateScan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := s.info
+	info.Errors = append([]string(nil), s.info.Errors...)
+	return info
+}
+
+// hashedFile is a scanned file and its hashes: one for images, one per
+// keyframe for videos.
+type hashedFile struct {
+	DuplicateFile
+	hashes []uint64
+}
+
+// run lists the files, hashes them through the regular pipeline (so
+// hashes are cached like any phash=1 request) and groups the duplicates.
+func (s *runningScan) run(ctx context.Context, origin *media.Origin) {
+	defer s.cancel()
+	files, err := s.list(ctx, origin)
+	var hashed []hashedFile
+	if err == nil {
+		hashed = s.hash(ctx, origin, files)
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.info.FinishedAt = &now
+	switch {
+	case errors.Is(err, context.Canceled):
+		s.info.Status = "canceled"
+	case err != nil:
+		s.info.Status = "failed"
+		s.info.Error = err.Error()
+		log.Error("duplicate scan failed", "id", s.info.ID, "host", s.info.Host, "prefix", s.info.Prefix, "error", err)
+	default:
+		s.info.Status = "done"
+		s.info.Groups = groupDuplicates(hashed, s.info.Threshold)
+	}
+	id := s.info.ID
+	time.AfterFunc(duplicateScanRetention, func() { duplicateScans.Delete(id) })
+}
+
+// list returns the images and videos below the scan's prefix. A path found
+// in several storages is listed once, as staging takes it from the first.
+func (s *runningScan) list(ctx context.Context, origin *media.Origin) ([]DuplicateFile, error) {
+	seen := map[string]bool{}
+	var files []DuplicateFile
+	for _, storage := range origin.Storages {
+		err := storage.WalkFiles(ctx, s.info.Prefix, func(p string, size int64) error {
+			if seen[p] {
+				return nil
+			}
+			t, ok := lookupMediaType(strings.TrimPrefix(strings.ToLower(path.Ext(p)), "."))
+			if !ok || (mediaCategory(t.Mime) != "image" && mediaCategory(t.Mime) != "video") {
+				return nil
+			}
+			seen[p] = true
+			files = append(files, DuplicateFile{Path: p, Size: size})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("storage %d: %w", storage.StorageID, err)
+		}
+	}
+	s.mu.Lock()
+	s.info.Files = len(files)
+	s.mu.Unlock()
+	return files, nil
+}
+
+// hash requests phash=1 of each file; failures are counted and the file
+// left out of the comparison.
+func (s *runningScan) hash(ctx context.Context, origin *media.Origin, files []DuplicateFile) []hashedFile {
+	jobs := make(chan DuplicateFile)
+	var mu sync.Mutex
+	var hashed []hashedFile
+	var wg sync.WaitGroup
+	for range duplicateScanWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				h, err := fetchPHash(ctx, s.info.Host, path.Join("/", origin.PrefixPath, f.Path))
+				if ctx.Err() != nil {
+					continue
+				}
+				s.mu.Lock()
+				if err != nil {
+					s.info.Failed++
+					if len(s.info.Errors) < maxDuplicateScanErrors {
+						s.info.Errors = append(s.info.Errors, f.Path+": "+err.Error())
+					}
+				} else {
+					s.info.Hashed++
+				}
+				s.mu.Unlock()
+				if err == nil {
+					f.PHash = h.Hash
+					mu.Lock()
+					hashed = append(hashed, hashedFile{DuplicateFile: f, hashes: parsePHashes(h)})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, f := range files {
+		select {
+		case jobs <- f:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return hashed
+}
+
+// fetchPHash runs GET uri?phash=1 on host in-process.
+func fetchPHash(ctx context.Context, host, uri string) (*encoders.PHash, error) {
+	resp, err := serveInternal(ctx, host, uri, map[string]string{"phash": "1"})
+	if err != nil {
+		return nil, errors.New(status.Convert(err).Message())
+	}
+	defer resp.CloseBodyStream() //nolint:errcheck
+	var h encoders.PHash
+	if err := json.Unmarshal(resp.Body(), &h); err != nil {
+		return nil, fmt.Errorf("invalid phash response: %w", err)
+	}
+	return &h, nil
+}
+
+// parsePHashes returns the keyframe hashes of a video, or the hash of an
+// image.
+func parsePHashes(h *encoders.PHash) []uint64 {
+	var hashes []uint64
+	if len(h.Keyframes) == 0 {
+		if v, err := strconv.ParseUint(h.Hash, 16, 64); err == nil {
+			hashes = append(hashes, v)
+		}
+		return hashes
+	}
+	for _, k := range h.Keyframes {
+		if v, err := strconv.ParseUint(k.Hash, 16, 64); err == nil {
+			hashes = append(hashes, v)
+		}
+	}
+	return hashes
+}
+
+// phashDistance is the Hamming distance of two images, or the mean distance
+// of the corresponding keyframes of two videos. Images are never compared
+// with videos.
+func phashDistance(a, b []uint64) (int, bool) {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0, false
+	}
+	total := 0
+	for i := range a {
+		total += bits.OnesCount64(a[i] ^ b[i])
+	}
+	return total / len(a), true
+}
+
+// groupDuplicates joins files within threshold of each other into groups
+// of two or more, largest groups first. Every pair is compared, which is
+// fine for the tens of thousands of files a prefix usually holds.
+func groupDuplicates(files []hashedFile, threshold int) []DuplicateGroup {
+	parent := make([]int, len(files))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range files {
+		for j := i + 1; j < len(files); j++ {
+			if d, ok := phashDistance(files[i].hashes, files[j].hashes); ok && d <= threshold {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	members := map[int][]DuplicateFile{}
+	for i, f := range files {
+		root := find(i)
+		members[root] = append(members[root], f.DuplicateFile)
+	}
+	groups := []DuplicateGroup{}
+	for _, m := range members {
+		if len(m) < 2 {
+			continue
+		}
+		sort.Slice(m, func(i, j int) bool { return m[i].Path < m[j].Path })
+		groups = append(groups, DuplicateGroup{Files: m})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if len(groups[i].Files) != len(groups[j].Files) {
+			return len(groups[i].Files) > len(groups[j].Files)
+		}
+		return groups[i].Files[0].Path < groups[j].Files[0].Path
+	})
+	return groups
+}
@@ -0,0 +1,66 @@
+package mediax
+
+import (
+	"net/url"
+
+	"github.com/getevo/evo/v2"
+	"mediax/apps/media"
+)
+
+// requestEvent returns an event of type typ about the asset of req.
+func requestEvent(typ string, req *media.Request) media.Event {
+	e := media.Event{
+		Type:    typ,
+		Project: req.Origin.Project.Name,
+		Domain:  req.Domain,
+		Path:    req.OriginalFilePath,
+		TraceID: req.TraceID,
+	}
+	if req.Url != nil {
+		e.Options = eventOptions(req.Url.QueryString)
+	}
+	return e
+}
+
+// eventOptions returns query without the parameters that authorize the
+// request rather than select the output.
+func eventOptions(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return ""
+	}
+	for _, key := range []string{"s", "expires", "api_key"} {
+		values.Del(key)
+	}
+	return values.Encode()
+}
+
+// emitServed publishes an asset.served event for req once its response is
+// complete, for the same responses recordUsage counts.
+func emitServed(key *media.APIKey, req *media.Request) {
+	if req.Origin == nil {
+		return
+	}
+	resp := req.Request.Context.Response()
+	status := resp.StatusCode()
+	if status != evo.StatusOK && status != evo.StatusPartialContent {
+		return
+	}
+	e := requestEvent(media.EventAssetServed, req)
+	e.Status = status
+	e.Mime = string(resp.Header.ContentType())
+	e.Bytes = int64(max(resp.Header.ContentLength(), 0))
+	if key != nil {
+		e.Tenant = key.Tenant
+	}
+	media.Emit(e)
+}
+
+// processingFailed records err, the failure of the encoder of req, for the
+// project's error report and publishes it as a processing.failed event.
+func processingFailed(req *media.Request, err error) {
+	media.RecordProcessingFailure(req.Origin.Project, req.OriginalFilePath, err)
+	e := requestEvent(media.EventProcessingFailed, req)
+	e.Error = err.Error()
+	media.Emit(e)
+}
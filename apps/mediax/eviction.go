@@ -2,18 +2,24 @@ package mediax
 
 import (
 	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
 	"mediax/apps/media"
 	"time"
 )
 
 // startEvictionLoop launches a background goroutine that periodically checks
 // every project's cache directory and removes the oldest files when the
-// configured cache size limit is exceeded.
+// configured cache size limit is exceeded. The period is MEDIAX.EvictionInterval.
 // It also runs once immediately on startup so the cache is clean from the start.
 func startEvictionLoop() {
+	interval, err := media.ParseDuration(settings.Get("MEDIAX.EvictionInterval", "5m").String())
+	if err != nil || interval <= 0 {
+		log.Warning("invalid MEDIAX.EvictionInterval, using default", "error", err)
+		interval = 5 * time.Minute
+	}
 	go func() {
 		runEviction()
-		ticker := time.NewTicker(5 * time.Minute)
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 		for range ticker.C {
 			runEviction()
@@ -21,14 +27,44 @@ func startEvictionLoop() {
 	}()
 }
 
+// migrateCacheLayout moves derived files written before cache sharding into
+// their shard directories, once per distinct project cache directory.
+func migrateCacheLayout() {
+	mu.RLock()
+	dirs := map[string]string{}
+	for _, o := range Origins {
+		if o.Project != nil && o.Project.CacheDir != "" {
+			dirs[o.Project.CacheDir] = o.Project.Name
+		}
+	}
+	mu.RUnlock()
+
+	for dir, project := range dirs {
+		moved, err := media.MigrateFlatCache(dir)
+		if err != nil {
+			log.Error("cache layout migration failed", "project", project, "cache_dir", dir, "error", err)
+			continue
+		}
+		if moved > 0 {
+			log.Info("cache layout migrated", "project", project, "files_moved", moved)
+		}
+	}
+}
+
 // runEviction iterates over all currently-loaded projects (under read-lock),
-// reports the current cache size to Prometheus, and evicts files when over limit.
+// reports the current cache size to Prometheus, and evicts files when over
+// the high watermark.
 func runEviction() {
+	high, low := media.EvictionWatermarks()
+
 	mu.RLock()
 	type projectInfo struct {
 		name     string
 		cacheDir string
 		maxBytes int64
+		warmDir  string
+		warmMax  int64
+		policy   media.EvictionPolicy
 	}
 	seen := map[int]bool{}
 	var projects []projectInfo
@@ -45,38 +81,91 @@ func runEviction() {
 		if err != nil || maxBytes == 0 {
 			continue
 		}
+		warmMax, _ := media.ParseCacheSize(o.Project.WarmCacheSize)
 		projects = append(projects, projectInfo{
 			name:     o.Project.Name,
 			cacheDir: o.Project.CacheDir,
 			maxBytes: maxBytes,
+			warmDir:  o.Project.WarmCacheDir,
+			warmMax:  warmMax,
+			policy:   o.Project.EvictionPolicy(),
 		})
 	}
 	mu.RUnlock()
 
 	for _, p := range projects {
 		// Report current size before eviction.
-		if sz, err := media.DirSize(p.cacheDir); err == nil {
-			media.MetricCacheSizeBytes.WithLabelValues(p.name).Set(float64(sz))
-		}
-
-		removed, freed, err := media.EvictCache(p.cacheDir, p.maxBytes)
+		sz, err := media.DirSize(p.cacheDir)
 		if err != nil {
-			log.Error("cache eviction failed", "project", p.name, "cache_dir", p.cacheDir, "error", err)
 			continue
 		}
-		if removed > 0 {
-			log.Info("cache eviction completed",
-				"project", p.name,
-				"files_removed", removed,
-				"bytes_freed", freed,
-			)
-			media.MetricCacheEvictedFilesTotal.WithLabelValues(p.name).Add(float64(removed))
-			media.MetricCacheEvictedBytesTotal.WithLabelValues(p.name).Add(float64(freed))
+		media.MetricCacheSizeBytes.WithLabelValues(p.name).Set(float64(sz))
+		media.SetCacheUsage(p.cacheDir, sz)
 
+		if sz > int64(float64(p.maxBytes)*high) {
+			target := int64(float64(p.maxBytes) * low)
+			if p.warmDir != "" {
+				demoteProject(p.name, p.cacheDir, p.warmDir, target, p.policy)
+			} else {
+				evictDir(p.name, p.cacheDir, target, p.policy, "cache size")
+			}
 			// Update the gauge to reflect the post-eviction size.
 			if sz, err := media.DirSize(p.cacheDir); err == nil {
 				media.MetricCacheSizeBytes.WithLabelValues(p.name).Set(float64(sz))
+				media.SetCacheUsage(p.cacheDir, sz)
 			}
 		}
+
+		if p.warmDir == "" {
+			continue
+		}
+		warmSize, err := media.DirSize(p.warmDir)
+		if err != nil {
+			continue
+		}
+		if p.warmMax > 0 && warmSize > int64(float64(p.warmMax)*high) {
+			evictDir(p.name, p.warmDir, int64(float64(p.warmMax)*low), p.policy, "warm cache size")
+			warmSize, _ = media.DirSize(p.warmDir)
+		}
+		media.MetricWarmCacheSizeBytes.WithLabelValues(p.name).Set(float64(warmSize))
+	}
+}
+
+// evictDir removes files from dir until it is back under target bytes.
+// reason is published with the cache.evicted event.
+func evictDir(project, dir string, target int64, policy media.EvictionPolicy, reason string) {
+	removed, freed, err := media.EvictCache(dir, target, policy)
+	if err != nil {
+		log.Error("cache eviction failed", "project", project, "cache_dir", dir, "error", err)
+		return
+	}
+	if removed > 0 {
+		log.Info("cache eviction completed",
+			"project", project,
+			"cache_dir", dir,
+			"files_removed", removed,
+			"bytes_freed", freed,
+		)
+		media.MetricCacheEvictedFilesTotal.WithLabelValues(project).Add(float64(removed))
+		media.MetricCacheEvictedBytesTotal.WithLabelValues(project).Add(float64(freed))
+		media.Emit(media.Event{Type: media.EventCacheEvicted, Project: project, Files: removed, Bytes: freed, Reason: reason})
+	}
+}
+
+// demoteProject moves files from the hot cache dir to the warm tier until
+// the hot dir is back under target bytes.
+func demoteProject(project, hotDir, warmDir string, target int64, policy media.EvictionPolicy) {
+	moved, bytes, err := media.DemoteCache(hotDir, warmDir, target, policy)
+	if err != nil {
+		log.Error("cache demotion failed", "project", project, "cache_dir", hotDir, "warm_cache_dir", warmDir, "error", err)
+		return
+	}
+	if moved > 0 {
+		log.Info("cache demotion completed",
+			"project", project,
+			"files_moved", moved,
+			"bytes_moved", bytes,
+		)
+		media.MetricCacheDemotedFilesTotal.WithLabelValues(project).Add(float64(moved))
 	}
 }
@@ -0,0 +1,221 @@
+package mediax
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// failureReportAssets is how many assets a report lists per project unless
+// ?assets= asks for another number.
+const failureReportAssets = 50
+
+// failureReportCheck is how often instances check whether the reports of
+// the previous day are due, and retry a failed delivery.
+const failureReportCheck = 5 * time.Minute
+
+// FailureReport serves the processing failures of ?day (YYYY-MM-DD, UTC;
+// default today) per project, optionally only of ?project_id: by category
+// and the ?assets assets that failed most. Failures are written every
+// MEDIAX.UsageSyncInterval, so the most recent ones may be missing.
+func (c Controller) FailureReport(request *evo.Request) any {
+	day := request.Query("day").String()
+	if day == "" {
+		day = time.Now().UTC().Format(time.DateOnly)
+	}
+	if _, err := time.Parse(time.DateOnly, day); err != nil {
+		return outcome.Text("invalid date " + day + ": expected YYYY-MM-DD").Status(evo.StatusBadRequest)
+	}
+	assets := failureReportAssets
+	if v := request.Query("assets").String(); v != "" {
+		assets = request.Query("assets").Int()
+		if assets < 0 || assets > listingMaxLimit {
+			return outcome.Text(fmt.Sprintf("invalid assets %q: must be between 0 and %d", v, listingMaxLimit)).Status(evo.StatusBadRequest)
+		}
+	}
+	reports, err := media.FailureReports(day, request.Query("project_id").Int(), assets)
+	if err != nil {
+		return err
+	}
+	return outcome.Json(reports)
+}
+
+// startFailureReports sends the failure reports of each day, once the
+// following day reaches MEDIAX.ErrorReportTime (UTC), to
+// MEDIAX.ErrorReportWebhook and MEDIAX.ErrorReportEmail. One instance sends
+// them; a failed delivery is retried every failureReportCheck. Days without
+// failures send nothing.
+func startFailureReports() {
+	go func() {
+		var sent string
+		ticker := time.NewTicker(failureReportCheck)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			day, due := failureReportDue(time.Now().UTC())
+			if !due || day == sent {
+				continue
+			}
+			if err := sendFailureReports(day); err != nil {
+				log.Error("failure report delivery failed", "day", day, "error", err)
+				continue
+			}
+			sent = day
+		}
+	}()
+}
+
+// failureReportDue returns the day whose reports are sent at now and
+// whether they are due: delivery is configured and ErrorReportTime passed.
+func failureReportDue(now time.Time) (string, bool) {
+	if settings.Get("MEDIAX.ErrorReportWebhook", "").String() == "" && settings.Get("MEDIAX.ErrorReportEmail", "").String() == "" {
+		return "", false
+	}
+	at := settings.Get("MEDIAX.ErrorReportTime", "06:00").String()
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		log.Warning("invalid MEDIAX.ErrorReportTime, using 06:00", "value", at)
+		t, _ = time.Parse("15:04", "06:00")
+	}
+	midnight := now.Truncate(24 * time.Hour)
+	if now.Before(midnight.Add(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute)) {
+		return "", false
+	}
+	return midnight.AddDate(0, 0, -1).Format(time.DateOnly), true
+}
+
+// sendFailureReports delivers the reports of day unless another instance
+// claimed them.
+func sendFailureReports(day string) error {
+	// Failures of this instance belong in the report too.
+	if err := media.SyncProcessingFailures(); err != nil {
+		return err
+	}
+	claimed, err := media.ClaimFailureReport(day)
+	if err != nil || !claimed {
+		return err
+	}
+	reports, err := media.FailureReports(day, 0, failureReportAssets)
+	if err == nil && len(reports) > 0 {
+		err = deliverFailureReports(day, reports)
+	}
+	if err != nil {
+		if releaseErr := media.ReleaseFailureReport(day); releaseErr != nil {
+			log.Error("cannot release failure report claim", "day", day, "error", releaseErr)
+		}
+		return err
+	}
+	log.Info("failure reports sent", "day", day, "projects", len(reports))
+	return nil
+}
+
+// deliverFailureReports posts the reports to the webhook and mails them to
+// the recipients that are configured.
+func deliverFailureReports(day string, reports []media.FailureReport) error {
+	var errs []error
+	if webhook := settings.Get("MEDIAX.ErrorReportWebhook", "").String(); webhook != "" {
+		if err := postFailureReports(webhook, day, reports); err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		}
+	}
+	if recipients := settings.Get("MEDIAX.ErrorReportEmail", "").String(); recipients != "" {
+		if err := mailFailureReports(recipients, day, reports); err != nil {
+			errs = append(errs, fmt.Errorf("email: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// postFailureReports posts {"day": ..., "reports": [...]} to url.
+func postFailureReports(url, day string, reports []media.FailureReport) error {
+	body, err := json.Marshal(map[string]any{"day": day, "reports": reports})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) //nolint:errcheck
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
+
+// mailFailureReports mails the reports as plain text to the comma-separated
+// recipients through MEDIAX.SMTPAddress (host:port), authenticating with
+// MEDIAX.SMTPUsername and MEDIAX.SMTPPassword when set.
+func mailFailureReports(recipients, day string, reports []media.FailureReport) error {
+	addr := settings.Get("MEDIAX.SMTPAddress", "").String()
+	if addr == "" {
+		return errors.New("MEDIAX.SMTPAddress is not set")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid MEDIAX.SMTPAddress: %w", err)
+	}
+	from := settings.Get("MEDIAX.SMTPFrom", "mediax@"+host).String()
+	var to []string
+	for _, r := range strings.Split(recipients, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			to = append(to, r)
+		}
+	}
+	var auth smtp.Auth
+	if user := settings.Get("MEDIAX.SMTPUsername", "").String(); user != "" {
+		auth = smtp.PlainAuth("", user, settings.Get("MEDIAX.SMTPPassword", "").String(), host)
+	}
+
+	var total int64
+	for _, r := range reports {
+		total += r.Failures
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: MediaX processing failures on %s: %d\r\n", day, total)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(failureReportText(reports), "\n", "\r\n"))
+	return smtp.SendMail(addr, auth, from, to, []byte(msg.String()))
+}
+
+// failureReportText formats reports for reading.
+func failureReportText(reports []media.FailureReport) string {
+	var b strings.Builder
+	for i, r := range reports {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s (project %d): %d failures\n", r.Project, r.ProjectID, r.Failures)
+		for _, c := range r.Categories {
+			fmt.Fprintf(&b, "  %8d  %s\n", c.Count, c.Category)
+		}
+		if len(r.Assets) > 0 {
+			b.WriteString("  Assets failing most:\n")
+		}
+		for _, a := range r.Assets {
+			lastError := strings.Join(strings.Fields(a.LastError), " ")
+			if r := []rune(lastError); len(r) > 200 {
+				lastError = string(r[:200]) + "..."
+			}
+			fmt.Fprintf(&b, "  %8d  %s [%s] %s\n", a.Count, a.Path, a.Category, lastError)
+		}
+	}
+	return b.String()
+}
@@ -1,20 +1,24 @@
 package mediax
 
 import (
+	"errors"
 	"fmt"
 	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/log"
 	"mediax/apps/media"
 	"net/url"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
 
 var (
 	// mu protects Origins and VideoProfiles for concurrent read access.
-	// InitializeConfig holds a write lock for its entire duration, so readers
-	// always see a fully-consistent snapshot and never a partially-built map.
+	// InitializeConfig builds new maps and swaps them under the write lock,
+	// so readers always see a fully-consistent snapshot and never a
+	// partially-built map.
 	mu sync.RWMutex
 
 	// ready is closed exactly once after the first successful InitializeConfig,
@@ -24,47 +28,134 @@ var (
 
 	Origins       map[string]*media.Origin
 	VideoProfiles map[string]*media.VideoProfile
+	APIKeys       map[string]*media.APIKey
 )
 
+// reloadMu serializes InitializeConfig calls, and guards liveStorages.
+var reloadMu sync.Mutex
+
+// liveStorages are the initialized storages of the current configuration by
+// ID, with the settings they were initialized from.
+var liveStorages = map[int]liveStorage{}
+
+type liveStorage struct {
+	signature string
+	storage   *media.Storage
+}
+
+// InitializeConfig loads origins, storages, profiles, API keys and external
+// processors. Everything is built outside mu, so requests keep being served
+// from the previous configuration during a reload; mu is only held to swap
+// the maps. Storages whose type, config string and base path did not change
+// keep their connected backend; the rest (and storages that failed before)
+// are initialized again.
 func InitializeConfig() {
-	// Write-lock for the full duration: this serializes concurrent reload calls
-	// AND prevents readers from seeing a half-built map during the swap.
-	mu.Lock()
-	defer mu.Unlock()
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
 
 	// Always signal readiness after the first call completes, even if a reload
 	// is what triggered this call.
 	defer readyOnce.Do(func() { close(ready) })
 
 	var origins []media.Origin
-	db.Preload("Project").Where("deleted_at IS NULL").Find(&origins)
+	db.Preload("Project", "deleted_at IS NULL").Preload("Project.CachePriorities", "deleted_at IS NULL").Where("deleted_at IS NULL").Find(&origins)
 
 	newOrigins := make(map[string]*media.Origin, len(origins))
+	tiers := map[string]string{}
 	var storages []media.Storage
-	db.Order("priority ASC").Find(&storages)
+	db.Where("deleted_at IS NULL").Order("priority ASC").Find(&storages)
+	newLive := map[int]liveStorage{}
 	for idx := range origins {
 		origin := origins[idx]
+		// Origins of deleted or missing projects are not served.
+		if origin.Project == nil {
+			continue
+		}
 		for i := range storages {
 			if storages[i].ProjectID == origin.ProjectID {
-				storages[i].Init()
+				if _, done := newLive[storages[i].StorageID]; !done {
+					newLive[storages[i].StorageID] = connectStorage(&storages[i])
+				}
 				origin.Storages = append(origin.Storages, &storages[i])
 			}
 		}
+		if origin.Project.WarmCacheDir != "" {
+			tiers[origin.Project.CacheDir] = origin.Project.WarmCacheDir
+		}
 		newOrigins[strings.ToLower(origin.Domain)] = &origin
 	}
+	liveStorages = newLive
+	media.PruneStorageHealth(func(id int) bool {
+		_, ok := newLive[id]
+		return ok
+	})
 
 	var videoProfiles []media.VideoProfile
 	db.Find(&videoProfiles)
 	newVideoProfiles := make(map[string]*media.VideoProfile, len(videoProfiles))
 	for idx := range videoProfiles {
 		vp := videoProfiles[idx]
+		// Requests naming a skipped profile are refused as unknown.
+		if err := vp.Validate(); err != nil {
+			log.Warning("skipping invalid video profile", "profile", vp.Profile, "error", err)
+			continue
+		}
 		newVideoProfiles[vp.Profile] = &vp
 	}
 
-	// Atomic swap: readers blocked by mu.RLock will see the new maps immediately
-	// after this function returns.
+	var apiKeys []media.APIKey
+	db.Where("deleted_at IS NULL AND active = ?", true).Find(&apiKeys)
+	newAPIKeys := make(map[string]*media.APIKey, len(apiKeys))
+	for idx := range apiKeys {
+		key := apiKeys[idx]
+		if key.Token != "" {
+			newAPIKeys[key.Token] = &key
+		}
+	}
+
+	var processors []media.ExternalProcessor
+	db.Where("deleted_at IS NULL").Order("external_processor_id ASC").Find(&processors)
+
+	// Swap under the write lock. Requests in flight keep the origins and
+	// storages they already looked up; new requests see the new maps.
+	mu.Lock()
 	Origins = newOrigins
 	VideoProfiles = newVideoProfiles
+	APIKeys = newAPIKeys
+	setExternalProcessors(processors)
+	mu.Unlock()
+	media.SetCacheTiers(tiers)
+}
+
+// connectStorage initializes s, reusing the backend of the live storage with
+// the same ID when its settings are unchanged and it initialized fine.
+func connectStorage(s *media.Storage) liveStorage {
+	signature := s.Type + "\x00" + s.ConfigString + "\x00" + s.BasePath
+	if live, ok := liveStorages[s.StorageID]; ok && live.signature == signature && live.storage.FS != nil {
+		s.FS, s.BasePath = live.storage.FS, live.storage.BasePath
+		return liveStorage{signature: signature, storage: s}
+	}
+	// Failures are recorded; staging skips the storage.
+	s.Init() //nolint:errcheck
+	return liveStorage{signature: signature, storage: s}
+}
+
+// loadedProjects returns the distinct projects with a cache dir referenced by
+// the loaded origins, ordered by project ID.
+func loadedProjects() []*media.Project {
+	mu.RLock()
+	seen := map[int]bool{}
+	var projects []*media.Project
+	for _, o := range Origins {
+		if o.Project == nil || seen[o.ProjectID] || o.Project.CacheDir == "" {
+			continue
+		}
+		seen[o.ProjectID] = true
+		projects = append(projects, o.Project)
+	}
+	mu.RUnlock()
+	sort.Slice(projects, func(i, j int) bool { return projects[i].ProjectID < projects[j].ProjectID })
+	return projects
 }
 
 // lookupOrigin returns the Origin for a hostname under a read lock.
@@ -75,6 +166,28 @@ func lookupOrigin(host string) (*media.Origin, bool) {
 	return v, ok
 }
 
+// errForbiddenDomain is returned for hosts that match no origin.
+var errForbiddenDomain = errors.New("forbidden domain")
+
+// purgeMedia drops the staged original of path (a request path on host) so
+// it is fetched from storage again. See media.PurgeStaged.
+func purgeMedia(host, path string) (int, error) {
+	<-ready
+	origin, ok := lookupOrigin(strings.ToLower(host))
+	if !ok || origin.Project == nil {
+		return 0, errForbiddenDomain
+	}
+	return media.PurgeStaged(origin.Project, TrimPrefix(path, origin.PrefixPath))
+}
+
+// lookupAPIKey returns an active APIKey by token under a read lock.
+func lookupAPIKey(token string) (*media.APIKey, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	v, ok := APIKeys[token]
+	return v, ok
+}
+
 // lookupVideoProfile returns a VideoProfile by name under a read lock.
 func lookupVideoProfile(profile string) (*media.VideoProfile, bool) {
 	mu.RLock()
@@ -0,0 +1,42 @@
+package mediax
+
+import (
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"github.com/google/uuid"
+	"mediax/apps/media"
+)
+
+// generatorRequest resolves the origin and API key of a request to an image
+// generator (/generate/qr, /placeholder) or for a ZIP archive (/zip).
+// Generated images belong to no storage but are cached in the project of
+// the domain and charged to it. A non-nil response refuses the request.
+func generatorRequest(request *evo.Request) (*media.Request, *media.APIKey, any) {
+	<-ready
+	url := request.URL()
+	url.Host = requestHost(request)
+	origin, ok := lookupOrigin(url.Host)
+	if !ok {
+		return nil, nil, outcome.Text(errForbiddenDomain.Error()).Status(evo.StatusForbidden)
+	}
+	req := &media.Request{
+		Request: request,
+		Domain:  url.Host,
+		Url:     url,
+		Origin:  origin,
+		TraceID: uuid.New().String(),
+		Options: &media.Options{},
+	}
+	request.Set("X-Trace-ID", req.TraceID)
+	if err := req.Options.ParseDelivery(request.Query); err != nil {
+		return nil, nil, outcome.Text(err.Error()).Status(evo.StatusBadRequest)
+	}
+	if refused := checkAccess(req); refused != nil {
+		return nil, nil, refused
+	}
+	apiKey, status, err := authorizeAPIKey(req)
+	if err != nil {
+		return nil, nil, outcome.Text(err.Error()).Status(status)
+	}
+	return req, apiKey, nil
+}
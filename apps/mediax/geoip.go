@@ -0,0 +1,312 @@
+package mediax
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// geoIPReload is how often the database file is checked for updates, e.g.
+// by geoipupdate.
+const geoIPReload = time.Minute
+
+// geoIP caches the database of MEDIAX.GeoIPDatabase.
+var geoIP struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	checked time.Time
+	db      *mmdb
+}
+
+// geoIPDatabase returns the MaxMind database at MEDIAX.GeoIPDatabase, or nil
+// when none is configured or it cannot be read. It is reopened when the
+// setting or the file changes.
+func geoIPDatabase() *mmdb {
+	path := settings.Get("MEDIAX.GeoIPDatabase", "").String()
+	geoIP.Lock()
+	defer geoIP.Unlock()
+	if path == geoIP.path && time.Since(geoIP.checked) < geoIPReload {
+		return geoIP.db
+	}
+	geoIP.checked = time.Now()
+	if path == "" {
+		geoIP.path, geoIP.db = "", nil
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if path != geoIP.path {
+			log.Error("cannot open GeoIP database", "path", path, "error", err)
+		}
+		geoIP.path, geoIP.db = path, nil
+		return nil
+	}
+	if path == geoIP.path && info.ModTime().Equal(geoIP.modTime) {
+		return geoIP.db
+	}
+	db, err := openMMDB(path)
+	if err != nil {
+		log.Error("cannot open GeoIP database", "path", path, "error", err)
+		db = nil
+	}
+	geoIP.path, geoIP.modTime, geoIP.db = path, info.ModTime(), db
+	return db
+}
+
+// countryOf returns the ISO 3166-1 alpha-2 code of the country ip is located
+// in, falling back to the country it is registered in, or "" when unknown.
+func countryOf(ip net.IP) (string, error) {
+	db := geoIPDatabase()
+	if db == nil {
+		return "", errors.New("no GeoIP database configured (MEDIAX.GeoIPDatabase)")
+	}
+	record, err := db.lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	m, _ := record.(map[string]any)
+	for _, field := range []string{"country", "registered_country"} {
+		if country, ok := m[field].(map[string]any); ok {
+			if code, ok := country["iso_code"].(string); ok && code != "" {
+				return code, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdb is a MaxMind DB file (GeoIP2 / GeoLite2), read into memory. See
+// https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint
+	ipVersion  uint
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(file, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	meta := file[i+len(mmdbMetadataMarker):]
+	v, _, err := (&mmdbDecoder{data: meta}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	m, _ := v.(map[string]any)
+	db := &mmdb{
+		nodeCount:  mmdbUint(m["node_count"]),
+		recordSize: mmdbUint(m["record_size"]),
+		ipVersion:  mmdbUint(m["ip_version"]),
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("truncated search tree")
+	}
+	db.tree = file[:treeSize]
+	db.data = file[treeSize+16 : i]
+	// IPv4 addresses are looked up as ::a.b.c.d in IPv6 databases.
+	if db.ipVersion == 6 {
+		for bit := 0; bit < 96 && db.ipv4Start < db.nodeCount; bit++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// lookup returns the record of the network ip is in, or nil.
+func (db *mmdb) lookup(ip net.IP) (any, error) {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node, bits = ip4, db.ipv4Start, 32
+	} else if ip = ip.To16(); ip == nil || db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < bits && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		return nil, nil // not found
+	}
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.data)) {
+		return nil, errors.New("corrupt search tree")
+	}
+	v, _, err := (&mmdbDecoder{data: db.data}).decode(offset, 0)
+	return v, err
+}
+
+// record returns the left (side 0) or right (side 1) record of node.
+func (db *mmdb) record(node, side uint) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[side*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if side == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[side*4:]))
+	}
+}
+
+// mmdbDecoder decodes values of a MaxMind DB data section.
+type mmdbDecoder struct {
+	data []byte
+}
+
+// decode returns the value at offset and the offset following it. depth
+// guards against pointer loops in corrupt files.
+func (d *mmdbDecoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	kind := uint(ctrl >> 5)
+	if kind == 1 { // pointer
+		ptrSize := uint(ctrl>>3&3) + 1
+		b, err := d.bytes(offset, ptrSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		var target uint
+		if ptrSize < 4 {
+			target = uint(ctrl & 7)
+		}
+		for _, c := range b {
+			target = target<<8 | uint(c)
+		}
+		target += [...]uint{0, 2048, 526336, 0}[ptrSize-1]
+		v, _, err := d.decode(target, depth+1)
+		return v, offset + ptrSize, err
+	}
+	if kind == 0 { // extended
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(b[0])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		size = 0
+		for _, c := range b {
+			size = size<<8 | uint(c)
+		}
+		size += [...]uint{29, 285, 65821}[n-1]
+		offset += n
+	}
+
+	switch kind {
+	case 7: // map
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if m[key], offset, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, size)
+		for i := range a {
+			if a[i], offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case 14: // boolean, held in the size
+		return size != 0, offset, nil
+	}
+	b, err = d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch kind {
+	case 2: // utf-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4, 10: // bytes, uint128
+		return b, offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8: // int32
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int32(n), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+func (d *mmdbDecoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.data)) {
+		return nil, errors.New("unexpected end of data")
+	}
+	return d.data[offset : offset+n], nil
+}
+
+// mmdbUint returns an unsigned metadata value, or 0.
+func mmdbUint(v any) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
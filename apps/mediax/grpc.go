@@ -0,0 +1,320 @@
+package mediax
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"mediax/apps/mediax/mediaxpb"
+	"mediax/mediaurl"
+)
+
+// grpcChunkSize is the payload size of each streamed Chunk message.
+const grpcChunkSize = 64 * 1024
+
+// grpcStagingRetry is how long Process waits before retrying a file that is
+// still being staged (the HTTP API answers 307 in that case).
+const grpcStagingRetry = 500 * time.Millisecond
+
+// startGRPCServer serves the MediaX gRPC API on MEDIAX.GRPCAddress. It is
+// disabled when the address is empty. Every call must carry MEDIAX.GRPCToken
+// as "authorization: Bearer <token>" metadata; without a token the server
+// does not start, as Purge and Prewarm would be open to anyone reaching it.
+func startGRPCServer() {
+	address := settings.Get("MEDIAX.GRPCAddress", "").String()
+	if address == "" {
+		return
+	}
+	token := settings.Get("MEDIAX.GRPCToken", "").String()
+	if token == "" {
+		log.Error("grpc server not started: MEDIAX.GRPCToken is required with MEDIAX.GRPCAddress", "address", address)
+		return
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Error("grpc listen failed", "address", address, "error", err)
+		return
+	}
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := checkGRPCToken(ctx, token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := checkGRPCToken(ss.Context(), token); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	mediaxpb.RegisterMediaXServer(server, grpcServer{})
+	go func() {
+		log.Info("grpc server listening", "address", address)
+		if err := server.Serve(listener); err != nil {
+			log.Error("grpc server stopped", "error", err)
+		}
+	}()
+}
+
+func checkGRPCToken(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(v, "Bearer ")), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid or missing token")
+}
+
+// grpcServer implements mediaxpb.MediaXServer on top of the HTTP pipeline, so
+// both APIs share option parsing, staging, caching and encoders.
+type grpcServer struct {
+	mediaxpb.UnimplementedMediaXServer
+}
+
+// Process streams the processed file. The first chunk carries the MIME type
+// and total size.
+func (grpcServer) Process(req *mediaxpb.ProcessRequest, stream grpc.ServerStreamingServer[mediaxpb.Chunk]) error {
+	resp, err := serveExternal(stream.Context(), req.Host, req.Path, req.Options)
+	if err != nil {
+		return err
+	}
+	defer resp.CloseBodyStream() //nolint:errcheck
+	w := &chunkWriter{
+		stream: stream,
+		first:  &mediaxpb.Chunk{MimeType: string(resp.Header.ContentType()), Size: int64(resp.Header.ContentLength())},
+	}
+	if err := resp.BodyWriteTo(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// GetMetadata returns what ?detail=true returns over HTTP.
+func (grpcServer) GetMetadata(ctx context.Context, req *mediaxpb.MediaRequest) (*mediaxpb.MetadataResponse, error) {
+	options := map[string]string{"detail": "true"}
+	// MediaRequest carries no options; signed origins take the signature of
+	// path?detail=true[&expires=...] as metadata.
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-mediax-signature"); len(v) > 0 {
+			options["s"] = v[0]
+		}
+		if v := md.Get("x-mediax-expires"); len(v) > 0 {
+			options["expires"] = v[0]
+		}
+	}
+	resp, err := serveExternal(ctx, req.Host, req.Path, options)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.CloseBodyStream() //nolint:errcheck
+	// Media types without metadata serve the file itself instead.
+	var fields map[string]any
+	if !strings.HasPrefix(string(resp.Header.ContentType()), "application/json") || json.Unmarshal(resp.Body(), &fields) != nil {
+		return nil, status.Error(codes.FailedPrecondition, "no metadata available for this media type")
+	}
+	result, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &mediaxpb.MetadataResponse{Metadata: result}, nil
+}
+
+// Purge drops the staged original of a file so it is fetched from storage again.
+func (grpcServer) Purge(_ context.Context, req *mediaxpb.MediaRequest) (*mediaxpb.PurgeResponse, error) {
+	removed, err := purgeMedia(req.Host, req.Path)
+	if errors.Is(err, errForbiddenDomain) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &mediaxpb.PurgeResponse{Removed: int32(removed)}, nil
+}
+
+// Prewarm generates each requested variant and discards the output, so later
+// requests are served from cache. Failures are reported per variant.
+func (grpcServer) Prewarm(ctx context.Context, req *mediaxpb.PrewarmRequest) (*mediaxpb.PrewarmResponse, error) {
+	variants := make([]map[string]string, len(req.Variants))
+	for i, v := range req.Variants {
+		variants[i] = v.GetOptions()
+	}
+	generated, failures := prewarmMedia(ctx, req.Host, req.Path, variants)
+	if ctx.Err() != nil {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return &mediaxpb.PrewarmResponse{Generated: int32(generated), Errors: failures}, nil
+}
+
+// prewarmMedia generates each variant of path on host through the regular
+// pipeline and discards the output. It stops early when ctx ends.
+func prewarmMedia(ctx context.Context, host, path string, variants []map[string]string) (generated int, failures []string) {
+	failures = []string{}
+	for i, options := range variants {
+		resp, err := serveInternal(ctx, host, path, options)
+		if ctx.Err() != nil {
+			return generated, failures
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("variant %d: %s", i, status.Convert(err).Message()))
+			continue
+		}
+		resp.CloseBodyStream() //nolint:errcheck
+		generated++
+	}
+	return generated, failures
+}
+
+// serveInternal runs GET path?options for host through the HTTP handler chain
+// in-process on behalf of MediaX itself (prewarm, the CLI, ZIP downloads,
+// background jobs) and returns the successful response, whose body stream
+// the caller must close. Internal requests are trusted: they are signed for
+// origins that require it and skip API keys, IP rules, forensic watermarks
+// and HLS encryption (see isInternal). Staging redirects are retried until
+// the file is ready or ctx ends.
+func serveInternal(ctx context.Context, host, path string, options map[string]string) (*fasthttp.Response, error) {
+	return serveInProcess(ctx, host, path, options, true)
+}
+
+// serveExternal runs the request of a gRPC client like serveInternal but
+// as an HTTP request of that client: options must carry the signature and
+// API key the origin requires (or the key is sent as x-api-key metadata),
+// IP rules apply to the client's address, and outputs are watermarked and
+// encrypted as over HTTP.
+func serveExternal(ctx context.Context, host, path string, options map[string]string) (*fasthttp.Response, error) {
+	return serveInProcess(ctx, host, path, options, false)
+}
+
+func serveInProcess(ctx context.Context, host, path string, options map[string]string, internal bool) (*fasthttp.Response, error) {
+	query := neturl.Values{}
+	for k, v := range options {
+		query.Set(k, v)
+	}
+	uri := "/" + strings.TrimLeft(path, "/")
+	<-ready
+	// Internal calls are trusted; sign them for origins that require it.
+	if origin, ok := lookupOrigin(host); internal && ok && origin.SigningKey != "" && origin.URLDialect == "" {
+		query.Set("s", mediaurl.Sign(origin.SigningKey, uri, query))
+	}
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	var remoteAddr net.Addr
+	var apiKey string
+	if !internal {
+		if p, ok := peer.FromContext(ctx); ok {
+			remoteAddr = p.Addr
+		}
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-api-key")) > 0 {
+			apiKey = md.Get("x-api-key")[0]
+		}
+	}
+	handler := evo.GetFiber().Handler()
+	for {
+		fctx := &fasthttp.RequestCtx{}
+		var req fasthttp.Request
+		req.Header.SetMethod(fasthttp.MethodGet)
+		req.SetRequestURI(uri)
+		req.Header.SetHost(host)
+		if internal {
+			req.Header.Set("X-Mediax-Internal", internalToken)
+		} else if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		fctx.Init(&req, remoteAddr, nil)
+		handler(fctx)
+
+		code := fctx.Response.StatusCode()
+		if code == fasthttp.StatusOK {
+			return &fctx.Response, nil
+		}
+		body := strings.TrimSpace(string(fctx.Response.Body()))
+		fctx.Response.CloseBodyStream() //nolint:errcheck
+		if code != fasthttp.StatusTemporaryRedirect {
+			return nil, status.Error(grpcCode(code), body)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-time.After(grpcStagingRetry):
+		}
+	}
+}
+
+// grpcCode maps an HTTP status of the media handler onto a gRPC status code.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case fasthttp.StatusBadRequest, fasthttp.StatusUnsupportedMediaType:
+		return codes.InvalidArgument
+	case fasthttp.StatusUnauthorized:
+		return codes.Unauthenticated
+	case fasthttp.StatusForbidden:
+		return codes.PermissionDenied
+	case fasthttp.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case fasthttp.StatusNotFound:
+		return codes.NotFound
+	case fasthttp.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// chunkWriter splits the response body into Chunk messages of grpcChunkSize.
+type chunkWriter struct {
+	stream grpc.ServerStreamingServer[mediaxpb.Chunk]
+	first  *mediaxpb.Chunk
+	buf    []byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(grpcChunkSize-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+		if len(w.buf) == grpcChunkSize {
+			if err := w.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush sends the buffered bytes. The first call always sends a message, so
+// an empty body still delivers the MIME type.
+func (w *chunkWriter) Flush() error {
+	if len(w.buf) == 0 && w.first == nil {
+		return nil
+	}
+	chunk := &mediaxpb.Chunk{}
+	if w.first != nil {
+		chunk, w.first = w.first, nil
+	}
+	chunk.Data = w.buf
+	if err := w.stream.Send(chunk); err != nil {
+		return err
+	}
+	w.buf = make([]byte, 0, grpcChunkSize)
+	return nil
+}
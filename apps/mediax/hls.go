@@ -0,0 +1,155 @@
+package mediax
+
+import (
+	"errors"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"github.com/gofiber/fiber/v2"
+	"mediax/apps/media"
+	"mediax/encoders"
+	"mediax/mediaurl"
+)
+
+// serveHLSPlaylist answers hls=1 with the playlist at playlistPath, its
+// segments named by URLs relative to the request: the same file and query
+// with segment=N, signed again on origins with a signing_key so players
+// can fetch them without knowing the key. On projects with hls_encryption
+// the segment URLs carry the current key epoch, and an EXT-X-KEY tag points
+// at the key of that epoch, under the same URL with hls_key set.
+func serveHLSPlaylist(req *media.Request, playlistPath string) error {
+	data, err := os.ReadFile(playlistPath)
+	if err != nil {
+		return err
+	}
+	query := neturl.Values{}
+	req.Request.Context.Request().URI().QueryArgs().VisitAll(func(k, v []byte) {
+		if k := string(k); k != "s" && k != "segment" && k != "epoch" && k != "hls_key" {
+			query.Add(k, string(v))
+		}
+	})
+	// "./" keeps a file name with a colon from reading as a URL scheme.
+	base := "./" + neturl.PathEscape(path.Base(req.Url.Path))
+	sign := req.Origin.SigningKey != "" && req.Origin.URLDialect == ""
+	uri := func(key, value string) string {
+		q := neturl.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set(key, value)
+		if sign {
+			signed := neturl.Values{}
+			for k, v := range q {
+				if k != "api_key" {
+					signed[k] = v
+				}
+			}
+			q.Set("s", mediaurl.Sign(req.Origin.SigningKey, req.Url.Path, signed))
+		}
+		return base + "?" + q.Encode()
+	}
+
+	encrypted := req.Origin.Project.HLSEncryption
+	if encrypted {
+		epoch := strconv.FormatInt(req.Origin.Project.HLSKeyEpoch(time.Now()), 10)
+		data = []byte(encoders.InsertHLSKey(string(data), uri("hls_key", epoch)))
+		query.Set("epoch", epoch)
+	}
+	body := encoders.RewriteHLSPlaylist(string(data), func(n int) string {
+		return uri("segment", strconv.Itoa(n))
+	})
+
+	c := req.Request.Context
+	c.Set("Content-Type", "application/vnd.apple.mpegurl")
+	// Playlists carrying a credential or an expiring signature are not
+	// shared caches' to keep, nor are those naming a key that rotates.
+	if query.Has("api_key") || query.Has("expires") || encrypted {
+		c.Set("Cache-Control", "private, max-age=300")
+	} else {
+		c.Set("Cache-Control", "public, max-age=86400")
+	}
+	c.Status(fiber.StatusOK)
+	_, err = c.Write([]byte(body))
+	return err
+}
+
+// encryptsHLS reports whether req, for an HLS segment, is answered
+// encrypted. Internal requests (prewarms) serve no player and are not.
+func encryptsHLS(req *media.Request) bool {
+	return req.Options.HLS && req.Options.Segment > 0 && req.Origin.Project.HLSEncryption && !isInternal(req)
+}
+
+// hlsEpoch returns the key epoch query parameter key of req.
+func hlsEpoch(req *media.Request, key string) (int64, error) {
+	epoch, err := strconv.ParseInt(req.Request.Query(key).String(), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", key, req.Request.Query(key).String())
+	}
+	return epoch, nil
+}
+
+// serveHLSKey answers hls_key=E with the 16-byte AES-128 key of epoch E of
+// the project. The key is reached through the same URL as the media, so
+// signatures, expiry and API keys guard it as they guard the segments;
+// players must not keep it.
+func serveHLSKey(req *media.Request) any {
+	if !req.Origin.Project.HLSEncryption {
+		return outcome.Text("hls encryption is not enabled for this project").Status(evo.StatusNotFound)
+	}
+	epoch, err := hlsEpoch(req, "hls_key")
+	if err != nil {
+		return outcome.Text(err.Error()).Status(evo.StatusBadRequest)
+	}
+	key, err := req.Origin.Project.HLSKey(epoch)
+	if errors.Is(err, media.ErrHLSKeyExpired) {
+		metricHLSKeys.WithLabelValues(req.Origin.Project.Name, "expired").Inc()
+		return outcome.Text(err.Error()).Status(evo.StatusForbidden)
+	}
+	if err != nil {
+		return err
+	}
+	metricHLSKeys.WithLabelValues(req.Origin.Project.Name, "served").Inc()
+	c := req.Request.Context
+	c.Set("Content-Type", "application/octet-stream")
+	c.Set("Cache-Control", "private, no-store")
+	c.Status(fiber.StatusOK)
+	_, err = c.Write(key)
+	return err
+}
+
+// serveEncryptedSegment answers segment=N with the segment at path
+// encrypted under the key of the epoch its URL names. Encryption is
+// deterministic, so the response is cached and revalidated like the
+// plain segment.
+func serveEncryptedSegment(req *media.Request, path string) error {
+	epoch, err := hlsEpoch(req, "epoch")
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	key, err := req.Origin.Project.HLSKey(epoch)
+	if errors.Is(err, media.ErrHLSKeyExpired) {
+		return fiber.NewError(fiber.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	encrypted, err := media.EncryptHLSSegment(data, key, req.Options.Segment-1)
+	if err != nil {
+		return err
+	}
+	return req.ServeBytes("video/mp2t", path, encrypted, info.ModTime())
+}
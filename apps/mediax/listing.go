@@ -0,0 +1,254 @@
+package mediax
+
+import (
+	"context"
+	"fmt"
+	neturl "net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"mediax/apps/media"
+	"mediax/mediaurl"
+)
+
+// Listings return listingDefaultLimit entries per page unless ?limit= asks
+// for more, up to listingMaxLimit, with thumbnails of listingDefaultThumb
+// unless ?thumb= gives another size.
+const (
+	listingDefaultLimit = 100
+	listingMaxLimit     = 1000
+	listingDefaultThumb = "320x240"
+)
+
+// listingEntry is a file or directory of a listing. URL is the file, or for
+// a directory its own listing; Thumbnail is a preview of images, videos,
+// documents and 3D models.
+type listingEntry struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Type      string `json:"type"`
+	Mime      string `json:"mime,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	URL       string `json:"url"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+// listing is the response of /list. Next is the URL of the following page.
+type listing struct {
+	Prefix  string         `json:"prefix"`
+	Entries []listingEntry `json:"entries"`
+	Next    string         `json:"next,omitempty"`
+}
+
+// ListFolder serves GET /list?prefix=: the media files and subdirectories
+// directly below a path on origins with directory_listing, sorted by name,
+// for gallery frontends. URLs in the listing are relative to the host and,
+// on origins with a signing_key, signed with the listing's expiry; an
+// api_key in the query is passed on to them. Pages hold ?limit= entries
+// after ?cursor=, the key of the last entry of the previous page (its name,
+// with a trailing slash for a directory).
+func (c Controller) ListFolder(request *evo.Request) any {
+	req, apiKey, refused := generatorRequest(request)
+	if refused != nil {
+		return refused
+	}
+	defer func() { recordUsage(apiKey, req) }()
+	if !req.Origin.DirectoryListing || req.Origin.URLDialect != "" {
+		return outcome.Text("directory listing is not enabled for this domain").Status(evo.StatusNotFound)
+	}
+	if err := verifyURLSignature(req); err != nil {
+		return outcome.Text(err.Error()).Status(evo.StatusForbidden)
+	}
+	l, err := newLister(req)
+	if err != nil {
+		return outcome.Text(err.Error()).Status(evo.StatusBadRequest)
+	}
+	entries, more, err := l.page(req.Request.Context.Context())
+	if err != nil {
+		return err
+	}
+
+	result := listing{Prefix: l.prefix, Entries: []listingEntry{}}
+	for _, e := range entries {
+		result.Entries = append(result.Entries, e.listingEntry)
+	}
+	if more {
+		result.Next = l.listURL(l.prefix, entries[len(entries)-1].key)
+	}
+
+	if l.apiKey != "" || !l.expires.IsZero() {
+		request.Set("Cache-Control", "private, max-age=60")
+	} else {
+		request.Set("Cache-Control", "public, max-age=60")
+	}
+	return outcome.Json(result)
+}
+
+// lister lists one page of a directory and builds the URLs in it.
+type lister struct {
+	origin  *media.Origin
+	prefix  string // request path of the directory, with a leading slash
+	cursor  string
+	limit   int
+	thumb   string // WxH of thumbnails
+	expires time.Time
+	apiKey  string
+}
+
+func newLister(req *media.Request) (*lister, error) {
+	query := req.Request.Query
+	l := &lister{
+		origin: req.Origin,
+		prefix: path.Clean("/" + query("prefix").String()),
+		cursor: query("cursor").String(),
+		limit:  listingDefaultLimit,
+		thumb:  listingDefaultThumb,
+		apiKey: query("api_key").String(),
+	}
+	if v := query("limit").String(); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > listingMaxLimit {
+			return nil, fmt.Errorf("invalid limit %q: must be between 1 and %d", v, listingMaxLimit)
+		}
+		l.limit = n
+	}
+	if v := query("thumb").String(); v != "" {
+		w, h, ok := strings.Cut(v, "x")
+		width, errW := strconv.Atoi(w)
+		height, errH := strconv.Atoi(h)
+		if !ok || errW != nil || errH != nil || width < 1 || height < 1 || width > mediaurl.MaxDimension || height > mediaurl.MaxDimension {
+			return nil, fmt.Errorf("invalid thumb %q: expected WxH", v)
+		}
+		l.thumb = v
+	}
+	if v := query("expires").String(); v != "" {
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires %q", v)
+		}
+		l.expires = time.Unix(ts, 0)
+	}
+	return l, nil
+}
+
+// keyedEntry is a listing entry and its key in listing order (see
+// media.DirEntry.Key).
+type keyedEntry struct {
+	listingEntry
+	key string
+}
+
+// page returns the entries directly below the prefix in the origin's
+// storages after the cursor, sorted by key, at most limit of them, and
+// whether more follow. Each storage is read only as far as the page needs.
+// A path found in several storages is listed once, as staging takes it from
+// the first.
+func (l *lister) page(ctx context.Context) ([]keyedEntry, bool, error) {
+	storagePrefix := TrimPrefix(l.prefix, l.origin.PrefixPath)
+	seen := map[string]bool{}
+	var entries []keyedEntry
+	for _, storage := range l.origin.Storages {
+		// limit+1 entries of each storage tell whether another page follows.
+		n := 0
+		err := storage.ListDir(ctx, storagePrefix, l.cursor, func(e media.DirEntry) bool {
+			if e.Name == "" || strings.HasPrefix(e.Name, ".") {
+				return true
+			}
+			p := path.Join(l.prefix, e.Name)
+			var entry listingEntry
+			if e.Dir {
+				entry = listingEntry{Name: e.Name, Path: p, Type: "directory", URL: l.listURL(p, "")}
+			} else {
+				ext := strings.TrimPrefix(strings.ToLower(path.Ext(e.Name)), ".")
+				t, ok := lookupMediaType(ext)
+				if !ok || !l.origin.AllowsExtension(ext) {
+					return true
+				}
+				entry = l.file(p, e.Name, t.Mime, e.Size)
+			}
+			if !seen[e.Name] {
+				seen[e.Name] = true
+				entries = append(entries, keyedEntry{listingEntry: entry, key: e.Key()})
+			}
+			n++
+			return n <= l.limit
+		})
+		if err != nil {
+			return nil, false, fmt.Errorf("listing storage %d: %w", storage.StorageID, err)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	if len(entries) > l.limit {
+		return entries[:l.limit], true, nil
+	}
+	return entries, false, nil
+}
+
+// file returns the entry of the file at request path p.
+func (l *lister) file(p, name, mime string, size int64) listingEntry {
+	category := mediaCategory(mime)
+	e := listingEntry{Name: name, Path: p, Type: category, Mime: mime, Size: size, URL: l.mediaURL(p, mediaurl.Options{})}
+	width, height, _ := strings.Cut(l.thumb, "x")
+	w, _ := strconv.Atoi(width)
+	h, _ := strconv.Atoi(height)
+	switch category {
+	case "image":
+		e.Thumbnail = l.mediaURL(p, mediaurl.Options{Width: w, Height: h})
+	case "video", "document":
+		e.Thumbnail = l.mediaURL(p, mediaurl.Options{Thumbnail: l.thumb, Format: "jpg"})
+	case "model":
+		e.Thumbnail = l.mediaURL(p, mediaurl.Options{Thumbnail: l.thumb, Format: "png"})
+	}
+	// Audio has cover art only sometimes; players show their own.
+	return e
+}
+
+// mediaURL returns the host-relative URL of p with o, signed on origins
+// with a signing_key.
+func (l *lister) mediaURL(p string, o mediaurl.Options) string {
+	o.Expires = l.expires
+	u, err := mediaurl.Build("", p, o, l.origin.SigningKey)
+	if err != nil {
+		return ""
+	}
+	return l.withAPIKey(u)
+}
+
+// listURL returns the URL of the listing of dir, from after cursor.
+func (l *lister) listURL(dir, cursor string) string {
+	query := neturl.Values{}
+	query.Set("prefix", dir)
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	if l.limit != listingDefaultLimit {
+		query.Set("limit", strconv.Itoa(l.limit))
+	}
+	if l.thumb != listingDefaultThumb {
+		query.Set("thumb", l.thumb)
+	}
+	if l.origin.SigningKey != "" {
+		if !l.expires.IsZero() {
+			query.Set("expires", strconv.FormatInt(l.expires.Unix(), 10))
+		}
+		query.Set("s", mediaurl.Sign(l.origin.SigningKey, mediaurl.ListPath, query))
+	}
+	return l.withAPIKey(mediaurl.ListPath + "?" + query.Encode())
+}
+
+// withAPIKey appends the request's api_key to u, which is not signed.
+func (l *lister) withAPIKey(u string) string {
+	if l.apiKey == "" {
+		return u
+	}
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return u + sep + "api_key=" + neturl.QueryEscape(l.apiKey)
+}
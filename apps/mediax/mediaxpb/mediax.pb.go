@@ -0,0 +1,550 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: mediax.proto
+
+package mediaxpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type MediaRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Host          string                 `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	Path          string                 `protobuf:"bytes,2,opt,name=path,proto3" json:"path,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MediaRequest) Reset() {
+	*x = MediaRequest{}
+	mi := &file_mediax_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MediaRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MediaRequest) ProtoMessage() {}
+
+func (x *MediaRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mediax_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MediaRequest.ProtoReflect.Descriptor instead.
+func (*MediaRequest) Descriptor() ([]byte, []int) {
+	return file_mediax_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *MediaRequest) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *MediaRequest) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+type ProcessRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Host          string                 `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	Path          string                 `protobuf:"bytes,2,opt,name=path,proto3" json:"path,omitempty"`
+	Options       map[string]string      `protobuf:"bytes,3,rep,name=options,proto3" json:"options,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProcessRequest) Reset() {
+	*x = ProcessRequest{}
+	mi := &file_mediax_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProcessRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProcessRequest) ProtoMessage() {}
+
+func (x *ProcessRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mediax_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProcessRequest.ProtoReflect.Descriptor instead.
+func (*ProcessRequest) Descriptor() ([]byte, []int) {
+	return file_mediax_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ProcessRequest) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *ProcessRequest) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *ProcessRequest) GetOptions() map[string]string {
+	if x != nil {
+		return x.Options
+	}
+	return nil
+}
+
+type Chunk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Data          []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	MimeType      string                 `protobuf:"bytes,2,opt,name=mime_type,json=mimeType,proto3" json:"mime_type,omitempty"`
+	Size          int64                  `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Chunk) Reset() {
+	*x = Chunk{}
+	mi := &file_mediax_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Chunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Chunk) ProtoMessage() {}
+
+func (x *Chunk) ProtoReflect() protoreflect.Message {
+	mi := &file_mediax_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Chunk.ProtoReflect.Descriptor instead.
+func (*Chunk) Descriptor() ([]byte, []int) {
+	return file_mediax_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Chunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Chunk) GetMimeType() string {
+	if x != nil {
+		return x.MimeType
+	}
+	return ""
+}
+
+func (x *Chunk) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+type MetadataResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Metadata      *structpb.Struct       `protobuf:"bytes,1,opt,name=metadata,proto3" json:"metadata,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MetadataResponse) Reset() {
+	*x = MetadataResponse{}
+	mi := &file_mediax_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MetadataResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MetadataResponse) ProtoMessage() {}
+
+func (x *MetadataResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mediax_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MetadataResponse.ProtoReflect.Descriptor instead.
+func (*MetadataResponse) Descriptor() ([]byte, []int) {
+	return file_mediax_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *MetadataResponse) GetMetadata() *structpb.Struct {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+type PurgeResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Removed       int32                  `protobuf:"varint,1,opt,name=removed,proto3" json:"removed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PurgeResponse) Reset() {
+	*x = PurgeResponse{}
+	mi := &file_mediax_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PurgeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PurgeResponse) ProtoMessage() {}
+
+func (x *PurgeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mediax_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PurgeResponse.ProtoReflect.Descriptor instead.
+func (*PurgeResponse) Descriptor() ([]byte, []int) {
+	return file_mediax_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PurgeResponse) GetRemoved() int32 {
+	if x != nil {
+		return x.Removed
+	}
+	return 0
+}
+
+type Variant struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Options       map[string]string      `protobuf:"bytes,1,rep,name=options,proto3" json:"options,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Variant) Reset() {
+	*x = Variant{}
+	mi := &file_mediax_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Variant) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Variant) ProtoMessage() {}
+
+func (x *Variant) ProtoReflect() protoreflect.Message {
+	mi := &file_mediax_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Variant.ProtoReflect.Descriptor instead.
+func (*Variant) Descriptor() ([]byte, []int) {
+	return file_mediax_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Variant) GetOptions() map[string]string {
+	if x != nil {
+		return x.Options
+	}
+	return nil
+}
+
+type PrewarmRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Host          string                 `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	Path          string                 `protobuf:"bytes,2,opt,name=path,proto3" json:"path,omitempty"`
+	Variants      []*Variant             `protobuf:"bytes,3,rep,name=variants,proto3" json:"variants,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PrewarmRequest) Reset() {
+	*x = PrewarmRequest{}
+	mi := &file_mediax_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PrewarmRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PrewarmRequest) ProtoMessage() {}
+
+func (x *PrewarmRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_mediax_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PrewarmRequest.ProtoReflect.Descriptor instead.
+func (*PrewarmRequest) Descriptor() ([]byte, []int) {
+	return file_mediax_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PrewarmRequest) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *PrewarmRequest) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *PrewarmRequest) GetVariants() []*Variant {
+	if x != nil {
+		return x.Variants
+	}
+	return nil
+}
+
+type PrewarmResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Generated     int32                  `protobuf:"varint,1,opt,name=generated,proto3" json:"generated,omitempty"`
+	Errors        []string               `protobuf:"bytes,2,rep,name=errors,proto3" json:"errors,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PrewarmResponse) Reset() {
+	*x = PrewarmResponse{}
+	mi := &file_mediax_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PrewarmResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PrewarmResponse) ProtoMessage() {}
+
+func (x *PrewarmResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_mediax_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PrewarmResponse.ProtoReflect.Descriptor instead.
+func (*PrewarmResponse) Descriptor() ([]byte, []int) {
+	return file_mediax_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *PrewarmResponse) GetGenerated() int32 {
+	if x != nil {
+		return x.Generated
+	}
+	return 0
+}
+
+func (x *PrewarmResponse) GetErrors() []string {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+var File_mediax_proto protoreflect.FileDescriptor
+
+const file_mediax_proto_rawDesc = "" +
+	"\n" +
+	"\fmediax.proto\x12\tmediax.v1\x1a\x1cgoogle/protobuf/struct.proto\"6\n" +
+	"\fMediaRequest\x12\x12\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\x12\x12\n" +
+	"\x04path\x18\x02 \x01(\tR\x04path\"\xb6\x01\n" +
+	"\x0eProcessRequest\x12\x12\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\x12\x12\n" +
+	"\x04path\x18\x02 \x01(\tR\x04path\x12@\n" +
+	"\aoptions\x18\x03 \x03(\v2&.mediax.v1.ProcessRequest.OptionsEntryR\aoptions\x1a:\n" +
+	"\fOptionsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"L\n" +
+	"\x05Chunk\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\x12\x1b\n" +
+	"\tmime_type\x18\x02 \x01(\tR\bmimeType\x12\x12\n" +
+	"\x04size\x18\x03 \x01(\x03R\x04size\"G\n" +
+	"\x10MetadataResponse\x123\n" +
+	"\bmetadata\x18\x01 \x01(\v2\x17.google.protobuf.StructR\bmetadata\")\n" +
+	"\rPurgeResponse\x12\x18\n" +
+	"\aremoved\x18\x01 \x01(\x05R\aremoved\"\x80\x01\n" +
+	"\aVariant\x129\n" +
+	"\aoptions\x18\x01 \x03(\v2\x1f.mediax.v1.Variant.OptionsEntryR\aoptions\x1a:\n" +
+	"\fOptionsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"h\n" +
+	"\x0ePrewarmRequest\x12\x12\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\x12\x12\n" +
+	"\x04path\x18\x02 \x01(\tR\x04path\x12.\n" +
+	"\bvariants\x18\x03 \x03(\v2\x12.mediax.v1.VariantR\bvariants\"G\n" +
+	"\x0fPrewarmResponse\x12\x1c\n" +
+	"\tgenerated\x18\x01 \x01(\x05R\tgenerated\x12\x16\n" +
+	"\x06errors\x18\x02 \x03(\tR\x06errors2\x85\x02\n" +
+	"\x06MediaX\x128\n" +
+	"\aProcess\x12\x19.mediax.v1.ProcessRequest\x1a\x10.mediax.v1.Chunk0\x01\x12C\n" +
+	"\vGetMetadata\x12\x17.mediax.v1.MediaRequest\x1a\x1b.mediax.v1.MetadataResponse\x12:\n" +
+	"\x05Purge\x12\x17.mediax.v1.MediaRequest\x1a\x18.mediax.v1.PurgeResponse\x12@\n" +
+	"\aPrewarm\x12\x19.mediax.v1.PrewarmRequest\x1a\x1a.mediax.v1.PrewarmResponseB\x1dZ\x1bmediax/apps/mediax/mediaxpbb\x06proto3"
+
+var (
+	file_mediax_proto_rawDescOnce sync.Once
+	file_mediax_proto_rawDescData []byte
+)
+
+func file_mediax_proto_rawDescGZIP() []byte {
+	file_mediax_proto_rawDescOnce.Do(func() {
+		file_mediax_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_mediax_proto_rawDesc), len(file_mediax_proto_rawDesc)))
+	})
+	return file_mediax_proto_rawDescData
+}
+
+var file_mediax_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_mediax_proto_goTypes = []any{
+	(*MediaRequest)(nil),     // 0: mediax.v1.MediaRequest
+	(*ProcessRequest)(nil),   // 1: mediax.v1.ProcessRequest
+	(*Chunk)(nil),            // 2: mediax.v1.Chunk
+	(*MetadataResponse)(nil), // 3: mediax.v1.MetadataResponse
+	(*PurgeResponse)(nil),    // 4: mediax.v1.PurgeResponse
+	(*Variant)(nil),          // 5: mediax.v1.Variant
+	(*PrewarmRequest)(nil),   // 6: mediax.v1.PrewarmRequest
+	(*PrewarmResponse)(nil),  // 7: mediax.v1.PrewarmResponse
+	nil,                      // 8: mediax.v1.ProcessRequest.OptionsEntry
+	nil,                      // 9: mediax.v1.Variant.OptionsEntry
+	(*structpb.Struct)(nil),  // 10: google.protobuf.Struct
+}
+var file_mediax_proto_depIdxs = []int32{
+	8,  // 0: mediax.v1.ProcessRequest.options:type_name -> mediax.v1.ProcessRequest.OptionsEntry
+	10, // 1: mediax.v1.MetadataResponse.metadata:type_name -> google.protobuf.Struct
+	9,  // 2: mediax.v1.Variant.options:type_name -> mediax.v1.Variant.OptionsEntry
+	5,  // 3: mediax.v1.PrewarmRequest.variants:type_name -> mediax.v1.Variant
+	1,  // 4: mediax.v1.MediaX.Process:input_type -> mediax.v1.ProcessRequest
+	0,  // 5: mediax.v1.MediaX.GetMetadata:input_type -> mediax.v1.MediaRequest
+	0,  // 6: mediax.v1.MediaX.Purge:input_type -> mediax.v1.MediaRequest
+	6,  // 7: mediax.v1.MediaX.Prewarm:input_type -> mediax.v1.PrewarmRequest
+	2,  // 8: mediax.v1.MediaX.Process:output_type -> mediax.v1.Chunk
+	3,  // 9: mediax.v1.MediaX.GetMetadata:output_type -> mediax.v1.MetadataResponse
+	4,  // 10: mediax.v1.MediaX.Purge:output_type -> mediax.v1.PurgeResponse
+	7,  // 11: mediax.v1.MediaX.Prewarm:output_type -> mediax.v1.PrewarmResponse
+	8,  // [8:12] is the sub-list for method output_type
+	4,  // [4:8] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_mediax_proto_init() }
+func file_mediax_proto_init() {
+	if File_mediax_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_mediax_proto_rawDesc), len(file_mediax_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   10,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_mediax_proto_goTypes,
+		DependencyIndexes: file_mediax_proto_depIdxs,
+		MessageInfos:      file_mediax_proto_msgTypes,
+	}.Build()
+	File_mediax_proto = out.File
+	file_mediax_proto_goTypes = nil
+	file_mediax_proto_depIdxs = nil
+}
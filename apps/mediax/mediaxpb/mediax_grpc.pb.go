@@ -0,0 +1,261 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: mediax.proto
+
+package mediaxpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	MediaX_Process_FullMethodName     = "/mediax.v1.MediaX/Process"
+	MediaX_GetMetadata_FullMethodName = "/mediax.v1.MediaX/GetMetadata"
+	MediaX_Purge_FullMethodName       = "/mediax.v1.MediaX/Purge"
+	MediaX_Prewarm_FullMethodName     = "/mediax.v1.MediaX/Prewarm"
+)
+
+// MediaXClient is the client API for MediaX service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// MediaX exposes the HTTP media pipeline to internal services as typed RPCs.
+// Media is addressed the same way as over HTTP: the origin host plus the
+// path, with processing options given as query-style key/value pairs
+// (w, h, f, q, preview, thumbnail, profile, ...).
+type MediaXClient interface {
+	// Process returns the processed media as a stream of chunks. The first
+	// chunk carries the MIME type and total size.
+	Process(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Chunk], error)
+	// GetMetadata returns the detail=true metadata of a file.
+	GetMetadata(ctx context.Context, in *MediaRequest, opts ...grpc.CallOption) (*MetadataResponse, error)
+	// Purge drops the staged original (forcing a refetch from storage) and any
+	// cached not-found result for the path.
+	Purge(ctx context.Context, in *MediaRequest, opts ...grpc.CallOption) (*PurgeResponse, error)
+	// Prewarm generates the given variants ahead of traffic.
+	Prewarm(ctx context.Context, in *PrewarmRequest, opts ...grpc.CallOption) (*PrewarmResponse, error)
+}
+
+type mediaXClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMediaXClient(cc grpc.ClientConnInterface) MediaXClient {
+	return &mediaXClient{cc}
+}
+
+func (c *mediaXClient) Process(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Chunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &MediaX_ServiceDesc.Streams[0], MediaX_Process_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ProcessRequest, Chunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type MediaX_ProcessClient = grpc.ServerStreamingClient[Chunk]
+
+func (c *mediaXClient) GetMetadata(ctx context.Context, in *MediaRequest, opts ...grpc.CallOption) (*MetadataResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MetadataResponse)
+	err := c.cc.Invoke(ctx, MediaX_GetMetadata_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mediaXClient) Purge(ctx context.Context, in *MediaRequest, opts ...grpc.CallOption) (*PurgeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PurgeResponse)
+	err := c.cc.Invoke(ctx, MediaX_Purge_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mediaXClient) Prewarm(ctx context.Context, in *PrewarmRequest, opts ...grpc.CallOption) (*PrewarmResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PrewarmResponse)
+	err := c.cc.Invoke(ctx, MediaX_Prewarm_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MediaXServer is the server API for MediaX service.
+// All implementations must embed UnimplementedMediaXServer
+// for forward compatibility.
+//
+// MediaX exposes the HTTP media pipeline to internal services as typed RPCs.
+// Media is addressed the same way as over HTTP: the origin host plus the
+// path, with processing options given as query-style key/value pairs
+// (w, h, f, q, preview, thumbnail, profile, ...).
+type MediaXServer interface {
+	// Process returns the processed media as a stream of chunks. The first
+	// chunk carries the MIME type and total size.
+	Process(*ProcessRequest, grpc.ServerStreamingServer[Chunk]) error
+	// GetMetadata returns the detail=true metadata of a file.
+	GetMetadata(context.Context, *MediaRequest) (*MetadataResponse, error)
+	// Purge drops the staged original (forcing a refetch from storage) and any
+	// cached not-found result for the path.
+	Purge(context.Context, *MediaRequest) (*PurgeResponse, error)
+	// Prewarm generates the given variants ahead of traffic.
+	Prewarm(context.Context, *PrewarmRequest) (*PrewarmResponse, error)
+	mustEmbedUnimplementedMediaXServer()
+}
+
+// UnimplementedMediaXServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedMediaXServer struct{}
+
+func (UnimplementedMediaXServer) Process(*ProcessRequest, grpc.ServerStreamingServer[Chunk]) error {
+	return status.Error(codes.Unimplemented, "method Process not implemented")
+}
+func (UnimplementedMediaXServer) GetMetadata(context.Context, *MediaRequest) (*MetadataResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetMetadata not implemented")
+}
+func (UnimplementedMediaXServer) Purge(context.Context, *MediaRequest) (*PurgeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Purge not implemented")
+}
+func (UnimplementedMediaXServer) Prewarm(context.Context, *PrewarmRequest) (*PrewarmResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Prewarm not implemented")
+}
+func (UnimplementedMediaXServer) mustEmbedUnimplementedMediaXServer() {}
+func (UnimplementedMediaXServer) testEmbeddedByValue()                {}
+
+// UnsafeMediaXServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MediaXServer will
+// result in compilation errors.
+type UnsafeMediaXServer interface {
+	mustEmbedUnimplementedMediaXServer()
+}
+
+func RegisterMediaXServer(s grpc.ServiceRegistrar, srv MediaXServer) {
+	// If the following call panics, it indicates UnimplementedMediaXServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&MediaX_ServiceDesc, srv)
+}
+
+func _MediaX_Process_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ProcessRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MediaXServer).Process(m, &grpc.GenericServerStream[ProcessRequest, Chunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type MediaX_ProcessServer = grpc.ServerStreamingServer[Chunk]
+
+func _MediaX_GetMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MediaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MediaXServer).GetMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MediaX_GetMetadata_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MediaXServer).GetMetadata(ctx, req.(*MediaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MediaX_Purge_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MediaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MediaXServer).Purge(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MediaX_Purge_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MediaXServer).Purge(ctx, req.(*MediaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MediaX_Prewarm_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PrewarmRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MediaXServer).Prewarm(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MediaX_Prewarm_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MediaXServer).Prewarm(ctx, req.(*PrewarmRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// MediaX_ServiceDesc is the grpc.ServiceDesc for MediaX service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MediaX_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "mediax.v1.MediaX",
+	HandlerType: (*MediaXServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetMetadata",
+			Handler:    _MediaX_GetMetadata_Handler,
+		},
+		{
+			MethodName: "Purge",
+			Handler:    _MediaX_Purge_Handler,
+		},
+		{
+			MethodName: "Prewarm",
+			Handler:    _MediaX_Prewarm_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Process",
+			Handler:       _MediaX_Process_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "mediax.proto",
+}
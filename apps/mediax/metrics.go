@@ -21,4 +21,69 @@ var (
 		Help:      "Histogram of encoder processing durations in seconds.",
 		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
 	}, []string{"extension"})
+
+	// metricPanics counts recovered panics, in a request handler or an encoder.
+	metricPanics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "panics_total",
+		Help:      "Total number of panics recovered while serving requests.",
+	}, []string{"where"})
+
+	// metricModeration counts moderated requests by project and outcome:
+	// safe, unsafe or error.
+	metricModeration = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "moderation_total",
+		Help:      "Total number of requests checked by content moderation.",
+	}, []string{"project", "verdict"})
+
+	// metricWatermarks counts image outputs of projects with forensic
+	// watermarks by project and outcome: marked, too_small (served
+	// unmarked) or error.
+	metricWatermarks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "watermarks_total",
+		Help:      "Total number of outputs served with a forensic watermark, or failing to get one.",
+	}, []string{"project", "result"})
+
+	// metricHLSKeys counts requests for HLS encryption keys by project and
+	// result: served, or expired for epochs no longer valid.
+	metricHLSKeys = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "hls_keys_total",
+		Help:      "Total number of HLS encryption key requests.",
+	}, []string{"project", "result"})
+
+	// metricAccessDenied counts requests refused by the IP and country rules
+	// of origins, by project and reason: ip, country or geoip_error.
+	metricAccessDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "access_denied_total",
+		Help:      "Total number of requests refused by origin IP and country rules.",
+	}, []string{"project", "reason"})
+
+	// metricZips counts ZIP downloads by project and result: complete,
+	// partial (with errors.txt) or aborted.
+	metricZips = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mediax",
+		Name:      "zip_downloads_total",
+		Help:      "Total number of ZIP archives streamed.",
+	}, []string{"project", "result"})
+
+	// metricPipelineDuration and metricPipelineOutputBytes measure the new
+	// outputs of requests an encoder alternative supports, by pipeline
+	// ("primary" or the alternative; see routeCanary) and output format, to
+	// compare a canary with the encoder it would replace.
+	metricPipelineDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mediax",
+		Name:      "pipeline_duration_seconds",
+		Help:      "Histogram of the time taken to generate outputs, by pipeline.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"pipeline", "format"})
+	metricPipelineOutputBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mediax",
+		Name:      "pipeline_output_bytes",
+		Help:      "Histogram of the size of generated outputs, by pipeline.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"pipeline", "format"})
 )
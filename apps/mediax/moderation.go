@@ -0,0 +1,61 @@
+package mediax
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"mediax/apps/media"
+	"mediax/encoders"
+)
+
+// moderate applies the project's moderation policy to the staged image or
+// video of req and returns the response refusing it, or nil to serve it.
+// JSON outputs (detail, phash) show nothing of the content and are not
+// moderated.
+func moderate(req *media.Request) any {
+	project := req.Origin.Project
+	if project.ModerationPolicy == "" || req.Options.Detail || req.Options.PHash {
+		return nil
+	}
+	if family := mediaCategory(req.MediaType.Mime); family != "image" && family != "video" {
+		return nil
+	}
+	verdict, err := encoders.Moderate(req)
+	if errors.Is(err, media.ErrOverloaded) {
+		return overloaded(req)
+	}
+	if err != nil {
+		metricModeration.WithLabelValues(project.Name, "error").Inc()
+		log.Error("content moderation failed", "trace_id", req.TraceID, "project", project.Name, "path", req.OriginalFilePath, "error", err)
+		// Without a verdict nothing may be served under "block".
+		if project.ModerationPolicy == "block" {
+			metricRequests.WithLabelValues(req.Extension, "error").Inc()
+			return outcome.Text("content moderation unavailable").Status(evo.StatusServiceUnavailable)
+		}
+		return nil
+	}
+
+	unsafe := verdict.Score >= project.ModerationCutoff()
+	if !unsafe {
+		metricModeration.WithLabelValues(project.Name, "safe").Inc()
+	} else {
+		metricModeration.WithLabelValues(project.Name, "unsafe").Inc()
+		log.Warning("content flagged by moderation", "trace_id", req.TraceID, "project", project.Name, "path", req.OriginalFilePath, "score", verdict.Score, "policy", project.ModerationPolicy)
+	}
+	switch project.ModerationPolicy {
+	case "block":
+		if unsafe {
+			metricRequests.WithLabelValues(req.Extension, "rejected").Inc()
+			return outcome.Text("blocked by content moderation").Status(evo.StatusUnavailableForLegalReasons)
+		}
+	case "flag":
+		req.Request.Set("X-Moderation-Score", strconv.FormatFloat(verdict.Score, 'f', 3, 64))
+		if unsafe {
+			req.Request.Set("X-Moderation", "flagged")
+		}
+	}
+	return nil
+}
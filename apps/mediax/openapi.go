@@ -0,0 +1,256 @@
+package mediax
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"mediax/apps/media"
+	"mediax/mediaurl"
+)
+
+// mediaParameters documents the media query parameters shared across media
+// types. They are referenced from each path as components.
+var mediaParameters = map[string]map[string]any{
+	"w":           queryParam("w", "Width in pixels, snapped down to a supported size", intSchema(0, mediaurl.MaxDimension)),
+	"h":           queryParam("h", "Height in pixels, snapped down to a supported size", intSchema(0, mediaurl.MaxDimension)),
+	"size":        queryParam("size", "Width and height as WxH", map[string]any{"type": "string", "pattern": `^\d+x\d+$`}),
+	"q":           queryParam("q", "Quality, snapped down to a supported level", intSchema(1, 100)),
+	"crop":        queryParam("crop", "Crop to the requested size instead of keeping the aspect ratio", boolSchema()),
+	"ar":          queryParam("ar", "Aspect ratio such as 16:9 or 9:16, deriving the missing one of w and h", map[string]any{"type": "string", "pattern": `^\d+:\d+$`}),
+	"scale":       queryParam("scale", "Percentage of the source dimensions, instead of w and h", intSchema(1, 100)),
+	"pad":         queryParam("pad", "Letterbox into w x h instead of cropping", boolSchema()),
+	"fit":         queryParam("fit", "Fit inside w x h keeping the aspect ratio instead of cropping", boolSchema()),
+	"dir":         queryParam("dir", "Crop direction", map[string]any{"type": "string", "enum": []string{"top", "bottom", "left", "right", "center"}}),
+	"raw":         queryParam("raw", "Serve the original file unchanged, ignoring every other option", boolSchema()),
+	"download":    queryParam("download", "Serve as an attachment", boolSchema()),
+	"disposition": queryParam("disposition", "Content-Disposition type, overriding download", map[string]any{"type": "string", "enum": []string{"inline", "attachment"}}),
+	"filename":    queryParam("filename", "File name in the Content-Disposition, RFC 5987 encoded when not ASCII", map[string]any{"type": "string", "maxLength": 255}),
+	"detail":      queryParam("detail", "Return JSON metadata instead of the file", boolSchema()),
+	"loudness":    queryParam("loudness", "With detail=true, measure the EBU R128 loudness of audio", boolSchema()),
+	"ocr":         queryParam("ocr", "Return the recognized text with bounding boxes as JSON", boolSchema()),
+	"lang":        queryParam("lang", "Tesseract languages for ocr, e.g. eng or eng+deu", map[string]any{"type": "string", "pattern": mediaurl.LangPattern.String()}),
+	"phash":       queryParam("phash", "Return the perceptual hash of an image or video keyframes as JSON", boolSchema()),
+	"dzi":         queryParam("dzi", "Return the Deep Zoom descriptor", boolSchema()),
+	"tile":        queryParam("tile", "Deep Zoom tile address level/col_row", map[string]any{"type": "string", "pattern": mediaurl.TilePattern.String()}),
+	"preview":     queryParam("preview", "Video preview quality: true, 480p, 720p, 1080p, 4k or WxH", map[string]any{"type": "string"}),
+	"thumbnail":   queryParam("thumbnail", "Thumbnail size: 480p, 720p, 1080p, 4k or WxH", map[string]any{"type": "string"}),
+	"ss":          queryParam("ss", "Thumbnail timestamp in seconds", intSchema(0, 0)),
+	"frame":       queryParam("frame", "Single frame of an animated GIF or WebP, numbered from 1", intSchema(1, 0)),
+	"trim":        queryParam("trim", "Remove uniform borders before resizing", boolSchema()),
+	"bg_remove":   queryParam("bg_remove", "Make the background of this colour transparent (png, webp, avif or gif output)", map[string]any{"type": "string", "pattern": mediaurl.ColorPattern.String()}),
+	"bg":          queryParam("bg", "remove cuts the subject out with the background removal service (png, webp, avif or gif output); answered 202 while in progress", map[string]any{"type": "string", "enum": []string{"remove"}}),
+	"fuzz":        queryParam("fuzz", "Colour distance in percent for trim and bg_remove", intSchema(0, 100)),
+	"strip":       queryParam("strip", "Remove EXIF, XMP and other metadata from the image", boolSchema()),
+	"dpi":         queryParam("dpi", "Resolution for print: sets the image's density metadata, and renders PDF and office pages at this DPI", intSchema(mediaurl.MinDPI, mediaurl.MaxDPI)),
+	"maxbytes":    queryParam("maxbytes", "Largest output size such as 200KB; the quality of jpg, webp or avif output is lowered until it fits, 422 if it cannot", map[string]any{"type": "string", "pattern": `^\d+(\.\d+)?\s*([KkMm]?[Bb])?$`}),
+	"flatten":     queryParam("flatten", "Render PDF annotations and form fields into the page content", boolSchema()),
+	"pages":       queryParam("pages", "Pages of a PDF or TIFF converted to TIFF or PDF, e.g. 1-3,5", map[string]any{"type": "string", "pattern": mediaurl.PagesPattern.String()}),
+	"compression": queryParam("compression", "Compression of TIFF output: g4 (bilevel, for fax), lzw or none", map[string]any{"type": "string", "enum": []string{"g4", "lzw", "none"}}),
+	"attachment":  queryParam("attachment", "Single attachment of an email message, numbered from 1", intSchema(1, 0)),
+	"chapter":     queryParam("chapter", "Single chapter of an audiobook, numbered from 1", intSchema(1, 0)),
+	"hls":         queryParam("hls", "Return the HTTP Live Streaming playlist of AAC segments in MPEG-TS", boolSchema()),
+	"segment":     queryParam("segment", "With hls=true, a single segment of the playlist, numbered from 1", intSchema(1, 0)),
+	"epoch":       queryParam("epoch", "With segment, the key epoch an encrypted segment is encrypted for; set in playlist URLs", intSchema(0, 0)),
+	"hls_key":     queryParam("hls_key", "With hls=true, the AES-128 key of this epoch, on projects with hls_encryption; set in playlist URLs", intSchema(0, 0)),
+	"profile":     queryParam("profile", "Video profile name", map[string]any{"type": "string"}),
+	"vb":          queryParam("vb", "Video bitrate of a profile transcode such as 2500k, instead of the quality; overrides the profile", map[string]any{"type": "string", "pattern": mediaurl.BitratePattern.String()}),
+	"ab":          queryParam("ab", "Audio bitrate of a profile transcode such as 128k; overrides the profile", map[string]any{"type": "string", "pattern": mediaurl.BitratePattern.String()}),
+	"twopass":     queryParam("twopass", "Encode a profile transcode in two passes; needs a video bitrate", boolSchema()),
+	"s":           queryParam("s", "URL signature, required on origins with a signing_key", map[string]any{"type": "string"}),
+	"expires":     queryParam("expires", "Expiry of a signed URL in unix seconds", intSchema(0, 0)),
+	"uid":         queryParam("uid", "User the response is served to, recorded with its forensic watermark on projects that embed them", map[string]any{"type": "string", "maxLength": 255}),
+}
+
+// categoryParameters lists the parameters each media category understands,
+// besides f (whose values depend on the source extension).
+var categoryParameters = map[string][]string{
+	"image":    {"w", "h", "size", "ar", "scale", "q", "crop", "pad", "fit", "dir", "frame", "trim", "bg_remove", "fuzz", "bg", "strip", "dpi", "maxbytes", "pages", "compression", "detail", "phash", "ocr", "lang", "dzi", "tile", "download", "disposition", "filename"},
+	"video":    {"w", "h", "q", "preview", "thumbnail", "scale", "ss", "profile", "vb", "ab", "twopass", "detail", "phash", "download", "disposition", "filename"},
+	"audio":    {"q", "thumbnail", "detail", "loudness", "chapter", "hls", "segment", "epoch", "hls_key", "download", "disposition", "filename"},
+	"model":    {"q", "thumbnail", "preview", "download", "disposition", "filename"},
+	"document": {"w", "h", "q", "thumbnail", "dpi", "pages", "compression", "flatten", "attachment", "ocr", "lang", "download", "disposition", "filename"},
+}
+
+// OpenAPI serves an OpenAPI 3 description of the media routes, generated
+// from the registered media types.
+func (c Controller) OpenAPI(request *evo.Request) any {
+	return outcome.Json(buildOpenAPI())
+}
+
+func buildOpenAPI() map[string]any {
+	types := loadedMediaTypes()
+	extensions := make([]string, 0, len(types))
+	for ext := range types {
+		extensions = append(extensions, ext)
+	}
+	sort.Strings(extensions)
+
+	paths := map[string]any{}
+	for _, ext := range extensions {
+		t := types[ext]
+		category := mediaCategory(t.Mime)
+		formats := make([]string, 0, len(t.Encoders))
+		for f := range t.Encoders {
+			formats = append(formats, f)
+		}
+		sort.Strings(formats)
+
+		params := []any{
+			map[string]any{"name": "path", "in": "path", "required": true,
+				"description": "File path below the origin prefix, without the extension",
+				"schema":      map[string]any{"type": "string"}},
+			queryParam("f", "Output format", map[string]any{"type": "string", "enum": formats, "default": ext}),
+		}
+		for _, name := range append(categoryParameters[category], "raw", "s", "expires", "uid") {
+			params = append(params, map[string]any{"$ref": "#/components/parameters/" + name})
+		}
+
+		content := map[string]any{}
+		for _, f := range formats {
+			content[outputMime(types, t, f)] = map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}
+		}
+		if category != "document" {
+			content["application/json"] = map[string]any{"schema": map[string]any{"type": "object"}}
+		}
+
+		paths["/{path}."+ext] = map[string]any{
+			"get": map[string]any{
+				"tags":        []string{category},
+				"summary":     "Serve or transform a ." + ext + " file",
+				"operationId": "get_" + ext,
+				"parameters":  params,
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The processed file, or JSON metadata with detail=true", "content": content},
+					"307": map[string]any{"description": "The file is being staged; retry the same URL"},
+					"400": map[string]any{"description": "Invalid parameters"},
+					"401": map[string]any{"description": "Missing or invalid API key"},
+					"403": map[string]any{"description": "Unknown domain or invalid signature"},
+					"404": map[string]any{"description": "File not found"},
+					"413": map[string]any{"description": "Source file larger than MEDIAX.MaxSourceSize"},
+					"415": map[string]any{"description": "Unsupported media type or output format"},
+					"422": map[string]any{"description": "The image does not fit in maxbytes"},
+					"429": map[string]any{"description": "API key quota exceeded"},
+					"503": map[string]any{"description": "Insufficient cache space, or overloaded (see Retry-After)"},
+					"504": map[string]any{"description": "Transcode stopped when X-Request-Budget elapsed"},
+				},
+			},
+		}
+	}
+
+	paths["/generate/qr"] = map[string]any{
+		"get": map[string]any{
+			"tags":        []string{"generate"},
+			"summary":     "Generate a QR code",
+			"operationId": "generate_qr",
+			"parameters": []any{
+				map[string]any{"name": "text", "in": "query", "required": true,
+					"description": "Text to encode, in UTF-8",
+					"schema":      map[string]any{"type": "string"}},
+				queryParam("size", "Width and height in pixels", map[string]any{"type": "integer", "minimum": 21, "maximum": maxQRSize, "default": defaultQRSize}),
+				queryParam("format", "Output format", map[string]any{"type": "string", "enum": []string{"png", "svg"}, "default": "png"}),
+				queryParam("level", "Error correction level", map[string]any{"type": "string", "enum": []string{"L", "M", "Q", "H"}, "default": "M"}),
+				queryParam("margin", "Quiet zone around the code, in modules", map[string]any{"type": "integer", "minimum": 0, "maximum": maxQRMargin, "default": defaultQRMargin}),
+				map[string]any{"$ref": "#/components/parameters/download"},
+				map[string]any{"$ref": "#/components/parameters/disposition"},
+				map[string]any{"$ref": "#/components/parameters/filename"},
+			},
+			"responses": map[string]any{
+				"200": map[string]any{"description": "The QR code", "content": map[string]any{
+					"image/png":     map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+					"image/svg+xml": map[string]any{"schema": map[string]any{"type": "string"}},
+				}},
+				"400": map[string]any{"description": "Invalid parameters, or the text does not fit"},
+				"401": map[string]any{"description": "Missing or invalid API key"},
+				"403": map[string]any{"description": "Unknown domain"},
+			},
+		},
+	}
+	paths["/placeholder/{size}"] = map[string]any{
+		"get": map[string]any{
+			"tags":        []string{"generate"},
+			"summary":     "Generate a placeholder image",
+			"operationId": "generate_placeholder",
+			"parameters": []any{
+				map[string]any{"name": "size", "in": "path", "required": true,
+					"description": "{width}x{height}, optionally followed by .png, .jpg, .webp or .gif",
+					"schema":      map[string]any{"type": "string"}},
+				queryParam("f", "Output format, overriding the extension", map[string]any{"type": "string", "enum": []string{"png", "jpg", "webp", "gif"}, "default": "png"}),
+				queryParam("bg", "Background colour name or hex value", map[string]any{"type": "string", "default": "cccccc"}),
+				queryParam("color", "Text colour name or hex value", map[string]any{"type": "string", "default": "555555"}),
+				queryParam("text", "Text drawn in the middle; empty for none. Defaults to the size", map[string]any{"type": "string", "maxLength": maxPlaceholderText}),
+				map[string]any{"$ref": "#/components/parameters/download"},
+				map[string]any{"$ref": "#/components/parameters/disposition"},
+				map[string]any{"$ref": "#/components/parameters/filename"},
+			},
+			"responses": map[string]any{
+				"200": map[string]any{"description": "The placeholder image", "content": map[string]any{
+					"image/png":  map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+					"image/jpeg": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+					"image/webp": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+					"image/gif":  map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}},
+				}},
+				"400": map[string]any{"description": "Invalid size, colour, text or format"},
+				"401": map[string]any{"description": "Missing or invalid API key"},
+				"403": map[string]any{"description": "Unknown domain"},
+			},
+		},
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "MediaX media API",
+			"description": "On-the-fly media transformation. Every path is served on the domain of a configured origin.",
+			"version":     "1.0",
+		},
+		"tags": []any{
+			map[string]any{"name": "image"},
+			map[string]any{"name": "video"},
+			map[string]any{"name": "audio"},
+			map[string]any{"name": "model"},
+			map[string]any{"name": "document"},
+			map[string]any{"name": "generate"},
+		},
+		"paths":      paths,
+		"components": map[string]any{"parameters": mediaParameters},
+	}
+}
+
+// mediaCategory groups a source MIME type into image, video, audio, model or
+// document.
+func mediaCategory(mime string) string {
+	for _, c := range []string{"image", "video", "audio", "model"} {
+		if strings.HasPrefix(mime, c+"/") {
+			return c
+		}
+	}
+	return "document"
+}
+
+// outputMime returns the MIME type served for output format f of t. Formats
+// that are media types themselves (e.g. thumbnails of videos, audio and
+// documents) use that type's MIME type rather than the source encoder's.
+func outputMime(types map[string]*media.Type, t *media.Type, f string) string {
+	if out, ok := types[f]; ok {
+		return out.Mime
+	}
+	return t.Encoders[f].Mime
+}
+
+func queryParam(name, description string, schema map[string]any) map[string]any {
+	return map[string]any{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+func intSchema(minimum, maximum int) map[string]any {
+	s := map[string]any{"type": "integer", "minimum": minimum}
+	if maximum > 0 {
+		s["maximum"] = maximum
+	}
+	return s
+}
+
+func boolSchema() map[string]any {
+	return map[string]any{"type": "boolean"}
+}
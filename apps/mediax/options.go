@@ -0,0 +1,52 @@
+package mediax
+
+import (
+	"errors"
+
+	"github.com/getevo/evo/v2"
+	"mediax/apps/media"
+)
+
+// optionsError is an error of ParseOptions with the HTTP status ServeMedia
+// answers it with.
+type optionsError struct {
+	status int
+	err    error
+}
+
+func (e *optionsError) Error() string { return e.err.Error() }
+
+func (e *optionsError) Unwrap() error { return e.err }
+
+// ParseOptions parses the options of a request for a file of mediaType on
+// origin as ServeMedia does: query merged with the origin's default and
+// forced options, checked against its allow lists, with the video profile
+// resolved. Requests for the unmodified file get the direct encoder, so no
+// encoder runs for them.
+func ParseOptions(mediaType *media.Type, query media.QueryFunc, origin *media.Origin) (*media.Options, error) {
+	options, err := mediaType.ParseOptions(query, origin)
+	if errors.Is(err, media.ErrFormatNotAllowed) {
+		return nil, &optionsError{status: evo.StatusUnsupportedMediaType, err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if options.Profile != "" {
+		vp, ok := lookupVideoProfile(options.Profile)
+		if !ok {
+			return nil, &optionsError{status: evo.StatusBadRequest, err: errors.New("unknown video profile: " + options.Profile)}
+		}
+		options.VideoProfile = vp
+		if _, _, _, err := options.TranscodeSettings(); err != nil {
+			return nil, &optionsError{status: evo.StatusBadRequest, err: err}
+		}
+	}
+	passthrough := options.Passthrough(mediaType.Extension)
+	if family := mediaCategory(mediaType.Mime); !passthrough && origin.Project.EncoderDisabled(family) {
+		return nil, &optionsError{status: evo.StatusForbidden, err: errors.New(family + " processing is disabled for this domain")}
+	}
+	if passthrough {
+		options.Encoder = mediaType.DirectEncoder()
+	}
+	return options, nil
+}
@@ -0,0 +1,103 @@
+package mediax
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"mediax/encoders"
+	"mediax/mediaurl"
+)
+
+// maxPlaceholderText is the longest ?text= of a placeholder, in characters.
+const maxPlaceholderText = 64
+
+// placeholderMimes are the formats of /placeholder.
+var placeholderMimes = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"webp": "image/webp",
+	"gif":  "image/gif",
+}
+
+// Placeholder serves GET /placeholder/{width}x{height}[.format]: a plain
+// image of ?bg= colour with ?text= (the size by default) in ?color=. The
+// format is the extension or ?f=, png by default. Images are generated
+// once and cached in the project of the requested domain.
+func (c Controller) Placeholder(request *evo.Request) any {
+	req, apiKey, refused := generatorRequest(request)
+	if refused != nil {
+		return refused
+	}
+	defer func() { recordUsage(apiKey, req) }()
+
+	p, err := parsePlaceholder(request)
+	if err != nil {
+		return outcome.Text(err.Error()).Status(evo.StatusBadRequest)
+	}
+	req.ProcessedFilePath, err = encoders.GeneratePlaceholder(req.Origin.Project.CacheDir, p)
+	if err != nil {
+		log.Error("failed to generate placeholder", "trace_id", req.TraceID, "error", err)
+		return outcome.Text("failed to generate placeholder").Status(evo.StatusInternalServerError)
+	}
+	return req.ServeFile(placeholderMimes[p.Format], req.ProcessedFilePath)
+}
+
+// parsePlaceholder reads and validates the path and query of /placeholder.
+func parsePlaceholder(request *evo.Request) (encoders.Placeholder, error) {
+	p := encoders.Placeholder{Background: "cccccc", Color: "555555", Format: "png"}
+	name := path.Base(request.URL().Path)
+	if ext := path.Ext(name); ext != "" {
+		p.Format = strings.ToLower(ext[1:])
+		name = strings.TrimSuffix(name, ext)
+	}
+	if f := request.Query("f").String(); f != "" {
+		p.Format = strings.ToLower(f)
+	}
+	if p.Format == "jpeg" {
+		p.Format = "jpg"
+	}
+	if _, ok := placeholderMimes[p.Format]; !ok {
+		return p, errors.New("format must be png, jpg, webp or gif")
+	}
+
+	w, h, ok := strings.Cut(strings.ToLower(name), "x")
+	if !ok {
+		w, h = name, name
+	}
+	var err error
+	if p.Width, err = strconv.Atoi(w); err == nil {
+		p.Height, err = strconv.Atoi(h)
+	}
+	if err != nil || p.Width < 1 || p.Height < 1 || p.Width > mediaurl.MaxDimension || p.Height > mediaurl.MaxDimension {
+		return p, fmt.Errorf("size must be {width}x{height} between 1 and %d", mediaurl.MaxDimension)
+	}
+
+	for param, value := range map[string]*string{"bg": &p.Background, "color": &p.Color} {
+		if c := request.Query(param).String(); c != "" {
+			if !mediaurl.ColorPattern.MatchString(c) {
+				return p, fmt.Errorf("invalid %s colour %q: expected a colour name or hex value", param, c)
+			}
+			*value = c
+		}
+	}
+
+	p.Text = fmt.Sprintf("%d×%d", p.Width, p.Height)
+	if request.Context.Request().URI().QueryArgs().Has("text") {
+		p.Text = strings.TrimSpace(request.Query("text").String())
+	}
+	if !utf8.ValidString(p.Text) || utf8.RuneCountInString(p.Text) > maxPlaceholderText {
+		return p, fmt.Errorf("text must be valid UTF-8 of at most %d characters", maxPlaceholderText)
+	}
+	if strings.IndexFunc(p.Text, unicode.IsControl) >= 0 {
+		return p, errors.New("text must not contain control characters")
+	}
+	return p, nil
+}
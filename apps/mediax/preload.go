@@ -0,0 +1,59 @@
+package mediax
+
+import (
+	neturl "net/url"
+	"strconv"
+
+	"mediax/apps/media"
+	"mediax/mediaurl"
+)
+
+// lqipWidth is the width of the placeholder announced by the lqip hint.
+const lqipWidth = 32
+
+// preload announces the companion assets the origin's preload_hints ask for
+// in Link: rel=preload headers of a response of type mime to req: the poster
+// frame of a video and the tiny placeholder of an image. MediaX cannot send
+// 103 Early Hints itself; CDNs that support them turn these headers into
+// one on the next request for the same URL.
+func preload(req *media.Request, mime string) {
+	origin := req.Origin
+	// Dialect origins do not serve the native URLs the hints are made of.
+	if origin.PreloadHints == "" || origin.URLDialect != "" || req.OriginalFilePath == "" {
+		return
+	}
+	o := req.Options
+	source, output := mediaCategory(req.MediaType.Mime), mediaCategory(mime)
+	for _, hint := range origin.Preloads() {
+		query := neturl.Values{}
+		switch {
+		case hint == "poster" && source == "video" && output == "video" && !o.HLS && origin.AllowsFormat("jpg"):
+			query.Set("f", "jpg")
+		case hint == "lqip" && source == "image" && output == "image" && !o.DZI && o.Tile == "" &&
+			(o.Width == 0 || o.Width > lqipWidth) && origin.AllowsFormat(req.Extension):
+			query.Set("w", strconv.Itoa(lqipWidth))
+			query.Set("q", "30")
+		default:
+			continue
+		}
+		req.Request.Context.Append("Link", "<"+companionURL(req, query)+">; rel=preload; as=image")
+	}
+}
+
+// companionURL returns the URL of the variant of the file of req given by
+// query, carrying the api_key and expires of the request and signed on
+// origins with a signing_key.
+func companionURL(req *media.Request, query neturl.Values) string {
+	args := req.Request.Context.Request().URI().QueryArgs()
+	if v := args.Peek("expires"); len(v) > 0 {
+		query.Set("expires", string(v))
+	}
+	if key := req.Origin.SigningKey; key != "" {
+		query.Set("s", mediaurl.Sign(key, req.Url.Path, query))
+	}
+	// api_key is not part of the signature.
+	if v := args.Peek("api_key"); len(v) > 0 {
+		query.Set("api_key", string(v))
+	}
+	return (&neturl.URL{Path: req.Url.Path, RawQuery: query.Encode()}).String()
+}
@@ -0,0 +1,243 @@
+package mediax
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/status"
+	"mediax/apps/media"
+)
+
+const (
+	// profileRegenerationRetention is how long finished jobs stay listed.
+	profileRegenerationRetention = 24 * time.Hour
+	// maxProfileRegenerationErrors caps the errors a job reports.
+	maxProfileRegenerationErrors = 100
+	// defaultRegenerationRate is the variants regenerated per second when
+	// the request gives no rate.
+	defaultRegenerationRate = 1
+)
+
+// ProfileRegeneration is a job invalidating, and optionally regenerating,
+// the cached variants made with a video profile.
+type ProfileRegeneration struct {
+	ID          string     `json:"id"`
+	Profile     string     `json:"profile"`
+	Regenerate  bool       `json:"regenerate"`
+	Rate        float64    `json:"rate"`   // regenerations per second at most
+	Status      string     `json:"status"` // running, done, failed or canceled
+	Error       string     `json:"error,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Variants    int        `json:"variants"`    // recorded variants of the profile
+	Invalidated int        `json:"invalidated"` // outputs removed from this instance's cache
+	Regenerated int        `json:"regenerated"`
+	Failed      int        `json:"failed"`
+	Errors      []string   `json:"errors,omitempty"`
+}
+
+// runningRegeneration is a ProfileRegeneration and the function stopping
+// it.
+type runningRegeneration struct {
+	mu     sync.Mutex
+	info   ProfileRegeneration
+	cancel context.CancelFunc
+}
+
+// profileRegenerations holds the running and recently finished jobs by ID.
+var profileRegenerations sync.Map
+
+// profileRegenerationRequest is the body of POST /admin/profiles/regenerate.
+type profileRegenerationRequest struct {
+	Profile    string  `json:"profile"`
+	Regenerate bool    `json:"regenerate"`
+	Rate       float64 `json:"rate"`
+}
+
+// StartProfileRegeneration removes the cached variants made with a video
+// profile, e.g. after its size or bitrate changed, and with regenerate
+// requests them again through the regular pipeline, one at a time and at
+// most rate per second. The job runs in the background; its progress is
+// read from GET /admin/profiles/regenerate?id=.
+func (c Controller) StartProfileRegeneration(request *evo.Request) any {
+	<-ready
+	var body profileRegenerationRequest
+	if err := request.BodyParser(&body); err != nil {
+		return outcome.Text("invalid request body").Status(evo.StatusBadRequest)
+	}
+	if body.Profile == "" {
+		return outcome.Text("profile is required").Status(evo.StatusBadRequest)
+	}
+	if body.Rate == 0 {
+		body.Rate = defaultRegenerationRate
+	}
+	if body.Rate < 0 || body.Rate > 100 {
+		return outcome.Text("rate must be positive and at most 100").Status(evo.StatusBadRequest)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &runningRegeneration{cancel: cancel, info: ProfileRegeneration{
+		ID:         uuid.New().String(),
+		Profile:    body.Profile,
+		Regenerate: body.Regenerate,
+		Rate:       body.Rate,
+		Status:     "running",
+		StartedAt:  time.Now(),
+	}}
+	profileRegenerations.Store(job.info.ID, job)
+	go job.run(ctx)
+	return outcome.Json(job.snapshot()).Status(evo.StatusAccepted)
+}
+
+// ProfileRegenerations lists the jobs, newest first, or returns job ?id=.
+func (c Controller) ProfileRegenerations(request *evo.Request) any {
+	if id := request.Query("id").String(); id != "" {
+		v, ok := profileRegenerations.Load(id)
+		if !ok {
+			return outcome.Text("job not found").Status(evo.StatusNotFound)
+		}
+		return outcome.Json(v.(*runningRegeneration).snapshot())
+	}
+	list := []ProfileRegeneration{}
+	profileRegenerations.Range(func(_, v any) bool {
+		list = append(list, v.(*runningRegeneration).snapshot())
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.After(list[j].StartedAt) })
+	return outcome.Json(list)
+}
+
+// CancelProfileRegeneration stops the running job ?id=.
+func (c Controller) CancelProfileRegeneration(request *evo.Request) any {
+	v, ok := profileRegenerations.Load(request.Query("id").String())
+	if !ok {
+		return outcome.Text("job not found").Status(evo.StatusNotFound)
+	}
+	v.(*runningRegeneration).cancel()
+	return outcome.Json(map[string]bool{"canceled": true})
+}
+
+func (j *runningRegeneration) snapshot() ProfileRegeneration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	info := j.info
+	info.Errors = append([]string(nil), j.info.Errors...)
+	return info
+}
+
+// run goes through the recorded variants of the profile, including the ones
+// this instance has not written yet.
+func (j *runningRegeneration) run(ctx context.Context) {
+	defer j.cancel()
+	err := media.SyncProfileVariants()
+	var variants []media.ProfileVariant
+	if err == nil {
+		variants, err = media.ProfileVariants(j.info.Profile)
+	}
+	if err == nil {
+		j.mu.Lock()
+		j.info.Variants = len(variants)
+		j.mu.Unlock()
+		j.process(ctx, variants)
+		err = ctx.Err()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.info.FinishedAt = &now
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.info.Status = "canceled"
+	case err != nil:
+		j.info.Status = "failed"
+		j.info.Error = err.Error()
+		log.Error("profile regeneration failed", "id", j.info.ID, "profile", j.info.Profile, "error", err)
+	default:
+		j.info.Status = "done"
+	}
+	id := j.info.ID
+	time.AfterFunc(profileRegenerationRetention, func() { profileRegenerations.Delete(id) })
+}
+
+// process removes the output of each variant and, with regenerate,
+// requests it again, waiting for the rate between requests.
+func (j *runningRegeneration) process(ctx context.Context, variants []media.ProfileVariant) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / j.info.Rate))
+	defer ticker.Stop()
+	for i, v := range variants {
+		if j.info.Regenerate && i > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		origin, ok := lookupOrigin(v.Domain)
+		if !ok {
+			j.fail(v, errForbiddenDomain)
+			continue
+		}
+		removed, err := media.InvalidateProfileVariant(origin.Project, v)
+		if err != nil {
+			j.fail(v, err)
+			continue
+		}
+		if removed {
+			j.mu.Lock()
+			j.info.Invalidated++
+			j.mu.Unlock()
+		}
+		if !j.info.Regenerate {
+			continue
+		}
+		if err := regenerateVariant(ctx, origin, v); err != nil {
+			if ctx.Err() == nil {
+				j.fail(v, err)
+			}
+			continue
+		}
+		j.mu.Lock()
+		j.info.Regenerated++
+		j.mu.Unlock()
+	}
+}
+
+func (j *runningRegeneration) fail(v media.ProfileVariant, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.info.Failed++
+	if len(j.info.Errors) < maxProfileRegenerationErrors {
+		j.info.Errors = append(j.info.Errors, fmt.Sprintf("%s/%s?%s: %s", v.Domain, v.Path, v.Options, err))
+	}
+}
+
+// regenerateVariant runs the request that produced v in-process; the output
+// is written to the cache and recorded as any other.
+func regenerateVariant(ctx context.Context, origin *media.Origin, v media.ProfileVariant) error {
+	query, err := url.ParseQuery(v.Options)
+	if err != nil {
+		return err
+	}
+	options := make(map[string]string, len(query))
+	for k := range query {
+		options[k] = query.Get(k)
+	}
+	resp, err := serveInternal(ctx, v.Domain, path.Join("/", origin.PrefixPath, v.Path), options)
+	if err != nil {
+		return errors.New(status.Convert(err).Message())
+	}
+	return resp.CloseBodyStream()
+}
@@ -0,0 +1,151 @@
+package mediax
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// trustedProxies caches the parsed MEDIAX.TrustedProxies setting.
+var trustedProxies struct {
+	sync.Mutex
+	raw  string
+	nets []*net.IPNet
+}
+
+// proxyNets returns the networks of MEDIAX.TrustedProxies, a comma-separated
+// list of CIDRs and addresses. It is re-parsed when the setting changes.
+func proxyNets() []*net.IPNet {
+	raw := settings.Get("MEDIAX.TrustedProxies", "").String()
+	trustedProxies.Lock()
+	defer trustedProxies.Unlock()
+	if raw == trustedProxies.raw {
+		return trustedProxies.nets
+	}
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Warning("ignoring invalid trusted proxy", "entry", entry, "error", err)
+			continue
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies.raw, trustedProxies.nets = raw, nets
+	return nets
+}
+
+// requestHost returns the host origins are matched against. Without
+// MEDIAX.TrustedProxies it is the host fiber reports. With it, the Host
+// header is used unless the peer is a trusted proxy, whose Forwarded host=
+// or X-Forwarded-Host takes precedence. MEDIAX.StripPort drops any port.
+func requestHost(request *evo.Request) string {
+	var host string
+	if nets := proxyNets(); len(nets) == 0 {
+		host = request.URL().Host
+	} else {
+		host = string(request.Context.Request().URI().Host())
+		if peer := request.Context.Context().RemoteIP(); containsIP(nets, peer) {
+			if forwarded := forwardedHost(request.Header("Forwarded")); forwarded != "" {
+				host = forwarded
+			} else if xfh := request.Header("X-Forwarded-Host"); xfh != "" {
+				host, _, _ = strings.Cut(xfh, ",")
+			}
+		}
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	if settings.Get("MEDIAX.StripPort", false).Bool() {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	return host
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHost returns the host= parameter of an RFC 7239 Forwarded header,
+// taken from the first element that has one: the proxy nearest the client.
+func forwardedHost(header string) string {
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "host") {
+				return strings.Trim(value, `"`)
+			}
+		}
+	}
+	return ""
+}
+
+// clientIP returns the address of the client. Without
+// MEDIAX.TrustedProxies it is the peer. With it, the Forwarded for= or
+// X-Forwarded-For chain of trusted peers is walked back from the nearest
+// hop to the first address that is not a trusted proxy; nil when that
+// entry is not an address (e.g. "unknown" or an obfuscated node).
+func clientIP(request *evo.Request) net.IP {
+	peer := request.Context.Context().RemoteIP()
+	nets := proxyNets()
+	if len(nets) == 0 || !containsIP(nets, peer) {
+		return peer
+	}
+	hops := forwardedFor(request.Header("Forwarded"))
+	if len(hops) == 0 {
+		for _, hop := range strings.Split(request.Header("X-Forwarded-For"), ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil || !containsIP(nets, ip) {
+			return ip
+		}
+	}
+	return peer
+}
+
+// forwardedFor returns the for= addresses of an RFC 7239 Forwarded header,
+// client first, without quotes, brackets or ports.
+func forwardedFor(header string) []string {
+	var hops []string
+	for _, element := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || !strings.EqualFold(key, "for") {
+				continue
+			}
+			value = strings.Trim(value, `"`)
+			if strings.HasPrefix(value, "[") {
+				value, _, _ = strings.Cut(value[1:], "]")
+			} else if host, _, err := net.SplitHostPort(value); err == nil {
+				value = host
+			}
+			hops = append(hops, value)
+		}
+	}
+	return hops
+}
@@ -0,0 +1,102 @@
+package mediax
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"mediax/encoders"
+)
+
+const (
+	// maxQRText is the longest text a code is generated for, in bytes; a
+	// version 40 code at level L holds 2953.
+	maxQRText = 2953
+	// defaultQRSize and maxQRSize bound ?size=, in pixels.
+	defaultQRSize = 300
+	maxQRSize     = 2048
+	// defaultQRMargin is the quiet zone the QR specification asks for.
+	defaultQRMargin = 4
+	maxQRMargin     = 32
+)
+
+// GenerateQR serves GET /generate/qr: a QR code of ?text= as PNG or SVG
+// (?format=), ?size= pixels square, with error correction ?level= (L, M, Q
+// or H) and a quiet zone of ?margin= modules. Codes are generated once and
+// cached in the project of the requested domain.
+func (c Controller) GenerateQR(request *evo.Request) any {
+	req, apiKey, refused := generatorRequest(request)
+	if refused != nil {
+		return refused
+	}
+	defer func() { recordUsage(apiKey, req) }()
+
+	code, err := parseQRCode(request)
+	if err != nil {
+		return outcome.Text(err.Error()).Status(evo.StatusBadRequest)
+	}
+	req.ProcessedFilePath, err = encoders.GenerateQR(req.Origin.Project.CacheDir, code)
+	if err != nil {
+		if errors.Is(err, encoders.ErrQRTooLarge) {
+			return outcome.Text(err.Error()).Status(evo.StatusBadRequest)
+		}
+		log.Error("failed to generate QR code", "trace_id", req.TraceID, "error", err)
+		return outcome.Text("failed to generate QR code").Status(evo.StatusInternalServerError)
+	}
+	mime := "image/png"
+	if code.Format == "svg" {
+		mime = "image/svg+xml"
+	}
+	return req.ServeFile(mime, req.ProcessedFilePath)
+}
+
+// parseQRCode reads and validates the query of /generate/qr.
+func parseQRCode(request *evo.Request) (encoders.QRCode, error) {
+	code := encoders.QRCode{
+		Text:   request.Query("text").String(),
+		Size:   defaultQRSize,
+		Format: strings.ToLower(request.Query("format").String()),
+		Level:  strings.ToUpper(request.Query("level").String()),
+		Margin: defaultQRMargin,
+	}
+	if code.Text == "" {
+		return code, errors.New("text is required")
+	}
+	if len(code.Text) > maxQRText || !utf8.ValidString(code.Text) {
+		return code, errors.New("text must be valid UTF-8 of at most " + strconv.Itoa(maxQRText) + " bytes")
+	}
+	if code.Format == "" {
+		code.Format = strings.ToLower(request.Query("f").String())
+	}
+	switch code.Format {
+	case "":
+		code.Format = "png"
+	case "png", "svg":
+	default:
+		return code, errors.New("format must be png or svg")
+	}
+	if code.Level == "" {
+		code.Level = "M"
+	} else if !encoders.ValidQRLevel(code.Level) {
+		return code, errors.New("level must be L, M, Q or H")
+	}
+	if v := request.Query("size").String(); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 21 || n > maxQRSize {
+			return code, errors.New("size must be between 21 and " + strconv.Itoa(maxQRSize))
+		}
+		code.Size = n
+	}
+	if v := request.Query("margin").String(); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxQRMargin {
+			return code, errors.New("margin must be between 0 and " + strconv.Itoa(maxQRMargin))
+		}
+		code.Margin = n
+	}
+	return code, nil
+}
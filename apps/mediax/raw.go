@@ -0,0 +1,76 @@
+package mediax
+
+import (
+	"mime"
+	"net/http"
+	"os"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"mediax/apps/media"
+)
+
+// serveRaw answers raw=1 with the original object unchanged. No other
+// option is read and no encoder runs, so any file on the storages can be
+// fetched, typed by the media type registry or else by its extension or
+// content. The origin's extension and format lists and content moderation
+// still apply; origins with forced options and projects with forensic
+// watermarks refuse raw requests, which would bypass them.
+func serveRaw(req *media.Request) any {
+	if req.Origin.ForcedOptions != "" || req.Origin.Project.ForensicWatermark {
+		return outcome.Text("raw is not allowed on this domain").Status(evo.StatusForbidden)
+	}
+	if !req.Origin.AllowsExtension(req.Extension) || !req.Origin.AllowsFormat(req.Extension) {
+		return outcome.Text("format not allowed: " + req.Extension).Status(evo.StatusUnsupportedMediaType)
+	}
+	t, ok := lookupMediaType(req.Extension)
+	if !ok {
+		t = &media.Type{Extension: req.Extension, Mime: mime.TypeByExtension("." + req.Extension)}
+	}
+	req.MediaType = t
+	req.Options = &media.Options{}
+	req.OriginalFilePath = TrimPrefix(req.Url.Path, req.Origin.PrefixPath)
+
+	if err := media.EnsureFreeSpace(req.Origin.Project); err != nil {
+		metricRequests.WithLabelValues(req.Extension, "rejected").Inc()
+		return outcome.Text("insufficient storage space").Status(evo.StatusServiceUnavailable)
+	}
+	if err := media.EnsureCacheQuota(req.Origin.Project); err != nil {
+		metricRequests.WithLabelValues(req.Extension, "rejected").Inc()
+		return outcome.Text("project cache quota exceeded").Status(evo.StatusServiceUnavailable)
+	}
+	if err := req.StageFile(); err != nil {
+		return stagingFailed(req, err)
+	}
+	defer media.AcquireCacheFile(req.StagedFilePath)()
+	if refused := moderate(req); refused != nil {
+		return refused
+	}
+
+	mimeType := t.Mime
+	if mimeType == "" {
+		mimeType = sniffMime(req.StagedFilePath)
+	}
+	// Whatever the source is, it must not run as a page of the media domain.
+	req.Request.Set("X-Content-Type-Options", "nosniff")
+	req.Request.Set("Content-Security-Policy", "sandbox")
+	if err := req.ServeFile(mimeType, req.StagedFilePath); err != nil {
+		metricRequests.WithLabelValues(req.Extension, "error").Inc()
+		return err
+	}
+	metricRequests.WithLabelValues(req.Extension, "ok").Inc()
+	return nil
+}
+
+// sniffMime returns the MIME type of the content of filePath, or
+// application/octet-stream when it cannot be read.
+func sniffMime(filePath string) string {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	return http.DetectContentType(head[:n])
+}
@@ -0,0 +1,40 @@
+package mediax
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"mediax/apps/media"
+)
+
+// recoverPanics wraps handler so a panic while serving a request becomes a
+// 500 carrying the request's trace ID instead of crashing the instance.
+func recoverPanics(handler func(*evo.Request) any) func(*evo.Request) any {
+	return func(request *evo.Request) (result any) {
+		defer func() {
+			if r := recover(); r != nil {
+				traceID := string(request.Context.Response().Header.Peek("X-Trace-ID"))
+				log.Error("panic serving request", "trace_id", traceID, "path", request.Path(), "panic", r, "stack", string(debug.Stack()))
+				metricPanics.WithLabelValues("handler").Inc()
+				result = outcome.Text("internal error, trace id " + traceID).Status(evo.StatusInternalServerError)
+			}
+		}()
+		return handler(request)
+	}
+}
+
+// runProcessor runs the encoder's Processor on req, turning a panic in it
+// into an error so one bad file or option cannot take the process down.
+func runProcessor(encoder *media.Encoder, req *media.Request) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("encoder panic", "trace_id", req.TraceID, "path", req.OriginalFilePath, "panic", r, "stack", string(debug.Stack()))
+			metricPanics.WithLabelValues("encoder").Inc()
+			err = fmt.Errorf("encoder failed (trace id %s): %v", req.TraceID, r)
+		}
+	}()
+	return encoder.Processor(req)
+}
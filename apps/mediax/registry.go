@@ -0,0 +1,141 @@
+package mediax
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"mediax/apps/media"
+	"mediax/encoders"
+)
+
+// mediaTypes is MediaTypes plus the external processors from the database.
+// It is rebuilt when either changes and read under mu.
+var (
+	mediaTypes         = maps.Clone(MediaTypes)
+	externalProcessors []media.ExternalProcessor
+)
+
+// RegisterMediaType adds or replaces the media type of t.Extension, e.g. from
+// a plugin package's init function, so niche formats can be served without
+// changing the encoders package.
+func RegisterMediaType(t *media.Type) {
+	mu.Lock()
+	defer mu.Unlock()
+	MediaTypes[strings.ToLower(t.Extension)] = t
+	mediaTypes = buildMediaTypes(externalProcessors)
+}
+
+// RegisterEncoder adds output format to the existing media type extension.
+func RegisterEncoder(extension, format string, encoder *media.Encoder) error {
+	mu.Lock()
+	defer mu.Unlock()
+	t, ok := MediaTypes[strings.ToLower(extension)]
+	if !ok {
+		return fmt.Errorf("unknown media type: %s", extension)
+	}
+	encoders := maps.Clone(t.Encoders)
+	encoders[strings.ToLower(format)] = encoder
+	MediaTypes[strings.ToLower(extension)] = &media.Type{Extension: t.Extension, Mime: t.Mime, Encoders: encoders, Direct: t.Direct}
+	mediaTypes = buildMediaTypes(externalProcessors)
+	return nil
+}
+
+// setExternalProcessors replaces the external processors. Callers hold mu.
+func setExternalProcessors(processors []media.ExternalProcessor) {
+	externalProcessors = processors
+	mediaTypes = buildMediaTypes(processors)
+}
+
+// buildMediaTypes returns MediaTypes with the encoders of processors added.
+// Types are copied before they are extended, so MediaTypes stays untouched.
+func buildMediaTypes(processors []media.ExternalProcessor) map[string]*media.Type {
+	types := maps.Clone(MediaTypes)
+	for _, p := range processors {
+		ext, format := strings.ToLower(p.Extension), strings.ToLower(p.Format)
+		if ext == "" || format == "" || p.Command == "" {
+			log.Warning("skipping incomplete external processor", "id", p.ExternalProcessorID)
+			continue
+		}
+		t := &media.Type{Extension: ext, Mime: p.Mime, Encoders: map[string]*media.Encoder{}}
+		if existing, ok := types[ext]; ok {
+			t.Mime, t.Direct = existing.Mime, existing.Direct
+			t.Encoders = maps.Clone(existing.Encoders)
+		}
+		if t.Mime == "" {
+			t.Mime = "application/octet-stream"
+		}
+		// New types serve their original without f=.
+		if _, ok := t.Encoders[ext]; !ok {
+			t.Encoders[ext] = &media.Encoder{Mime: t.Mime}
+		}
+		t.Encoders[format] = encoders.External(p)
+		types[ext] = t
+	}
+	return types
+}
+
+// lookupMediaType returns the media type of extension under a read lock.
+func lookupMediaType(extension string) (*media.Type, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	t, ok := mediaTypes[extension]
+	return t, ok
+}
+
+// loadedMediaTypes returns the current media types by extension.
+func loadedMediaTypes() map[string]*media.Type {
+	mu.RLock()
+	defer mu.RUnlock()
+	return mediaTypes
+}
+
+// validateMediaTypes checks that every (source, output) pair of types has an
+// encoder that can read the source: encoders without a processor only serve
+// the source's own format, and encoders declaring an Input family only read
+// sources of that family. App.Register refuses to start otherwise.
+func validateMediaTypes(types map[string]*media.Type) error {
+	extensions := make([]string, 0, len(types))
+	for ext := range types {
+		extensions = append(extensions, ext)
+	}
+	sort.Strings(extensions)
+
+	var errs []error
+	for _, ext := range extensions {
+		t := types[ext]
+		if t == nil || t.Mime == "" || !strings.EqualFold(t.Extension, ext) {
+			errs = append(errs, fmt.Errorf("media type %s: extension or mime missing", ext))
+			continue
+		}
+		if t.Direct != nil && t.Direct.Processor != nil {
+			errs = append(errs, fmt.Errorf("media type %s: direct encoder has a processor", ext))
+		}
+		family := mediaCategory(t.Mime)
+		for format, enc := range t.Encoders {
+			switch {
+			case enc == nil:
+				errs = append(errs, fmt.Errorf("media type %s: no encoder for %s", ext, format))
+			case enc.Processor == nil && !sameFormat(format, ext):
+				errs = append(errs, fmt.Errorf("media type %s: %s would serve the %s source unchanged", ext, format, ext))
+			case enc.Input != "" && enc.Input != family:
+				errs = append(errs, fmt.Errorf("media type %s: %s encoder reads %s sources, not %s", ext, format, enc.Input, family))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sameFormat reports whether two format names denote the same format.
+func sameFormat(a, b string) bool {
+	norm := func(f string) string {
+		if f = strings.ToLower(f); f == "jpeg" {
+			return "jpg"
+		}
+		return f
+	}
+	return norm(a) == norm(b)
+}
@@ -0,0 +1,35 @@
+package mediax
+
+import (
+	"github.com/getevo/restify"
+	"mediax/apps/media"
+)
+
+// registerConfigHooks reloads the configuration whenever the admin API
+// creates, updates or deletes a model it is built from, so the change is
+// served as soon as the call returns instead of after POST /admin/reload.
+// The hooks run after the database write, and the reload swaps in the new
+// configuration as a whole. Other instances still need a reload.
+func registerConfigHooks() {
+	hook := func(obj any, c *restify.Context) error {
+		if changesConfig(obj) {
+			// Storages may have changed, so previously missing files may
+			// now exist.
+			media.PurgeNegativeCache(0, "")
+			InitializeConfig()
+		}
+		return nil
+	}
+	restify.OnAfterSave(hook)
+	restify.OnAfterDelete(hook)
+}
+
+// changesConfig reports whether obj is a model InitializeConfig loads.
+func changesConfig(obj any) bool {
+	switch obj.(type) {
+	case *media.Project, *media.Storage, *media.Origin, *media.CachePriority,
+		*media.VideoProfile, *media.APIKey, *media.ExternalProcessor:
+		return true
+	}
+	return false
+}
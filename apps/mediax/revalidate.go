@@ -0,0 +1,75 @@
+package mediax
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"mediax/apps/media"
+)
+
+// regenerateTimeout bounds how long a background regeneration waits for its
+// source to be staged.
+const regenerateTimeout = 10 * time.Minute
+
+// regenerating holds the cache keys of variants being regenerated in the
+// background, so concurrent stale hits start one regeneration.
+var regenerating sync.Map
+
+// serveStaleVariant answers req with the output last served for its variant
+// when the source changed inside the project's stale_while_revalidate
+// window, and regenerates the variant from the new source in the
+// background. It reports whether req was answered.
+func serveStaleVariant(req *media.Request) bool {
+	// Dialect origins do not serve the native URLs regeneration requests;
+	// internal requests are the regenerations themselves and prewarms.
+	// Watermarked outputs are made per request from the current output.
+	if req.Origin.URLDialect != "" || isInternal(req) || req.Options.HLS || req.Options.Detail || req.Origin.Project.ForensicWatermark {
+		return false
+	}
+	path, mime, ok := req.StaleVariant()
+	if !ok {
+		return false
+	}
+	if err := req.ServeFile(mime, path); err != nil {
+		return false
+	}
+	// Shared caches keep the stale output only briefly; the next request
+	// after the regeneration gets the new one.
+	req.Request.Set("Cache-Control", "public, max-age=60")
+	req.Request.Set("Warning", `110 - "Response is Stale"`)
+	media.MetricStaleVariantsServedTotal.WithLabelValues(req.Origin.Project.Name).Inc()
+	regenerate(req)
+	return true
+}
+
+// regenerate runs req again in the background, as an internal request,
+// which encodes its variant from the current source and remembers it. A
+// failed regeneration forgets the stale output so it is not served again.
+func regenerate(req *media.Request) {
+	key := req.CacheKey()
+	if _, running := regenerating.LoadOrStore(key, true); running {
+		return
+	}
+	query := map[string]string{}
+	req.Request.Context.Request().URI().QueryArgs().VisitAll(func(k, v []byte) {
+		// Internal requests are trusted: they need no credential or signature.
+		if name := string(k); name != "s" && name != "api_key" && name != "expires" {
+			query[name] = string(v)
+		}
+	})
+	host, path := req.Domain, req.Url.Path
+	go func() {
+		defer regenerating.Delete(key)
+		ctx, cancel := context.WithTimeout(context.Background(), regenerateTimeout)
+		defer cancel()
+		resp, err := serveInternal(ctx, host, path, query)
+		if err != nil {
+			log.Error("variant regeneration failed", "trace_id", req.TraceID, "host", host, "path", path, "error", err)
+			req.ForgetVariant()
+			return
+		}
+		resp.CloseBodyStream() //nolint:errcheck
+	}()
+}
@@ -0,0 +1,537 @@
+package mediax
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// derivativesBucket is the single virtual bucket exposed by the S3 gateway.
+// Keys are <project_id>/<variant dir>/<shard>/<file>, e.g.
+// 1/images/ab/cd/abcd….webp.
+const derivativesBucket = "derivatives"
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3MaxClockSkew is how far the X-Amz-Date of a request may be from now, as
+// on S3.
+const s3MaxClockSkew = 15 * time.Minute
+
+// errS3RequestTimeTooSkewed refuses requests dated outside s3MaxClockSkew.
+var errS3RequestTimeTooSkewed = errors.New("the difference between the request time and the current time is too large")
+
+// isS3GatewayHost reports whether requests for host are S3 API calls.
+// The gateway is enabled by setting MEDIAX.S3GatewayHost.
+func isS3GatewayHost(host string) bool {
+	gw := settings.Get("MEDIAX.S3GatewayHost", "").String()
+	return gw != "" && strings.EqualFold(gw, host)
+}
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name   `xml:"ListBucketResult"`
+	Xmlns                 string     `xml:"xmlns,attr"`
+	Name                  string     `xml:"Name"`
+	Prefix                string     `xml:"Prefix"`
+	Delimiter             string     `xml:"Delimiter,omitempty"`
+	MaxKeys               int        `xml:"MaxKeys"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	Marker                *string    `xml:"Marker,omitempty"`
+	NextMarker            string     `xml:"NextMarker,omitempty"`
+	KeyCount              *int       `xml:"KeyCount,omitempty"`
+	StartAfter            string     `xml:"StartAfter,omitempty"`
+	ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+}
+
+type s3BucketList struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   struct {
+		ID string `xml:"ID"`
+	} `xml:"Owner"`
+	Buckets []struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	} `xml:"Buckets>Bucket"`
+}
+
+// serveS3Gateway answers a read-only subset of the S3 API (ListBuckets,
+// ListObjects v1/v2, GetObject, HeadObject) over the derived files of every
+// project cache, so S3 tooling can pull processed variants. Requests must use
+// path-style addressing.
+func serveS3Gateway(request *evo.Request) any {
+	if request.Method() != "GET" && request.Method() != "HEAD" {
+		return s3Fail(request, 405, "MethodNotAllowed", "the derivatives gateway is read-only", "")
+	}
+	if err := verifyS3Signature(request); err != nil {
+		code := "SignatureDoesNotMatch"
+		switch {
+		case errors.Is(err, errS3GatewayDisabled):
+			code = "AccessDenied"
+		case errors.Is(err, errS3RequestTimeTooSkewed):
+			code = "RequestTimeTooSkewed"
+		}
+		return s3Fail(request, 403, code, err.Error(), "")
+	}
+
+	p := strings.TrimPrefix(request.Path(), "/")
+	if p == "" {
+		var list = s3BucketList{Xmlns: s3Namespace}
+		list.Owner.ID = "mediax"
+		list.Buckets = append(list.Buckets, struct {
+			Name         string `xml:"Name"`
+			CreationDate string `xml:"CreationDate"`
+		}{Name: derivativesBucket, CreationDate: time.Unix(0, 0).UTC().Format(time.RFC3339)})
+		return s3XML(request, 200, list)
+	}
+
+	bucket, key, _ := strings.Cut(p, "/")
+	if bucket != derivativesBucket {
+		return s3Fail(request, 404, "NoSuchBucket", "the specified bucket does not exist", bucket)
+	}
+	if key == "" {
+		return s3ListObjects(request)
+	}
+	key, err := url.PathUnescape(key)
+	if err != nil {
+		return s3Fail(request, 400, "InvalidURI", err.Error(), key)
+	}
+	path, ok := s3ObjectPath(key)
+	if !ok {
+		return s3Fail(request, 404, "NoSuchKey", "the specified key does not exist", key)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return s3Fail(request, 404, "NoSuchKey", "the specified key does not exist", key)
+	}
+	request.Set("ETag", s3ETag(info))
+	request.Set("Last-Modified", info.ModTime().UTC().Format(time.RFC1123))
+	// SendFile handles Range and HEAD.
+	return request.Context.SendFile(path)
+}
+
+// s3ObjectPath resolves a gateway key to a derived file inside a project
+// cache. Only the derived variant directories are exposed.
+func s3ObjectPath(key string) (string, bool) {
+	id, rest, ok := strings.Cut(key, "/")
+	if !ok {
+		return "", false
+	}
+	sub, _, _ := strings.Cut(rest, "/")
+	if !isDerivedDir(sub) {
+		return "", false
+	}
+	for _, p := range s3Projects() {
+		if strconv.Itoa(p.ProjectID) != id {
+			continue
+		}
+		path := filepath.Join(media.DerivedDir(p.CacheDir, ""), filepath.FromSlash(rest))
+		if !strings.HasPrefix(path, media.DerivedDir(p.CacheDir, sub)+string(filepath.Separator)) {
+			return "", false
+		}
+		return path, true
+	}
+	return "", false
+}
+
+// s3Projects returns the projects whose derived files the gateway exposes.
+// Projects embedding forensic watermarks, or with an origin requiring API
+// keys, are left out: the gateway would serve their files unmarked or
+// without a key.
+func s3Projects() []*media.Project {
+	refused := map[int]bool{}
+	mu.RLock()
+	for _, o := range Origins {
+		if o.RequireAPIKey {
+			refused[o.ProjectID] = true
+		}
+	}
+	mu.RUnlock()
+	var projects []*media.Project
+	for _, p := range loadedProjects() {
+		if !p.ForensicWatermark && !refused[p.ProjectID] {
+			projects = append(projects, p)
+		}
+	}
+	return projects
+}
+
+func isDerivedDir(sub string) bool {
+	for _, d := range media.DerivedCacheDirs {
+		if d == sub {
+			return true
+		}
+	}
+	return false
+}
+
+// s3ListObjects implements ListObjects (v1, marker) and ListObjectsV2
+// (list-type=2, continuation-token/start-after) with prefix, delimiter and
+// max-keys.
+func s3ListObjects(request *evo.Request) any {
+	v2 := request.Query("list-type").String() == "2"
+	prefix := request.Query("prefix").String()
+	delimiter := request.Query("delimiter").String()
+	maxKeys := 1000
+	if v := request.Query("max-keys").String(); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < maxKeys {
+			maxKeys = n
+		}
+	}
+	after := request.Query("marker").String()
+	if v2 {
+		after = request.Query("start-after").String()
+		if token := request.Query("continuation-token").String(); token != "" {
+			decoded, err := hex.DecodeString(token)
+			if err != nil {
+				return s3Fail(request, 400, "InvalidArgument", "invalid continuation token", "")
+			}
+			after = string(decoded)
+		}
+	}
+
+	result := s3ListResult{Xmlns: s3Namespace, Name: derivativesBucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys}
+	if v2 {
+		result.StartAfter = request.Query("start-after").String()
+		result.ContinuationToken = request.Query("continuation-token").String()
+	} else {
+		result.Marker = &after
+	}
+
+	listing := s3Listing{prefix: prefix, delimiter: delimiter, after: after, maxKeys: maxKeys, result: &result}
+	listing.list()
+	last := listing.last
+	if result.IsTruncated {
+		if v2 {
+			result.NextContinuationToken = hex.EncodeToString([]byte(last))
+		} else {
+			result.NextMarker = last
+		}
+	}
+	if v2 {
+		count := len(result.Contents) + len(result.CommonPrefixes)
+		result.KeyCount = &count
+	}
+	return s3XML(request, 200, result)
+}
+
+// s3Listing reads one page of derived files for ListObjects: the keys
+// after after that start with prefix, in key order, keys containing
+// delimiter past the prefix folded into common prefixes. Directories are
+// read in key order from after on, and reading stops once the page is
+// full, so each page costs what it lists rather than a walk of every cache.
+type s3Listing struct {
+	prefix    string
+	delimiter string
+	after     string
+	maxKeys   int
+	result    *s3ListResult
+	last      string // last key or common prefix added
+}
+
+// s3Dir is a directory of a listing and its key, ending in "/".
+type s3Dir struct {
+	key  string
+	path string
+}
+
+// list fills the page from the variant directories of the exposed projects.
+func (l *s3Listing) list() {
+	var roots []s3Dir
+	for _, p := range s3Projects() {
+		for _, sub := range media.DerivedCacheDirs {
+			roots = append(roots, s3Dir{key: strconv.Itoa(p.ProjectID) + "/" + sub + "/", path: media.DerivedDir(p.CacheDir, sub)})
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].key < roots[j].key })
+	for _, d := range roots {
+		if !l.dir(d) {
+			return
+		}
+	}
+}
+
+// dir adds the keys below d. It returns false once the page is full.
+func (l *s3Listing) dir(d s3Dir) bool {
+	// Skip directories outside the prefix or listed on earlier pages.
+	if !strings.HasPrefix(d.key, l.prefix) && !strings.HasPrefix(l.prefix, d.key) {
+		return true
+	}
+	if d.key <= l.after && !strings.HasPrefix(l.after, d.key) {
+		return true
+	}
+	// Every key below a directory past the delimiter folds into one prefix.
+	if common, ok := l.commonPrefix(d.key); ok {
+		if common <= l.after || common == l.last || !hasS3Object(d.path) {
+			return true
+		}
+		return l.add(common, nil)
+	}
+
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return true
+	}
+	type child struct {
+		key   string
+		entry fs.DirEntry
+	}
+	children := make([]child, len(entries))
+	for i, e := range entries {
+		children[i] = child{key: d.key + e.Name(), entry: e}
+		if e.IsDir() {
+			children[i].key += "/"
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].key < children[j].key })
+	for _, c := range children {
+		path := filepath.Join(d.path, c.entry.Name())
+		if c.entry.IsDir() {
+			if !l.dir(s3Dir{key: c.key, path: path}) {
+				return false
+			}
+			continue
+		}
+		if !strings.HasPrefix(c.key, l.prefix) || c.key <= l.after || !isS3Object(c.key) {
+			continue
+		}
+		if common, ok := l.commonPrefix(c.key); ok {
+			if !l.add(common, nil) {
+				return false
+			}
+			continue
+		}
+		info, err := c.entry.Info()
+		if err != nil {
+			continue
+		}
+		if !l.add(c.key, &s3Object{
+			Key:          c.key,
+			LastModified: info.ModTime().UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         s3ETag(info),
+			Size:         info.Size(),
+			StorageClass: "STANDARD",
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// commonPrefix returns the common prefix key folds into, if the delimiter
+// occurs in it past the listing prefix.
+func (l *s3Listing) commonPrefix(key string) (string, bool) {
+	if l.delimiter == "" || !strings.HasPrefix(key, l.prefix) {
+		return "", false
+	}
+	i := strings.Index(key[len(l.prefix):], l.delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return key[:len(l.prefix)+i+len(l.delimiter)], true
+}
+
+// add adds a key, or a common prefix when obj is nil, to the page. Keys
+// arrive in order, so a common prefix repeats only right after itself. It
+// returns false once the page is full.
+func (l *s3Listing) add(entry string, obj *s3Object) bool {
+	if entry <= l.after || entry == l.last {
+		return true
+	}
+	if len(l.result.Contents)+len(l.result.CommonPrefixes) >= l.maxKeys {
+		l.result.IsTruncated = true
+		return false
+	}
+	if obj == nil {
+		l.result.CommonPrefixes = append(l.result.CommonPrefixes, s3Prefix{Prefix: entry})
+	} else {
+		l.result.Contents = append(l.result.Contents, *obj)
+	}
+	l.last = entry
+	return true
+}
+
+// isS3Object reports whether the file of key is served: lock files and
+// partial writes are not.
+func isS3Object(key string) bool {
+	return !strings.HasSuffix(key, ".lock") && !strings.HasSuffix(key, ".part")
+}
+
+// hasS3Object reports whether dir holds a served file, as S3 lists only
+// prefixes of existing objects.
+func hasS3Object(dir string) bool {
+	found := false
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && isS3Object(path) {
+			found = true
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+func s3ETag(info fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().Unix(), info.Size())
+}
+
+func s3XML(request *evo.Request, status int, v any) any {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	request.Set("Content-Type", "application/xml")
+	request.Status(status)
+	request.Context.Write(append([]byte(xml.Header), body...)) //nolint:errcheck
+	return nil
+}
+
+func s3Fail(request *evo.Request, status int, code, message, resource string) any {
+	return s3XML(request, status, s3Error{Code: code, Message: message, Resource: resource})
+}
+
+// errS3GatewayDisabled refuses gateway requests while no credentials are
+// configured: the gateway bypasses the origins' access rules, so it is never
+// anonymous.
+var errS3GatewayDisabled = errors.New("the gateway is disabled until MEDIAX.S3GatewayAccessKey and MEDIAX.S3GatewaySecretKey are set")
+
+// checkS3Gateway logs when the gateway host is set without credentials,
+// which keeps the gateway disabled.
+func checkS3Gateway() {
+	if settings.Get("MEDIAX.S3GatewayHost", "").String() != "" && !s3GatewayCredentials() {
+		log.Error("s3 gateway disabled", "error", errS3GatewayDisabled)
+	}
+}
+
+func s3GatewayCredentials() bool {
+	return settings.Get("MEDIAX.S3GatewayAccessKey", "").String() != "" && settings.Get("MEDIAX.S3GatewaySecretKey", "").String() != ""
+}
+
+// verifyS3Signature checks an AWS Signature Version 4 Authorization header
+// against MEDIAX.S3GatewayAccessKey/S3GatewaySecretKey. Requests dated more
+// than s3MaxClockSkew away from now are refused, so captured requests cannot
+// be replayed later.
+func verifyS3Signature(request *evo.Request) error {
+	if !s3GatewayCredentials() {
+		return errS3GatewayDisabled
+	}
+	accessKey := settings.Get("MEDIAX.S3GatewayAccessKey", "").String()
+	secretKey := settings.Get("MEDIAX.S3GatewaySecretKey", "").String()
+	auth := request.Header("Authorization")
+	algo, params, ok := strings.Cut(auth, " ")
+	if !ok || algo != "AWS4-HMAC-SHA256" {
+		return fmt.Errorf("missing AWS4-HMAC-SHA256 authorization")
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(params, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(part), "="); ok {
+			fields[k] = v
+		}
+	}
+	scope := strings.Split(fields["Credential"], "/")
+	if len(scope) != 5 || scope[0] != accessKey || scope[4] != "aws4_request" {
+		return fmt.Errorf("invalid credential")
+	}
+	amzDate := request.Header("X-Amz-Date")
+	if amzDate == "" {
+		return fmt.Errorf("missing x-amz-date")
+	}
+	date, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || scope[1] != amzDate[:8] {
+		return fmt.Errorf("invalid x-amz-date")
+	}
+	if skew := time.Since(date); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		return errS3RequestTimeTooSkewed
+	}
+	payloadHash := request.Header("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		value := request.Header(h)
+		if h == "host" {
+			value = string(request.Context.Request().Host())
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	args := request.Context.Request().URI().QueryArgs()
+	var query []string
+	args.VisitAll(func(k, v []byte) {
+		query = append(query, s3Escape(string(k))+"="+s3Escape(string(v)))
+	})
+	sort.Strings(query)
+
+	canonicalRequest := strings.Join([]string{
+		request.Method(),
+		string(request.Context.Request().URI().PathOriginal()),
+		strings.Join(query, "&"),
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	credentialScope := strings.Join(scope[1:], "/")
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + credentialScope + "\n" + hex.EncodeToString(digest[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, s := range scope[1:] {
+		key = hmacSHA256(key, s)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return fmt.Errorf("the request signature does not match")
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape applies the RFC 3986 encoding SigV4 expects for query components.
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
@@ -0,0 +1,28 @@
+package mediax
+
+import (
+	neturl "net/url"
+	"time"
+
+	"mediax/apps/media"
+	"mediax/mediaurl"
+)
+
+// verifyURLSignature checks the s= parameter of native URLs on origins with a
+// signing_key; see mediaurl.Verify for the scheme. The api_key parameter is a
+// credential, not part of the URL, and is not signed.
+func verifyURLSignature(req *media.Request) error {
+	if req.Origin.SigningKey == "" || req.Origin.URLDialect != "" {
+		return nil
+	}
+	query := neturl.Values{}
+	req.Request.Context.Request().URI().QueryArgs().VisitAll(func(k, v []byte) {
+		if string(k) != "api_key" {
+			query.Add(string(k), string(v))
+		}
+	})
+	if mediaurl.Verify(req.Origin.SigningKey, req.Url.Path, query, time.Now()) != nil {
+		return errBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package mediax
+
+import (
+	"time"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/db"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// recordUsage charges a served request to its origin and, when the request
+// carried one, to its API key: the response bytes and, when an encoder
+// produced an output or metadata, one transformation.
+func recordUsage(key *media.APIKey, req *media.Request) {
+	resp := req.Request.Context.Response()
+	status := resp.StatusCode()
+	if status != evo.StatusOK && status != evo.StatusPartialContent {
+		return
+	}
+	bytes := int64(max(resp.Header.ContentLength(), 0))
+	var transformations int64
+	if req.ProcessedFilePath != "" || len(req.Metadata) > 0 {
+		transformations = 1
+	}
+	media.RecordOriginUsage(req.Origin, bytes, transformations)
+	if key != nil {
+		media.RecordAPIKeyUsage(key.APIKeyID, bytes, transformations)
+	}
+}
+
+// startUsageSync periodically writes origin and API key usage, processing
+// failures and profile variants to the database and reads back the key
+// totals of all instances, every MEDIAX.UsageSyncInterval.
+func startUsageSync() {
+	interval, err := media.ParseDuration(settings.Get("MEDIAX.UsageSyncInterval", "1m").String())
+	if err != nil || interval <= 0 {
+		log.Warning("invalid MEDIAX.UsageSyncInterval, using default", "error", err)
+		interval = time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			if err := media.SyncOriginUsage(); err != nil {
+				log.Error("origin usage sync failed", "error", err)
+			}
+			if err := media.SyncAPIKeyUsage(); err != nil {
+				log.Error("api key usage sync failed", "error", err)
+			}
+			if err := media.SyncProcessingFailures(); err != nil {
+				log.Error("processing failure sync failed", "error", err)
+			}
+			if err := media.SyncProfileVariants(); err != nil {
+				log.Error("profile variant sync failed", "error", err)
+			}
+		}
+	}()
+}
+
+// usageReport is one origin's entry in the /admin/usage response.
+type usageReport struct {
+	ProjectID       int    `json:"project_id"`
+	OriginID        int    `json:"origin_id"`
+	Domain          string `json:"domain"`
+	Bytes           int64  `json:"bytes"`
+	Transformations int64  `json:"transformations"`
+}
+
+// Usage reports bytes served and transformations per origin between ?from
+// and ?to (YYYY-MM-DD, inclusive; default: the current month), optionally
+// limited to ?project_id. Usage is written every MEDIAX.UsageSyncInterval,
+// so the most recent requests may be missing.
+func (c Controller) Usage(request *evo.Request) any {
+	now := time.Now().UTC()
+	from := request.Query("from").String()
+	if from == "" {
+		from = now.Format("2006-01") + "-01"
+	}
+	to := request.Query("to").String()
+	if to == "" {
+		to = now.Format(time.DateOnly)
+	}
+	for _, day := range []string{from, to} {
+		if _, err := time.Parse(time.DateOnly, day); err != nil {
+			return outcome.Text("invalid date " + day + ": expected YYYY-MM-DD").Status(evo.StatusBadRequest)
+		}
+	}
+
+	query := db.Model(&media.OriginUsage{}).
+		Select("origin_usage.project_id, origin_usage.origin_id, origin.domain, SUM(origin_usage.bytes) AS bytes, SUM(origin_usage.transformations) AS transformations").
+		Joins("LEFT JOIN origin ON origin.origin_id = origin_usage.origin_id").
+		Where("origin_usage.day BETWEEN ? AND ?", from, to).
+		Group("origin_usage.project_id, origin_usage.origin_id, origin.domain").
+		Order("origin_usage.project_id, origin_usage.origin_id")
+	if projectID := request.Query("project_id").Int(); projectID > 0 {
+		query = query.Where("origin_usage.project_id = ?", projectID)
+	}
+	result := []usageReport{}
+	if err := query.Scan(&result).Error; err != nil {
+		return err
+	}
+	return outcome.Json(result)
+}
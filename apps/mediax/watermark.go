@@ -0,0 +1,90 @@
+package mediax
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"mediax/apps/media"
+	"mediax/encoders"
+)
+
+// watermarks reports whether req is answered with a forensic watermark in
+// its output of the MIME type. Internal requests (prewarms, regenerations)
+// serve no one and are not marked.
+func watermarks(req *media.Request, mime string) bool {
+	return req.Origin.Project.ForensicWatermark && !isInternal(req) && encoders.CanWatermark(mime)
+}
+
+// serveWatermarked answers req with a copy of the output at path carrying
+// a new forensic watermark, recorded for the uid the request was made for
+// and its API key. Outputs too small to hold a watermark are served as they
+// are; any other failure refuses the request rather than serve it unmarked.
+func serveWatermarked(req *media.Request, mime, path string, key *media.APIKey) error {
+	project := req.Origin.Project.Name
+	var keyID int
+	if key != nil {
+		keyID = key.APIKeyID
+	}
+	payload, err := req.NewWatermark(req.Request.Query("uid").String(), keyID)
+	if err != nil {
+		metricWatermarks.WithLabelValues(project, "error").Inc()
+		return fmt.Errorf("recording watermark: %w", err)
+	}
+	marked, err := encoders.Watermark(path, payload)
+	if errors.Is(err, encoders.ErrImageTooSmall) {
+		metricWatermarks.WithLabelValues(project, "too_small").Inc()
+		return req.ServeFile(mime, path)
+	}
+	if err != nil {
+		metricWatermarks.WithLabelValues(project, "error").Inc()
+		log.Error("watermarking failed", "trace_id", req.TraceID, "project", project, "path", req.OriginalFilePath, "error", err)
+		return err
+	}
+	data, err := os.ReadFile(marked)
+	os.Remove(marked)
+	if err != nil {
+		return err
+	}
+	metricWatermarks.WithLabelValues(project, "marked").Inc()
+	return req.ServePrivate(mime, path, data)
+}
+
+// DetectWatermark reads the forensic watermark of the image uploaded as the
+// multipart field "file" and answers the Watermark recorded for it: who was
+// served the copy, when and how.
+func (c Controller) DetectWatermark(request *evo.Request) any {
+	header, err := request.FormFile("file")
+	if err != nil {
+		return outcome.Text("a file is required").Status(evo.StatusBadRequest)
+	}
+	tmp, err := os.CreateTemp("", "watermark-*"+filepath.Ext(header.Filename))
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := request.SaveFile(header, tmp.Name()); err != nil {
+		return err
+	}
+
+	payload, err := encoders.ExtractWatermark(tmp.Name())
+	if errors.Is(err, encoders.ErrNoWatermark) {
+		return outcome.Text(err.Error()).Status(evo.StatusNotFound)
+	}
+	if err != nil {
+		return outcome.Text(err.Error()).Status(evo.StatusUnprocessableEntity)
+	}
+	watermark, err := media.FindWatermark(payload)
+	if errors.Is(err, media.ErrUnknownWatermark) {
+		return outcome.Text(err.Error()).Status(evo.StatusNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	return outcome.Json(watermark)
+}
@@ -0,0 +1,368 @@
+package mediax
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getevo/evo/v2"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/outcome"
+	"github.com/getevo/evo/v2/lib/settings"
+	"github.com/valyala/fasthttp"
+	"google.golang.org/grpc/status"
+	"mediax/apps/media"
+)
+
+// zipWorkers is how many files of an archive are fetched ahead of the one
+// being written.
+const zipWorkers = 4
+
+// zipManifest is the body of POST /zip: the files to package, named by
+// their paths on the request's host, and every file below Prefix. Options
+// (e.g. {"w": "1600", "f": "jpg"}) apply to every file and are overridden
+// by a file's own.
+type zipManifest struct {
+	Name    string            `json:"name"`
+	Prefix  string            `json:"prefix"`
+	Options map[string]string `json:"options"`
+	Files   []zipFile         `json:"files"`
+}
+
+// zipFile is one file of a zipManifest. Name is its path in the archive;
+// by default the file name the response is downloaded as, below the
+// directories between Prefix and the file.
+type zipFile struct {
+	Path    string            `json:"path"`
+	Name    string            `json:"name"`
+	Options map[string]string `json:"options"`
+}
+
+// zipEntry is a file resolved for an archive.
+type zipEntry struct {
+	path    string // request path
+	dir     string // directory in the archive
+	name    string // name in the archive, or "" for the download name
+	options map[string]string
+}
+
+// ServeZip streams a ZIP archive of the files of a zipManifest, each
+// fetched through the regular pipeline with its options, so transformed
+// outputs are cached and moderated as for single requests. The request
+// passes the origin's access rules and API key like a media request; on
+// origins with a signing_key it is signed with mediaurl.SignZip. Files that
+// fail are listed in errors.txt at the end of the archive, as the status
+// has been sent by then.
+func (c Controller) ServeZip(request *evo.Request) any {
+	req, apiKey, refused := generatorRequest(request)
+	if refused != nil {
+		return refused
+	}
+	body := []byte(request.Body())
+	if err := verifyZipSignature(req, body); err != nil {
+		return outcome.Text(err.Error()).Status(evo.StatusForbidden)
+	}
+	var manifest zipManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return outcome.Text("invalid request body").Status(evo.StatusBadRequest)
+	}
+	if req.Origin.Project.ForensicWatermark {
+		// Archived files would leave unmarked.
+		return outcome.Text("zip downloads are disabled for projects with forensic watermarks").Status(evo.StatusForbidden)
+	}
+	limit := settings.Get("MEDIAX.ZipMaxFiles", 1000).Int()
+	entries, err := manifest.entries(request.Context.Context(), req.Origin, limit)
+	if errors.Is(err, errZipTooManyFiles) {
+		return outcome.Text(fmt.Sprintf("more than %d files requested, at most %d can be packaged", limit, limit)).Status(evo.StatusRequestEntityTooLarge)
+	}
+	if err != nil {
+		return outcome.Text(err.Error()).Status(evo.StatusBadRequest)
+	}
+	if len(entries) == 0 {
+		return outcome.Text("no files to package").Status(evo.StatusNotFound)
+	}
+
+	name := manifest.Name
+	if name == "" {
+		name = "download.zip"
+	} else if !strings.HasSuffix(strings.ToLower(name), ".zip") {
+		name += ".zip"
+	}
+	host, project, traceID := req.Domain, req.Origin.Project.Name, req.TraceID
+	request.Set("Content-Type", "application/zip")
+	request.Set("Content-Disposition", media.ContentDisposition("attachment", name))
+	request.Set("Cache-Control", "private, no-store")
+	request.Context.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("panic writing zip", "trace_id", traceID, "panic", r, "stack", string(debug.Stack()))
+				metricPanics.WithLabelValues("zip").Inc()
+			}
+		}()
+		counter := &countingWriter{w: w}
+		transformations, failures, err := writeZip(counter, host, entries)
+		if err == nil {
+			err = w.Flush()
+		}
+		result := "complete"
+		switch {
+		case err != nil:
+			result = "aborted"
+			log.Warning("zip download aborted", "trace_id", traceID, "host", host, "error", err)
+		case len(failures) > 0:
+			result = "partial"
+		}
+		metricZips.WithLabelValues(project, result).Inc()
+		// The files were counted for the origin as they were fetched.
+		if apiKey != nil {
+			media.RecordAPIKeyUsage(apiKey.APIKeyID, counter.n, transformations)
+		}
+	})
+	return nil
+}
+
+// verifyZipSignature checks a ZIP request on an origin with a signing_key:
+// its s= must sign the sha256= of the body. Origins with a signed URL
+// dialect cannot sign it and refuse it.
+func verifyZipSignature(req *media.Request, body []byte) error {
+	if req.Origin.URLDialect != "" {
+		if req.Origin.DialectKey != "" {
+			return errBadSignature
+		}
+		return nil
+	}
+	if req.Origin.SigningKey == "" {
+		return nil
+	}
+	if err := verifyURLSignature(req); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	if req.Request.Query("sha256").String() != hex.EncodeToString(sum[:]) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// errZipTooManyFiles is returned by zipManifest.entries when the manifest
+// resolves to more files than the limit.
+var errZipTooManyFiles = errors.New("too many files to package")
+
+// entries resolves the files of the manifest: those listed, then those
+// below the prefix in the origin's storages, sorted by path. Past limit
+// files (0 for none) it stops listing and returns errZipTooManyFiles.
+func (m zipManifest) entries(ctx context.Context, origin *media.Origin, limit int) ([]zipEntry, error) {
+	prefix := strings.Trim(path.Clean("/"+m.Prefix), "/")
+	var entries []zipEntry
+	for _, f := range m.Files {
+		if strings.Trim(f.Path, "/") == "" {
+			return nil, errors.New("a file without path")
+		}
+		p := path.Clean("/" + f.Path)
+		dir := ""
+		if rel, ok := strings.CutPrefix(p, "/"+prefix+"/"); ok && m.Prefix != "" {
+			dir = path.Dir(rel)
+		}
+		options := maps.Clone(m.Options)
+		if options == nil {
+			options = map[string]string{}
+		}
+		maps.Copy(options, f.Options)
+		entries = append(entries, zipEntry{path: p, dir: dir, name: f.Name, options: options})
+	}
+	if limit > 0 && len(entries) > limit {
+		return nil, errZipTooManyFiles
+	}
+	if m.Prefix == "" {
+		return entries, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	seen := map[string]bool{}
+	var listed []zipEntry
+	storagePrefix := TrimPrefix(prefix, origin.PrefixPath)
+	for _, storage := range origin.Storages {
+		err := storage.WalkFiles(ctx, storagePrefix, func(p string, size int64) error {
+			ext := strings.TrimPrefix(strings.ToLower(path.Ext(p)), ".")
+			if _, ok := lookupMediaType(ext); !ok || seen[p] || !origin.AllowsExtension(ext) {
+				return nil
+			}
+			if limit > 0 && len(entries)+len(listed) >= limit {
+				cancel()
+				return errZipTooManyFiles
+			}
+			seen[p] = true
+			rel := strings.Trim(strings.TrimPrefix(p, storagePrefix), "/")
+			listed = append(listed, zipEntry{
+				path:    path.Join("/", origin.PrefixPath, p),
+				dir:     path.Dir(rel),
+				options: maps.Clone(m.Options),
+			})
+			return nil
+		})
+		if errors.Is(err, errZipTooManyFiles) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing storage %d: %w", storage.StorageID, err)
+		}
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].path < listed[j].path })
+	return append(entries, listed...), nil
+}
+
+// zipFetch is an entry fetched for an archive.
+type zipFetch struct {
+	resp *fasthttp.Response
+	err  error
+}
+
+// writeZip fetches the entries from host, zipWorkers at a time, and writes
+// them to w in order, uncompressed: media is compressed already. It returns
+// how many entries were transformed, the entries that failed and the error
+// that ended the archive early, such as the client going away.
+func writeZip(w io.Writer, host string, entries []zipEntry) (transformations int64, failures []string, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make([]chan zipFetch, len(entries))
+	for i := range results {
+		results[i] = make(chan zipFetch, 1)
+	}
+	// A slot is held from the fetch of an entry until it is written.
+	slots := make(chan struct{}, zipWorkers)
+	go func() {
+		for i, e := range entries {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[i] <- zipFetch{err: ctx.Err()}
+				continue
+			}
+			go func() {
+				fileCtx, cancel := context.WithTimeout(ctx, zipFileTimeout())
+				defer cancel()
+				options := map[string]string{}
+				maps.Copy(options, e.options)
+				options["download"] = "true" // for the name in Content-Disposition
+				resp, err := serveInternal(fileCtx, host, e.path, options)
+				if err != nil {
+					<-slots
+				}
+				results[i] <- zipFetch{resp: resp, err: err}
+			}()
+		}
+	}()
+
+	zw := zip.NewWriter(w)
+	names := map[string]bool{}
+	for i, e := range entries {
+		r := <-results[i]
+		if r.err != nil {
+			if err == nil {
+				failures = append(failures, e.path+": "+status.Convert(r.err).Message())
+			}
+			continue
+		}
+		if err == nil { // otherwise draining after the archive failed
+			if err = writeZipEntry(zw, names, e, r.resp); err != nil {
+				cancel()
+			} else if len(e.options) > 0 {
+				transformations++
+			}
+		}
+		r.resp.CloseBodyStream() //nolint:errcheck
+		<-slots
+	}
+	if err != nil {
+		return transformations, failures, err
+	}
+	if len(failures) > 0 {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: uniqueZipName(names, "errors.txt"), Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return transformations, failures, err
+		}
+		if _, err := io.WriteString(fw, strings.Join(failures, "\n")+"\n"); err != nil {
+			return transformations, failures, err
+		}
+	}
+	return transformations, failures, zw.Close()
+}
+
+// writeZipEntry writes the response fetched for e to the archive, named
+// and dated after its Content-Disposition and Last-Modified.
+func writeZipEntry(zw *zip.Writer, names map[string]bool, e zipEntry, resp *fasthttp.Response) error {
+	modified, err := http.ParseTime(string(resp.Header.Peek("Last-Modified")))
+	if err != nil {
+		modified = time.Now()
+	}
+	name := uniqueZipName(names, e.archiveName(string(resp.Header.Peek("Content-Disposition"))))
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+	return resp.BodyWriteTo(fw)
+}
+
+// archiveName returns the path of e in the archive: its name, or the file
+// name of the response's Content-Disposition below its directory. Paths
+// cannot leave the archive root.
+func (e zipEntry) archiveName(disposition string) string {
+	name := e.name
+	if name == "" {
+		name = path.Base(e.path)
+		if _, params, err := mime.ParseMediaType(disposition); err == nil && params["filename"] != "" {
+			name = path.Base(params["filename"])
+		}
+		name = path.Join(e.dir, name)
+	}
+	return strings.TrimLeft(path.Clean("/"+name), "/")
+}
+
+// uniqueZipName returns name, or name with " (2)", " (3)"... before its
+// extension when an earlier entry has it.
+func uniqueZipName(names map[string]bool, name string) string {
+	unique := name
+	ext := path.Ext(name)
+	for n := 2; names[unique]; n++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+	}
+	names[unique] = true
+	return unique
+}
+
+// zipFileTimeout returns how long one file of an archive may take to fetch
+// and transform (MEDIAX.ZipFileTimeout).
+func zipFileTimeout() time.Duration {
+	d, err := media.ParseDuration(settings.Get("MEDIAX.ZipFileTimeout", "5m").String())
+	if err != nil || d <= 0 {
+		return 5 * time.Minute
+	}
+	return d
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
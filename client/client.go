@@ -0,0 +1,227 @@
+// Package client is a Go client for MediaX. It builds (optionally signed)
+// transformation URLs with mediaurl and calls the admin cache APIs.
+//
+//	c, err := client.New(client.Config{BaseURL: "https://media.example.com", SigningKey: key})
+//	src, err := c.URL("/images/photo.jpg", client.Options{Width: 800, Format: "webp"})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediax/mediaurl"
+)
+
+// Options describes a transformation; see mediaurl.Options.
+type Options = mediaurl.Options
+
+// Config configures a Client.
+type Config struct {
+	// BaseURL is the origin domain (and prefix path) media URLs are built on.
+	// Admin calls go to the same server and name its host as the origin.
+	BaseURL string
+	// SigningKey signs media URLs; it must match the origin's signing_key.
+	SigningKey string
+	// AdminToken is sent as a bearer token on admin calls; it must match
+	// the server's MEDIAX.AdminToken.
+	AdminToken string
+	// HTTPClient defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// Client talks to one MediaX origin.
+type Client struct {
+	base       *url.URL
+	signingKey string
+	adminToken string
+	http       *http.Client
+}
+
+// New returns a Client for cfg.
+func New(cfg Config) (*Client, error) {
+	base, err := url.Parse(cfg.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url: %w", err)
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("invalid base url %q: scheme and host are required", cfg.BaseURL)
+	}
+	base.RawQuery, base.Fragment = "", ""
+	c := &Client{base: base, signingKey: cfg.SigningKey, adminToken: cfg.AdminToken, http: cfg.HTTPClient}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	return c, nil
+}
+
+// Error is returned for non-2xx responses.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("mediax: %d %s", e.StatusCode, e.Message)
+}
+
+// VariantStats is the cache usage of one variant type.
+type VariantStats struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// ProjectCacheStats is one project's entry of the cache statistics.
+type ProjectCacheStats struct {
+	ProjectID  int                      `json:"project_id"`
+	Project    string                   `json:"project"`
+	CacheDir   string                   `json:"cache_dir"`
+	TotalFiles int64                    `json:"total_files"`
+	TotalBytes int64                    `json:"total_bytes"`
+	Variants   map[string]*VariantStats `json:"variants"`
+	// CollectedAt is when the server last walked the cache for these numbers.
+	CollectedAt time.Time `json:"collected_at"`
+}
+
+// PrewarmResult reports how many variants were generated and why others failed.
+type PrewarmResult struct {
+	Generated int      `json:"generated"`
+	Errors    []string `json:"errors"`
+}
+
+// URL returns the media URL of path with the given options, signed when the
+// client has a signing key.
+func (c *Client) URL(path string, o Options) (string, error) {
+	return mediaurl.Build(c.base.String(), path, o, c.signingKey)
+}
+
+// Metadata returns what ?detail=true returns for path.
+func (c *Client) Metadata(ctx context.Context, path string) (map[string]any, error) {
+	src, err := c.URL(path, Options{Detail: true})
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]any
+	return result, c.do(ctx, http.MethodGet, src, nil, &result)
+}
+
+// Purge drops the cached original of path so it is fetched from storage again.
+// It returns the number of cache entries removed.
+func (c *Client) Purge(ctx context.Context, path string) (int, error) {
+	query := url.Values{"host": {c.base.Host}, "path": {c.mediaPath(path)}}
+	var result struct {
+		Removed int `json:"removed"`
+	}
+	err := c.do(ctx, http.MethodPost, c.adminURL("/admin/cache/purge", query), nil, &result)
+	return result.Removed, err
+}
+
+// Prewarm generates the given variants of path into the server cache.
+func (c *Client) Prewarm(ctx context.Context, path string, variants ...Options) (*PrewarmResult, error) {
+	body := struct {
+		Host     string              `json:"host"`
+		Path     string              `json:"path"`
+		Variants []map[string]string `json:"variants"`
+	}{Host: c.base.Host, Path: c.mediaPath(path)}
+	for _, v := range variants {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+		variant := map[string]string{}
+		for k, values := range v.Query() {
+			variant[k] = values[0]
+		}
+		body.Variants = append(body.Variants, variant)
+	}
+	var result PrewarmResult
+	if err := c.do(ctx, http.MethodPost, c.adminURL("/admin/cache/prewarm", nil), body, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// PurgeNegativeCache forgets cached not-found results of a project (0 for
+// all projects), optionally limited to path relative to the origin prefix.
+func (c *Client) PurgeNegativeCache(ctx context.Context, projectID int, path string) (int, error) {
+	query := url.Values{}
+	if projectID > 0 {
+		query.Set("project_id", strconv.Itoa(projectID))
+	}
+	if path != "" {
+		query.Set("path", path)
+	}
+	var result struct {
+		Purged int `json:"purged"`
+	}
+	err := c.do(ctx, http.MethodPost, c.adminURL("/admin/cache/negative/purge", query), nil, &result)
+	return result.Purged, err
+}
+
+// CacheStats returns the cache usage of a project, or of all projects when
+// projectID is 0.
+func (c *Client) CacheStats(ctx context.Context, projectID int) ([]ProjectCacheStats, error) {
+	query := url.Values{}
+	if projectID > 0 {
+		query.Set("project_id", strconv.Itoa(projectID))
+	}
+	var result []ProjectCacheStats
+	return result, c.do(ctx, http.MethodGet, c.adminURL("/admin/cache/stats", query), nil, &result)
+}
+
+// Reload makes the server reload origins, storages and profiles.
+func (c *Client) Reload(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, c.adminURL("/admin/reload", nil), nil, nil)
+}
+
+// mediaPath returns path below the base URL path, as the server sees it.
+func (c *Client) mediaPath(path string) string {
+	return strings.TrimRight(c.base.Path, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+func (c *Client) adminURL(path string, query url.Values) string {
+	u := url.URL{Scheme: c.base.Scheme, Host: c.base.Host, Path: path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// do sends a request with an optional JSON body and decodes a JSON response
+// into out (unless out is nil).
+func (c *Client) do(ctx context.Context, method, target string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.adminToken != "" && strings.HasPrefix(req.URL.Path, "/admin/") {
+		req.Header.Set("Authorization", "Bearer "+c.adminToken)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
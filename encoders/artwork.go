@@ -0,0 +1,163 @@
+package encoders
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/dhowden/tag"
+	"mediax/apps/media"
+)
+
+// ErrNoArtwork is returned for album art thumbnails of audio without
+// artwork when the project's AudioCover is "none".
+var ErrNoArtwork = errors.New("audio file does not contain embedded artwork")
+
+// stageDefaultCover stages the project's default cover image from the
+// origin's storages, like a requested file.
+func stageDefaultCover(input *media.Request, path string) (string, error) {
+	cover := *input
+	cover.OriginalFilePath = strings.Trim(path, `\/`)
+	cover.StagedFilePath = ""
+	if err := cover.StageFile(); err != nil {
+		return "", fmt.Errorf("default audio cover %s: %w", path, err)
+	}
+	return cover.StagedFilePath, nil
+}
+
+// artworkPictures returns the pictures embedded in an audio file. ID3v2 tags
+// may hold several (front cover, back cover, artist, ...); the tag library
+// keeps the extra frames as APIC_0, APIC_1, ... in Raw.
+func artworkPictures(m tag.Metadata) []*tag.Picture {
+	var keys []string
+	for k, v := range m.Raw() {
+		if p, ok := v.(*tag.Picture); ok && p != nil && len(p.Data) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var pictures []*tag.Picture
+	for _, k := range keys {
+		pictures = append(pictures, m.Raw()[k].(*tag.Picture))
+	}
+	if p := m.Picture(); len(pictures) == 0 && p != nil && len(p.Data) > 0 {
+		pictures = append(pictures, p)
+	}
+	return pictures
+}
+
+// coverArtwork returns the front cover among pictures, or the first one.
+func coverArtwork(pictures []*tag.Picture) *tag.Picture {
+	for _, p := range pictures {
+		if p.Type == "Cover (front)" {
+			return p
+		}
+	}
+	if len(pictures) > 0 {
+		return pictures[0]
+	}
+	return nil
+}
+
+// artworkMime returns the MIME type of picture data sniffed from its bytes;
+// the type declared in the tag is often wrong (PNG labelled image/jpeg).
+func artworkMime(data []byte) string {
+	mime := http.DetectContentType(data)
+	if !strings.HasPrefix(mime, "image/") {
+		return ""
+	}
+	return mime
+}
+
+// artworkInput returns the ImageMagick input reading picture data of mime
+// from stdin, so the coder does not depend on a file extension.
+func artworkInput(mime string) string {
+	switch mime {
+	case "image/jpeg":
+		return "jpeg:-"
+	case "image/png":
+		return "png:-"
+	case "image/gif":
+		return "gif:-"
+	case "image/webp":
+		return "webp:-"
+	case "image/bmp":
+		return "bmp:-"
+	}
+	return "-" // let ImageMagick detect it
+}
+
+// coverPalette holds the background colours of generated covers.
+var coverPalette = []string{"#1e88e5", "#43a047", "#e53935", "#8e24aa", "#fb8c00", "#00897b", "#3949ab", "#6d4c41"}
+
+// generatedCoverArgs returns ImageMagick arguments drawing a square cover:
+// the initials of the artist (or title, or file name) above the artist and
+// title, on a colour picked from the same text so tracks of one artist
+// share a colour.
+func generatedCoverArgs(m tag.Metadata, filename string) []string {
+	var artist, title string
+	if m != nil {
+		artist, title = firstNonEmpty(m.AlbumArtist(), m.Artist()), strings.TrimSpace(m.Title())
+	}
+	if title == "" {
+		title = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+	label := firstNonEmpty(artist, title)
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(label)))
+	args := []string{"-size", "800x800", "xc:" + coverPalette[h.Sum32()%uint32(len(coverPalette))], "-fill", "white"}
+	if initials := coverInitials(label); initials != "" {
+		args = append(args, "-gravity", "center", "-pointsize", "280", "-annotate", "+0-60", initials)
+	}
+	caption := coverCaption(title)
+	if artist != "" {
+		caption = coverCaption(artist + " - " + title)
+	}
+	if caption != "" {
+		args = append(args, "-gravity", "south", "-pointsize", "40", "-annotate", "+0+80", caption)
+	}
+	return args
+}
+
+// coverCaption returns text safe to pass to -annotate: printable ASCII
+// without '%', '\' and '@', which ImageMagick reads as escapes or file
+// references, at most 36 characters long.
+func coverCaption(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) || r == '%' || r == '\\' || r == '@' {
+			return -1
+		}
+		return r
+	}, text)
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > 36 {
+		text = strings.TrimSpace(text[:33]) + "..."
+	}
+	return text
+}
+
+// coverInitials returns the first letter of up to two words of label,
+// limited to ASCII letters and digits (see sanitizeLabel).
+func coverInitials(label string) string {
+	var initials string
+	for _, word := range strings.FieldsFunc(label, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if initials += sanitizeLabel(word[:1]); len(initials) == 2 {
+			break
+		}
+	}
+	return initials
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -1,15 +1,16 @@
 package encoders
 
 import (
-	"crypto/md5"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dhowden/tag"
 	"github.com/getevo/evo/v2/lib/gpath"
 	"github.com/getevo/evo/v2/lib/log"
 	"mediax/apps/media"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
@@ -18,41 +19,56 @@ import (
 var Mp3 = media.Encoder{
 	Mime:      "audio/mpeg",
 	Processor: FFmpeg,
+	Input:     "audio",
 }
 
 var Wav = media.Encoder{
 	Mime:      "audio/wav",
 	Processor: FFmpeg,
+	Input:     "audio",
 }
 
 var Flac = media.Encoder{
 	Mime:      "audio/flac",
 	Processor: FFmpeg,
+	Input:     "audio",
 }
 
 var Aac = media.Encoder{
 	Mime:      "audio/aac",
 	Processor: FFmpeg,
+	Input:     "audio",
 }
 
 var Ogg = media.Encoder{
 	Mime:      "audio/ogg",
 	Processor: FFmpeg,
+	Input:     "audio",
 }
 
 var M4a = media.Encoder{
 	Mime:      "audio/mp4",
 	Processor: FFmpeg,
+	Input:     "audio",
+}
+
+// M4b encodes audiobooks: AAC in MP4, like M4a, usually with chapters.
+var M4b = media.Encoder{
+	Mime:      "audio/mp4",
+	Processor: FFmpeg,
+	Input:     "audio",
 }
 
 var Wma = media.Encoder{
 	Mime:      "audio/x-ms-wma",
 	Processor: FFmpeg,
+	Input:     "audio",
 }
 
 var Opus = media.Encoder{
 	Mime:      "audio/opus",
 	Processor: FFmpeg,
+	Input:     "audio",
 }
 
 // AudioMetadata represents all audio metadata information
@@ -71,20 +87,50 @@ type AudioMetadata struct {
 	DiscTotal   int    `json:"disc_total,omitempty"`
 
 	// Technical metadata
-	Format   string `json:"format,omitempty"`
-	FileType string `json:"file_type,omitempty"`
+	Format        string  `json:"format,omitempty"`
+	FileType      string  `json:"file_type,omitempty"`
+	Codec         string  `json:"codec,omitempty"`
+	Duration      float64 `json:"duration,omitempty"` // seconds
+	Bitrate       int     `json:"bitrate,omitempty"`  // bits per second
+	SampleRate    int     `json:"sample_rate,omitempty"`
+	Channels      int     `json:"channels,omitempty"`
+	ChannelLayout string  `json:"channel_layout,omitempty"`
+	BitsPerSample int     `json:"bits_per_sample,omitempty"`
+
+	// Chapter marks, e.g. of an M4B audiobook
+	Chapters []AudioChapter `json:"chapters,omitempty"`
+
+	// ReplayGain tags of the file, and the measured loudness with loudness=true
+	ReplayGain *ReplayGain    `json:"replaygain,omitempty"`
+	Loudness   *AudioLoudness `json:"loudness,omitempty"`
 
 	// File information
 	Filename string `json:"filename,omitempty"`
 	FileSize int64  `json:"file_size,omitempty"`
 
 	// Artwork information
-	HasArtwork  bool `json:"has_artwork"`
-	ArtworkSize int  `json:"artwork_size,omitempty"`
+	HasArtwork   bool   `json:"has_artwork"`
+	ArtworkSize  int    `json:"artwork_size,omitempty"`
+	ArtworkMime  string `json:"artwork_mime,omitempty"`  // sniffed from the picture data
+	ArtworkCount int    `json:"artwork_count,omitempty"` // embedded pictures, e.g. front and back cover
 }
 
-// generateAudioMetadata extracts all metadata from audio file and returns as JSON
+// generateAudioMetadata extracts all metadata from audio file and returns as JSON.
+// Tags come from the tag library, technical fields from ffprobe; with
+// loudness=true the file is also measured with ffmpeg's loudnorm filter.
 func generateAudioMetadata(input *media.Request) error {
+	// Generate cache key for metadata
+	cacheKey := input.CacheKey()
+	jsonPath, err := media.CachePath(input.Origin.Project.CacheDir, "audio_metadata", cacheKey, fmt.Sprintf("%s.json", cacheKey))
+	if err != nil {
+		return err
+	}
+	input.ProcessedFilePath = jsonPath
+	input.ProcessedMimeType = "application/json"
+	if gpath.IsFileExist(jsonPath) {
+		return nil
+	}
+
 	// Open the audio file
 	file, err := os.Open(input.StagedFilePath)
 	if err != nil {
@@ -98,40 +144,46 @@ func generateAudioMetadata(input *media.Request) error {
 		return fmt.Errorf("failed to get file info: %v", err)
 	}
 
-	// Parse metadata using tag library
+	audioMeta := AudioMetadata{
+		Filename: filepath.Base(input.OriginalFilePath),
+		FileSize: fileInfo.Size(),
+	}
+
+	// Parse tags using tag library; untagged files (e.g. WAV) still get
+	// the technical fields
 	metadata, err := tag.ReadFrom(file)
-	if err != nil {
-		return fmt.Errorf("failed to read audio metadata: %v", err)
+	if err == nil {
+		audioMeta.Title = metadata.Title()
+		audioMeta.Artist = metadata.Artist()
+		audioMeta.Album = metadata.Album()
+		audioMeta.AlbumArtist = metadata.AlbumArtist()
+		audioMeta.Composer = metadata.Composer()
+		audioMeta.Genre = metadata.Genre()
+		audioMeta.Year = metadata.Year()
+		audioMeta.Format = string(metadata.Format())
+		audioMeta.FileType = string(metadata.FileType())
+		audioMeta.Track, audioMeta.TrackTotal = metadata.Track()
+		audioMeta.Disc, audioMeta.DiscTotal = metadata.Disc()
+
+		// Describe the picture thumbnails are made from
+		pictures := artworkPictures(metadata)
+		if picture := coverArtwork(pictures); picture != nil {
+			audioMeta.HasArtwork = true
+			audioMeta.ArtworkSize = len(picture.Data)
+			audioMeta.ArtworkMime = artworkMime(picture.Data)
+			audioMeta.ArtworkCount = len(pictures)
+		}
+	} else if input.Debug {
+		log.Debug("No audio tags", "trace_id", input.TraceID, "error", err.Error())
 	}
 
-	// Create metadata structure
-	audioMeta := AudioMetadata{
-		Title:       metadata.Title(),
-		Artist:      metadata.Artist(),
-		Album:       metadata.Album(),
-		AlbumArtist: metadata.AlbumArtist(),
-		Composer:    metadata.Composer(),
-		Genre:       metadata.Genre(),
-		Year:        metadata.Year(),
-		Format:      string(metadata.Format()),
-		FileType:    string(metadata.FileType()),
-		Filename:    filepath.Base(input.OriginalFilePath),
-		FileSize:    fileInfo.Size(),
-		HasArtwork:  metadata.Picture() != nil,
-	}
-
-	// Get track and disc numbers
-	track, trackTotal := metadata.Track()
-	audioMeta.Track = track
-	audioMeta.TrackTotal = trackTotal
-
-	disc, discTotal := metadata.Disc()
-	audioMeta.Disc = disc
-	audioMeta.DiscTotal = discTotal
-
-	// Get artwork size if available
-	if picture := metadata.Picture(); picture != nil {
-		audioMeta.ArtworkSize = len(picture.Data)
+	if err := probeAudio(input.StagedFilePath, &audioMeta); err != nil {
+		log.Warning("ffprobe of audio failed", "trace_id", input.TraceID, "path", input.OriginalFilePath, "error", err)
+	}
+	if input.Options.Loudness {
+		if audioMeta.Loudness, err = measureLoudness(input.StagedFilePath); err != nil {
+			return err
+		}
 	}
 
 	// Convert to JSON
@@ -140,26 +192,10 @@ func generateAudioMetadata(input *media.Request) error {
 		return fmt.Errorf("failed to marshal metadata to JSON: %v", err)
 	}
 
-	// Create a temporary JSON file
-	cacheDir := filepath.Join(input.Origin.Project.CacheDir, "audio_metadata")
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to create audio metadata cache dir: %w", err)
-	}
-
-	// Generate cache key for metadata
-	cacheKey := fmt.Sprintf("%x", md5.Sum([]byte(input.OriginalFilePath+"_metadata")))
-	jsonPath := filepath.Join(cacheDir, fmt.Sprintf("%s.json", cacheKey))
-
 	// Write JSON to file
-	err = os.WriteFile(jsonPath, jsonData, 0644)
-	if err != nil {
+	if err := writeFileAtomic(jsonPath, jsonData); err != nil {
 		return fmt.Errorf("failed to write JSON metadata file: %v", err)
 	}
-
-	// Set the processed file path and MIME type
-	input.ProcessedFilePath = jsonPath
-	input.ProcessedMimeType = "application/json"
-
 	return nil
 }
 
@@ -176,10 +212,10 @@ func generateAudioThumbnail(input *media.Request) error {
 	}
 
 	// Generate cache key and check if thumbnail already exists
-	cacheKey := fmt.Sprintf("%x", md5.Sum([]byte(input.OriginalFilePath+input.Options.Thumbnail+outputFormat)))
-	cacheDir := filepath.Join(input.Origin.Project.CacheDir, "audio_thumbnails")
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to create audio thumbnail cache dir: %w", err)
+	cacheKey := input.CacheKey()
+	cacheDir, err := media.CacheShardDir(input.Origin.Project.CacheDir, "audio_thumbnails", cacheKey)
+	if err != nil {
+		return err
 	}
 
 	// Determine final file extension
@@ -213,28 +249,55 @@ func generateAudioThumbnail(input *media.Request) error {
 	}
 	defer file.Close()
 
-	// Parse metadata using tag library
+	// Files without tags get a generated cover like files without artwork.
 	metadata, err := tag.ReadFrom(file)
-	if err != nil {
-		return fmt.Errorf("failed to read audio metadata: %v", err)
+	if err != nil && input.Debug {
+		log.Debug("No audio tags, generating cover", "trace_id", input.TraceID, "error", err.Error())
 	}
 
-	// Get embedded artwork
-	picture := metadata.Picture()
-	if picture == nil {
-		return fmt.Errorf("audio file does not contain embedded artwork")
+	// Feed the embedded front cover to ImageMagick through stdin with its
+	// sniffed format, or draw a cover when there is none.
+	var args []string
+	var artwork *tag.Picture
+	if metadata != nil {
+		artwork = coverArtwork(artworkPictures(metadata))
 	}
-
-	// Step 1: Save the embedded artwork as a temporary JPEG file
-	jpegPath := filepath.Join(cacheDir, fmt.Sprintf("%s_%s_temp.jpg", cacheKey, input.Options.Thumbnail))
-
-	err = os.WriteFile(jpegPath, picture.Data, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to save embedded artwork: %v", err)
+	if artwork == nil {
+		// The tag library skips some covers, e.g. JPEG covr atoms of M4B
+		// audiobooks; ffmpeg demuxes them as attached picture streams.
+		data, err := extractAttachedPicture(input.StagedFilePath)
+		if errors.Is(err, media.ErrOverloaded) {
+			return err
+		}
+		if err == nil && artworkMime(data) != "" {
+			artwork = &tag.Picture{Data: data}
+		} else if err != nil && input.Debug {
+			log.Debug("No attached picture stream", "trace_id", input.TraceID, "error", err.Error())
+		}
+	}
+	if artwork != nil {
+		mime := artworkMime(artwork.Data)
+		args = []string{artworkInput(mime)}
+		if input.Debug {
+			input.Request.Set("X-Debug-Audio-Artwork", "embedded "+mime)
+		}
+	} else {
+		switch cover := input.Origin.Project.AudioCover; cover {
+		case "none":
+			return fmt.Errorf("%s: %w", input.OriginalFilePath, ErrNoArtwork)
+		case "", "generated":
+			args = generatedCoverArgs(metadata, input.OriginalFilePath)
+		default:
+			path, err := stageDefaultCover(input, cover)
+			if err != nil {
+				return err
+			}
+			args = []string{path}
+		}
+		if input.Debug {
+			input.Request.Set("X-Debug-Audio-Artwork", "fallback "+input.Origin.Project.AudioCover)
+		}
 	}
-
-	// Step 2: Use ImageMagick convert to change format and size based on user input
-	args := []string{jpegPath}
 
 	// Parse thumbnail parameter for size
 	if strings.Contains(input.Options.Thumbnail, "x") {
@@ -257,19 +320,19 @@ func generateAudioThumbnail(input *media.Request) error {
 	args = append(args, finalPath)
 
 	// Execute ImageMagick convert
-	convertCmd := exec.Command("convert", args...)
-	output, err := convertCmd.CombinedOutput()
+	cvCtx, cvCancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cvCancel()
+	cmd := command(cvCtx, "convert", args...)
+	if artwork != nil {
+		cmd.Stdin = bytes.NewReader(artwork.Data)
+	}
+	output, err := cmd.CombinedOutput()
 	if err != nil {
-		// Clean up temporary JPEG file
-		if rmErr := os.Remove(jpegPath); rmErr != nil && !os.IsNotExist(rmErr) {
-			log.Warning("failed to remove temp jpeg", "path", jpegPath, "error", rmErr)
+		os.Remove(finalPath)
+		if cvCtx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("convert timed out after %s", imageConvertTimeout())
 		}
-		return fmt.Errorf("ImageMagick convert error: %v\noutput: %s", err, truncateOutput(output))
-	}
-
-	// Clean up temporary JPEG file
-	if rmErr := os.Remove(jpegPath); rmErr != nil && !os.IsNotExist(rmErr) {
-		log.Warning("failed to remove temp jpeg", "path", jpegPath, "error", rmErr)
+		return fmt.Errorf("ImageMagick convert error: %w\noutput: %s", err, truncateOutput(output))
 	}
 
 	input.ProcessedFilePath = finalPath
@@ -289,6 +352,11 @@ func processAudio(input *media.Request) error {
 		return generateAudioMetadata(input)
 	}
 
+	// Segmented for HTTP Live Streaming
+	if opts.HLS {
+		return processHLS(input)
+	}
+
 	// Check if this is a thumbnail request (image format output)
 	if opts.Thumbnail != "" {
 		if opts.OutputFormat == "" {
@@ -307,7 +375,12 @@ func processAudio(input *media.Request) error {
 // convertAudio handles the standard audio conversion using FFmpeg
 func convertAudio(input *media.Request) error {
 	var opts = input.Options
-	input.ProcessedFilePath = strings.TrimSuffix(input.StagedFilePath, filepath.Ext(input.StagedFilePath)) + opts.ToString() + "." + opts.OutputFormat
+	cacheKey := input.CacheKey()
+	var err error
+	input.ProcessedFilePath, err = media.CachePath(input.Origin.Project.CacheDir, "audio", cacheKey, cacheKey+"."+opts.OutputFormat)
+	if err != nil {
+		return err
+	}
 
 	if gpath.IsFileExist(input.ProcessedFilePath) {
 		return nil
@@ -315,6 +388,19 @@ func convertAudio(input *media.Request) error {
 
 	args := []string{"-i", input.StagedFilePath}
 
+	// A chapter is cut from the source by its marks. Cut to the source's
+	// own format without a quality change, the audio stream is copied.
+	copyStream := false
+	if opts.Chapter > 0 {
+		chapter, err := audioChapter(input.StagedFilePath, opts.Chapter)
+		if err != nil {
+			return err
+		}
+		args = []string{"-ss", fmt.Sprintf("%.3f", chapter.Start), "-i", input.StagedFilePath,
+			"-t", fmt.Sprintf("%.3f", chapter.End-chapter.Start), "-map", "0:a:0", "-map_chapters", "-1"}
+		copyStream = opts.Quality == 0 && input.MediaType != nil && strings.EqualFold(opts.OutputFormat, input.MediaType.Extension)
+	}
+
 	// Audio quality settings
 	if opts.Quality > 0 {
 		switch strings.ToLower(opts.OutputFormat) {
@@ -323,7 +409,7 @@ func convertAudio(input *media.Request) error {
 			// Convert our 1-100 scale to 0-9 scale (inverted)
 			mp3Quality := 9 - (opts.Quality * 9 / 100)
 			args = append(args, "-q:a", fmt.Sprintf("%d", mp3Quality))
-		case "aac", "m4a":
+		case "aac", "m4a", "m4b":
 			// For AAC, use bitrate based on quality (64k to 320k)
 			bitrate := 64 + (opts.Quality * 256 / 100)
 			args = append(args, "-b:a", fmt.Sprintf("%dk", bitrate))
@@ -343,36 +429,37 @@ func convertAudio(input *media.Request) error {
 	}
 
 	// Audio codec selection based on output format
-	switch strings.ToLower(opts.OutputFormat) {
-	case "mp3":
+	switch format := strings.ToLower(opts.OutputFormat); {
+	case copyStream:
+		args = append(args, "-codec:a", "copy")
+	case format == "mp3":
 		args = append(args, "-codec:a", "libmp3lame")
-	case "aac", "m4a":
+	case format == "aac", format == "m4a", format == "m4b":
 		args = append(args, "-codec:a", "aac")
-	case "ogg":
+	case format == "ogg":
 		args = append(args, "-codec:a", "libvorbis")
-	case "flac":
+	case format == "flac":
 		args = append(args, "-codec:a", "flac")
-	case "wav":
+	case format == "wav":
 		args = append(args, "-codec:a", "pcm_s16le")
-	case "wma":
+	case format == "wma":
 		args = append(args, "-codec:a", "wmav2")
-	case "opus":
+	case format == "opus":
 		args = append(args, "-codec:a", "libopus")
 	}
 
+	// Formats players start on before the end are sent while encoding.
+	if canStream(input, opts.OutputFormat) {
+		return streamTranscode(input, opts.OutputFormat, opts.OutputFormat, args...)
+	}
+
 	// Overwrite output file if it exists
 	args = append(args, "-y")
 
 	// Add output file
 	args = append(args, input.ProcessedFilePath)
 
-	cmd := exec.Command("ffmpeg", args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("ffmpeg error: %v\noutput: %s", err, truncateOutput(output))
-	}
-
-	return nil
+	return transcode(input, opts.OutputFormat, input.ProcessedFilePath, audioEncodeTimeout(), args...)
 }
 
 // FFmpeg processor for audio conversion
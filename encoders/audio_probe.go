@@ -0,0 +1,265 @@
+package encoders
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ReplayGain holds the ReplayGain tags of a file as written by the tagger,
+// e.g. "-6.20 dB" and "0.988525".
+type ReplayGain struct {
+	TrackGain string `json:"track_gain,omitempty"`
+	TrackPeak string `json:"track_peak,omitempty"`
+	AlbumGain string `json:"album_gain,omitempty"`
+	AlbumPeak string `json:"album_peak,omitempty"`
+}
+
+// AudioLoudness is the EBU R128 loudness of a file measured by ffmpeg.
+type AudioLoudness struct {
+	Integrated float64 `json:"integrated_lufs"`
+	TruePeak   float64 `json:"true_peak_dbtp"`
+	Range      float64 `json:"range_lu"`
+	// TrackGain is the ReplayGain 2.0 track gain: the change bringing the
+	// file to the -18 LUFS reference.
+	TrackGain float64 `json:"track_gain_db"`
+}
+
+// AudioChapter is a chapter mark of an audiobook (or other audio with
+// chapters); Index is the chapter= value selecting it.
+type AudioChapter struct {
+	Index int     `json:"index"`
+	Title string  `json:"title,omitempty"`
+	Start float64 `json:"start"` // seconds
+	End   float64 `json:"end"`   // seconds
+}
+
+// ffprobeAudio is the part of ffprobe's JSON output read for audio files.
+type ffprobeAudio struct {
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		BitRate    string            `json:"bit_rate"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType        string            `json:"codec_type"`
+		CodecName        string            `json:"codec_name"`
+		SampleRate       string            `json:"sample_rate"`
+		Channels         int               `json:"channels"`
+		ChannelLayout    string            `json:"channel_layout"`
+		BitsPerSample    int               `json:"bits_per_sample"`
+		BitsPerRawSample string            `json:"bits_per_raw_sample"`
+		BitRate          string            `json:"bit_rate"`
+		Tags             map[string]string `json:"tags"`
+		Disposition      struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Chapters []struct {
+		StartTime string            `json:"start_time"`
+		EndTime   string            `json:"end_time"`
+		Tags      map[string]string `json:"tags"`
+	} `json:"chapters"`
+}
+
+// ffprobeAudioFile runs ffprobe on path.
+func ffprobeAudioFile(path string) (*ffprobeAudio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout())
+	defer cancel()
+	output, err := command(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", "-show_chapters", path).Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("ffprobe timed out after %s", probeTimeout())
+		}
+		return nil, fmt.Errorf("ffprobe error: %w", err)
+	}
+	var probe ffprobeAudio
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("invalid ffprobe output: %w", err)
+	}
+	return &probe, nil
+}
+
+// chapters returns the chapter marks of the probed file.
+func (probe *ffprobeAudio) chapters() []AudioChapter {
+	var chapters []AudioChapter
+	for i, c := range probe.Chapters {
+		chapter := AudioChapter{Index: i + 1, Title: c.Tags["title"]}
+		chapter.Start, _ = strconv.ParseFloat(c.StartTime, 64)
+		chapter.End, _ = strconv.ParseFloat(c.EndTime, 64)
+		chapters = append(chapters, chapter)
+	}
+	return chapters
+}
+
+// audioChapter returns chapter n (1-based) of the file at path.
+func audioChapter(path string, n int) (AudioChapter, error) {
+	probe, err := ffprobeAudioFile(path)
+	if err != nil {
+		return AudioChapter{}, err
+	}
+	chapters := probe.chapters()
+	if n > len(chapters) {
+		return AudioChapter{}, fmt.Errorf("chapter %d out of range: file has %d chapters", n, len(chapters))
+	}
+	return chapters[n-1], nil
+}
+
+// probeAudio fills the technical fields, chapters and ReplayGain tags of
+// meta from ffprobe. Cover art the tag library could not read (e.g. JPEG
+// covers of some M4B files) is reported from the attached picture streams.
+func probeAudio(path string, meta *AudioMetadata) error {
+	probe, err := ffprobeAudioFile(path)
+	if err != nil {
+		return err
+	}
+
+	if meta.Format == "" {
+		meta.Format = probe.Format.FormatName
+	}
+	meta.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	meta.Bitrate, _ = strconv.Atoi(probe.Format.BitRate)
+	meta.Chapters = probe.chapters()
+	tags := probe.Format.Tags
+	found := false
+	for _, st := range probe.Streams {
+		if st.Disposition.AttachedPic == 1 && !meta.HasArtwork {
+			meta.ArtworkCount++
+			if meta.ArtworkMime == "" {
+				meta.ArtworkMime = map[string]string{"mjpeg": "image/jpeg", "png": "image/png"}[st.CodecName]
+			}
+		}
+		if st.CodecType != "audio" || found {
+			continue
+		}
+		found = true
+		meta.Codec = st.CodecName
+		meta.SampleRate, _ = strconv.Atoi(st.SampleRate)
+		meta.Channels = st.Channels
+		meta.ChannelLayout = st.ChannelLayout
+		meta.BitsPerSample = st.BitsPerSample
+		if meta.BitsPerSample == 0 {
+			meta.BitsPerSample, _ = strconv.Atoi(st.BitsPerRawSample)
+		}
+		if meta.Bitrate == 0 {
+			meta.Bitrate, _ = strconv.Atoi(st.BitRate)
+		}
+		// Vorbis comments (FLAC, Ogg, Opus) are stream tags.
+		if len(tags) == 0 {
+			tags = st.Tags
+		}
+	}
+	if !meta.HasArtwork && meta.ArtworkCount > 0 {
+		meta.HasArtwork = true
+	}
+	fillTags(meta, tags)
+	meta.ReplayGain = replayGainTags(tags)
+	return nil
+}
+
+// fillTags sets the tag fields the tag library left empty, e.g. because it
+// could not parse the file, from ffprobe's tags.
+func fillTags(meta *AudioMetadata, tags map[string]string) {
+	lower := make(map[string]string, len(tags))
+	for k, v := range tags {
+		lower[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+	for _, f := range []struct {
+		field *string
+		key   string
+	}{
+		{&meta.Title, "title"},
+		{&meta.Artist, "artist"},
+		{&meta.Album, "album"},
+		{&meta.AlbumArtist, "album_artist"},
+		{&meta.Composer, "composer"},
+		{&meta.Genre, "genre"},
+	} {
+		if *f.field == "" {
+			*f.field = lower[f.key]
+		}
+	}
+}
+
+// extractAttachedPicture returns the first attached picture (cover) stream
+// of path as ffmpeg demuxes it, for files whose tags the tag library cannot
+// read.
+func extractAttachedPicture(path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout())
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := command(ctx, "ffmpeg", "-v", "error", "-i", path, "-map", "0:v:0", "-c", "copy", "-frames:v", "1", "-f", "image2pipe", "-")
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("cover extraction timed out after %s", probeTimeout())
+		}
+		return nil, fmt.Errorf("ffmpeg error: %w\noutput: %s", err, truncateOutput(stderr.Bytes()))
+	}
+	return data, nil
+}
+
+// replayGainTags returns the REPLAYGAIN_* tags, whose case differs between
+// taggers, or nil without any.
+func replayGainTags(tags map[string]string) *ReplayGain {
+	var rg ReplayGain
+	for k, v := range tags {
+		switch strings.ToLower(k) {
+		case "replaygain_track_gain":
+			rg.TrackGain = v
+		case "replaygain_track_peak":
+			rg.TrackPeak = v
+		case "replaygain_album_gain":
+			rg.AlbumGain = v
+		case "replaygain_album_peak":
+			rg.AlbumPeak = v
+		}
+	}
+	if rg == (ReplayGain{}) {
+		return nil
+	}
+	return &rg
+}
+
+// measureLoudness decodes path through ffmpeg's loudnorm filter, which
+// prints its measurement as JSON after the log output.
+func measureLoudness(path string) (*AudioLoudness, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), audioEncodeTimeout())
+	defer cancel()
+	output, err := command(ctx, "ffmpeg", "-hide_banner", "-nostats", "-i", path,
+		"-map", "0:a:0", "-af", "loudnorm=print_format=json", "-f", "null", "-").CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("loudness measurement timed out after %s", audioEncodeTimeout())
+		}
+		return nil, fmt.Errorf("ffmpeg error: %w\noutput: %s", err, truncateOutput(output))
+	}
+	start := bytes.LastIndexByte(output, '{')
+	end := bytes.LastIndexByte(output, '}')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no loudnorm measurement in ffmpeg output")
+	}
+	var m struct {
+		InputI   string `json:"input_i"`
+		InputTP  string `json:"input_tp"`
+		InputLRA string `json:"input_lra"`
+	}
+	if err := json.Unmarshal(output[start:end+1], &m); err != nil {
+		return nil, fmt.Errorf("invalid loudnorm measurement: %w", err)
+	}
+	loudness := &AudioLoudness{}
+	loudness.Integrated, _ = strconv.ParseFloat(m.InputI, 64)
+	loudness.TruePeak, _ = strconv.ParseFloat(m.InputTP, 64)
+	loudness.Range, _ = strconv.ParseFloat(m.InputLRA, 64)
+	// Silence measures -inf (or -70, the gate), which has no usable gain.
+	if !math.IsInf(loudness.Integrated, 0) && loudness.Integrated > -70 {
+		loudness.TrackGain = math.Round((-18-loudness.Integrated)*100) / 100
+	}
+	return loudness, nil
+}
@@ -0,0 +1,153 @@
+package encoders
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// ErrCutoutPending is returned for bg=remove while the cutout is made in
+// the background; the request is answered 202 so the client retries.
+var ErrCutoutPending = errors.New("background removal in progress, retry later")
+
+// ErrCutoutDisabled is returned for bg=remove without
+// MEDIAX.BackgroundRemovalURL.
+var ErrCutoutDisabled = errors.New("background removal is not configured")
+
+// cutoutFailureTTL is how long a failed background job answers requests
+// with its error before the cutout is attempted again.
+const cutoutFailureTTL = time.Minute
+
+// cutoutJob is a background removal running or recently failed.
+type cutoutJob struct {
+	err      error
+	failedAt time.Time
+}
+
+// cutoutJobs holds the jobs by cutout path.
+var cutoutJobs sync.Map
+
+// cutout returns the staged source with its background removed by the
+// service at MEDIAX.BackgroundRemovalURL, as a PNG cached per source. With
+// MEDIAX.BackgroundRemovalAsync (the default) a missing cutout is made in
+// the background and ErrCutoutPending returned meanwhile.
+func cutout(input *media.Request) (string, error) {
+	service := settings.Get("MEDIAX.BackgroundRemovalURL", "").String()
+	if service == "" {
+		return "", ErrCutoutDisabled
+	}
+	key := (&media.Options{RemoveBackground: true}).CacheKey(input.SourceID())
+	path, err := media.CachePath(input.Origin.Project.CacheDir, "cutouts", key, key+".png")
+	if err != nil {
+		return "", err
+	}
+	if gpath.IsFileExist(path) {
+		return path, nil
+	}
+	if !settings.Get("MEDIAX.BackgroundRemovalAsync", true).Bool() {
+		if err := removeBackground(context.Background(), service, input.StagedFilePath, path); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+
+	v, running := cutoutJobs.LoadOrStore(path, &cutoutJob{})
+	if job := v.(*cutoutJob); running {
+		if job.err == nil {
+			return "", ErrCutoutPending
+		}
+		if time.Since(job.failedAt) < cutoutFailureTTL {
+			return "", job.err
+		}
+		// Retry after the failure expired.
+		cutoutJobs.Delete(path)
+		if _, running = cutoutJobs.LoadOrStore(path, &cutoutJob{}); running {
+			return "", ErrCutoutPending
+		}
+	}
+	release := media.AcquireCacheFile(input.StagedFilePath)
+	go func(source, name string) {
+		defer release()
+		err := removeBackground(context.Background(), service, source, path)
+		if err == nil || errors.Is(err, media.ErrOverloaded) {
+			cutoutJobs.Delete(path)
+			return
+		}
+		log.Error("background removal failed", "path", name, "error", err)
+		cutoutJobs.Store(path, &cutoutJob{err: err, failedAt: time.Now()})
+	}(input.StagedFilePath, input.OriginalFilePath)
+	return "", ErrCutoutPending
+}
+
+// removeBackground posts source as the multipart field "file" to service
+// (the API of rembg's server and similar wrappers around segmentation
+// models) and writes the image it answers to output. The call takes a
+// heavy pool slot like a local conversion.
+func removeBackground(ctx context.Context, service, source, output string) error {
+	timeout := commandTimeout("BackgroundRemovalTimeout", 2*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	release, err := media.Admit(ctx, media.PoolHeavy)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filepath.Base(source))
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	_, err = io.Copy(part, f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read source: %w", err)
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, service, &body)
+	if err != nil {
+		return fmt.Errorf("invalid MEDIAX.BackgroundRemovalURL: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("background removal timed out after %s", timeout)
+		}
+		return fmt.Errorf("background removal service: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 256<<20))
+	if err != nil {
+		return fmt.Errorf("background removal service: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("background removal service answered %s: %s", resp.Status, truncateOutput(data))
+	}
+	if mime := http.DetectContentType(data); !strings.HasPrefix(mime, "image/") {
+		return fmt.Errorf("background removal service answered %s, not an image", mime)
+	}
+	return writeFileAtomic(output, data)
+}
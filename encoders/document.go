@@ -2,14 +2,13 @@ package encoders
 
 import (
 	"context"
-	"crypto/md5"
 	"fmt"
 	"github.com/getevo/evo/v2/lib/log"
 	"mediax/apps/media"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -27,86 +26,109 @@ func sanitizeLabel(s string) string {
 var Pdf = media.Encoder{
 	Mime:      "application/pdf",
 	Processor: processDocument,
+	Input:     "document",
+}
+
+// PdfA is PDF/A-2b output of PDF sources (?f=pdfa), for archiving.
+var PdfA = media.Encoder{
+	Mime:      "application/pdf",
+	Processor: processDocument,
+	Input:     "document",
 }
 
 // Docx Microsoft Office formats
 var Docx = media.Encoder{
 	Mime:      "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 var Xlsx = media.Encoder{
 	Mime:      "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 var Pptx = media.Encoder{
 	Mime:      "application/vnd.openxmlformats-officedocument.presentationml.presentation",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 // Legacy Microsoft Office formats
 var Doc = media.Encoder{
 	Mime:      "application/msword",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 var Xls = media.Encoder{
 	Mime:      "application/vnd.ms-excel",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 var Ppt = media.Encoder{
 	Mime:      "application/vnd.ms-powerpoint",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 // OpenDocument formats
 var Odt = media.Encoder{
 	Mime:      "application/vnd.oasis.opendocument.text",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 var Ods = media.Encoder{
 	Mime:      "application/vnd.oasis.opendocument.spreadsheet",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 var Odp = media.Encoder{
 	Mime:      "application/vnd.oasis.opendocument.presentation",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 // Text formats
 var Txt = media.Encoder{
 	Mime:      "text/plain",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 var Rtf = media.Encoder{
 	Mime:      "application/rtf",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 var Csv = media.Encoder{
 	Mime:      "text/csv",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 // Other common formats
 var Epub = media.Encoder{
 	Mime:      "application/epub+zip",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 var Xml = media.Encoder{
 	Mime:      "application/xml",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 var Json = media.Encoder{
 	Mime:      "application/json",
 	Processor: processDocument,
+	Input:     "document",
 }
 
 // DocumentMetadata represents document metadata information
@@ -119,9 +141,10 @@ type DocumentMetadata struct {
 	LastModified string `json:"last_modified,omitempty"`
 }
 
-// generateDocumentThumbnail creates a thumbnail from the first page of a document
+// generateDocumentThumbnail creates a thumbnail from the first page of a
+// document, or with dpi and no thumbnail size the first page at full size.
 func generateDocumentThumbnail(input *media.Request) error {
-	if input.Options.Thumbnail == "" {
+	if input.Options.Thumbnail == "" && input.Options.DPI == 0 {
 		return nil
 	}
 
@@ -132,10 +155,10 @@ func generateDocumentThumbnail(input *media.Request) error {
 	}
 
 	// Generate cache key and check if thumbnail already exists
-	cacheKey := fmt.Sprintf("%x", md5.Sum([]byte(input.OriginalFilePath+input.Options.Thumbnail+outputFormat)))
-	cacheDir := filepath.Join(input.Origin.Project.CacheDir, "document_thumbnails")
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to create document thumbnail cache dir: %w", err)
+	cacheKey := input.CacheKey()
+	cacheDir, err := media.CacheShardDir(input.Origin.Project.CacheDir, "document_thumbnails", cacheKey)
+	if err != nil {
+		return err
 	}
 
 	// Determine final file extension
@@ -173,7 +196,7 @@ func generateDocumentThumbnail(input *media.Request) error {
 	switch {
 	case fileExt == ".pdf":
 		// Use pdftoppm for PDF files
-		if err := convertPdfToImage(input.StagedFilePath, tempImagePath); err == nil {
+		if err := convertPdfToImage(input.StagedFilePath, tempImagePath, input.Options.DPI); err == nil {
 			conversionSuccessful = true
 		} else if input.Debug {
 			log.Debug("PDF to image conversion failed, will use generic thumbnail", "trace_id", input.TraceID, "error", err.Error())
@@ -182,7 +205,7 @@ func generateDocumentThumbnail(input *media.Request) error {
 		fileExt == ".xlsx" || fileExt == ".xls" || fileExt == ".ods" ||
 		fileExt == ".pptx" || fileExt == ".ppt" || fileExt == ".odp":
 		// Use LibreOffice for Office documents
-		if err := convertOfficeToImage(input.StagedFilePath, tempImagePath); err == nil {
+		if err := convertOfficeToImage(input.StagedFilePath, tempImagePath, input.Options.DPI); err == nil {
 			conversionSuccessful = true
 		} else if input.Debug {
 			log.Debug("Office to image conversion failed, will use generic thumbnail", "trace_id", input.TraceID, "error", err.Error())
@@ -208,9 +231,9 @@ func generateDocumentThumbnail(input *media.Request) error {
 	} else {
 		// Create a blank image as a last resort
 		blankImagePath := filepath.Join(cacheDir, fmt.Sprintf("%s_%s_blank.png", cacheKey, input.Options.Thumbnail))
-		bCtx, bCancel := context.WithTimeout(context.Background(), imageConvertTimeout)
+		bCtx, bCancel := context.WithTimeout(context.Background(), imageConvertTimeout())
 		defer bCancel()
-		err := exec.CommandContext(bCtx, "convert", "-size", "800x600", "xc:white",
+		err := command(bCtx, "convert", "-size", "800x600", "xc:white",
 			"-gravity", "center",
 			"-pointsize", "24",
 			"-annotate", "0", "Document Preview Unavailable",
@@ -225,7 +248,9 @@ func generateDocumentThumbnail(input *media.Request) error {
 	args := []string{sourceImage}
 
 	// Parse thumbnail parameter for size
-	if strings.Contains(input.Options.Thumbnail, "x") {
+	if input.Options.Thumbnail == "" {
+		// Full size page at dpi
+	} else if strings.Contains(input.Options.Thumbnail, "x") {
 		// Custom dimensions (e.g., "256x256")
 		args = append(args, "-resize", input.Options.Thumbnail+"^")
 		args = append(args, "-gravity", "center")
@@ -240,14 +265,15 @@ func generateDocumentThumbnail(input *media.Request) error {
 	if input.Options.Quality > 0 {
 		args = append(args, "-quality", fmt.Sprintf("%d", input.Options.Quality))
 	}
+	args = append(args, densityArgs(input.Options)...)
 
 	// Set output file
 	args = append(args, finalPath)
 
 	// Execute ImageMagick convert
-	cvCtx, cvCancel := context.WithTimeout(context.Background(), imageConvertTimeout)
+	cvCtx, cvCancel := context.WithTimeout(context.Background(), imageConvertTimeout())
 	defer cvCancel()
-	convertCmd := exec.CommandContext(cvCtx, "convert", args...)
+	convertCmd := command(cvCtx, "convert", args...)
 	output, err := convertCmd.CombinedOutput()
 	if err != nil {
 		// Clean up temporary files
@@ -258,9 +284,9 @@ func generateDocumentThumbnail(input *media.Request) error {
 			}
 		}
 		if cvCtx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("ImageMagick convert timed out after %s", imageConvertTimeout)
+			return fmt.Errorf("ImageMagick convert timed out after %s", imageConvertTimeout())
 		}
-		return fmt.Errorf("ImageMagick convert error: %v\noutput: %s", err, truncateOutput(output))
+		return fmt.Errorf("ImageMagick convert error: %w\noutput: %s", err, truncateOutput(output))
 	}
 
 	// Clean up temporary files
@@ -276,17 +302,22 @@ func generateDocumentThumbnail(input *media.Request) error {
 	return nil
 }
 
-// convertPdfToImage converts the first page of a PDF to an image
-func convertPdfToImage(pdfPath, outputPath string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), officeConvertTimeout)
+// convertPdfToImage converts the first page of a PDF to an image, at dpi
+// or pdftoppm's default of 150 when dpi is 0.
+func convertPdfToImage(pdfPath, outputPath string, dpi int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), officeConvertTimeout())
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "pdftoppm", "-png", "-singlefile", "-f", "1", "-l", "1", pdfPath, strings.TrimSuffix(outputPath, ".png"))
+	args := []string{"-png", "-singlefile", "-f", "1", "-l", "1"}
+	if dpi > 0 {
+		args = append(args, "-r", strconv.Itoa(dpi))
+	}
+	cmd := command(ctx, "pdftoppm", append(args, pdfPath, strings.TrimSuffix(outputPath, ".png"))...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("pdftoppm timed out after %s", officeConvertTimeout)
+			return fmt.Errorf("pdftoppm timed out after %s", officeConvertTimeout())
 		}
-		return fmt.Errorf("pdftoppm error: %v\noutput: %s", err, truncateOutput(output))
+		return fmt.Errorf("pdftoppm error: %w\noutput: %s", err, truncateOutput(output))
 	}
 
 	// pdftoppm adds "-1" to the filename, so we need to rename it
@@ -302,27 +333,19 @@ func convertPdfToImage(pdfPath, outputPath string) error {
 }
 
 // convertOfficeToImage converts the first page of an Office document to an image
-func convertOfficeToImage(officePath, outputPath string) error {
+func convertOfficeToImage(officePath, outputPath string, dpi int) error {
 	// Create a temporary directory for conversion
 	tempDir := filepath.Join(filepath.Dir(outputPath), "temp_"+filepath.Base(officePath))
 	os.MkdirAll(tempDir, 0755)
 	defer os.RemoveAll(tempDir)
 
 	// Use LibreOffice to convert to PDF first
-	// LibreOffice will create a PDF with the same base name as the input file
 	baseFileName := filepath.Base(officePath)
 	baseNameWithoutExt := strings.TrimSuffix(baseFileName, filepath.Ext(baseFileName))
 	expectedPdfPath := filepath.Join(tempDir, baseNameWithoutExt+".pdf")
 
-	ctx, cancel := context.WithTimeout(context.Background(), officeConvertTimeout)
-	defer cancel()
-	cmd := exec.CommandContext(ctx, "soffice", "--headless", "--convert-to", "pdf", "--outdir", tempDir, officePath)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("LibreOffice conversion timed out after %s", officeConvertTimeout)
-		}
-		return fmt.Errorf("LibreOffice conversion error: %v\noutput: %s", err, truncateOutput(output))
+	if err := convertOffice(officePath, expectedPdfPath); err != nil {
+		return err
 	}
 
 	// Check if the PDF was created
@@ -331,7 +354,7 @@ func convertOfficeToImage(officePath, outputPath string) error {
 	}
 
 	// Now convert the PDF to image using pdftoppm
-	return convertPdfToImage(expectedPdfPath, outputPath)
+	return convertPdfToImage(expectedPdfPath, outputPath, dpi)
 }
 
 // createGenericThumbnail creates a generic thumbnail for document types without specific converters
@@ -345,9 +368,9 @@ func createGenericThumbnail(docPath, outputPath, fileType string) error {
 	}
 
 	// Create a blank canvas with file type text
-	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "convert", "-size", "800x600", "xc:white",
+	cmd := command(ctx, "convert", "-size", "800x600", "xc:white",
 		"-gravity", "center",
 		"-pointsize", "72",
 		"-annotate", "0", safeLabel,
@@ -355,9 +378,9 @@ func createGenericThumbnail(docPath, outputPath, fileType string) error {
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("ImageMagick timed out after %s", imageConvertTimeout)
+			return fmt.Errorf("ImageMagick timed out after %s", imageConvertTimeout())
 		}
-		return fmt.Errorf("ImageMagick error: %v\noutput: %s", err, truncateOutput(output))
+		return fmt.Errorf("ImageMagick error: %w\noutput: %s", err, truncateOutput(output))
 	}
 	return nil
 }
@@ -368,9 +391,63 @@ func processDocument(input *media.Request) error {
 		return fmt.Errorf("input is nil")
 	}
 
+	if input.Options.OCR {
+		return generateOCR(input)
+	}
+	if isTiff(input.Options.OutputFormat) {
+		return pdfToTiff(input)
+	}
+	if input.Options.Thumbnail == "" && (input.Options.OutputFormat == "pdfa" || input.Options.Flatten) {
+		return normalizePdf(input)
+	}
 	if !isImageFormat(input.Options.OutputFormat) {
 		input.Options.OutputFormat = "jpg"
 	}
 
 	return generateDocumentThumbnail(input)
 }
+
+// normalizePdf rewrites a PDF source with ghostscript: as PDF/A-2b for
+// ?f=pdfa, and with annotations and form fields rendered into the page
+// content for ?flatten=true.
+func normalizePdf(input *media.Request) error {
+	if input.MediaType == nil || input.MediaType.Extension != "pdf" {
+		return fmt.Errorf("pdfa and flatten need a pdf source")
+	}
+	cacheKey := input.CacheKey()
+	outputPath, err := media.CachePath(input.Origin.Project.CacheDir, "documents", cacheKey, cacheKey+".pdf")
+	if err != nil {
+		return err
+	}
+	input.ProcessedMimeType = "application/pdf"
+	if _, err := os.Stat(outputPath); err == nil {
+		input.ProcessedFilePath = outputPath
+		return nil
+	}
+
+	tempPath := outputPath + ".tmp"
+	args := []string{"-dBATCH", "-dNOPAUSE", "-dQUIET", "-dSAFER", "-sDEVICE=pdfwrite"}
+	if input.Options.OutputFormat == "pdfa" {
+		args = append(args, "-dPDFA=2", "-dPDFACompatibilityPolicy=1", "-sColorConversionStrategy=RGB")
+	}
+	if input.Options.Flatten {
+		args = append(args, "-dPreserveAnnots=false", "-dShowAcroForm=true")
+	}
+	args = append(args, "-sOutputFile="+tempPath, input.StagedFilePath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), officeConvertTimeout())
+	defer cancel()
+	output, err := command(ctx, "gs", args...).CombinedOutput()
+	if err != nil {
+		os.Remove(tempPath)
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("ghostscript timed out after %s", officeConvertTimeout())
+		}
+		return fmt.Errorf("ghostscript error: %w\noutput: %s", err, truncateOutput(output))
+	}
+	if err := os.Rename(tempPath, outputPath); err != nil {
+		return err
+	}
+	input.ProcessedFilePath = outputPath
+	return nil
+}
@@ -0,0 +1,266 @@
+package encoders
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"mediax/apps/media"
+)
+
+// Email formats. Image and pdf outputs render the message; ?attachment=N
+// serves its N-th attachment.
+var (
+	Eml = media.Encoder{Mime: "message/rfc822", Processor: processEmail, Input: "document"}
+	Msg = media.Encoder{Mime: "application/vnd.ms-outlook", Processor: processEmail, Input: "document"}
+)
+
+// emailMessage is the part of a message that is rendered or extracted.
+type emailMessage struct {
+	headers     [][2]string
+	body        string
+	attachments []emailAttachment
+}
+
+type emailAttachment struct {
+	filename    string
+	contentType string
+	data        []byte
+}
+
+// processEmail renders an .eml or .msg message to a PDF or image, or
+// extracts one attachment. Outlook .msg files are converted to .eml with
+// msgconvert first.
+func processEmail(input *media.Request) error {
+	opts := input.Options
+	format := strings.ToLower(opts.OutputFormat)
+	if opts.Attachment == 0 && format != "pdf" && !isImageFormat(format) {
+		return nil // the original message
+	}
+
+	cacheKey := input.CacheKey()
+	dir, err := media.CacheShardDir(input.Origin.Project.CacheDir, "email", cacheKey)
+	if err != nil {
+		return err
+	}
+	workDir, err := os.MkdirTemp(dir, cacheKey+"-work")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	emlPath := input.StagedFilePath
+	if strings.EqualFold(filepath.Ext(emlPath), ".msg") {
+		emlPath = filepath.Join(workDir, "message.eml")
+		if err := convertMsg(input.StagedFilePath, emlPath); err != nil {
+			return err
+		}
+	}
+	raw, err := os.ReadFile(emlPath)
+	if err != nil {
+		return err
+	}
+	msg, err := parseEmail(raw)
+	if err != nil {
+		return err
+	}
+
+	if opts.Attachment > 0 {
+		if opts.Attachment > len(msg.attachments) {
+			return fmt.Errorf("attachment %d out of range: message has %d attachments", opts.Attachment, len(msg.attachments))
+		}
+		a := msg.attachments[opts.Attachment-1]
+		path := filepath.Join(dir, cacheKey+"-"+safeFilename(a.filename))
+		if !gpath.IsFileExist(path) {
+			if err := os.WriteFile(path, a.data, 0644); err != nil {
+				return err
+			}
+		}
+		input.ProcessedFilePath = path
+		input.ProcessedMimeType = a.contentType
+		return nil
+	}
+
+	return renderPage(input, "email", msg.renderHTML())
+}
+
+// convertMsg converts an Outlook .msg file to .eml with msgconvert.
+func convertMsg(msgPath, emlPath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), officeConvertTimeout())
+	defer cancel()
+	out, err := command(ctx, "msgconvert", "--outfile", emlPath, msgPath).CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("msgconvert timed out after %s", officeConvertTimeout())
+		}
+		return fmt.Errorf("msgconvert error: %w\noutput: %s", err, truncateOutput(out))
+	}
+	return nil
+}
+
+var wordDecoder = mime.WordDecoder{}
+
+// parseEmail reads the headers, the first text body and the attachments of
+// a MIME message.
+func parseEmail(raw []byte) (*emailMessage, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid email: %w", err)
+	}
+	msg := &emailMessage{}
+	for _, h := range []string{"From", "To", "Cc", "Date", "Subject"} {
+		if v := m.Header.Get(h); v != "" {
+			if decoded, err := wordDecoder.DecodeHeader(v); err == nil {
+				v = decoded
+			}
+			msg.headers = append(msg.headers, [2]string{h, v})
+		}
+	}
+	var plain, htmlBody string
+	var walk func(header map[string][]string, body io.Reader) error
+	walk = func(header map[string][]string, body io.Reader) error {
+		get := func(k string) string {
+			if v := header[k]; len(v) > 0 {
+				return v[0]
+			}
+			return ""
+		}
+		mediaType, params, _ := mime.ParseMediaType(get("Content-Type"))
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			mr := multipart.NewReader(body, params["boundary"])
+			for {
+				part, err := mr.NextRawPart()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := walk(part.Header, part); err != nil {
+					return err
+				}
+			}
+		}
+		data, err := io.ReadAll(decodeTransfer(get("Content-Transfer-Encoding"), body))
+		if err != nil {
+			return err
+		}
+		disposition, dparams, _ := mime.ParseMediaType(get("Content-Disposition"))
+		filename := dparams["filename"]
+		if filename == "" {
+			filename = params["name"]
+		}
+		if decoded, err := wordDecoder.DecodeHeader(filename); err == nil {
+			filename = decoded
+		}
+		switch {
+		case disposition == "attachment" || filename != "":
+			if filename == "" {
+				filename = "attachment-" + strconv.Itoa(len(msg.attachments)+1)
+			}
+			msg.attachments = append(msg.attachments, emailAttachment{filename: filename, contentType: mediaType, data: data})
+		case mediaType == "text/plain" && plain == "":
+			plain = string(data)
+		case mediaType == "text/html" && htmlBody == "":
+			htmlBody = string(data)
+		}
+		return nil
+	}
+	if err := walk(m.Header, m.Body); err != nil {
+		return nil, fmt.Errorf("invalid email: %w", err)
+	}
+	msg.body = plain
+	if msg.body == "" {
+		msg.body = htmlToText(htmlBody)
+	}
+	return msg, nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &lineJoiner{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// lineJoiner drops line breaks, which base64 bodies wrap at 76 columns.
+type lineJoiner struct{ r io.Reader }
+
+func (l *lineJoiner) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	j := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
+
+var (
+	htmlBlockTags = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/li|/h[1-6])[^>]*>`)
+	htmlDrop      = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+	htmlTags      = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// htmlToText reduces an HTML body to text. Rendering the sender's HTML would
+// let a message load remote resources from the renderer.
+func htmlToText(s string) string {
+	s = htmlDrop.ReplaceAllString(s, "")
+	s = htmlBlockTags.ReplaceAllString(s, "\n")
+	s = htmlTags.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
+
+// renderHTML returns a self-contained page of the headers, the text body and
+// the attachment names.
+func (m *emailMessage) renderHTML() []byte {
+	var b bytes.Buffer
+	b.WriteString(`<html><head><meta charset="utf-8"></head><body style="font-family:sans-serif"><table>`)
+	for _, h := range m.headers {
+		fmt.Fprintf(&b, "<tr><td><b>%s:</b></td><td>%s</td></tr>", h[0], html.EscapeString(h[1]))
+	}
+	b.WriteString("</table><hr><pre style=\"white-space:pre-wrap;font-family:sans-serif\">")
+	b.WriteString(html.EscapeString(m.body))
+	b.WriteString("</pre>")
+	if len(m.attachments) > 0 {
+		b.WriteString("<hr><b>Attachments:</b><ol>")
+		for _, a := range m.attachments {
+			fmt.Fprintf(&b, "<li>%s (%d bytes)</li>", html.EscapeString(a.filename), len(a.data))
+		}
+		b.WriteString("</ol>")
+	}
+	b.WriteString("</body></html>")
+	return b.Bytes()
+}
+
+var unsafeFilename = regexp.MustCompile(`[^\w.\-]+`)
+
+// safeFilename returns name reduced to a safe file name.
+func safeFilename(name string) string {
+	name = unsafeFilename.ReplaceAllString(filepath.Base(name), "_")
+	if name == "" || name == "." || name == ".." {
+		return "attachment"
+	}
+	return name
+}
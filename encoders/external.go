@@ -0,0 +1,78 @@
+package encoders
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"mediax/apps/media"
+)
+
+// External returns an encoder that runs the command of p to produce its
+// output format; see media.ExternalProcessor for the command template.
+func External(p media.ExternalProcessor) *media.Encoder {
+	timeout, err := media.ParseDuration(p.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	template := strings.Fields(p.Command)
+	format := strings.ToLower(p.Format)
+	return &media.Encoder{
+		Mime: p.OutputMime,
+		Processor: func(input *media.Request) error {
+			return runExternal(input, template, format, p.OutputMime, timeout)
+		},
+	}
+}
+
+func runExternal(input *media.Request, template []string, format, mime string, timeout time.Duration) error {
+	if len(template) == 0 {
+		return fmt.Errorf("external processor for %s has no command", format)
+	}
+	cacheKey := input.CacheKey()
+	outputPath, err := media.CachePath(input.Origin.Project.CacheDir, "external", cacheKey, cacheKey+"."+format)
+	if err != nil {
+		return err
+	}
+	input.ProcessedMimeType = mime
+	if gpath.IsFileExist(outputPath) {
+		input.ProcessedFilePath = outputPath
+		return nil
+	}
+
+	// Keep the extension on the temp file; many tools pick the format from it.
+	tempPath := strings.TrimSuffix(outputPath, "."+format) + ".tmp." + format
+	opts := input.Options
+	replacer := strings.NewReplacer(
+		"{input}", input.StagedFilePath,
+		"{output}", tempPath,
+		"{width}", strconv.Itoa(opts.Width),
+		"{height}", strconv.Itoa(opts.Height),
+		"{quality}", strconv.Itoa(opts.Quality),
+		"{format}", format,
+	)
+	args := make([]string, len(template))
+	for i, a := range template {
+		args[i] = replacer.Replace(a)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	output, err := command(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		os.Remove(tempPath)
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s timed out after %s", args[0], timeout)
+		}
+		return fmt.Errorf("%s error: %w\noutput: %s", args[0], err, truncateOutput(output))
+	}
+	if err := os.Rename(tempPath, outputPath); err != nil {
+		return fmt.Errorf("%s did not write its output: %w", args[0], err)
+	}
+	input.ProcessedFilePath = outputPath
+	return nil
+}
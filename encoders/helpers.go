@@ -1,19 +1,63 @@
 package encoders
 
-import "time"
+import (
+	"time"
+
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
 
 const (
 	// Video preview constants
-	chunkDuration       = 4.0  // seconds per preview chunk
-	maxPreviewDuration  = 20.0 // maximum preview duration in seconds
-	ffmpegCRF           = "28" // FFmpeg CRF for preview compression (higher = smaller file)
-	maxConcurrentChunks = 4    // maximum concurrent FFmpeg chunk extraction goroutines
-
-	// Command timeout constants (#5)
-	imageConvertTimeout  = 60 * time.Second  // timeout for ImageMagick convert/identify
-	officeConvertTimeout = 120 * time.Second // timeout for LibreOffice/pdftoppm conversions
+	chunkDuration      = 4.0  // seconds per preview chunk
+	maxPreviewDuration = 20.0 // maximum preview duration in seconds
+	ffmpegCRF          = "28" // FFmpeg CRF for preview compression (higher = smaller file)
 )
 
+// Command timeouts (#5). Every external command runs under one of them.
+
+// imageConvertTimeout bounds ImageMagick convert/identify (MEDIAX.ImageTimeout).
+func imageConvertTimeout() time.Duration {
+	return commandTimeout("ImageTimeout", time.Minute)
+}
+
+// officeConvertTimeout bounds LibreOffice, pdftoppm, gs, msgconvert and
+// the model renderer (MEDIAX.DocumentTimeout).
+func officeConvertTimeout() time.Duration {
+	return commandTimeout("DocumentTimeout", 2*time.Minute)
+}
+
+// audioEncodeTimeout bounds ffmpeg audio transcoding (MEDIAX.AudioTimeout).
+func audioEncodeTimeout() time.Duration {
+	return commandTimeout("AudioTimeout", 10*time.Minute)
+}
+
+// videoEncodeTimeout bounds ffmpeg profile transcoding (MEDIAX.VideoTimeout).
+func videoEncodeTimeout() time.Duration {
+	return commandTimeout("VideoTimeout", 10*time.Minute)
+}
+
+// videoFrameTimeout bounds ffmpeg thumbnails and preview chunks
+// (MEDIAX.VideoFrameTimeout).
+func videoFrameTimeout() time.Duration {
+	return commandTimeout("VideoFrameTimeout", time.Minute)
+}
+
+// probeTimeout bounds ffprobe (MEDIAX.ProbeTimeout).
+func probeTimeout() time.Duration {
+	return commandTimeout("ProbeTimeout", 30*time.Second)
+}
+
+// commandTimeout reads MEDIAX.<name>, falling back to def when it is unset
+// or invalid.
+func commandTimeout(name string, def time.Duration) time.Duration {
+	d, err := media.ParseDuration(settings.Get("MEDIAX."+name, def.String()).String())
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
 // truncateOutput caps command stderr/stdout at 500 characters to prevent log bloat (#6).
 func truncateOutput(output []byte) string {
 	const maxLen = 500
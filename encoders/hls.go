@@ -0,0 +1,160 @@
+package encoders
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"github.com/getevo/evo/v2/lib/settings"
+	"github.com/gofiber/fiber/v2"
+	"mediax/apps/media"
+)
+
+// HLSPlaylist is the name of the playlist in an HLS directory; the
+// segments next to it are named by HLSSegmentName.
+const HLSPlaylist = "index.m3u8"
+
+// HLSSegmentName returns the file name of segment n (1-based) of an HLS
+// directory.
+func HLSSegmentName(n int) string {
+	return fmt.Sprintf("%05d.ts", n-1)
+}
+
+// hlsSegmentDuration returns the target segment length in seconds
+// (MEDIAX.HLSSegmentDuration).
+func hlsSegmentDuration() int {
+	if d := settings.Get("MEDIAX.HLSSegmentDuration", 10).Int(); d > 0 {
+		return d
+	}
+	return 10
+}
+
+// processHLS serves the playlist (hls=1) or a single segment (hls=1,
+// segment=N) of audio segmented for HTTP Live Streaming. One ffmpeg run
+// encodes the whole source to AAC segments in MPEG-TS, so playback starts
+// after the first segment is fetched rather than the whole file. The
+// playlist names its segments by file; the controller rewrites them into
+// URLs.
+func processHLS(input *media.Request) error {
+	// Playlist and segments share one directory, keyed without the segment.
+	dirOpts := *input.Options
+	dirOpts.Segment = 0
+	key := dirOpts.CacheKey(input.SourceID())
+	shard, err := media.CacheShardDir(input.Origin.Project.CacheDir, "hls", key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(shard, key+".hls")
+	playlist := filepath.Join(dir, HLSPlaylist)
+
+	if input.Options.Segment > 0 {
+		input.ProcessedFilePath = filepath.Join(dir, HLSSegmentName(input.Options.Segment))
+		input.ProcessedMimeType = "video/mp2t"
+	} else {
+		input.ProcessedFilePath = playlist
+		input.ProcessedMimeType = "application/vnd.apple.mpegurl"
+	}
+	// Eviction removes files one by one; a directory missing the playlist
+	// or a segment it lists is rebuilt.
+	if gpath.IsFileExist(playlist) {
+		if gpath.IsFileExist(input.ProcessedFilePath) {
+			return nil
+		}
+		if !hlsListsSegment(playlist, input.Options.Segment) {
+			return fiber.NewError(fiber.StatusNotFound, "segment out of range")
+		}
+	}
+	os.RemoveAll(dir)
+
+	tmpDir, err := os.MkdirTemp(shard, key+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	bitrate := 128
+	if q := input.Options.Quality; q > 0 {
+		// As for AAC conversions: 64k to 320k.
+		bitrate = 64 + (q * 256 / 100)
+	}
+	tmpPlaylist := filepath.Join(tmpDir, HLSPlaylist)
+	err = transcode(input, "hls", tmpPlaylist, audioEncodeTimeout(),
+		"-i", input.StagedFilePath,
+		"-map", "0:a:0",
+		"-codec:a", "aac",
+		"-b:a", strconv.Itoa(bitrate)+"k",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentDuration()),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_type", "mpegts",
+		"-hls_segment_filename", filepath.Join(tmpDir, "%05d.ts"),
+		"-y", tmpPlaylist,
+	)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil && !gpath.IsFileExist(playlist) {
+		return err
+	}
+	if !gpath.IsFileExist(input.ProcessedFilePath) {
+		return fiber.NewError(fiber.StatusNotFound, "segment out of range")
+	}
+	return nil
+}
+
+// hlsListsSegment reports whether the playlist lists segment n; the
+// playlist itself (n = 0) always counts as listed.
+func hlsListsSegment(playlist string, n int) bool {
+	if n == 0 {
+		return true
+	}
+	data, err := os.ReadFile(playlist)
+	if err != nil {
+		return false
+	}
+	return hlsSegmentCount(string(data)) >= n
+}
+
+// hlsSegmentCount returns the number of segments a playlist lists.
+func hlsSegmentCount(playlist string) int {
+	n := 0
+	for _, line := range strings.Split(playlist, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			n++
+		}
+	}
+	return n
+}
+
+// RewriteHLSPlaylist replaces the segment file names of a playlist written
+// by processHLS with uri(n), the URL of segment n.
+func RewriteHLSPlaylist(playlist string, uri func(n int) string) string {
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		name := strings.TrimSpace(line)
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".ts")); err == nil {
+			lines[i] = uri(n + 1)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// InsertHLSKey adds an EXT-X-KEY tag to a playlist, before its first
+// segment, saying its segments are AES-128 encrypted under the key at uri.
+// No IV is given, so players use each segment's media sequence number, as
+// media.EncryptHLSSegment does.
+func InsertHLSKey(playlist, uri string) string {
+	tag := `#EXT-X-KEY:METHOD=AES-128,URI="` + uri + `"`
+	lines := strings.Split(playlist, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#EXTINF") {
+			return strings.Join(append(lines[:i:i], append([]string{tag}, lines[i:]...)...), "\n")
+		}
+	}
+	return playlist
+}
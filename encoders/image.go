@@ -6,11 +6,10 @@ import (
 	"fmt"
 	"github.com/getevo/evo/v2/lib/gpath"
 	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
 	"github.com/rwcarlsen/goexif/exif"
 	"mediax/apps/media"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -18,28 +17,37 @@ import (
 )
 
 var Png = media.Encoder{
-	Mime:      "image/png",
-	Processor: Imagick,
+	Mime:         "image/png",
+	Processor:    Imagick,
+	Input:        "image",
+	Alternatives: map[string]media.EncoderAlternative{"vips": Vips},
 }
 
 var Jpeg = media.Encoder{
-	Mime:      "image/jpeg",
-	Processor: Imagick,
+	Mime:         "image/jpeg",
+	Processor:    Imagick,
+	Input:        "image",
+	Alternatives: map[string]media.EncoderAlternative{"vips": Vips},
 }
 
 var Gif = media.Encoder{
 	Mime:      "image/gif",
 	Processor: Imagick,
+	Input:     "image",
 }
 
 var Webp = media.Encoder{
-	Mime:      "image/webp",
-	Processor: Imagick,
+	Mime:         "image/webp",
+	Processor:    Imagick,
+	Input:        "image",
+	Alternatives: map[string]media.EncoderAlternative{"vips": Vips},
 }
 
 var Avif = media.Encoder{
-	Mime:      "image/avif",
-	Processor: Imagick,
+	Mime:         "image/avif",
+	Processor:    Imagick,
+	Input:        "image",
+	Alternatives: map[string]media.EncoderAlternative{"vips": Vips},
 }
 
 // ExtractImageExif extracts metadata from an image file using both ImageMagick and EXIF
@@ -155,10 +163,17 @@ func processImage(input *media.Request) error {
 		return fmt.Errorf("input is nil")
 	}
 
+	if input.Options.PHash {
+		return generatePHash(input, false)
+	}
+	if input.Options.OCR {
+		return generateOCR(input)
+	}
+
 	// Extract metadata if detail=true
 	if input.Options.Detail {
 		// Generate metadata cache file path
-		metadataCacheFile := strings.TrimSuffix(input.StagedFilePath, filepath.Ext(input.StagedFilePath)) + ".metadata.json"
+		metadataCacheFile := media.MetadataSidecar(input.StagedFilePath)
 
 		// Check if metadata cache file exists
 		if gpath.IsFileExist(metadataCacheFile) {
@@ -240,20 +255,59 @@ func processImage(input *media.Request) error {
 		}
 	}
 
-	// Currently we only have one type of image processing
-	// If more types are added in the future, we can add conditional logic here
+	if input.Options.DZI || input.Options.Tile != "" {
+		return processTiles(input)
+	}
 	return convertImage(input)
 }
 
 // convertImage handles the standard image conversion using ImageMagick
 func convertImage(input *media.Request) error {
 	var opts = input.Options
-	input.ProcessedFilePath = strings.TrimSuffix(input.StagedFilePath, filepath.Ext(input.StagedFilePath)) + opts.ToString() + "." + opts.OutputFormat
+	// scale= is resolved first: the cache key holds the pixel size.
+	if opts.Scale > 0 {
+		width, height, err := imageDimensions(input.StagedFilePath)
+		if err != nil {
+			return err
+		}
+		opts.ResolveScale(width, height)
+	}
+	fields, err := input.Origin.Project.ImageMetadataFields()
+	if err != nil {
+		return err
+	}
+	cacheKey := input.CacheKey()
+	if len(fields) > 0 {
+		// Outputs carry the project's metadata, so changing it makes new ones.
+		cacheKey = opts.CacheKey(input.SourceID() + "|" + string(xmpPacket(fields)))
+	}
+	input.ProcessedFilePath, err = media.CachePath(input.Origin.Project.CacheDir, "images", cacheKey, cacheKey+"."+opts.OutputFormat)
+	if err != nil {
+		return err
+	}
 
 	if gpath.IsFileExist(input.ProcessedFilePath) {
 		return nil
 	}
-	args := []string{input.StagedFilePath}
+	var args []string
+	if opts.RemoveBackground {
+		// The cutout, a single PNG frame, replaces the source
+		path, err := cutout(input)
+		if err != nil {
+			return err
+		}
+		args = []string{path}
+	} else if args, err = frameArgs(input); err != nil {
+		return err
+	}
+	// Trim before resizing so w and h apply to the content. Frames of an
+	// animation would trim to different sizes, so animations are not trimmed.
+	if opts.Trim && !(len(args) > 1 && args[1] == "-coalesce") {
+		args = append(args, "-fuzz", fuzz(opts, trimFuzz()), "-trim", "+repage")
+	}
+	if opts.BgRemove != "" {
+		args = append(args, bgRemoveArgs(opts)...)
+	}
 
 	// Handle resizing logic
 	var resizeStr string
@@ -275,6 +329,17 @@ func convertImage(input *media.Request) error {
 			// Can't crop without both dimensions
 			resizeStr = fmt.Sprintf("%dx%d", opts.Width, opts.Height)
 			args = append(args, "-resize", resizeStr)
+		} else if opts.Pad {
+			// Fit inside and letterbox; transparent where the format allows
+			resizeStr = fmt.Sprintf("%dx%d", opts.Width, opts.Height)
+			background := "white"
+			if alphaFormats[strings.ToLower(opts.OutputFormat)] {
+				background = "none"
+			}
+			args = append(args, "-resize", resizeStr,
+				"-background", background,
+				"-gravity", getGravity(opts.CropDirection),
+				"-extent", resizeStr)
 		} else {
 			resizeStr = fmt.Sprintf("%dx%d^", opts.Width, opts.Height)
 			args = append(args, "-resize", resizeStr)
@@ -286,21 +351,39 @@ func convertImage(input *media.Request) error {
 		}
 	}
 
+	if opts.Strip {
+		args = append(args, "-strip")
+	}
+	// Embedded after -strip: the project's metadata is kept in every output.
+	embed, cleanup, err := embedMetadataArgs(fields, input.ProcessedFilePath)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	args = append(args, embed...)
+	args = append(args, densityArgs(opts)...)
+	// Drop the crop offsets of coalesced frames before re-optimizing them.
+	if len(args) > 1 && args[1] == "-coalesce" {
+		args = append(args, "+repage", "-layers", "Optimize")
+	}
+	if opts.MaxBytes > 0 {
+		return encodeUnderBytes(input, args)
+	}
 	// Apply quality if specified
 	if opts.Quality > 0 {
 		args = append(args, "-quality", fmt.Sprintf("%d", opts.Quality))
 	}
 
 	args = append(args, input.ProcessedFilePath)
-	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "convert", args...)
+	cmd := command(ctx, "convert", args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("convert timed out after %s", imageConvertTimeout)
+			return fmt.Errorf("convert timed out after %s", imageConvertTimeout())
 		}
-		return fmt.Errorf("convert error: %v\noutput: %s", err, truncateOutput(output))
+		return fmt.Errorf("convert error: %w\noutput: %s", err, truncateOutput(output))
 	}
 
 	return nil
@@ -309,6 +392,115 @@ func convertImage(input *media.Request) error {
 // Imagick processor for image conversion
 var Imagick = processImage
 
+// trimFuzz is the colour distance -trim treats as the border colour
+// (MEDIAX.TrimFuzz), so JPEG noise in a white margin is trimmed too.
+func trimFuzz() string {
+	fuzz := settings.Get("MEDIAX.TrimFuzz", 10).Int()
+	if fuzz < 0 || fuzz > 100 {
+		fuzz = 10
+	}
+	return fmt.Sprintf("%d%%", fuzz)
+}
+
+// fuzz returns the request's fuzz= as an ImageMagick percentage, or def.
+func fuzz(opts *media.Options, def string) string {
+	if opts.Fuzz > 0 {
+		return fmt.Sprintf("%d%%", opts.Fuzz)
+	}
+	return def
+}
+
+// bgRemoveArgs returns convert arguments making the background transparent:
+// a flood fill from a one-pixel border of the colour, so it reaches every
+// edge but leaves enclosed areas of the same colour (white text in a logo)
+// alone.
+func bgRemoveArgs(opts *media.Options) []string {
+	return []string{"-alpha", "set", "-bordercolor", magickColor(opts.BgRemove), "-border", "1",
+		"-fill", "none", "-fuzz", fuzz(opts, "5%"), "-draw", "color 0,0 floodfill", "-shave", "1x1"}
+}
+
+// densityArgs returns convert arguments recording the dpi of opts in the
+// output's resolution metadata (JFIF density, PNG pHYs, TIFF resolution),
+// for print. The pixels are not resampled.
+func densityArgs(opts *media.Options) []string {
+	if opts.DPI == 0 {
+		return nil
+	}
+	return []string{"-units", "PixelsPerInch", "-density", strconv.Itoa(opts.DPI)}
+}
+
+// magickColor returns a colour of mediaurl.ColorPattern as ImageMagick
+// reads it: hex values without the leading '#' get one.
+func magickColor(color string) string {
+	if _, err := strconv.ParseUint(color, 16, 64); err == nil && (len(color) == 6 || len(color) == 8) {
+		return "#" + color
+	}
+	return color
+}
+
+// alphaFormats are the output formats with transparency.
+var alphaFormats = map[string]bool{"png": true, "webp": true, "avif": true, "gif": true}
+
+// animatedFormats are the formats that can hold more than one frame.
+var animatedFormats = map[string]bool{"gif": true, "webp": true}
+
+// pagedFormats hold pages rather than frames: image output is one page,
+// the first or ?frame=N.
+var pagedFormats = map[string]bool{"tif": true, "tiff": true}
+
+// frameArgs returns the leading convert arguments for the staged file. An
+// animated source is coalesced into full frames before resizing, so frames
+// stored as partial updates keep their position, and re-optimized afterwards.
+// ?frame=N (1-based) and outputs that cannot be animated use a single frame,
+// as do animations over MEDIAX.MaxAnimationFrames.
+func frameArgs(input *media.Request) ([]string, error) {
+	src := input.StagedFilePath
+	if input.MediaType != nil && pagedFormats[input.MediaType.Extension] {
+		return []string{fmt.Sprintf("%s[%d]", src, max(input.Options.Frame-1, 0))}, nil
+	}
+	if input.MediaType == nil || !animatedFormats[input.MediaType.Extension] {
+		return []string{src}, nil
+	}
+	frames, err := countFrames(src)
+	if err != nil {
+		return nil, err
+	}
+	opts := input.Options
+	if opts.Frame > frames {
+		return nil, fmt.Errorf("frame %d out of range: image has %d frames", opts.Frame, frames)
+	}
+	if opts.Frame > 0 {
+		return []string{fmt.Sprintf("%s[%d]", src, opts.Frame-1)}, nil
+	}
+	if frames == 1 {
+		return []string{src}, nil
+	}
+	if !animatedFormats[strings.ToLower(opts.OutputFormat)] {
+		return []string{src + "[0]"}, nil
+	}
+	if limit := settings.Get("MEDIAX.MaxAnimationFrames", 300).Int(); limit > 0 && frames > limit {
+		log.Warning("animation exceeds frame limit, using the first frame", "path", src, "frames", frames, "limit", limit)
+		return []string{src + "[0]"}, nil
+	}
+	return []string{src, "-coalesce"}, nil
+}
+
+// countFrames returns the number of frames of an image file.
+func countFrames(path string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	output, err := command(ctx, "identify", "-ping", "-format", "%n\n", path).Output()
+	if err != nil {
+		return 0, fmt.Errorf("identify error: %w", err)
+	}
+	first, _, _ := strings.Cut(string(output), "\n")
+	n, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil || n < 1 {
+		return 1, nil
+	}
+	return n, nil
+}
+
 // Map crop direction to ImageMagick gravity
 func getGravity(direction string) string {
 	switch strings.ToLower(direction) {
@@ -330,15 +522,15 @@ func extractImageMagickMetadata(filePath string) (map[string]interface{}, error)
 	metadata := make(map[string]interface{})
 
 	// Run identify command with detailed format
-	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "identify", "-format", "%w,%h,%[colorspace],%[depth],%[quality],%[format],%[exif:*]", filePath)
+	cmd := command(ctx, "identify", "-format", "%w,%h,%[colorspace],%[depth],%[quality],%[format],%[exif:*]", filePath)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			return nil, fmt.Errorf("imagemagick identify timed out after %s", imageConvertTimeout)
+			return nil, fmt.Errorf("imagemagick identify timed out after %s", imageConvertTimeout())
 		}
-		return nil, fmt.Errorf("imagemagick identify error: %v\noutput: %s", err, truncateOutput(output))
+		return nil, fmt.Errorf("imagemagick identify error: %w\noutput: %s", err, truncateOutput(output))
 	}
 
 	// Parse the output
@@ -384,9 +576,9 @@ func extractImageMagickMetadata(filePath string) (map[string]interface{}, error)
 	}
 
 	// Get more detailed information using verbose mode
-	ctx2, cancel2 := context.WithTimeout(context.Background(), imageConvertTimeout)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), imageConvertTimeout())
 	defer cancel2()
-	cmd = exec.CommandContext(ctx2, "identify", "-verbose", filePath)
+	cmd = command(ctx2, "identify", "-verbose", filePath)
 	verboseOutput, err := cmd.CombinedOutput()
 	if err == nil {
 		// Extract DPI information using regex
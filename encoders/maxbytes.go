@@ -0,0 +1,88 @@
+package encoders
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"mediax/apps/media"
+)
+
+const (
+	// maxBytesQuality is the quality maxbytes starts from when q is not set.
+	maxBytesQuality = 90
+	// minMaxBytesQuality is the lowest quality maxbytes goes down to;
+	// below it images fall apart into blocks.
+	minMaxBytesQuality = 10
+)
+
+// ErrMaxBytesUnreachable is returned when an image is larger than maxbytes
+// even at the lowest quality.
+var ErrMaxBytesUnreachable = errors.New("image does not fit in maxbytes")
+
+// encodeUnderBytes runs convert with args (the source and its operations,
+// without -quality) and writes the result to input.ProcessedFilePath at the
+// highest quality up to q whose file is at most Options.MaxBytes. The
+// operations run once into a lossless intermediate; only the encoding is
+// repeated, in a binary search over the quality.
+func encodeUnderBytes(input *media.Request, args []string) error {
+	opts := input.Options
+	dir := filepath.Dir(input.ProcessedFilePath)
+	work, err := os.MkdirTemp(dir, filepath.Base(input.ProcessedFilePath)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+
+	intermediate := filepath.Join(work, "image.miff")
+	if err := runConvert(append(args, "miff:"+intermediate)...); err != nil {
+		return err
+	}
+
+	format := strings.ToLower(opts.OutputFormat)
+	encode := func(quality int) (string, int64, error) {
+		out := filepath.Join(work, strconv.Itoa(quality)+"."+format)
+		if err := runConvert(intermediate, "-quality", strconv.Itoa(quality), format+":"+out); err != nil {
+			return "", 0, err
+		}
+		info, err := os.Stat(out)
+		if err != nil {
+			return "", 0, err
+		}
+		return out, info.Size(), nil
+	}
+
+	hi := opts.Quality
+	if hi == 0 {
+		hi = maxBytesQuality
+	}
+	best, size, err := encode(hi)
+	if err != nil {
+		return err
+	}
+	if size > opts.MaxBytes {
+		// The largest quality in [lo, hi) that fits; size shrinks with the
+		// quality, give or take a few bytes.
+		best = ""
+		lo := minMaxBytesQuality
+		for lo < hi {
+			mid := (lo + hi) / 2
+			out, n, err := encode(mid)
+			if err != nil {
+				return err
+			}
+			if n <= opts.MaxBytes {
+				best, lo = out, mid+1
+			} else {
+				hi = mid
+			}
+		}
+		if best == "" {
+			return fmt.Errorf("%w: over %d bytes even at quality %d", ErrMaxBytesUnreachable, opts.MaxBytes, minMaxBytesQuality)
+		}
+	}
+	return os.Rename(best, input.ProcessedFilePath)
+}
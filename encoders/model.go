@@ -0,0 +1,161 @@
+package encoders
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// 3D model formats. Image outputs are rendered previews; the model's own
+// format serves the original.
+var (
+	Glb  = media.Encoder{Mime: "model/gltf-binary", Processor: processModel, Input: "model"}
+	Gltf = media.Encoder{Mime: "model/gltf+json", Processor: processModel, Input: "model"}
+	Obj  = media.Encoder{Mime: "model/obj", Processor: processModel, Input: "model"}
+	Stl  = media.Encoder{Mime: "model/stl", Processor: processModel, Input: "model"}
+)
+
+// defaultModelRenderer renders one view with F3D (https://f3d.app), which
+// reads glTF, GLB, OBJ and STL and renders offscreen with --output.
+const defaultModelRenderer = "f3d --output={output} --resolution={width},{height} --camera-azimuth-angle={angle} --up=+Y {input}"
+
+// processModel renders a still (?thumbnail=, or any image f=) or, with
+// ?preview=true and f=gif or f=webp, an animated turntable of a 3D model.
+// The renderer is MEDIAX.ModelRenderer, a command template with {input},
+// {output}, {width}, {height} and {angle} (degrees of azimuth).
+func processModel(input *media.Request) error {
+	opts := input.Options
+	format := strings.ToLower(opts.OutputFormat)
+	if !isImageFormat(format) {
+		return nil // the original model
+	}
+	size := opts.Thumbnail
+	if size == "" {
+		size = opts.Preview
+	}
+	width, height := modelSize(size)
+	turntable := opts.Preview != ""
+	if turntable && format != "gif" && format != "webp" {
+		return fmt.Errorf("3d previews are animated: use f=gif or f=webp")
+	}
+
+	cacheKey := input.CacheKey()
+	outputPath, err := media.CachePath(input.Origin.Project.CacheDir, "model_previews", cacheKey, cacheKey+"."+format)
+	if err != nil {
+		return err
+	}
+	input.ProcessedMimeType = "image/" + strings.Replace(format, "jpg", "jpeg", 1)
+	if gpath.IsFileExist(outputPath) {
+		input.ProcessedFilePath = outputPath
+		return nil
+	}
+
+	workDir, err := os.MkdirTemp(filepath.Dir(outputPath), cacheKey+"-frames")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	frames := 1
+	if turntable {
+		frames = max(settings.Get("MEDIAX.ModelTurntableFrames", 24).Int(), 2)
+	}
+	var rendered []string
+	for i := 0; i < frames; i++ {
+		frame := filepath.Join(workDir, fmt.Sprintf("frame%03d.png", i))
+		if err := renderModel(input.StagedFilePath, frame, width, height, 360*i/frames); err != nil {
+			if i > 0 {
+				return err
+			}
+			// No renderer available: fall back to a labelled placeholder.
+			if err := createGenericThumbnail(input.StagedFilePath, frame, strings.TrimPrefix(filepath.Ext(input.StagedFilePath), ".")); err != nil {
+				return err
+			}
+			frames = 1
+		}
+		rendered = append(rendered, frame)
+	}
+
+	args := []string{}
+	if len(rendered) > 1 {
+		args = append(args, "-delay", "8", "-loop", "0")
+	}
+	args = append(args, rendered...)
+	args = append(args, "-resize", fmt.Sprintf("%dx%d", width, height))
+	if opts.Quality > 0 {
+		args = append(args, "-quality", strconv.Itoa(opts.Quality))
+	}
+	if len(rendered) > 1 {
+		args = append(args, "-layers", "Optimize")
+	}
+	tempPath := filepath.Join(workDir, "out."+format)
+	args = append(args, tempPath)
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	if output, err := command(ctx, "convert", args...).CombinedOutput(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("convert timed out after %s", imageConvertTimeout())
+		}
+		return fmt.Errorf("convert error: %w\noutput: %s", err, truncateOutput(output))
+	}
+	if err := os.Rename(tempPath, outputPath); err != nil {
+		return err
+	}
+	input.ProcessedFilePath = outputPath
+	return nil
+}
+
+// renderModel renders one view of the model at path into output (PNG).
+func renderModel(path, output string, width, height, angle int) error {
+	template := strings.Fields(settings.Get("MEDIAX.ModelRenderer", defaultModelRenderer).String())
+	if len(template) == 0 {
+		return fmt.Errorf("no model renderer configured")
+	}
+	replacer := strings.NewReplacer(
+		"{input}", path,
+		"{output}", output,
+		"{width}", strconv.Itoa(width),
+		"{height}", strconv.Itoa(height),
+		"{angle}", strconv.Itoa(angle),
+	)
+	args := make([]string, len(template))
+	for i, a := range template {
+		args[i] = replacer.Replace(a)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), officeConvertTimeout())
+	defer cancel()
+	out, err := command(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%s timed out after %s", args[0], officeConvertTimeout())
+		}
+		return fmt.Errorf("%s error: %w\noutput: %s", args[0], err, truncateOutput(out))
+	}
+	if !gpath.IsFileExist(output) {
+		return fmt.Errorf("%s did not write %s", args[0], output)
+	}
+	return nil
+}
+
+// modelSize returns the render size of a thumbnail/preview value: WxH, a
+// quality preset, or 720p when empty or "true".
+func modelSize(size string) (int, int) {
+	if w, h, ok := strings.Cut(size, "x"); ok {
+		width, err1 := strconv.Atoi(w)
+		height, err2 := strconv.Atoi(h)
+		if err1 == nil && err2 == nil && width > 0 && height > 0 {
+			return min(width, 3840), min(height, 3840)
+		}
+	}
+	if size == "" || size == "true" {
+		size = "720p"
+	}
+	return getQualityDimensions(size)
+}
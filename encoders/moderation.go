@@ -0,0 +1,215 @@
+package encoders
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// ModerationVerdict is the score of a moderated image: Score is the
+// probability (0-1) that it is not safe to show, Labels optional scores
+// per category (e.g. "porn", "violence") as the moderator reports them.
+type ModerationVerdict struct {
+	Score  float64            `json:"score"`
+	Labels map[string]float64 `json:"labels,omitempty"`
+}
+
+// Moderator scores images. image is the path of a JPEG of at most
+// moderationSize pixels per side: the staged image, or a frame from the
+// middle of a video.
+type Moderator interface {
+	Moderate(ctx context.Context, image string) (*ModerationVerdict, error)
+}
+
+// moderationSize is the longest side of the JPEG sent to the moderator.
+const moderationSize = 512
+
+var (
+	moderatorMu sync.RWMutex
+	moderator   Moderator
+)
+
+// SetModerator replaces the moderator, e.g. from a plugin package running
+// a local model. Without one, images are posted to MEDIAX.ModerationURL.
+func SetModerator(m Moderator) {
+	moderatorMu.Lock()
+	defer moderatorMu.Unlock()
+	moderator = m
+}
+
+// currentModerator returns the moderator set with SetModerator, the HTTP
+// moderator of MEDIAX.ModerationURL, or nil when moderation is not set up.
+func currentModerator() Moderator {
+	moderatorMu.RLock()
+	defer moderatorMu.RUnlock()
+	if moderator != nil {
+		return moderator
+	}
+	if url := settings.Get("MEDIAX.ModerationURL", "").String(); url != "" {
+		return httpModerator(url)
+	}
+	return nil
+}
+
+// ErrModerationDisabled is returned by Moderate when no moderator is set up.
+var ErrModerationDisabled = errors.New("content moderation is not configured")
+
+// Moderate returns the verdict on the staged image or video of input. The
+// verdict is cached per source, so each version of a file is scored once.
+func Moderate(input *media.Request) (*ModerationVerdict, error) {
+	m := currentModerator()
+	if m == nil {
+		return nil, ErrModerationDisabled
+	}
+	sum := md5.Sum([]byte(input.SourceID() + "|moderation"))
+	key := hex.EncodeToString(sum[:])
+	jsonPath, err := media.CachePath(input.Origin.Project.CacheDir, "moderation", key, key+".json")
+	if err != nil {
+		return nil, err
+	}
+	if data, err := os.ReadFile(jsonPath); err == nil {
+		var verdict ModerationVerdict
+		if json.Unmarshal(data, &verdict) == nil {
+			return &verdict, nil
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(jsonPath), key+"-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	sample := tmp.Name()
+	defer os.Remove(sample)
+	if strings.HasPrefix(input.MediaType.Mime, "video/") {
+		err = videoModerationFrame(input, sample)
+	} else {
+		err = imageModerationFrame(input.StagedFilePath, sample)
+	}
+	if err != nil {
+		return nil, err
+	}
+	timeout := commandTimeout("ModerationTimeout", 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	verdict, err := m.Moderate(ctx, sample)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("moderation timed out after %s", timeout)
+		}
+		return nil, fmt.Errorf("moderation: %w", err)
+	}
+	data, err := json.Marshal(verdict)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(jsonPath, data); err != nil {
+		return nil, err
+	}
+	return verdict, nil
+}
+
+// imageModerationFrame writes the first frame of the image at path to
+// output as an upright JPEG of at most moderationSize pixels per side.
+func imageModerationFrame(path, output string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	size := fmt.Sprintf("%dx%d>", moderationSize, moderationSize)
+	out, err := command(ctx, "convert", path+"[0]", "-auto-orient", "-thumbnail", size, "-background", "white", "-flatten", "jpg:"+output).CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("convert timed out after %s", imageConvertTimeout())
+		}
+		return fmt.Errorf("convert error: %w\noutput: %s", err, truncateOutput(out))
+	}
+	return nil
+}
+
+// videoModerationFrame writes the frame in the middle of the video to
+// output, like the default thumbnail, at most moderationSize pixels wide.
+func videoModerationFrame(input *media.Request, output string) error {
+	duration, err := getVideoDuration(sourceArgs(input)...)
+	if err != nil {
+		return fmt.Errorf("failed to get video duration: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), videoFrameTimeout())
+	defer cancel()
+	args := append([]string{"-v", "error", "-ss", strconv.FormatFloat(duration/2, 'f', 2, 64)}, sourceArgs(input)...)
+	args = append(args, "-frames:v", "1", "-vf", fmt.Sprintf("scale='min(%d,iw)':-2", moderationSize), "-y", output)
+	out, err := command(ctx, "ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("ffmpeg timed out after %s", videoFrameTimeout())
+		}
+		return fmt.Errorf("ffmpeg error: %w\noutput: %s", err, truncateOutput(out))
+	}
+	return nil
+}
+
+// httpModerator posts images as the multipart field "file" to its URL and
+// reads a ModerationVerdict from the JSON answer, e.g.
+// {"score": 0.93, "labels": {"porn": 0.93, "sexy": 0.05}}.
+type httpModerator string
+
+func (url httpModerator) Moderate(ctx context.Context, image string) (*ModerationVerdict, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filepath.Base(image))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(part, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, string(url), &body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MEDIAX.ModerationURL: %w", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("service answered %s: %s", resp.Status, truncateOutput(data))
+	}
+	var verdict ModerationVerdict
+	if err := json.Unmarshal(data, &verdict); err != nil {
+		return nil, fmt.Errorf("invalid verdict: %w", err)
+	}
+	if verdict.Score < 0 || verdict.Score > 1 {
+		return nil, fmt.Errorf("invalid verdict: score %g is not between 0 and 1", verdict.Score)
+	}
+	return &verdict, nil
+}
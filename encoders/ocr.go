@@ -0,0 +1,254 @@
+package encoders
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// ocrDPI is the resolution PDF pages are rendered at for OCR; Tesseract
+// is tuned for text scanned at about 300 DPI.
+const ocrDPI = 300
+
+// OCRResult is the ocr=1 response: the text of every page and the
+// recognized lines and words with their bounding boxes in pixels of the
+// page image (the image itself, or the PDF page at DPI).
+type OCRResult struct {
+	Language string    `json:"language"`
+	DPI      int       `json:"dpi,omitempty"`
+	Pages    []OCRPage `json:"pages"`
+	// Truncated is set when a PDF had more than MEDIAX.OCRMaxPages pages.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// OCRPage is one recognized image or PDF page.
+type OCRPage struct {
+	Page   int       `json:"page"`
+	Width  int       `json:"width"`
+	Height int       `json:"height"`
+	Text   string    `json:"text"`
+	Lines  []OCRLine `json:"lines"`
+}
+
+// OCRLine is a line of text and its words.
+type OCRLine struct {
+	Text string `json:"text"`
+	OCRBox
+	Words []OCRWord `json:"words"`
+}
+
+// OCRWord is a recognized word; Confidence is Tesseract's, 0-100.
+type OCRWord struct {
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"`
+	OCRBox
+}
+
+// OCRBox is a bounding box in pixels from the top left corner.
+type OCRBox struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// ocrMaxPages is the number of PDF pages recognized (MEDIAX.OCRMaxPages).
+func ocrMaxPages() int {
+	if n := settings.Get("MEDIAX.OCRMaxPages", 20).Int(); n > 0 {
+		return n
+	}
+	return 20
+}
+
+// ocrTimeout bounds each tesseract run (MEDIAX.OCRTimeout).
+func ocrTimeout() time.Duration {
+	return commandTimeout("OCRTimeout", 2*time.Minute)
+}
+
+// generateOCR writes the text of the staged image or PDF as JSON, cached
+// per source and language.
+func generateOCR(input *media.Request) error {
+	cacheKey := input.CacheKey()
+	jsonPath, err := media.CachePath(input.Origin.Project.CacheDir, "ocr", cacheKey, cacheKey+".json")
+	if err != nil {
+		return err
+	}
+	input.ProcessedFilePath = jsonPath
+	input.ProcessedMimeType = "application/json"
+	if gpath.IsFileExist(jsonPath) {
+		return nil
+	}
+
+	// Page images are rendered next to the result and removed afterwards.
+	workDir, err := os.MkdirTemp(filepath.Dir(jsonPath), cacheKey+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	result := OCRResult{Language: input.Options.Lang, Pages: []OCRPage{}}
+	var pages []string
+	if input.MediaType != nil && input.MediaType.Extension == "pdf" {
+		result.DPI = ocrDPI
+		if pages, result.Truncated, err = renderPdfPages(input.StagedFilePath, workDir); err != nil {
+			return err
+		}
+	} else {
+		page := filepath.Join(workDir, "page.png")
+		if err := ocrImage(input.StagedFilePath, page); err != nil {
+			return err
+		}
+		pages = []string{page}
+	}
+	for i, page := range pages {
+		p, err := recognize(page, input.Options.Lang)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", i+1, err)
+		}
+		p.Page = i + 1
+		result.Pages = append(result.Pages, *p)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(jsonPath, data)
+}
+
+// ocrImage writes the first frame of the image at path to output as an
+// upright greyscale PNG, which Tesseract reads whatever the source format.
+func ocrImage(path, output string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	out, err := command(ctx, "convert", path+"[0]", "-auto-orient", "-background", "white", "-flatten", "-colorspace", "gray", "png:"+output).CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("convert timed out after %s", imageConvertTimeout())
+		}
+		return fmt.Errorf("convert error: %w\noutput: %s", err, truncateOutput(out))
+	}
+	return nil
+}
+
+// renderPdfPages renders the first ocrMaxPages pages of the PDF into dir
+// as greyscale PNGs and returns them in page order, and whether the PDF
+// has more pages.
+func renderPdfPages(pdfPath, dir string) ([]string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), officeConvertTimeout())
+	defer cancel()
+	limit := ocrMaxPages()
+	// One page more than the limit tells whether pages were left out.
+	out, err := command(ctx, "pdftoppm", "-r", strconv.Itoa(ocrDPI), "-gray", "-png",
+		"-f", "1", "-l", strconv.Itoa(limit+1), pdfPath, filepath.Join(dir, "page")).CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, false, fmt.Errorf("pdftoppm timed out after %s", officeConvertTimeout())
+		}
+		return nil, false, fmt.Errorf("pdftoppm error: %w\noutput: %s", err, truncateOutput(out))
+	}
+	// pdftoppm zero-pads the page numbers to the width of the page count.
+	pages, err := filepath.Glob(filepath.Join(dir, "page-*.png"))
+	if err != nil {
+		return nil, false, err
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		if len(pages[i]) != len(pages[j]) {
+			return len(pages[i]) < len(pages[j])
+		}
+		return pages[i] < pages[j]
+	})
+	if len(pages) > limit {
+		return pages[:limit], true, nil
+	}
+	return pages, false, nil
+}
+
+// recognize runs tesseract on the image at path and groups its TSV output
+// into lines and words.
+func recognize(path, lang string) (*OCRPage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ocrTimeout())
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := command(ctx, "tesseract", path, "stdout", "-l", lang, "tsv")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("tesseract timed out after %s", ocrTimeout())
+		}
+		return nil, fmt.Errorf("tesseract error: %w\noutput: %s", err, truncateOutput(stderr.Bytes()))
+	}
+	return parseTesseractTSV(out), nil
+}
+
+// parseTesseractTSV reads tesseract's TSV output: one row per page (level
+// 1), block, paragraph, line (4) and word (5) with its box, confidence and
+// text.
+func parseTesseractTSV(tsv []byte) *OCRPage {
+	page := &OCRPage{Lines: []OCRLine{}}
+	var line *OCRLine
+	var text []string
+	flush := func() {
+		if line != nil && len(line.Words) > 0 {
+			page.Lines = append(page.Lines, *line)
+			text = append(text, line.Text)
+		}
+		line = nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(tsv))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		f := strings.Split(scanner.Text(), "\t")
+		if len(f) < 12 {
+			continue
+		}
+		level, err := strconv.Atoi(f[0])
+		if err != nil {
+			continue // header
+		}
+		var box OCRBox
+		box.X, _ = strconv.Atoi(f[6])
+		box.Y, _ = strconv.Atoi(f[7])
+		box.W, _ = strconv.Atoi(f[8])
+		box.H, _ = strconv.Atoi(f[9])
+		switch level {
+		case 1:
+			page.Width, page.Height = box.W, box.H
+		case 3: // paragraphs are separated by a blank line
+			flush()
+			if len(text) > 0 && text[len(text)-1] != "" {
+				text = append(text, "")
+			}
+		case 4:
+			flush()
+			line = &OCRLine{OCRBox: box}
+		case 5:
+			word := strings.TrimSpace(f[11])
+			if word == "" || line == nil {
+				continue
+			}
+			conf, _ := strconv.ParseFloat(f[10], 64)
+			line.Words = append(line.Words, OCRWord{Text: word, Confidence: conf, OCRBox: box})
+			if line.Text != "" {
+				line.Text += " "
+			}
+			line.Text += word
+		}
+	}
+	flush()
+	page.Text = strings.TrimSpace(strings.Join(text, "\n"))
+	return page
+}
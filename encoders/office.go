@@ -0,0 +1,197 @@
+package encoders
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// officePool runs LibreOffice conversions on a fixed number of workers. Each
+// worker owns a LibreOffice profile (-env:UserInstallation), so concurrent
+// conversions never fight over the profile lock. When unoserver is installed
+// every worker keeps a LibreOffice process running and converts through
+// unoconvert, avoiding the multi-second soffice start per document; otherwise
+// workers run soffice per conversion. Requests queue for a free worker for up
+// to MEDIAX.OfficeQueueTimeout.
+var officePool struct {
+	once    sync.Once
+	daemon  bool
+	workers chan *officeWorker
+}
+
+type officeWorker struct {
+	id      int
+	port    int // unoserver XML-RPC port
+	profile string
+	cmd     *exec.Cmd
+	exited  chan struct{}
+}
+
+func initOfficePool() {
+	size := settings.Get("MEDIAX.OfficeWorkers", 2).Int()
+	if size < 1 {
+		size = 1
+	}
+	basePort := settings.Get("MEDIAX.OfficeBasePort", 2003).Int()
+	_, errServer := exec.LookPath("unoserver")
+	_, errConvert := exec.LookPath("unoconvert")
+	officePool.daemon = errServer == nil && errConvert == nil
+	officePool.workers = make(chan *officeWorker, size)
+	for i := 0; i < size; i++ {
+		w := &officeWorker{
+			id:      i,
+			port:    basePort + 2*i,
+			profile: filepath.Join(os.TempDir(), "mediax-office-"+strconv.Itoa(i)),
+		}
+		// Workers join the pool as their LibreOffice comes up.
+		go func() {
+			if officePool.daemon {
+				if err := w.start(); err != nil {
+					log.Error("failed to start office worker", "worker", w.id, "error", err)
+				}
+			}
+			officePool.workers <- w
+		}()
+	}
+	log.Info("office conversion pool ready", "workers", size, "daemon", officePool.daemon)
+}
+
+// start launches the worker's unoserver and waits until it accepts connections.
+func (w *officeWorker) start() error {
+	w.stop()
+	// The server outlives single conversions, so it only gets the sandbox
+	// limits; each unoconvert call is bounded by officeConvertTimeout().
+	w.cmd = command(context.Background(), "unoserver",
+		"--interface", "127.0.0.1",
+		"--port", strconv.Itoa(w.port),
+		"--uno-port", strconv.Itoa(w.port+1),
+		"--user-installation", "file://"+w.profile,
+	).Cmd
+	if err := w.cmd.Start(); err != nil {
+		w.cmd = nil
+		return err
+	}
+	exited := make(chan struct{})
+	w.exited = exited
+	go func(cmd *exec.Cmd) {
+		cmd.Wait() //nolint:errcheck
+		close(exited)
+	}(w.cmd)
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			return fmt.Errorf("unoserver exited during startup")
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(w.port), time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	return fmt.Errorf("unoserver did not listen on port %d within 30s", w.port)
+}
+
+func (w *officeWorker) stop() {
+	if w.cmd == nil || w.cmd.Process == nil {
+		return
+	}
+	w.cmd.Process.Kill() //nolint:errcheck
+	<-w.exited
+	w.cmd = nil
+}
+
+// alive reports whether the worker's unoserver is running.
+func (w *officeWorker) alive() bool {
+	if w.cmd == nil {
+		return false
+	}
+	select {
+	case <-w.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// convertOffice converts officePath to a PDF at pdfPath on a pool worker.
+// The conversion itself is limited to officeConvertTimeout() after a worker
+// becomes free.
+func convertOffice(officePath, pdfPath string) error {
+	officePool.once.Do(initOfficePool)
+
+	queueTimeout, err := media.ParseDuration(settings.Get("MEDIAX.OfficeQueueTimeout", "2m").String())
+	if err != nil || queueTimeout <= 0 {
+		queueTimeout = 2 * time.Minute
+	}
+	var w *officeWorker
+	select {
+	case w = <-officePool.workers:
+	case <-time.After(queueTimeout):
+		return fmt.Errorf("no LibreOffice worker free within %s", queueTimeout)
+	}
+	defer func() { officePool.workers <- w }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), officeConvertTimeout())
+	defer cancel()
+
+	if !officePool.daemon {
+		return w.convertSoffice(ctx, officePath, pdfPath)
+	}
+	if !w.alive() {
+		log.Warning("restarting office worker", "worker", w.id)
+		if err := w.start(); err != nil {
+			return fmt.Errorf("office worker %d: %w", w.id, err)
+		}
+	}
+	output, err := command(ctx, "unoconvert",
+		"--host", "127.0.0.1", "--port", strconv.Itoa(w.port),
+		"--convert-to", "pdf", officePath, pdfPath,
+	).CombinedOutput()
+	if err != nil {
+		// A hung or crashed LibreOffice is replaced before the next job.
+		if ctx.Err() != nil || !w.alive() {
+			w.stop()
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("LibreOffice conversion timed out after %s", officeConvertTimeout())
+		}
+		return fmt.Errorf("LibreOffice conversion error: %w\noutput: %s", err, truncateOutput(output))
+	}
+	return nil
+}
+
+// convertSoffice converts with a one-off soffice process using the worker's
+// profile.
+func (w *officeWorker) convertSoffice(ctx context.Context, officePath, pdfPath string) error {
+	outDir := filepath.Dir(pdfPath)
+	cmd := command(ctx, "soffice", "--headless",
+		"-env:UserInstallation=file://"+w.profile,
+		"--convert-to", "pdf", "--outdir", outDir, officePath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("LibreOffice conversion timed out after %s", officeConvertTimeout())
+		}
+		return fmt.Errorf("LibreOffice conversion error: %w\noutput: %s", err, truncateOutput(output))
+	}
+	// soffice names the output after the input file.
+	produced := filepath.Join(outDir, strings.TrimSuffix(filepath.Base(officePath), filepath.Ext(officePath))+".pdf")
+	if produced != pdfPath {
+		return os.Rename(produced, pdfPath)
+	}
+	return nil
+}
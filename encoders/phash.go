@@ -0,0 +1,183 @@
+package encoders
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"mediax/apps/media"
+)
+
+// phashSize is the edge of the greyscale thumbnail the DCT is computed on;
+// the hash keeps the 8x8 lowest frequencies.
+const phashSize = 32
+
+// phashKeyframes is the number of keyframes hashed per video.
+const phashKeyframes = 5
+
+// PHash is the phash=1 response. Hash is a 64-bit DCT perceptual hash as 16
+// hex digits; images that look alike have hashes a small Hamming distance
+// apart. Videos also list the hashes of keyframes spread over the file,
+// and Hash is the one in the middle.
+type PHash struct {
+	Hash      string         `json:"phash"`
+	Keyframes []KeyframeHash `json:"keyframes,omitempty"`
+}
+
+// KeyframeHash is the perceptual hash of the keyframe at Time seconds.
+type KeyframeHash struct {
+	Time float64 `json:"time"`
+	Hash string  `json:"phash"`
+}
+
+// generatePHash writes the perceptual hash of the staged image or video as
+// JSON, cached per source like detail metadata.
+func generatePHash(input *media.Request, video bool) error {
+	cacheKey := input.CacheKey()
+	jsonPath, err := media.CachePath(input.Origin.Project.CacheDir, "phashes", cacheKey, cacheKey+".json")
+	if err != nil {
+		return err
+	}
+	input.ProcessedFilePath = jsonPath
+	input.ProcessedMimeType = "application/json"
+	if gpath.IsFileExist(jsonPath) {
+		return nil
+	}
+
+	var result PHash
+	if video {
+		if result.Keyframes, err = videoPHashes(input.StagedFilePath); err != nil {
+			return err
+		}
+		result.Hash = result.Keyframes[len(result.Keyframes)/2].Hash
+	} else {
+		pixels, err := imageGrey(input.StagedFilePath)
+		if err != nil {
+			return err
+		}
+		result.Hash = formatPHash(dctHash(pixels))
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(jsonPath, data)
+}
+
+// imageGrey returns the first frame of the image at path as phashSize x
+// phashSize 8-bit greyscale pixels, upright and stretched to the square.
+func imageGrey(path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	size := fmt.Sprintf("%dx%d!", phashSize, phashSize)
+	output, err := command(ctx, "convert", path+"[0]", "-auto-orient", "-colorspace", "gray", "-resize", size, "-depth", "8", "gray:-").Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("convert timed out after %s", imageConvertTimeout())
+		}
+		return nil, fmt.Errorf("convert error: %w", err)
+	}
+	if len(output) != phashSize*phashSize {
+		return nil, fmt.Errorf("convert returned %d bytes of greyscale, expected %d", len(output), phashSize*phashSize)
+	}
+	return output, nil
+}
+
+// videoPHashes hashes the keyframes at or before phashKeyframes positions
+// spread evenly over the video, skipping the first and last tenth where
+// intros and credits are shared between unrelated videos.
+func videoPHashes(path string) ([]KeyframeHash, error) {
+	duration, err := getVideoDuration(path)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]KeyframeHash, 0, phashKeyframes)
+	for i := range phashKeyframes {
+		at := duration * (0.1 + 0.8*float64(i)/float64(phashKeyframes-1))
+		pixels, err := videoKeyframeGrey(path, at)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, KeyframeHash{Time: math.Round(at*100) / 100, Hash: formatPHash(dctHash(pixels))})
+	}
+	return hashes, nil
+}
+
+// videoKeyframeGrey decodes the keyframe at or before at seconds as
+// phashSize x phashSize greyscale, like imageGrey.
+func videoKeyframeGrey(path string, at float64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), videoFrameTimeout())
+	defer cancel()
+	output, err := command(ctx, "ffmpeg", "-v", "error", "-skip_frame", "nokey",
+		"-ss", strconv.FormatFloat(at, 'f', 2, 64), "-i", path,
+		"-frames:v", "1", "-vf", fmt.Sprintf("scale=%d:%d:flags=area,format=gray", phashSize, phashSize),
+		"-f", "rawvideo", "-").Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("ffmpeg timed out after %s", videoFrameTimeout())
+		}
+		return nil, fmt.Errorf("ffmpeg error: %w", err)
+	}
+	if len(output) != phashSize*phashSize {
+		return nil, fmt.Errorf("no keyframe at %.2fs", at)
+	}
+	return output, nil
+}
+
+// dctHash computes the pHash of phashSize x phashSize greyscale pixels:
+// the 2D DCT-II is taken and each of the 8x8 lowest frequencies becomes a
+// bit, set when the coefficient is above their median. The DC term, which
+// only reflects overall brightness, is left out of the median.
+func dctHash(pixels []byte) uint64 {
+	const n = phashSize
+	var cosines [8][n]float64
+	for u := range 8 {
+		for x := range n {
+			cosines[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * n))
+		}
+	}
+	// Rows first, keeping only the low frequencies.
+	var rows [n][8]float64
+	for y := range n {
+		for u := range 8 {
+			var sum float64
+			for x := range n {
+				sum += float64(pixels[y*n+x]) * cosines[u][x]
+			}
+			rows[y][u] = sum
+		}
+	}
+	var coefficients [64]float64
+	for v := range 8 {
+		for u := range 8 {
+			var sum float64
+			for y := range n {
+				sum += rows[y][u] * cosines[v][y]
+			}
+			coefficients[v*8+u] = sum
+		}
+	}
+
+	sorted := make([]float64, 63)
+	copy(sorted, coefficients[1:])
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, c := range coefficients {
+		if c > median {
+			hash |= 1 << (63 - i)
+		}
+	}
+	return hash
+}
+
+// formatPHash returns hash as 16 hex digits.
+func formatPHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
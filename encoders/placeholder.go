@@ -0,0 +1,93 @@
+package encoders
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"mediax/apps/media"
+)
+
+// Placeholder describes an image of /placeholder.
+type Placeholder struct {
+	Width      int
+	Height     int
+	Background string // colour of mediaurl.ColorPattern
+	Color      string // text colour
+	Text       string // drawn centred; empty for a plain image
+	Format     string // png, jpg, webp or gif
+}
+
+// GeneratePlaceholder writes the image to the placeholder cache of
+// cacheDir, once per distinct image, and returns its path.
+func GeneratePlaceholder(cacheDir string, p Placeholder) (string, error) {
+	sum := md5.Sum([]byte(fmt.Sprintf("%dx%d|%s|%s|%s|%s", p.Width, p.Height, p.Background, p.Color, p.Format, p.Text)))
+	key := hex.EncodeToString(sum[:])
+	outputPath, err := media.CachePath(cacheDir, "placeholders", key, key+"."+p.Format)
+	if err != nil {
+		return "", err
+	}
+	if gpath.IsFileExist(outputPath) {
+		return outputPath, nil
+	}
+
+	args := []string{"-size", fmt.Sprintf("%dx%d", p.Width, p.Height), "xc:" + magickColor(p.Background)}
+	if p.Text != "" {
+		args = append(args, "-fill", magickColor(p.Color), "-gravity", "center",
+			"-pointsize", fmt.Sprint(placeholderPointSize(p)), "-annotate", "+0+0", escapeAnnotation(p.Text))
+	}
+	if p.Format == "jpg" || p.Format == "webp" {
+		args = append(args, "-quality", "85")
+	}
+	args = append(args, "-strip")
+
+	// Written next to the result and renamed, so a concurrent request never
+	// serves a partial image.
+	tmp, err := os.CreateTemp(filepath.Dir(outputPath), key+"-*."+p.Format)
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	out, err := command(ctx, "convert", append(args, p.Format+":"+tmp.Name())...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("convert timed out after %s", imageConvertTimeout())
+		}
+		return "", fmt.Errorf("convert error: %w\noutput: %s", err, truncateOutput(out))
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), outputPath); err != nil {
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// placeholderPointSize fits the text on one line: at most a third of the
+// height, and narrow enough that the text, at about 0.6 em per character,
+// fills at most four fifths of the width.
+func placeholderPointSize(p Placeholder) int {
+	size := min(p.Height/3, p.Width*4/(3*max(utf8.RuneCountInString(p.Text), 1)))
+	return max(size, 6)
+}
+
+// escapeAnnotation keeps ImageMagick from reading text as a format string
+// ('%' escapes, '\n') or, with a leading '@', as the name of a file to read
+// the text from.
+func escapeAnnotation(text string) string {
+	text = strings.NewReplacer(`\`, `\\`, "%", "%%").Replace(text)
+	if strings.HasPrefix(text, "@") {
+		text = `\` + text
+	}
+	return text
+}
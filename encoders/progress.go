@@ -0,0 +1,185 @@
+package encoders
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"mediax/apps/media"
+)
+
+// ErrTranscodeCanceled is returned for transcodes stopped through
+// CancelTranscode.
+var ErrTranscodeCanceled = errors.New("transcode canceled")
+
+// Transcode is the progress of a running ffmpeg transcode.
+type Transcode struct {
+	ID        string    `json:"id"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	Path      string    `json:"path"`
+	Output    string    `json:"output"` // profile or output format
+	StartedAt time.Time `json:"started_at"`
+	Duration  float64   `json:"duration"`  // source duration in seconds, 0 if unknown
+	Processed float64   `json:"processed"` // seconds of the source encoded so far
+	Percent   float64   `json:"percent"`
+	Speed     string    `json:"speed,omitempty"`
+}
+
+// runningTranscode is a Transcode and the function stopping it.
+type runningTranscode struct {
+	mu     sync.Mutex
+	info   Transcode
+	cancel context.CancelFunc
+}
+
+// transcodes holds the running transcodes by ID.
+var transcodes sync.Map
+
+// Transcodes returns the running transcodes, oldest first.
+func Transcodes() []Transcode {
+	var list []Transcode
+	transcodes.Range(func(_, v any) bool {
+		t := v.(*runningTranscode)
+		t.mu.Lock()
+		list = append(list, t.info)
+		t.mu.Unlock()
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// CancelTranscode kills the ffmpeg process of the transcode id and reports
+// whether it was running.
+func CancelTranscode(id string) bool {
+	v, ok := transcodes.Load(id)
+	if ok {
+		v.(*runningTranscode).cancel()
+	}
+	return ok
+}
+
+// transcode runs ffmpeg with args, writing outputPath, and tracks its
+// progress from -progress output. It is stopped after timeout, when the
+// request's Deadline passes or through CancelTranscode; a partial output
+// is removed so it is never served as a cached variant.
+func transcode(input *media.Request, label, outputPath string, timeout time.Duration, args ...string) error {
+	return runTranscode(input, label, outputPath, timeout, nil, args...)
+}
+
+// runTranscode is transcode with ffmpeg's stdout going to stdout when it is
+// set, for args ending in a pipe:1 output; progress is then read from
+// stderr, between ffmpeg's messages.
+func runTranscode(input *media.Request, label, outputPath string, timeout time.Duration, stdout io.Writer, args ...string) error {
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	budgetCtx := timeoutCtx
+	if !input.Deadline.IsZero() {
+		var cancelBudget context.CancelFunc
+		budgetCtx, cancelBudget = context.WithDeadline(timeoutCtx, input.Deadline)
+		defer cancelBudget()
+	}
+	ctx, cancelJob := context.WithCancel(budgetCtx)
+	defer cancelJob()
+
+	t := &runningTranscode{cancel: cancelJob, info: Transcode{
+		ID:        uuid.New().String(),
+		TraceID:   input.TraceID,
+		Path:      input.OriginalFilePath,
+		Output:    label,
+		StartedAt: time.Now(),
+	}}
+	if duration, err := getVideoDuration(input.StagedFilePath); err == nil {
+		t.info.Duration = duration
+	}
+	transcodes.Store(t.info.ID, t)
+	defer transcodes.Delete(t.info.ID)
+
+	var stderr bytes.Buffer
+	progress := &progressWriter{t: t}
+	var cmd sandboxCmd
+	if stdout == nil {
+		cmd = command(ctx, "ffmpeg", append([]string{"-progress", "pipe:1", "-nostats"}, args...)...)
+		cmd.Stdout = progress
+		cmd.Stderr = &stderr
+	} else {
+		cmd = command(ctx, "ffmpeg", append([]string{"-progress", "pipe:2", "-nostats"}, args...)...)
+		cmd.Stdout = stdout
+		progress.messages = &stderr
+		cmd.Stderr = progress
+	}
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	os.Remove(outputPath)
+	switch {
+	case errors.Is(err, media.ErrOverloaded):
+		return err
+	case timeoutCtx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("ffmpeg timed out after %s for %s", timeout, label)
+	case budgetCtx.Err() == context.DeadlineExceeded:
+		return fmt.Errorf("%s transcode of %s: %w", label, input.OriginalFilePath, media.ErrBudgetExceeded)
+	case ctx.Err() == context.Canceled:
+		return fmt.Errorf("%s transcode of %s: %w", label, input.OriginalFilePath, ErrTranscodeCanceled)
+	}
+	return fmt.Errorf("ffmpeg error: %w\noutput: %s", err, truncateOutput(stderr.Bytes()))
+}
+
+// progressWriter parses ffmpeg's -progress key=value lines into t. Other
+// lines are kept in messages when it is set.
+type progressWriter struct {
+	t        *runningTranscode
+	partial  []byte
+	messages *bytes.Buffer
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(strings.TrimSpace(string(w.partial[:i])))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *progressWriter) line(line string) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok || strings.Trim(key, "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+		if w.messages != nil {
+			w.messages.WriteString(line + "\n")
+		}
+		return
+	}
+	w.t.mu.Lock()
+	defer w.t.mu.Unlock()
+	info := &w.t.info
+	switch key {
+	case "out_time_us", "out_time_ms": // both are microseconds
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			info.Processed = float64(us) / 1e6
+			if info.Duration > 0 {
+				info.Percent = min(100, info.Processed/info.Duration*100)
+			}
+		}
+	case "speed":
+		info.Speed = value
+	case "progress":
+		if value == "end" {
+			info.Percent = 100
+		}
+	}
+}
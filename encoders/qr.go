@@ -0,0 +1,182 @@
+package encoders
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"slices"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"mediax/apps/media"
+)
+
+// QRCode describes a code of /generate/qr.
+type QRCode struct {
+	Text   string
+	Size   int    // width and height in pixels
+	Format string // png or svg
+	Level  string // error correction: L, M, Q or H
+	Margin int    // quiet zone around the code, in modules
+}
+
+// ErrQRTooLarge is returned by GenerateQR when the text does not fit in a
+// code at the requested error correction level, or the code does not fit
+// in the requested size.
+var ErrQRTooLarge = errors.New("text does not fit in a QR code of this size and level")
+
+// GenerateQR writes the code to the QR cache of cacheDir, once per distinct
+// code, and returns its path. qrencode lays out the modules; the image is
+// drawn here so that it is exactly Size pixels with whole-pixel modules.
+func GenerateQR(cacheDir string, code QRCode) (string, error) {
+	sum := md5.Sum([]byte(fmt.Sprintf("%s|%d|%s|%d|%s", code.Level, code.Size, code.Format, code.Margin, code.Text)))
+	key := hex.EncodeToString(sum[:])
+	outputPath, err := media.CachePath(cacheDir, "qr", key, key+"."+code.Format)
+	if err != nil {
+		return "", err
+	}
+	if gpath.IsFileExist(outputPath) {
+		return outputPath, nil
+	}
+
+	modules, err := qrModules(code.Text, code.Level)
+	if err != nil {
+		return "", err
+	}
+	var data []byte
+	if code.Format == "svg" {
+		data = qrSVG(modules, code.Size, code.Margin)
+	} else if data, err = qrPNG(modules, code.Size, code.Margin); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(outputPath, data); err != nil {
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// qrModules returns the module matrix of text, true for dark modules, from
+// qrencode's ASCII output where each module is "##" or two spaces.
+func qrModules(text, level string) ([][]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := command(ctx, "qrencode", "-t", "ASCII", "-m", "0", "-l", level, "-o", "-")
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("qrencode timed out after %s", imageConvertTimeout())
+		}
+		if strings.Contains(stderr.String(), "too large") {
+			return nil, ErrQRTooLarge
+		}
+		return nil, fmt.Errorf("qrencode error: %w\noutput: %s", err, truncateOutput(stderr.Bytes()))
+	}
+
+	var modules [][]bool
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		row := make([]bool, (len(line)+1)/2)
+		for i := range row {
+			row[i] = line[2*i] == '#'
+		}
+		modules = append(modules, row)
+	}
+	// Trailing light modules may have been trimmed; the code is square.
+	n := len(modules)
+	if n == 0 {
+		return nil, errors.New("qrencode returned no code")
+	}
+	for i, row := range modules {
+		if len(row) > n {
+			return nil, fmt.Errorf("qrencode returned a %dx%d code", len(row), n)
+		}
+		modules[i] = append(row, make([]bool, n-len(row))...)
+	}
+	return modules, nil
+}
+
+// qrLayout returns the pixels per module and the offset of the first module
+// for a code of n modules with margin quiet modules on each side, centred
+// in size pixels.
+func qrLayout(n, size, margin int) (scale, offset int, err error) {
+	total := n + 2*margin
+	scale = size / total
+	if scale < 1 {
+		return 0, 0, ErrQRTooLarge
+	}
+	return scale, (size-scale*total)/2 + scale*margin, nil
+}
+
+// qrPNG draws the modules as a black and white PNG of size x size pixels.
+func qrPNG(modules [][]bool, size, margin int) ([]byte, error) {
+	scale, offset, err := qrLayout(len(modules), size, margin)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y, row := range modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for py := offset + y*scale; py < offset+(y+1)*scale; py++ {
+				for px := offset + x*scale; px < offset+(x+1)*scale; px++ {
+					img.SetColorIndex(px, py, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// qrSVG draws the modules as an SVG of size x size pixels, one path of the
+// horizontal runs of dark modules in module units.
+func qrSVG(modules [][]bool, size, margin int) []byte {
+	total := len(modules) + 2*margin
+	var path strings.Builder
+	for y, row := range modules {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start+margin, y+margin, x-start, x-start)
+		}
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, total, total)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`, total, total, path.String())
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// qrLevels are the error correction levels qrencode accepts.
+var qrLevels = []string{"L", "M", "Q", "H"}
+
+// ValidQRLevel reports whether level is an error correction level.
+func ValidQRLevel(level string) bool {
+	return slices.Contains(qrLevels, level)
+}
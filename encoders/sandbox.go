@@ -0,0 +1,173 @@
+package encoders
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/getevo/evo/v2/lib/log"
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// sandboxCmd is an external command run under the MEDIAX.Sandbox* limits.
+// Its Run, Output and CombinedOutput first wait for a slot in the command's
+// work pool (see media.Admit) and record failures by type in
+// mediax_command_failures_total.
+type sandboxCmd struct {
+	*exec.Cmd
+	ctx  context.Context
+	name string
+}
+
+// command returns exec.CommandContext(ctx, name, args...) wrapped in the
+// sandbox configured by the MEDIAX.Sandbox* settings:
+//
+//   - SandboxMemory, SandboxCPUTime and SandboxOpenFiles set the address
+//     space, CPU seconds and open files of the process through prlimit;
+//   - SandboxNice and SandboxIOClass ("best-effort" or "idle") lower its
+//     scheduling priority through nice and ionice;
+//   - SandboxCgroup places it in a cgroup v2 directory (Linux only), whose
+//     memory.max, cpu.max and pids.max then apply to all commands together.
+//
+// Wrappers that are not installed are skipped with a warning. Callers give
+// ctx a deadline, which bounds the wall-clock time.
+func command(ctx context.Context, name string, args ...string) sandboxCmd {
+	argv := append(sandboxWrappers(), name)
+	argv = append(argv, args...)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	setCgroup(cmd, settings.Get("MEDIAX.SandboxCgroup", "").String())
+	return sandboxCmd{Cmd: cmd, ctx: ctx, name: name}
+}
+
+func (c sandboxCmd) Run() error {
+	release, err := media.Admit(c.ctx, commandPool(c.name))
+	if err != nil {
+		return err
+	}
+	defer release()
+	return c.observe(c.Cmd.Run())
+}
+
+func (c sandboxCmd) Output() ([]byte, error) {
+	release, err := media.Admit(c.ctx, commandPool(c.name))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	out, err := c.Cmd.Output()
+	return out, c.observe(err)
+}
+
+func (c sandboxCmd) CombinedOutput() ([]byte, error) {
+	release, err := media.Admit(c.ctx, commandPool(c.name))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	out, err := c.Cmd.CombinedOutput()
+	return out, c.observe(err)
+}
+
+// commandPool returns the work pool of a command: ImageMagick, qrencode
+// and the probes are image work, everything else (ffmpeg, LibreOffice, Ghostscript,
+// external processors) is heavy.
+func commandPool(name string) media.WorkPool {
+	switch name {
+	case "convert", "identify", "vips", "ffprobe", "qrencode":
+		return media.PoolImage
+	}
+	return media.PoolHeavy
+}
+
+// observe counts err by failure type and returns it as a media.CommandError,
+// which keeps its message.
+func (c sandboxCmd) observe(err error) error {
+	if err == nil {
+		return nil
+	}
+	reason := failureReason(c.ctx, err)
+	media.MetricCommandFailuresTotal.WithLabelValues(c.name, reason).Inc()
+	cmdErr := &media.CommandError{Command: c.name, Reason: reason, Err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		cmdErr.ExitCode = exitErr.ExitCode()
+	}
+	return cmdErr
+}
+
+// failureReason classifies a command error: timeout (deadline exceeded),
+// cpu (CPU time limit, SIGXCPU), killed (SIGKILL, e.g. the OOM killer or a
+// cgroup memory limit), crashed (other signals, often allocations failing
+// under the memory limit), start (the command could not be started) or
+// error (non-zero exit).
+func failureReason(ctx context.Context, err error) string {
+	if ctx.Err() == context.DeadlineExceeded {
+		return "timeout"
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return "start"
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return signalReason(status.Signal())
+	}
+	return "error"
+}
+
+// sandboxWrappers returns the prlimit, nice and ionice prefix of a command.
+func sandboxWrappers() []string {
+	var argv []string
+	var limits []string
+	if memory, err := media.ParseCacheSize(settings.Get("MEDIAX.SandboxMemory", "0").String()); err != nil {
+		log.Warning("invalid MEDIAX.SandboxMemory, ignoring", "error", err)
+	} else if memory > 0 {
+		limits = append(limits, "--as="+strconv.FormatInt(memory, 10))
+	}
+	if cpu, err := media.ParseDuration(settings.Get("MEDIAX.SandboxCPUTime", "0").String()); err != nil {
+		log.Warning("invalid MEDIAX.SandboxCPUTime, ignoring", "error", err)
+	} else if cpu > 0 {
+		limits = append(limits, "--cpu="+strconv.Itoa(max(int(cpu.Seconds()), 1)))
+	}
+	if files := settings.Get("MEDIAX.SandboxOpenFiles", 0).Int(); files > 0 {
+		limits = append(limits, "--nofile="+strconv.Itoa(files))
+	}
+	if len(limits) > 0 && hasWrapper("prlimit") {
+		argv = append(append([]string{"prlimit"}, limits...), "--")
+	}
+	if nice := settings.Get("MEDIAX.SandboxNice", 0).Int(); nice != 0 && hasWrapper("nice") {
+		argv = append(argv, "nice", "-n", strconv.Itoa(nice))
+	}
+	switch class := settings.Get("MEDIAX.SandboxIOClass", "").String(); class {
+	case "":
+	case "best-effort", "idle":
+		if hasWrapper("ionice") {
+			if class == "idle" {
+				argv = append(argv, "ionice", "-c", "3")
+			} else {
+				argv = append(argv, "ionice", "-c", "2", "-n", "7")
+			}
+		}
+	default:
+		log.Warning("invalid MEDIAX.SandboxIOClass, ignoring", "value", class)
+	}
+	return argv
+}
+
+// wrappers caches which sandbox wrapper commands are installed.
+var wrappers sync.Map
+
+func hasWrapper(name string) bool {
+	if found, ok := wrappers.Load(name); ok {
+		return found.(bool)
+	}
+	_, err := exec.LookPath(name)
+	if err != nil {
+		log.Warning("sandbox wrapper not installed, limit not applied", "command", name)
+	}
+	wrappers.Store(name, err == nil)
+	return err == nil
+}
@@ -0,0 +1,44 @@
+package encoders
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/getevo/evo/v2/lib/log"
+)
+
+// cgroups holds the open cgroup directories commands are started in.
+var cgroups sync.Map
+
+// setCgroup starts cmd directly inside the cgroup v2 directory dir, so no
+// part of the process runs outside its limits.
+func setCgroup(cmd *exec.Cmd, dir string) {
+	if dir == "" {
+		return
+	}
+	dir = filepath.Clean(dir)
+	f, ok := cgroups.Load(dir)
+	if !ok {
+		fd, err := os.Open(dir)
+		if err != nil {
+			log.Warning("cannot open sandbox cgroup, commands run outside it", "cgroup", dir, "error", err)
+			return
+		}
+		f, _ = cgroups.LoadOrStore(dir, fd)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(f.(*os.File).Fd())}
+}
+
+func signalReason(sig syscall.Signal) string {
+	switch sig {
+	case syscall.SIGXCPU:
+		return "cpu"
+	case syscall.SIGKILL:
+		return "killed"
+	default:
+		return "crashed"
+	}
+}
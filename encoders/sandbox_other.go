@@ -0,0 +1,29 @@
+//go:build !linux
+
+package encoders
+
+import (
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/getevo/evo/v2/lib/log"
+)
+
+var cgroupWarning sync.Once
+
+// setCgroup is a no-op: cgroups are only supported on Linux.
+func setCgroup(_ *exec.Cmd, dir string) {
+	if dir != "" {
+		cgroupWarning.Do(func() {
+			log.Warning("MEDIAX.SandboxCgroup is only supported on Linux, ignoring")
+		})
+	}
+}
+
+func signalReason(sig syscall.Signal) string {
+	if sig == syscall.SIGKILL {
+		return "killed"
+	}
+	return "crashed"
+}
@@ -0,0 +1,397 @@
+package encoders
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"mediax/apps/media"
+)
+
+// Markdown and source code. ?f=html returns a sanitized, syntax-highlighted
+// page; pdf and image outputs render that page.
+var (
+	Markdown = media.Encoder{Mime: "text/markdown", Processor: processSource, Input: "document"}
+	Code     = media.Encoder{Mime: "text/plain", Processor: processSource, Input: "document"}
+	Html     = media.Encoder{Mime: "text/html", Processor: processSource, Input: "document"}
+)
+
+// maxRenderedLines bounds the lines rendered into pdf and image previews,
+// which only show the first page anyway.
+const maxRenderedLines = 500
+
+// sourceLanguage describes just enough of a language to highlight it.
+type sourceLanguage struct {
+	lineComment  string
+	blockComment [2]string
+	quotes       string
+	keywords     map[string]bool
+}
+
+func language(lineComment, blockStart, blockEnd, quotes, keywords string) *sourceLanguage {
+	l := &sourceLanguage{lineComment: lineComment, blockComment: [2]string{blockStart, blockEnd}, quotes: quotes, keywords: map[string]bool{}}
+	for _, k := range strings.Fields(keywords) {
+		l.keywords[k] = true
+	}
+	return l
+}
+
+var (
+	cLike = "break case char const continue default do double else enum extern float for goto if int long return short signed sizeof static struct switch typedef union unsigned void volatile while"
+
+	// SourceLanguages maps source extensions to their highlighting rules.
+	SourceLanguages = map[string]*sourceLanguage{
+		"go":   language("//", "/*", "*/", "\"'`", "break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false"),
+		"py":   language("#", "", "", "\"'", "and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self"),
+		"js":   language("//", "/*", "*/", "\"'`", "async await break case catch class const continue default delete do else export extends finally for function if import in instanceof let new return super switch this throw try typeof var void while yield null undefined true false"),
+		"java": language("//", "/*", "*/", "\"'", "abstract boolean break byte case catch char class const continue default do double else enum extends final finally float for if implements import instanceof int interface long new package private protected public return short static super switch this throw throws try void while null true false"),
+		"c":    language("//", "/*", "*/", "\"'", cLike+" #include #define"),
+		"h":    language("//", "/*", "*/", "\"'", cLike+" #include #define"),
+		"cpp":  language("//", "/*", "*/", "\"'", cLike+" bool catch class delete namespace new nullptr private protected public template this throw try using virtual true false #include #define"),
+		"rs":   language("//", "/*", "*/", "\"", "as async await break const continue crate else enum extern fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait type unsafe use where while true false"),
+		"rb":   language("#", "", "", "\"'", "alias and begin break case class def do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true undef unless until when while yield"),
+		"php":  language("//", "/*", "*/", "\"'", "abstract array as break case catch class const continue default do echo else elseif extends final for foreach function if implements interface namespace new private protected public return static switch throw try use var while null true false"),
+		"sh":   language("#", "", "", "\"'", "case do done elif else esac export fi for function if in local return then until while"),
+		"sql":  language("--", "/*", "*/", "'", "select from where and or not insert into values update set delete create table drop alter index join left right inner outer on group by order having limit as null is in like SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER INDEX JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT AS NULL IS IN LIKE"),
+		"css":  language("", "/*", "*/", "\"'", ""),
+		"yaml": language("#", "", "", "\"'", "true false null"),
+		"yml":  language("#", "", "", "\"'", "true false null"),
+	}
+)
+
+// Highlight colors, chosen to stay readable on white.
+const (
+	colorComment = "#6a737d"
+	colorString  = "#032f62"
+	colorKeyword = "#d73a49"
+	colorNumber  = "#005cc5"
+)
+
+// processSource renders markdown and source files as highlighted HTML,
+// PDF or images.
+func processSource(input *media.Request) error {
+	format := strings.ToLower(input.Options.OutputFormat)
+	if format != "html" && format != "pdf" && !isImageFormat(format) {
+		return nil // the original file
+	}
+	data, err := os.ReadFile(input.StagedFilePath)
+	if err != nil {
+		return err
+	}
+	text := strings.ToValidUTF8(string(data), "�")
+	if format != "html" {
+		text = firstLines(text, maxRenderedLines)
+	}
+
+	var body string
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(input.StagedFilePath), "."))
+	if ext == "md" || ext == "markdown" {
+		body = renderMarkdown(text)
+	} else {
+		body = "<pre>" + highlight(text, SourceLanguages[ext]) + "</pre>"
+	}
+	page := `<!DOCTYPE html><html><head><meta charset="utf-8"><style>` +
+		`body{font-family:sans-serif;margin:24px}pre{font-family:monospace;font-size:10pt;white-space:pre-wrap}` +
+		`pre.block{background:#f6f8fa;padding:8px}blockquote{color:#6a737d}</style></head><body>` + body + `</body></html>`
+	return renderPage(input, "documents", []byte(page))
+}
+
+// firstLines returns the first n lines of s.
+func firstLines(s string, n int) string {
+	i := 0
+	for ; n > 0; n-- {
+		next := strings.IndexByte(s[i:], '\n')
+		if next < 0 {
+			return s
+		}
+		i += next + 1
+	}
+	return s[:i]
+}
+
+// highlight returns the escaped source with comments, strings, keywords and
+// numbers wrapped in colored spans. A nil lang only escapes.
+func highlight(src string, lang *sourceLanguage) string {
+	if lang == nil {
+		return html.EscapeString(src)
+	}
+	var b strings.Builder
+	span := func(color, s string) {
+		fmt.Fprintf(&b, `<span style="color:%s">%s</span>`, color, html.EscapeString(s))
+	}
+	for i := 0; i < len(src); {
+		rest := src[i:]
+		switch {
+		case lang.lineComment != "" && strings.HasPrefix(rest, lang.lineComment):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			span(colorComment, rest[:end])
+			i += end
+		case lang.blockComment[0] != "" && strings.HasPrefix(rest, lang.blockComment[0]):
+			end := strings.Index(rest[len(lang.blockComment[0]):], lang.blockComment[1])
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += len(lang.blockComment[0]) + len(lang.blockComment[1])
+			}
+			span(colorComment, rest[:end])
+			i += end
+		case strings.IndexByte(lang.quotes, rest[0]) >= 0:
+			end := stringEnd(rest)
+			span(colorString, rest[:end])
+			i += end
+		case isWordStart(rest[0]):
+			end := 1
+			for end < len(rest) && isWordByte(rest[end]) {
+				end++
+			}
+			word := rest[:end]
+			switch {
+			case lang.keywords[word]:
+				span(colorKeyword, word)
+			case unicode.IsDigit(rune(word[0])):
+				span(colorNumber, word)
+			default:
+				b.WriteString(html.EscapeString(word))
+			}
+			i += end
+		default:
+			b.WriteString(html.EscapeString(rest[:1]))
+			i++
+		}
+	}
+	return b.String()
+}
+
+// stringEnd returns the length of the string literal s starts with. Literals
+// other than backquoted ones end at the line.
+func stringEnd(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quote != '`':
+			i++
+		case s[i] == quote:
+			return i + 1
+		case s[i] == '\n' && quote != '`':
+			return i
+		}
+	}
+	return len(s)
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c == '#' || c >= 0x80 || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= 0x80 || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+var (
+	mdHeading = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	mdBullet  = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdOrdered = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdRule    = regexp.MustCompile(`^\s*(-\s*){3,}$|^\s*(\*\s*){3,}$|^\s*(_\s*){3,}$`)
+	mdCode    = regexp.MustCompile("`([^`]+)`")
+	mdStrong  = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	mdEm      = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+	mdImage   = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)[^)]*\)`)
+)
+
+// renderMarkdown converts the common subset of Markdown to HTML. Everything
+// is escaped and only its own tags are emitted, so raw HTML in the source
+// shows as text; images show their alt text instead of being loaded, and
+// links keep only http(s) and mailto targets.
+func renderMarkdown(src string) string {
+	var b strings.Builder
+	var paragraph []string
+	list := ""
+	closeBlocks := func() {
+		if len(paragraph) > 0 {
+			b.WriteString("<p>" + strings.Join(paragraph, "<br>") + "</p>")
+			paragraph = nil
+		}
+		if list != "" {
+			b.WriteString("</" + list + ">")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeBlocks()
+			b.WriteString("<" + tag + ">")
+			list = tag
+		}
+	}
+
+	lines := strings.Split(src, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		if fence, ok := strings.CutPrefix(strings.TrimSpace(line), "```"); ok {
+			closeBlocks()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, strings.TrimRight(lines[i], "\r"))
+			}
+			lang := SourceLanguages[strings.ToLower(strings.Fields(fence + " x")[0])]
+			b.WriteString(`<pre class="block">` + highlight(strings.Join(code, "\n"), lang) + "</pre>")
+			continue
+		}
+		switch m := mdHeading.FindStringSubmatch(line); {
+		case strings.TrimSpace(line) == "":
+			closeBlocks()
+		case m != nil:
+			closeBlocks()
+			n := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + n + ">" + markdownInline(m[2]) + "</h" + n + ">")
+		case mdRule.MatchString(line):
+			closeBlocks()
+			b.WriteString("<hr>")
+		case mdBullet.MatchString(line):
+			openList("ul")
+			b.WriteString("<li>" + markdownInline(mdBullet.FindStringSubmatch(line)[1]) + "</li>")
+		case mdOrdered.MatchString(line):
+			openList("ol")
+			b.WriteString("<li>" + markdownInline(mdOrdered.FindStringSubmatch(line)[1]) + "</li>")
+		case strings.HasPrefix(line, ">"):
+			closeBlocks()
+			b.WriteString("<blockquote>" + markdownInline(strings.TrimSpace(strings.TrimLeft(line, "> "))) + "</blockquote>")
+		default:
+			if list != "" {
+				closeBlocks()
+			}
+			paragraph = append(paragraph, markdownInline(strings.TrimSpace(line)))
+		}
+	}
+	closeBlocks()
+	return b.String()
+}
+
+// markdownInline renders code spans, emphasis, images and links of one
+// line. Code spans are set aside first so their content stays literal.
+func markdownInline(s string) string {
+	var spans []string
+	s = mdCode.ReplaceAllStringFunc(s, func(m string) string {
+		spans = append(spans, "<code>"+html.EscapeString(m[1:len(m)-1])+"</code>")
+		return "\x00" + strconv.Itoa(len(spans)-1) + "\x00"
+	})
+	s = html.EscapeString(s)
+	s = mdImage.ReplaceAllString(s, "[$1]")
+	s = mdLink.ReplaceAllStringFunc(s, func(m string) string {
+		parts := mdLink.FindStringSubmatch(m)
+		target := html.UnescapeString(parts[2])
+		if lower := strings.ToLower(target); strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "mailto:") {
+			return `<a href="` + html.EscapeString(target) + `">` + parts[1] + "</a>"
+		}
+		return parts[1]
+	})
+	s = mdStrong.ReplaceAllString(s, "<b>$1$2</b>")
+	s = mdEm.ReplaceAllString(s, "<i>$1$2</i>")
+	for i, span := range spans {
+		s = strings.Replace(s, "\x00"+strconv.Itoa(i)+"\x00", span, 1)
+	}
+	return s
+}
+
+// renderPage serves page, a self-contained HTML document, in the requested
+// output format: as is for html, otherwise converted to PDF by the
+// LibreOffice pool and, for images, rasterized from the first page.
+func renderPage(input *media.Request, sub string, page []byte) error {
+	opts := input.Options
+	format := strings.ToLower(opts.OutputFormat)
+	cacheKey := input.CacheKey()
+	dir, err := media.CacheShardDir(input.Origin.Project.CacheDir, sub, cacheKey)
+	if err != nil {
+		return err
+	}
+	outputPath := filepath.Join(dir, cacheKey+"."+format)
+	switch format {
+	case "html":
+		input.ProcessedMimeType = "text/html; charset=utf-8"
+	case "pdf":
+		input.ProcessedMimeType = "application/pdf"
+	default:
+		input.ProcessedMimeType = getImageMimeType(format)
+	}
+	if gpath.IsFileExist(outputPath) {
+		input.ProcessedFilePath = outputPath
+		return nil
+	}
+
+	workDir, err := os.MkdirTemp(dir, cacheKey+"-work")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+	htmlPath := filepath.Join(workDir, "page.html")
+	if err := os.WriteFile(htmlPath, page, 0644); err != nil {
+		return err
+	}
+	if format == "html" {
+		if err := os.Rename(htmlPath, outputPath); err != nil {
+			return err
+		}
+		input.ProcessedFilePath = outputPath
+		return nil
+	}
+	pdfPath := filepath.Join(workDir, "page.pdf")
+	if err := convertOffice(htmlPath, pdfPath); err != nil {
+		return err
+	}
+	if format == "pdf" {
+		if err := os.Rename(pdfPath, outputPath); err != nil {
+			return err
+		}
+		input.ProcessedFilePath = outputPath
+		return nil
+	}
+
+	pagePath := filepath.Join(workDir, "page.png")
+	if err := convertPdfToImage(pdfPath, pagePath, 0); err != nil {
+		return err
+	}
+	args := []string{pagePath}
+	if opts.Thumbnail != "" {
+		width, height := modelSize(opts.Thumbnail)
+		args = append(args, "-resize", fmt.Sprintf("%dx%d", width, height))
+	} else if opts.Width > 0 || opts.Height > 0 {
+		args = append(args, "-resize", fmt.Sprintf("%sx%s", dimension(opts.Width), dimension(opts.Height)))
+	}
+	if opts.Quality > 0 {
+		args = append(args, "-quality", strconv.Itoa(opts.Quality))
+	}
+	tempPath := filepath.Join(workDir, "out."+format)
+	args = append(args, tempPath)
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	if out, err := command(ctx, "convert", args...).CombinedOutput(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("convert timed out after %s", imageConvertTimeout())
+		}
+		return fmt.Errorf("convert error: %w\noutput: %s", err, truncateOutput(out))
+	}
+	if err := os.Rename(tempPath, outputPath); err != nil {
+		return err
+	}
+	input.ProcessedFilePath = outputPath
+	return nil
+}
+
+// dimension formats a resize dimension, empty for 0.
+func dimension(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
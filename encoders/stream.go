@@ -0,0 +1,99 @@
+package encoders
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/settings"
+	"mediax/apps/media"
+)
+
+// streamMuxers are the ffmpeg muxers of the output formats players start
+// on before the file is complete: none has a header that is rewritten once
+// the length is known.
+var streamMuxers = map[string]string{
+	"mp3":  "mp3",
+	"aac":  "adts",
+	"ogg":  "ogg",
+	"opus": "opus",
+}
+
+// canStream reports whether a conversion to format may be streamed to the
+// client of input while ffmpeg encodes it (MEDIAX.StreamTranscodes).
+func canStream(input *media.Request, format string) bool {
+	_, ok := streamMuxers[strings.ToLower(format)]
+	return ok && input.Stream && settings.Get("MEDIAX.StreamTranscodes", true).Bool()
+}
+
+// streamTranscode runs transcode in the background with ffmpeg writing
+// format to stdout, and sets input.ProcessedStream to the output as it is
+// encoded. The output goes to input.ProcessedFilePath at the same time and
+// is renamed into place when ffmpeg succeeds, so later requests are served
+// from the cache; a client that goes away stops receiving it, not the
+// encoding. Errors before ffmpeg writes anything are returned as from
+// transcode.
+func streamTranscode(input *media.Request, label, format string, args ...string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(input.ProcessedFilePath), filepath.Base(input.ProcessedFilePath)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	reader, client := io.Pipe()
+	w := &streamWriter{file: tmp, client: client, started: make(chan struct{})}
+	done := make(chan error, 1)
+	// The request no longer holds the staged source once it is answered.
+	release := media.AcquireCacheFile(input.StagedFilePath)
+	args = append(args, "-f", streamMuxers[strings.ToLower(format)], "pipe:1")
+	go func() {
+		defer release()
+		err := runTranscode(input, label, tmp.Name(), audioEncodeTimeout(), w, args...)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), input.ProcessedFilePath)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+		client.CloseWithError(err)
+		done <- err
+	}()
+
+	select {
+	case <-w.started:
+		input.ProcessedStream = reader
+		return nil
+	case err := <-done:
+		// Nothing was written: the error, or an empty output in the cache.
+		reader.Close()
+		return err
+	}
+}
+
+// streamWriter writes ffmpeg's output to the cache file, and to the client
+// until it goes away. started is closed on the first write.
+type streamWriter struct {
+	file    *os.File
+	client  *io.PipeWriter
+	started chan struct{}
+	wrote   bool
+	gone    bool
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if _, err := w.file.Write(p); err != nil {
+		return 0, err
+	}
+	if !w.wrote {
+		w.wrote = true
+		close(w.started)
+	}
+	if !w.gone {
+		if _, err := w.client.Write(p); err != nil {
+			w.gone = true
+		}
+	}
+	return len(p), nil
+}
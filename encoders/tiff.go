@@ -0,0 +1,150 @@
+package encoders
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"mediax/apps/media"
+)
+
+// faxDPI is the resolution PDFs are rendered at for TIFF output when dpi
+// is not given: the fine mode of fax machines, and enough for archives.
+const faxDPI = 200
+
+// Tiff is multi-page TIFF output of TIFF sources, with pages and
+// compression.
+var Tiff = media.Encoder{
+	Mime:      "image/tiff",
+	Processor: processTiff,
+	Input:     "image",
+}
+
+// TiffPdf is PDF output of TIFF sources, one page per TIFF page.
+var TiffPdf = media.Encoder{
+	Mime:      "application/pdf",
+	Processor: processTiff,
+	Input:     "image",
+}
+
+// PdfTiff is multi-page TIFF output of PDF sources, for fax and archiving.
+var PdfTiff = media.Encoder{
+	Mime:      "image/tiff",
+	Processor: processDocument,
+	Input:     "document",
+}
+
+// isTiff reports whether format is TIFF.
+func isTiff(format string) bool {
+	format = strings.ToLower(format)
+	return format == "tif" || format == "tiff"
+}
+
+// processTiff converts the selected pages of a TIFF source to a multi-page
+// TIFF or a PDF with ImageMagick.
+func processTiff(input *media.Request) error {
+	opts := input.Options
+	format := strings.ToLower(opts.OutputFormat)
+	cacheKey := input.CacheKey()
+	outputPath, err := media.CachePath(input.Origin.Project.CacheDir, "documents", cacheKey, cacheKey+"."+format)
+	if err != nil {
+		return err
+	}
+	input.ProcessedFilePath = outputPath
+	if isTiff(format) {
+		input.ProcessedMimeType = "image/tiff"
+	} else {
+		input.ProcessedMimeType = "application/pdf"
+	}
+	if _, err := os.Stat(outputPath); err == nil {
+		return nil
+	}
+
+	src := input.StagedFilePath
+	if opts.Pages != "" {
+		// ImageMagick numbers frames from 0.
+		ranges, err := media.PageRanges(opts.Pages)
+		if err != nil {
+			return err
+		}
+		frames := make([]string, len(ranges))
+		for i, r := range ranges {
+			frames[i] = strconv.Itoa(r[0] - 1)
+			if r[1] > r[0] {
+				frames[i] += "-" + strconv.Itoa(r[1]-1)
+			}
+		}
+		src += "[" + strings.Join(frames, ",") + "]"
+	}
+	args := []string{src}
+	switch opts.Compression {
+	case "g4":
+		args = append(args, "-type", "bilevel", "-compress", "Group4")
+	case "lzw":
+		args = append(args, "-compress", "LZW")
+	case "none":
+		args = append(args, "-compress", "None")
+	case "":
+		if isTiff(format) {
+			args = append(args, "-compress", "LZW")
+		}
+	}
+	// For PDF output the resolution also sets the page size.
+	args = append(args, densityArgs(opts)...)
+	tempPath := outputPath + ".tmp"
+	if err := runConvert(append(args, format+":"+tempPath)...); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, outputPath)
+}
+
+// pdfToTiff renders the selected pages of a PDF source into one multi-page
+// TIFF with ghostscript: bilevel with CCITT Group 4 compression for fax
+// (compression=g4), or in colour, LZW-compressed by default.
+func pdfToTiff(input *media.Request) error {
+	opts := input.Options
+	cacheKey := input.CacheKey()
+	outputPath, err := media.CachePath(input.Origin.Project.CacheDir, "documents", cacheKey, cacheKey+".tiff")
+	if err != nil {
+		return err
+	}
+	input.ProcessedFilePath = outputPath
+	input.ProcessedMimeType = "image/tiff"
+	if _, err := os.Stat(outputPath); err == nil {
+		return nil
+	}
+
+	dpi := opts.DPI
+	if dpi == 0 {
+		dpi = faxDPI
+	}
+	tempPath := outputPath + ".tmp"
+	args := []string{"-dBATCH", "-dNOPAUSE", "-dQUIET", "-dSAFER", "-r" + strconv.Itoa(dpi)}
+	switch opts.Compression {
+	case "g4":
+		args = append(args, "-sDEVICE=tiffg4")
+	case "none":
+		args = append(args, "-sDEVICE=tiff24nc", "-sCompression=none")
+	default:
+		args = append(args, "-sDEVICE=tiff24nc", "-sCompression=lzw")
+	}
+	if opts.Pages != "" {
+		args = append(args, "-sPageList="+opts.Pages)
+	}
+	args = append(args, "-sOutputFile="+tempPath, input.StagedFilePath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), officeConvertTimeout())
+	defer cancel()
+	output, err := command(ctx, "gs", args...).CombinedOutput()
+	if err != nil {
+		os.Remove(tempPath)
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("ghostscript timed out after %s", officeConvertTimeout())
+		}
+		return fmt.Errorf("ghostscript error: %w\noutput: %s", err, truncateOutput(output))
+	}
+	return os.Rename(tempPath, outputPath)
+}
@@ -0,0 +1,179 @@
+package encoders
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"github.com/getevo/evo/v2/lib/settings"
+	"github.com/gofiber/fiber/v2"
+	"mediax/apps/media"
+)
+
+// dziNamespace is the XML namespace of Deep Zoom image descriptors.
+const dziNamespace = "http://schemas.microsoft.com/deepzoom/2008"
+
+// tileGeometry returns the Deep Zoom tile size and overlap in pixels.
+func tileGeometry() (size, overlap int) {
+	size = settings.Get("MEDIAX.TileSize", 254).Int()
+	overlap = settings.Get("MEDIAX.TileOverlap", 1).Int()
+	if size <= 0 {
+		size = 254
+	}
+	if overlap < 0 {
+		overlap = 0
+	}
+	return size, overlap
+}
+
+// processTiles serves the Deep Zoom descriptor (dzi=1) or a single pyramid
+// tile (tile=level/col_row) of a large image. Every pyramid level is
+// rendered once into an ImageMagick pixel cache (.mpc) that tiles are cut
+// from, and every tile is cached on its own.
+func processTiles(input *media.Request) error {
+	opts := input.Options
+	cacheDir := input.Origin.Project.CacheDir
+	size, overlap := tileGeometry()
+	format := strings.ToLower(opts.OutputFormat)
+
+	width, height, err := imageDimensions(input.StagedFilePath)
+	if err != nil {
+		return err
+	}
+	maxLevel := int(math.Ceil(math.Log2(float64(max(width, height)))))
+
+	key := input.CacheKey()
+	ext := format
+	if opts.DZI {
+		ext = "xml"
+	}
+	out, err := media.CachePath(cacheDir, "tiles", key, fmt.Sprintf("%s_%d_%d.%s", key, size, overlap, ext))
+	if err != nil {
+		return err
+	}
+	input.ProcessedFilePath = out
+
+	if opts.DZI {
+		input.ProcessedMimeType = "application/xml"
+		if gpath.IsFileExist(out) {
+			return nil
+		}
+		descriptor := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+			`<Image xmlns="%s" TileSize="%d" Overlap="%d" Format="%s"><Size Width="%d" Height="%d"/></Image>`+"\n",
+			dziNamespace, size, overlap, format, width, height)
+		return writeFileAtomic(out, []byte(descriptor))
+	}
+
+	if gpath.IsFileExist(out) {
+		return nil
+	}
+	var level, col, row int
+	if _, err := fmt.Sscanf(opts.Tile, "%d/%d_%d", &level, &col, &row); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid tile address")
+	}
+	if level > maxLevel {
+		return fiber.NewError(fiber.StatusNotFound, "tile level out of range")
+	}
+	scale := math.Pow(2, float64(level-maxLevel))
+	levelWidth := int(math.Ceil(float64(width) * scale))
+	levelHeight := int(math.Ceil(float64(height) * scale))
+	x, y := col*size, row*size
+	if x >= levelWidth || y >= levelHeight {
+		return fiber.NewError(fiber.StatusNotFound, "tile out of range")
+	}
+	// Tiles overlap their neighbours on every inner edge.
+	x0, y0 := max(x-overlap, 0), max(y-overlap, 0)
+	x1, y1 := min(x+size+overlap, levelWidth), min(y+size+overlap, levelHeight)
+
+	levelImage, err := pyramidLevel(input, level, levelWidth, levelHeight)
+	if err != nil {
+		return err
+	}
+	args := []string{levelImage, "-crop", fmt.Sprintf("%dx%d+%d+%d", x1-x0, y1-y0, x0, y0), "+repage"}
+	if opts.Quality > 0 {
+		args = append(args, "-quality", strconv.Itoa(opts.Quality))
+	}
+	tmp := out + ".tmp." + format
+	args = append(args, tmp)
+	if err := runConvert(args...); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, out)
+}
+
+// pyramidLevel returns the .mpc pixel cache of the source scaled to the
+// given level, rendering it first if needed. Levels are rendered into a
+// temporary directory that is renamed into place, so concurrent requests
+// never read a half-written cache.
+func pyramidLevel(input *media.Request, level, width, height int) (string, error) {
+	levelOpts := media.Options{Tile: fmt.Sprintf("level/%d", level)}
+	key := levelOpts.CacheKey(input.SourceID())
+	shard, err := media.CacheShardDir(input.Origin.Project.CacheDir, "tiles", key)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(shard, key+".level")
+	mpc := filepath.Join(dir, "level.mpc")
+	// Eviction removes files one by one; a level missing either half is rebuilt.
+	if gpath.IsFileExist(mpc) && gpath.IsFileExist(filepath.Join(dir, "level.cache")) {
+		return mpc, nil
+	}
+	os.RemoveAll(dir)
+
+	tmpDir, err := os.MkdirTemp(shard, key+".tmp")
+	if err != nil {
+		return "", err
+	}
+	if err := runConvert(input.StagedFilePath+"[0]", "-resize", fmt.Sprintf("%dx%d!", width, height), filepath.Join(tmpDir, "level.mpc")); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		// Another request finished the same level first.
+		os.RemoveAll(tmpDir)
+	}
+	return mpc, nil
+}
+
+// imageDimensions reads the pixel size of the first frame without decoding it.
+func imageDimensions(path string) (width, height int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	output, err := command(ctx, "identify", "-ping", "-format", "%w %h", path+"[0]").CombinedOutput()
+	if err != nil {
+		return 0, 0, fmt.Errorf("identify error: %w\noutput: %s", err, truncateOutput(output))
+	}
+	if _, err := fmt.Sscanf(string(output), "%d %d", &width, &height); err != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("cannot read image dimensions: %q", truncateOutput(output))
+	}
+	return width, height, nil
+}
+
+// runConvert runs ImageMagick convert with the standard image timeout.
+func runConvert(args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	output, err := command(ctx, "convert", args...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("convert timed out after %s", imageConvertTimeout())
+		}
+		return fmt.Errorf("convert error: %w\noutput: %s", err, truncateOutput(output))
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -1,34 +1,33 @@
 package encoders
 
 import (
+	"bytes"
 	"context"
-	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"github.com/getevo/evo/v2/lib/log"
+	"math"
 	"mediax/apps/media"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
 )
 
 // getVideoDuration gets the duration of a video file in seconds using ffprobe
-func getVideoDuration(filePath string) (float64, error) {
-	// Set timeout for ffprobe command (10 seconds should be enough)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// source is the file path, or ffprobe input arguments from sourceArgs.
+func getVideoDuration(source ...string) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout())
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet", "-show_entries", "format=duration", "-of", "csv=p=0", filePath)
+	cmd := command(ctx, "ffprobe", append([]string{"-v", "quiet", "-show_entries", "format=duration", "-of", "csv=p=0"}, source...)...)
 	output, err := cmd.Output()
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			return 0, fmt.Errorf("ffprobe timed out after 10 seconds while getting video duration")
+			return 0, fmt.Errorf("ffprobe timed out after %s while getting video duration", probeTimeout())
 		}
-		return 0, fmt.Errorf("failed to get video duration: %v", err)
+		return 0, fmt.Errorf("failed to get video duration: %w", err)
 	}
 
 	durationStr := strings.TrimSpace(string(output))
@@ -40,6 +39,88 @@ func getVideoDuration(filePath string) (float64, error) {
 	return duration, nil
 }
 
+// getVideoDimensions returns the display size of the first video stream,
+// with width and height swapped for sources rotated by 90 degrees. source
+// is the file path, or ffprobe input arguments from sourceArgs.
+func getVideoDimensions(source ...string) (int, int, error) {
+	width, height, rotation, err := probeVideoStream(source...)
+	if err != nil {
+		return 0, 0, err
+	}
+	if rotation%180 != 0 {
+		return height, width, nil
+	}
+	return width, height, nil
+}
+
+// videoRotation returns the clockwise rotation of the first video stream,
+// 0, 90, 180 or 270. source is as for getVideoDimensions.
+func videoRotation(source ...string) (int, error) {
+	_, _, rotation, err := probeVideoStream(source...)
+	return rotation, err
+}
+
+// probeVideoStream returns the coded size and the clockwise rotation of the
+// first video stream.
+func probeVideoStream(source ...string) (int, int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout())
+	defer cancel()
+
+	args := []string{"-v", "quiet", "-select_streams", "v:0", "-show_entries", "stream=width,height:stream_side_data=rotation:stream_tags=rotate", "-of", "json"}
+	output, err := command(ctx, "ffprobe", append(args, source...)...).Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return 0, 0, 0, fmt.Errorf("ffprobe timed out after %s while getting video dimensions", probeTimeout())
+		}
+		return 0, 0, 0, fmt.Errorf("failed to get video dimensions: %w", err)
+	}
+	var probe struct {
+		Streams []struct {
+			Width        int `json:"width"`
+			Height       int `json:"height"`
+			SideDataList []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
+			Tags struct {
+				Rotate string `json:"rotate"`
+			} `json:"tags"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil || len(probe.Streams) == 0 || probe.Streams[0].Width == 0 {
+		return 0, 0, 0, fmt.Errorf("no video stream dimensions in ffprobe output")
+	}
+	st := probe.Streams[0]
+	var matrix float64
+	for _, sd := range st.SideDataList {
+		if sd.Rotation != 0 {
+			matrix = sd.Rotation
+			break
+		}
+	}
+	return st.Width, st.Height, clockwiseRotation(matrix, st.Tags.Rotate), nil
+}
+
+// uprightFilter prefixes filter with the ffmpeg filters that turn frames of
+// a source rotated clockwise by rotation upright. ffmpeg must read the
+// source with -noautorotate, or the frames are turned twice.
+func uprightFilter(rotation int, filter string) string {
+	var turn string
+	switch rotation {
+	case 90:
+		turn = "transpose=clock"
+	case 180:
+		turn = "hflip,vflip"
+	case 270:
+		turn = "transpose=cclock"
+	default:
+		return filter
+	}
+	if filter == "" {
+		return turn
+	}
+	return turn + "," + filter
+}
+
 // getQualityDimensions returns width and height for quality presets
 func getQualityDimensions(quality string) (int, int) {
 	switch strings.ToLower(quality) {
@@ -56,21 +137,16 @@ func getQualityDimensions(quality string) (int, int) {
 	}
 }
 
-// generateCacheKey generates a unique cache key for the processed file
-func generateCacheKey(originalPath string, options *media.Options) string {
-	h := md5.New()
-	h.Write([]byte(fmt.Sprintf("%s_%s_%s_%d_%s", originalPath, options.Preview, options.Thumbnail, options.SS, options.OutputFormat)))
-	return fmt.Sprintf("%x", h.Sum(nil))
-}
-
-// generatePreview creates a preview clip by intelligently splitting video into chunks
+// generatePreview creates a preview clip from chunks spread over the video,
+// in a single ffmpeg run: every chunk is an input seeked to its start and
+// trimmed, and the filter graph concatenates and scales them.
 func generatePreview(input *media.Request) error {
 	if input.Options.Preview == "" {
 		return nil
 	}
 
 	// Generate cache key and check if preview already exists
-	cacheKey := generateCacheKey(input.OriginalFilePath, input.Options)
+	cacheKey := input.CacheKey()
 	quality := input.Options.Preview
 	switch quality {
 	case "480p", "720p", "1080p", "4k":
@@ -79,9 +155,9 @@ func generatePreview(input *media.Request) error {
 		quality = "480p"
 	}
 
-	cacheDir := filepath.Join(input.Origin.Project.CacheDir, "previews")
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to create preview cache dir: %w", err)
+	cacheDir, err := media.CacheShardDir(input.Origin.Project.CacheDir, "previews", cacheKey)
+	if err != nil {
+		return err
 	}
 
 	previewPath := filepath.Join(cacheDir, fmt.Sprintf("%s_%s.mp4", cacheKey, quality))
@@ -108,7 +184,7 @@ func generatePreview(input *media.Request) error {
 	// Get video duration
 	duration, err := getVideoDuration(input.StagedFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to get video duration: %v", err)
+		return fmt.Errorf("failed to get video duration: %w", err)
 	}
 
 	// Calculate chunk parameters
@@ -129,98 +205,42 @@ func generatePreview(input *media.Request) error {
 	interval := duration / float64(chunksToExtract)
 
 	width, height := getQualityDimensions(quality)
-
-	// Create temporary directory for chunks
-	tempDir := filepath.Join(cacheDir, "temp_"+cacheKey)
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		return fmt.Errorf("failed to create chunk temp dir: %w", err)
+	rotation, err := videoRotation(input.StagedFilePath)
+	if err != nil {
+		return err
 	}
-	defer os.RemoveAll(tempDir)
-
-	// Extract chunks in parallel, bounded by a semaphore to limit concurrent FFmpeg processes.
-	var wg sync.WaitGroup
-	chunkSem := make(chan struct{}, maxConcurrentChunks)
-	chunkPaths := make([]string, chunksToExtract)
-	errors := make([]error, chunksToExtract)
 
+	// -t stops reading each input after its chunk; trim cuts the decoded
+	// frames exactly.
+	var args []string
+	var graph, inputs strings.Builder
 	for i := 0; i < chunksToExtract; i++ {
-		chunkSem <- struct{}{} // acquire slot
-		wg.Add(1)
-		go func(chunkIndex int) {
-			defer wg.Done()
-			defer func() { <-chunkSem }() // release slot
-
-			startTime := float64(chunkIndex) * interval
-			chunkPath := filepath.Join(tempDir, fmt.Sprintf("chunk_%d.mp4", chunkIndex))
-
-			// Set timeout for chunk extraction (60 seconds should be enough)
-			ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-			defer cancel()
-
-			// Extract chunk with no audio, compression, and quality scaling
-			cmd := exec.CommandContext(ctx, "ffmpeg",
-				"-ss", fmt.Sprintf("%.2f", startTime),
-				"-i", input.StagedFilePath,
-				"-t", fmt.Sprintf("%.2f", chunkDuration),
-				"-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2", width, height, width, height),
-				"-c:v", "libx264",
-				"-preset", "fast",
-				"-crf", ffmpegCRF, // Higher CRF for more compression
-				"-an", // Remove audio
-				"-y", chunkPath)
-
-			if err := cmd.Run(); err != nil {
-				if ctx.Err() == context.DeadlineExceeded {
-					errors[chunkIndex] = fmt.Errorf("chunk %d extraction timed out after 60 seconds", chunkIndex)
-				} else {
-					errors[chunkIndex] = fmt.Errorf("failed to extract chunk %d: %v", chunkIndex, err)
-				}
-				return
-			}
-
-			chunkPaths[chunkIndex] = chunkPath
-		}(i)
+		args = append(args, "-ss", fmt.Sprintf("%.2f", float64(i)*interval), "-t", fmt.Sprintf("%.2f", chunkDuration), "-noautorotate", "-i", input.StagedFilePath)
+		fmt.Fprintf(&graph, "[%d:v:0]%s[c%d];", i, uprightFilter(rotation, fmt.Sprintf("trim=duration=%.2f,setpts=PTS-STARTPTS", chunkDuration)), i)
+		fmt.Fprintf(&inputs, "[c%d]", i)
 	}
-
-	wg.Wait()
-
-	// Check for errors
-	for i, err := range errors {
-		if err != nil {
-			return fmt.Errorf("chunk %d extraction failed: %v", i, err)
-		}
-	}
-
-	// Create concat file
-	concatFile := filepath.Join(tempDir, "concat.txt")
-	concatContent := ""
-	for _, chunkPath := range chunkPaths {
-		if chunkPath != "" {
-			concatContent += fmt.Sprintf("file '%s'\n", chunkPath)
-		}
-	}
-
-	err = os.WriteFile(concatFile, []byte(concatContent), 0644)
-	if err != nil {
-		return fmt.Errorf("failed to create concat file: %v", err)
-	}
-
-	// Concatenate chunks with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, "ffmpeg",
-		"-f", "concat",
-		"-safe", "0",
-		"-i", concatFile,
-		"-c", "copy",
+	fmt.Fprintf(&graph, "%sconcat=n=%d:v=1:a=0,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2[out]",
+		inputs.String(), chunksToExtract, width, height, width, height)
+
+	// Encode with no audio, compression, and quality scaling
+	args = append(args,
+		"-filter_complex", graph.String(),
+		"-map", "[out]",
+		"-c:v", "libx264",
+		"-preset", "fast",
+		"-crf", ffmpegCRF, // Higher CRF for more compression
+		"-an", // Remove audio
 		"-y", previewPath)
 
-	if err := cmd.Run(); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), videoFrameTimeout())
+	defer cancel()
+	output, err := command(ctx, "ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		os.Remove(previewPath)
 		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("chunk concatenation timed out after 30 seconds")
+			return fmt.Errorf("preview generation timed out after %s", videoFrameTimeout())
 		}
-		return fmt.Errorf("failed to concatenate chunks: %v", err)
+		return fmt.Errorf("failed to generate preview: %w\noutput: %s", err, truncateOutput(output))
 	}
 
 	input.ProcessedFilePath = previewPath
@@ -284,6 +304,17 @@ func generateThumbnail(input *media.Request) error {
 		return nil
 	}
 
+	// scale= becomes a WxH thumbnail, keyed like one asked for directly
+	if opts := input.Options; opts.Scale > 0 {
+		width, height, err := getVideoDimensions(sourceArgs(input)...)
+		if err != nil {
+			return err
+		}
+		opts.ResolveScale(width, height)
+		opts.Thumbnail = fmt.Sprintf("%dx%d", opts.Width, opts.Height)
+		opts.Width, opts.Height, opts.KeepAspectRatio = 0, 0, true
+	}
+
 	// Determine output format (default to jpeg)
 	outputFormat := input.Options.OutputFormat
 	if outputFormat == "" {
@@ -291,10 +322,10 @@ func generateThumbnail(input *media.Request) error {
 	}
 
 	// Generate cache key and check if thumbnail already exists
-	cacheKey := generateCacheKey(input.OriginalFilePath, input.Options)
-	cacheDir := filepath.Join(input.Origin.Project.CacheDir, "thumbnails")
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to create thumbnail cache dir: %w", err)
+	cacheKey := input.CacheKey()
+	cacheDir, err := media.CacheShardDir(input.Origin.Project.CacheDir, "thumbnails", cacheKey)
+	if err != nil {
+		return err
 	}
 	// Determine final file extension
 	_, finalExtension := getImageFormat(outputFormat)
@@ -323,72 +354,62 @@ func generateThumbnail(input *media.Request) error {
 	// Determine timestamp (use ss if provided, otherwise middle of video)
 	timestamp := float64(input.Options.SS)
 	if input.Options.SS == 0 {
-		duration, err := getVideoDuration(input.StagedFilePath)
+		duration, err := getVideoDuration(sourceArgs(input)...)
 		if err != nil {
-			return fmt.Errorf("failed to get video duration: %v", err)
+			return fmt.Errorf("failed to get video duration: %w", err)
 		}
 		timestamp = duration / 2
 	}
 
-	// Step 1: Generate JPEG thumbnail with maximum scale using FFmpeg
-	jpegPath := filepath.Join(cacheDir, fmt.Sprintf("%s_%s_temp.jpg", cacheKey, input.Options.Thumbnail))
+	rotation, err := videoRotation(sourceArgs(input)...)
+	if err != nil {
+		return err
+	}
 
-	// Set timeout for FFmpeg command
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// ffmpeg scales the frame and encodes the target format itself, so it is
+	// encoded once. Seeking before the input lets remote sources fetch only
+	// the ranges around the frame.
+	ctx, cancel := context.WithTimeout(context.Background(), videoFrameTimeout())
 	defer cancel()
-
-	// Generate high-quality JPEG with maximum scale (no specific dimensions)
-	cmd := exec.CommandContext(ctx, "ffmpeg",
-		"-ss", fmt.Sprintf("%.2f", timestamp),
-		"-i", input.StagedFilePath,
-		"-vframes", "1",
-		"-q:v", "2", // High quality JPEG
-		"-y", jpegPath)
-
-	if err := cmd.Run(); err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("thumbnail generation timed out after 30 seconds")
+	args := append([]string{"-ss", fmt.Sprintf("%.2f", timestamp), "-noautorotate"}, sourceArgs(input)...)
+	args = append(args, "-frames:v", "1", "-vf", uprightFilter(rotation, thumbnailFilter(input.Options.Thumbnail)))
+
+	format, _ := getImageFormat(outputFormat)
+	if format == "avif" {
+		// ffmpeg builds rarely carry an AVIF encoder; hand ImageMagick a
+		// lossless PNG frame through a pipe instead of a temporary JPEG.
+		frame, err := command(ctx, "ffmpeg", append(args, "-c:v", "png", "-f", "image2pipe", "pipe:1")...).Output()
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("thumbnail generation timed out after %s", videoFrameTimeout())
+			}
+			return fmt.Errorf("failed to extract thumbnail: %w", err)
+		}
+		cvArgs := []string{"png:-"}
+		if input.Options.Quality > 0 {
+			cvArgs = append(cvArgs, "-quality", strconv.Itoa(input.Options.Quality))
+		}
+		cvCtx, cvCancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+		defer cvCancel()
+		cmd := command(cvCtx, "convert", append(cvArgs, finalPath)...)
+		cmd.Stdin = bytes.NewReader(frame)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			os.Remove(finalPath)
+			if cvCtx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("convert timed out after %s", imageConvertTimeout())
+			}
+			return fmt.Errorf("ImageMagick convert error: %w\noutput: %s", err, truncateOutput(output))
 		}
-		return fmt.Errorf("failed to extract thumbnail: %v", err)
-	}
-
-	// Step 2: Use ImageMagick convert to change format and size based on user input
-	args := []string{jpegPath}
-
-	// Parse thumbnail parameter for size
-	if strings.Contains(input.Options.Thumbnail, "x") {
-		// Custom dimensions (e.g., "60x60")
-		args = append(args, "-resize", input.Options.Thumbnail+"^")
-		args = append(args, "-gravity", "center")
-		args = append(args, "-crop", input.Options.Thumbnail+"+0+0")
 	} else {
-		// Quality presets (e.g., "1080p")
-		width, height := getQualityDimensions(input.Options.Thumbnail)
-		args = append(args, "-resize", fmt.Sprintf("%dx%d", width, height))
-	}
-
-	// Apply quality if specified
-	if input.Options.Quality > 0 {
-		args = append(args, "-quality", fmt.Sprintf("%d", input.Options.Quality))
-	}
-
-	// Set output file
-	args = append(args, finalPath)
-
-	// Execute ImageMagick convert
-	convertCmd := exec.Command("convert", args...)
-	output, err := convertCmd.CombinedOutput()
-	if err != nil {
-		// Clean up temporary JPEG file
-		if rmErr := os.Remove(jpegPath); rmErr != nil && !os.IsNotExist(rmErr) {
-			log.Warning("failed to remove temp jpeg", "path", jpegPath, "error", rmErr)
+		args = append(args, frameCodecArgs(format, input.Options.Quality)...)
+		output, err := command(ctx, "ffmpeg", append(args, "-f", "image2", "-update", "1", "-y", finalPath)...).CombinedOutput()
+		if err != nil {
+			os.Remove(finalPath)
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("thumbnail generation timed out after %s", videoFrameTimeout())
+			}
+			return fmt.Errorf("failed to extract thumbnail: %w\noutput: %s", err, truncateOutput(output))
 		}
-		return fmt.Errorf("ImageMagick convert error: %v\noutput: %s", err, truncateOutput(output))
-	}
-
-	// Clean up temporary JPEG file
-	if rmErr := os.Remove(jpegPath); rmErr != nil && !os.IsNotExist(rmErr) {
-		log.Warning("failed to remove temp jpeg", "path", jpegPath, "error", rmErr)
 	}
 
 	input.ProcessedFilePath = finalPath
@@ -396,6 +417,39 @@ func generateThumbnail(input *media.Request) error {
 	return nil
 }
 
+// thumbnailFilter returns the ffmpeg filter sizing a thumbnail: "WxH" fills
+// the box and crops the centre, quality presets ("720p") fit inside it.
+func thumbnailFilter(thumbnail string) string {
+	if w, h, ok := strings.Cut(thumbnail, "x"); ok {
+		return fmt.Sprintf("scale=%s:%s:force_original_aspect_ratio=increase:flags=lanczos,crop=%s:%s", w, h, w, h)
+	}
+	width, height := getQualityDimensions(thumbnail)
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease:flags=lanczos", width, height)
+}
+
+// frameCodecArgs returns the ffmpeg encoder arguments of a single-frame
+// image. PNG is always lossless and keeps an alpha channel; WebP is lossless
+// unless a quality is requested. Quality 1-100 maps onto each encoder's
+// scale, as for image outputs.
+func frameCodecArgs(format string, quality int) []string {
+	switch format {
+	case "png":
+		return []string{"-c:v", "png"}
+	case "webp":
+		if quality > 0 {
+			return []string{"-c:v", "libwebp", "-quality", strconv.Itoa(quality)}
+		}
+		return []string{"-c:v", "libwebp", "-lossless", "1"}
+	default:
+		// mjpeg's -q:v runs from 2 (best) to 31.
+		q := 2
+		if quality > 0 {
+			q = 2 + (100-min(quality, 100))*29/100
+		}
+		return []string{"-c:v", "mjpeg", "-q:v", strconv.Itoa(q)}
+	}
+}
+
 // VideoMetadata represents all video metadata information
 type VideoMetadata struct {
 	// Basic metadata
@@ -412,6 +466,18 @@ type VideoMetadata struct {
 	FrameRate   float64 `json:"frame_rate,omitempty"`
 	ColorSpace  string  `json:"color_space,omitempty"`
 	PixelFormat string  `json:"pixel_format,omitempty"`
+	// ColorTransfer and ColorPrimaries are ffprobe's names, e.g.
+	// smpte2084 and bt2020. HDR is hdr10 (PQ transfer), hlg or
+	// dolby_vision, and empty for SDR video.
+	ColorTransfer  string `json:"color_transfer,omitempty"`
+	ColorPrimaries string `json:"color_primaries,omitempty"`
+	HDR            string `json:"hdr,omitempty"`
+	// Rotation is the clockwise rotation in degrees (90, 180 or 270) the
+	// display matrix asks players to apply; Width and Height are as coded.
+	Rotation int `json:"rotation,omitempty"`
+	// KeyframeInterval is the mean time in seconds between keyframes over
+	// the first minute of the video.
+	KeyframeInterval float64 `json:"keyframe_interval,omitempty"`
 
 	// Audio stream metadata
 	AudioCodec    string `json:"audio_codec,omitempty"`
@@ -422,18 +488,31 @@ type VideoMetadata struct {
 	SubtitleCount int      `json:"subtitle_count,omitempty"`
 	SubtitleLangs []string `json:"subtitle_languages,omitempty"`
 
+	// Streams lists every stream with its default and forced flags.
+	Streams []StreamDisposition `json:"streams,omitempty"`
+
 	// File information
 	Filename string `json:"filename,omitempty"`
 	FilePath string `json:"file_path,omitempty"`
 }
 
+// StreamDisposition is a stream of a video file and its disposition flags.
+type StreamDisposition struct {
+	Index    int    `json:"index"`
+	Type     string `json:"type"`
+	Codec    string `json:"codec,omitempty"`
+	Language string `json:"language,omitempty"`
+	Default  bool   `json:"default"`
+	Forced   bool   `json:"forced"`
+}
+
 // generateVideoMetadata extracts all metadata from video file using ffprobe and returns as JSON
 func generateVideoMetadata(input *media.Request) error {
 	// Generate cache key for metadata
-	cacheKey := fmt.Sprintf("%x", md5.Sum([]byte(input.OriginalFilePath+"_metadata")))
-	cacheDir := filepath.Join(input.Origin.Project.CacheDir, "video_metadata")
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to create video metadata cache dir: %w", err)
+	cacheKey := input.CacheKey()
+	cacheDir, err := media.CacheShardDir(input.Origin.Project.CacheDir, "video_metadata", cacheKey)
+	if err != nil {
+		return err
 	}
 
 	jsonPath := filepath.Join(cacheDir, fmt.Sprintf("%s.json", cacheKey))
@@ -481,10 +560,10 @@ func generateVideoMetadata(input *media.Request) error {
 
 	// Get detailed video information using a single ffprobe call for both
 	// format and stream data, avoiding a second process spawn.
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout())
 	defer cancel()
 
-	probeCmd := exec.CommandContext(ctx, "ffprobe",
+	probeCmd := command(ctx, "ffprobe",
 		"-v", "quiet",
 		"-print_format", "json",
 		"-show_format",
@@ -515,9 +594,14 @@ func generateVideoMetadata(input *media.Request) error {
 				for _, stream := range streams {
 					if streamMap, ok := stream.(map[string]interface{}); ok {
 						codecType, _ := streamMap["codec_type"].(string)
+						metadata.Streams = append(metadata.Streams, streamDisposition(streamMap))
 
 						switch codecType {
 						case "video":
+							// Cover art is a video stream too.
+							if disposition, _ := streamMap["disposition"].(map[string]interface{}); disposition["attached_pic"] == float64(1) {
+								continue
+							}
 							if codec, ok := streamMap["codec_name"].(string); ok {
 								metadata.VideoCodec = codec
 							}
@@ -538,6 +622,10 @@ func generateVideoMetadata(input *media.Request) error {
 							if pixFmt, ok := streamMap["pix_fmt"].(string); ok {
 								metadata.PixelFormat = pixFmt
 							}
+							metadata.ColorTransfer, _ = streamMap["color_transfer"].(string)
+							metadata.ColorPrimaries, _ = streamMap["color_primaries"].(string)
+							metadata.HDR = hdrFormat(streamMap)
+							metadata.Rotation = displayRotation(streamMap)
 
 							// Extract frame rate
 							if rFrameRate, ok := streamMap["r_frame_rate"].(string); ok {
@@ -580,6 +668,14 @@ func generateVideoMetadata(input *media.Request) error {
 		}
 	}
 
+	if metadata.VideoCodec != "" {
+		if interval, err := keyframeInterval(input.StagedFilePath); err != nil {
+			log.Debug("Failed to measure keyframe interval", "trace_id", input.TraceID, "error", err)
+		} else {
+			metadata.KeyframeInterval = interval
+		}
+	}
+
 	// Convert to JSON
 	jsonData, err := json.MarshalIndent(metadata, "", "  ")
 	if err != nil {
@@ -599,13 +695,123 @@ func generateVideoMetadata(input *media.Request) error {
 	return nil
 }
 
+// streamDisposition returns the index, type, language and default and
+// forced flags of an ffprobe stream.
+func streamDisposition(stream map[string]interface{}) StreamDisposition {
+	var d StreamDisposition
+	if index, ok := stream["index"].(float64); ok {
+		d.Index = int(index)
+	}
+	d.Type, _ = stream["codec_type"].(string)
+	d.Codec, _ = stream["codec_name"].(string)
+	if tags, ok := stream["tags"].(map[string]interface{}); ok {
+		d.Language, _ = tags["language"].(string)
+	}
+	if disposition, ok := stream["disposition"].(map[string]interface{}); ok {
+		d.Default = disposition["default"] == float64(1)
+		d.Forced = disposition["forced"] == float64(1)
+	}
+	return d
+}
+
+// hdrFormat names the HDR format of an ffprobe video stream: dolby_vision
+// when it carries a Dolby Vision configuration, otherwise by its transfer
+// characteristics, hdr10 for PQ and hlg for hybrid log-gamma.
+func hdrFormat(stream map[string]interface{}) string {
+	if sideData, ok := stream["side_data_list"].([]interface{}); ok {
+		for _, sd := range sideData {
+			if m, ok := sd.(map[string]interface{}); ok && m["side_data_type"] == "DOVI configuration record" {
+				return "dolby_vision"
+			}
+		}
+	}
+	switch stream["color_transfer"] {
+	case "smpte2084":
+		return "hdr10"
+	case "arib-std-b67":
+		return "hlg"
+	}
+	return ""
+}
+
+// displayRotation returns the clockwise rotation of an ffprobe video
+// stream, 0, 90, 180 or 270, from its display matrix or, for files written
+// by older muxers, its rotate tag. The display matrix rotation is counter-
+// clockwise.
+func displayRotation(stream map[string]interface{}) int {
+	var matrix float64
+	if sideData, ok := stream["side_data_list"].([]interface{}); ok {
+		for _, sd := range sideData {
+			if m, ok := sd.(map[string]interface{}); ok {
+				if rotation, ok := m["rotation"].(float64); ok {
+					matrix = rotation
+					break
+				}
+			}
+		}
+	}
+	var tag string
+	if tags, ok := stream["tags"].(map[string]interface{}); ok {
+		tag, _ = tags["rotate"].(string)
+	}
+	return clockwiseRotation(matrix, tag)
+}
+
+// clockwiseRotation normalizes the counter-clockwise rotation of a display
+// matrix or, when there is none, a clockwise rotate tag to 0, 90, 180 or
+// 270 degrees clockwise.
+func clockwiseRotation(matrix float64, tag string) int {
+	degrees := -matrix
+	if degrees == 0 {
+		degrees, _ = strconv.ParseFloat(tag, 64)
+	}
+	r := int(math.Round(degrees/90)) * 90 % 360
+	if r < 0 {
+		r += 360
+	}
+	return r
+}
+
+// keyframeInterval returns the mean time between the keyframes of the
+// first video stream within its first 60 seconds, reading only packet
+// headers.
+func keyframeInterval(path string) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout())
+	defer cancel()
+	output, err := command(ctx, "ffprobe", "-v", "error", "-select_streams", "v:0",
+		"-read_intervals", "%+60", "-show_entries", "packet=pts_time,flags", "-of", "csv=p=0", path).Output()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return 0, fmt.Errorf("ffprobe timed out after %s while reading keyframes", probeTimeout())
+		}
+		return 0, fmt.Errorf("failed to read keyframes: %w", err)
+	}
+	var times []float64
+	for _, line := range strings.Split(string(output), "\n") {
+		pts, flags, ok := strings.Cut(strings.TrimSpace(line), ",")
+		if !ok || !strings.Contains(flags, "K") {
+			continue
+		}
+		if t, err := strconv.ParseFloat(pts, 64); err == nil {
+			times = append(times, t)
+		}
+	}
+	if len(times) < 2 {
+		return 0, fmt.Errorf("fewer than two keyframes in the first minute")
+	}
+	// Packets are in decoding order; keyframes are decoded in display order.
+	sort.Float64s(times)
+	interval := (times[len(times)-1] - times[0]) / float64(len(times)-1)
+	return math.Round(interval*1000) / 1000, nil
+}
+
 // generateProfiledVideo transcodes a video using a named VideoProfile (width, height, quality, codec).
 func generateProfiledVideo(input *media.Request) error {
 	vp := input.Options.VideoProfile
-	cacheKey := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s_profile_%s", input.OriginalFilePath, vp.Profile))))
-	cacheDir := filepath.Join(input.Origin.Project.CacheDir, "profiles")
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("failed to create profile cache dir: %w", err)
+	cacheKey := input.CacheKey()
+	cacheDir, err := media.CacheShardDir(input.Origin.Project.CacheDir, "profiles", cacheKey)
+	if err != nil {
+		return err
 	}
 	outputPath := filepath.Join(cacheDir, fmt.Sprintf("%s_%s.mp4", cacheKey, vp.Profile))
 
@@ -621,32 +827,63 @@ func generateProfiledVideo(input *media.Request) error {
 	if codec == "" {
 		codec = "libx264"
 	}
-	// Map quality 1-100 → CRF 51-0 (higher quality = lower CRF)
-	crf := 51 - (vp.Quality * 51 / 100)
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-	defer cancel()
+	videoBitrate, audioBitrate, twoPass, err := input.Options.TranscodeSettings()
+	if err != nil {
+		return err
+	}
+	videoArgs := []string{"-c:v", codec}
+	if videoBitrate > 0 {
+		// Peaks are held to the target by a two-second rate control buffer,
+		// so the stream stays under bitrate ceilings.
+		rate := strconv.Itoa(videoBitrate)
+		videoArgs = append(videoArgs, "-b:v", rate, "-maxrate", rate, "-bufsize", strconv.Itoa(2*videoBitrate))
+	} else {
+		// Map quality 1-100 → CRF 51-0 (higher quality = lower CRF)
+		crf := 51 - (vp.Quality * 51 / 100)
+		videoArgs = append(videoArgs, "-crf", strconv.Itoa(crf))
+	}
+	videoArgs = append(videoArgs, "-preset", "fast")
+	if audioBitrate == 0 {
+		audioBitrate = 128_000
+	}
 
 	scaleFilter := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2",
 		vp.Width, vp.Height, vp.Width, vp.Height)
+	rotation, err := videoRotation(input.StagedFilePath)
+	if err != nil {
+		return err
+	}
+	source := []string{"-noautorotate", "-i", input.StagedFilePath, "-vf", uprightFilter(rotation, scaleFilter)}
 
-	cmd := exec.CommandContext(ctx, "ffmpeg",
-		"-i", input.StagedFilePath,
-		"-vf", scaleFilter,
-		"-c:v", codec,
-		"-crf", strconv.Itoa(crf),
-		"-preset", "fast",
+	var passArgs []string
+	if twoPass {
+		// The first pass only analyses the video; its statistics let the
+		// second spend the bitrate where the video needs it.
+		work, err := os.MkdirTemp(cacheDir, cacheKey+"-pass-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(work)
+		passLog := filepath.Join(work, "ffmpeg2pass")
+		args := append(append(append([]string{}, source...), videoArgs...),
+			"-pass", "1", "-passlogfile", passLog, "-an", "-f", "null", "-")
+		if err := transcode(input, vp.Profile+" pass 1", passLog, videoEncodeTimeout(), args...); err != nil {
+			return fmt.Errorf("failed to transcode video with profile %q: %w", vp.Profile, err)
+		}
+		passArgs = []string{"-pass", "2", "-passlogfile", passLog}
+	}
+
+	// The frames are turned upright before scaling and the output carries
+	// no rotation, so players do not turn them again.
+	args := append(append(append(source, videoArgs...), passArgs...),
+		"-metadata:s:v:0", "rotate=0",
 		"-c:a", "aac",
-		"-b:a", "128k",
+		"-b:a", strconv.Itoa(audioBitrate),
 		"-movflags", "+faststart",
 		"-y", outputPath,
 	)
-
-	if err := cmd.Run(); err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("video transcoding timed out for profile %q", vp.Profile)
-		}
-		return fmt.Errorf("failed to transcode video with profile %q: %v", vp.Profile, err)
+	if err := transcode(input, vp.Profile, outputPath, videoEncodeTimeout(), args...); err != nil {
+		return fmt.Errorf("failed to transcode video with profile %q: %w", vp.Profile, err)
 	}
 
 	input.ProcessedFilePath = outputPath
@@ -659,6 +896,10 @@ func processVideo(input *media.Request) error {
 		log.Debug("Starting video processing", "trace_id", input.TraceID, "preview", input.Options.Preview, "thumbnail", input.Options.Thumbnail, "detail", input.Options.Detail)
 	}
 
+	if input.Options.PHash {
+		return generatePHash(input, true)
+	}
+
 	// Check if this is a detail request (JSON metadata output)
 	if input.Options.Detail {
 		if input.Debug {
@@ -698,53 +939,121 @@ func processVideo(input *media.Request) error {
 	return nil
 }
 
-// Video encoders with preview and thumbnail support
+// processVideoFrame serves an image output of a video: a thumbnail, at
+// 720p unless ?thumbnail gives a size.
+func processVideoFrame(input *media.Request) error {
+	if input.Options.PHash {
+		return generatePHash(input, true)
+	}
+	if input.Options.Detail {
+		return generateVideoMetadata(input)
+	}
+	if input.Options.Thumbnail == "" {
+		input.Options.Thumbnail = "720p"
+	}
+	return generateThumbnail(input)
+}
+
+// VideoFrame is wired under the image output keys of every video type. It
+// reads remote sources directly, so a frame never stages the whole video.
+var VideoFrame = media.Encoder{
+	Mime:      "image/jpeg",
+	Processor: processVideoFrame,
+	Input:     "video",
+	Remote:    true,
+}
+
+// sourceArgs returns the ffmpeg/ffprobe input arguments of the request's
+// source, passing the headers a remote source needs.
+func sourceArgs(input *media.Request) []string {
+	if input.SourceURL == "" {
+		return []string{"-i", input.StagedFilePath}
+	}
+	var headers strings.Builder
+	for k, values := range input.SourceHeaders {
+		for _, v := range values {
+			headers.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	args := []string{"-rw_timeout", "30000000"}
+	if headers.Len() > 0 {
+		args = append(args, "-headers", headers.String())
+	}
+	return append(args, "-i", input.SourceURL)
+}
+
+// Video encoders with preview, profile and metadata support, wired under
+// the source's own extension.
 var Mp4 = media.Encoder{
 	Mime:      "video/mp4",
 	Processor: processVideo,
+	Input:     "video",
 }
 
 var Webm = media.Encoder{
 	Mime:      "video/webm",
 	Processor: processVideo,
+	Input:     "video",
 }
 
 var Avi = media.Encoder{
 	Mime:      "video/x-msvideo",
 	Processor: processVideo,
+	Input:     "video",
 }
 
 var Mov = media.Encoder{
 	Mime:      "video/quicktime",
 	Processor: processVideo,
+	Input:     "video",
 }
 
 var Mkv = media.Encoder{
 	Mime:      "video/x-matroska",
 	Processor: processVideo,
+	Input:     "video",
 }
 
 var Flv = media.Encoder{
 	Mime:      "video/x-flv",
 	Processor: processVideo,
+	Input:     "video",
 }
 
 var Wmv = media.Encoder{
 	Mime:      "video/x-ms-wmv",
 	Processor: processVideo,
+	Input:     "video",
 }
 
 var M4v = media.Encoder{
 	Mime:      "video/x-m4v",
 	Processor: processVideo,
+	Input:     "video",
 }
 
 var ThreeGp = media.Encoder{
 	Mime:      "video/3gpp",
 	Processor: processVideo,
+	Input:     "video",
 }
 
 var Ogv = media.Encoder{
 	Mime:      "video/ogg",
 	Processor: processVideo,
+	Input:     "video",
 }
+
+// Direct video encoders serve the source unchanged.
+var (
+	Mp4Direct     = media.Encoder{Mime: "video/mp4"}
+	WebmDirect    = media.Encoder{Mime: "video/webm"}
+	AviDirect     = media.Encoder{Mime: "video/x-msvideo"}
+	MovDirect     = media.Encoder{Mime: "video/quicktime"}
+	MkvDirect     = media.Encoder{Mime: "video/x-matroska"}
+	FlvDirect     = media.Encoder{Mime: "video/x-flv"}
+	WmvDirect     = media.Encoder{Mime: "video/x-ms-wmv"}
+	M4vDirect     = media.Encoder{Mime: "video/x-m4v"}
+	ThreeGpDirect = media.Encoder{Mime: "video/3gpp"}
+	OgvDirect     = media.Encoder{Mime: "video/ogg"}
+)
@@ -0,0 +1,118 @@
+package encoders
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/gpath"
+	"mediax/apps/media"
+)
+
+// Vips converts images with libvips instead of ImageMagick, as a canary of
+// a pipeline migration (MEDIAX.CanaryEncoder=vips). It implements resizing,
+// cropping, quality, format and strip of still images; other requests run
+// ImageMagick.
+var Vips = media.EncoderAlternative{
+	Processor: vipsImage,
+	Supports:  vipsSupports,
+}
+
+// vipsFormats are the formats libvips reads and writes here.
+var vipsFormats = map[string]bool{"jpg": true, "jpeg": true, "png": true, "webp": true, "avif": true}
+
+// vipsMaxSize stands for an unbounded side: vips thumbnail needs a width.
+const vipsMaxSize = "10000000"
+
+// vipsSupports reports whether input asks for nothing but w, h, crop, q, f
+// and strip of a still image in one of vipsFormats, without the project's
+// metadata embedded.
+func vipsSupports(input *media.Request) bool {
+	if input.MediaType == nil || !vipsFormats[input.MediaType.Extension] || animatedFormats[input.MediaType.Extension] {
+		return false
+	}
+	opts := *input.Options
+	if !vipsFormats[strings.ToLower(opts.OutputFormat)] {
+		return false
+	}
+	opts.Width, opts.Height, opts.Quality, opts.OutputFormat, opts.Strip = 0, 0, 0, input.MediaType.Extension, false
+	if !opts.Passthrough(input.MediaType.Extension) {
+		return false
+	}
+	fields, err := input.Origin.Project.ImageMetadataFields()
+	return err == nil && len(fields) == 0
+}
+
+// vipsImage writes the output with vips thumbnail, cached like that of
+// convertImage but under the canary's cache key. Like convert, it keeps
+// the orientation of the pixels.
+func vipsImage(input *media.Request) error {
+	opts := input.Options
+	cacheKey := input.CacheKey()
+	var err error
+	input.ProcessedFilePath, err = media.CachePath(input.Origin.Project.CacheDir, "images", cacheKey, cacheKey+"."+opts.OutputFormat)
+	if err != nil {
+		return err
+	}
+	if gpath.IsFileExist(input.ProcessedFilePath) {
+		return nil
+	}
+
+	width, height := vipsMaxSize, vipsMaxSize
+	if opts.Width > 0 {
+		width = strconv.Itoa(opts.Width)
+	}
+	if opts.Height > 0 {
+		height = strconv.Itoa(opts.Height)
+	}
+	args := []string{"thumbnail", input.StagedFilePath, input.ProcessedFilePath + vipsSaveOptions(opts), width, "--height", height, "--no-rotate"}
+	switch {
+	case opts.Width == 0 && opts.Height == 0:
+		// No resize, only the format, quality or metadata change.
+		args = append(args, "--size", "down")
+	case !opts.KeepAspectRatio && opts.Width > 0 && opts.Height > 0:
+		args = append(args, "--crop", vipsCrop(opts.CropDirection))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), imageConvertTimeout())
+	defer cancel()
+	output, err := command(ctx, "vips", args...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("vips timed out after %s", imageConvertTimeout())
+		}
+		return fmt.Errorf("vips error: %w\noutput: %s", err, truncateOutput(output))
+	}
+	return nil
+}
+
+// vipsSaveOptions returns the save options vips reads from the end of the
+// output file name: quality for lossy formats and strip.
+func vipsSaveOptions(opts *media.Options) string {
+	var options []string
+	if opts.Quality > 0 && strings.ToLower(opts.OutputFormat) != "png" {
+		options = append(options, "Q="+strconv.Itoa(opts.Quality))
+	}
+	if opts.Strip {
+		options = append(options, "strip")
+	}
+	if len(options) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(options, ",") + "]"
+}
+
+// vipsCrop maps a crop direction to the part vips keeps, as getGravity
+// does for ImageMagick: the image is cut along one axis only, so top and
+// left keep the low end, bottom and right the high one.
+func vipsCrop(direction string) string {
+	switch strings.ToLower(direction) {
+	case "top", "left":
+		return "low"
+	case "bottom", "right":
+		return "high"
+	default:
+		return "centre"
+	}
+}
@@ -0,0 +1,87 @@
+package encoders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Watermarker hides a payload in media files and recovers it, for tracing
+// leaked copies back to the request that served them.
+type Watermarker interface {
+	// Supports reports whether files of the MIME type can be watermarked.
+	Supports(mime string) bool
+	// Embed writes the file at input to output, in the same format, with
+	// payload hidden in it.
+	Embed(ctx context.Context, input, output string, payload []byte) error
+	// Extract returns the payload hidden in the file at path, or
+	// ErrNoWatermark.
+	Extract(ctx context.Context, path string) ([]byte, error)
+}
+
+var (
+	watermarkerMu sync.RWMutex
+	watermarker   Watermarker = blockWatermarker{}
+)
+
+// SetWatermarker replaces the watermarker, e.g. from a plugin package with
+// a more robust algorithm or one for video. The default hides payloads in
+// the brightness of image blocks; see blockWatermarker.
+func SetWatermarker(w Watermarker) {
+	watermarkerMu.Lock()
+	defer watermarkerMu.Unlock()
+	watermarker = w
+}
+
+func currentWatermarker() Watermarker {
+	watermarkerMu.RLock()
+	defer watermarkerMu.RUnlock()
+	return watermarker
+}
+
+// ErrNoWatermark is returned by ExtractWatermark for files without a
+// readable watermark.
+var ErrNoWatermark = errors.New("no watermark found")
+
+// ErrImageTooSmall is returned by Watermark for images too small to hold
+// a watermark.
+var ErrImageTooSmall = errors.New("image too small to watermark")
+
+// CanWatermark reports whether outputs of the MIME type can be watermarked.
+func CanWatermark(mime string) bool {
+	return currentWatermarker().Supports(mime)
+}
+
+// Watermark returns a copy of the output at path with payload hidden in it,
+// written next to it for this request only. The caller removes it.
+func Watermark(path string, payload []byte) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "watermark-*"+filepath.Ext(path))
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	output := f.Name()
+	timeout := commandTimeout("WatermarkTimeout", time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := currentWatermarker().Embed(ctx, path, output, payload); err != nil {
+		os.Remove(output)
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("watermarking timed out after %s", timeout)
+		}
+		return "", fmt.Errorf("watermark: %w", err)
+	}
+	return output, nil
+}
+
+// ExtractWatermark returns the payload hidden in the file at path.
+func ExtractWatermark(path string) ([]byte, error) {
+	timeout := commandTimeout("WatermarkTimeout", time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return currentWatermarker().Extract(ctx, path)
+}
@@ -0,0 +1,245 @@
+package encoders
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getevo/evo/v2/lib/settings"
+)
+
+// blockPayloadBits is the size of the message blockWatermarker hides: a
+// payload of 8 bytes followed by its CRC-32.
+const blockPayloadBits = 96
+
+// blockRepeats is how many times the message should fit in an image; block
+// sizes shrink until it does.
+const blockRepeats = 3
+
+// blockSizes are the edges of the blocks tried, largest first. Smaller
+// blocks would not survive JPEG, which works on 8x8 blocks.
+var blockSizes = []int{16, 8}
+
+// blockFormats are the MIME types blockWatermarker embeds in. Palette
+// formats (GIF) would lose the small brightness shifts.
+var blockFormats = map[string]bool{"image/jpeg": true, "image/png": true, "image/webp": true, "image/avif": true}
+
+// blockWatermarker is the default Watermarker. It cuts the image into square
+// blocks, each carrying one bit of the message in turn, and shifts the mean
+// brightness of every block onto one of two interleaved lattices of step
+// MEDIAX.WatermarkStrength (default 8 of 255 levels): multiples of the step
+// for 0, odd half-steps for 1. Extraction reads the lattice each block is
+// nearest to and takes a weighted vote over the copies of every bit.
+//
+// The mark survives re-encoding and format changes, but not resizing,
+// cropping or rotation, which move the block grid.
+type blockWatermarker struct{}
+
+func (blockWatermarker) Supports(mime string) bool {
+	return blockFormats[mime]
+}
+
+func (blockWatermarker) Embed(ctx context.Context, input, output string, payload []byte) error {
+	if len(payload) != 8 {
+		return fmt.Errorf("payload of %d bytes: expected 8", len(payload))
+	}
+	frames, err := countFrames(input)
+	if err != nil {
+		return err
+	}
+	if frames > 1 {
+		return errors.New("animated images cannot be watermarked")
+	}
+	img, err := readPixels(ctx, input)
+	if err != nil {
+		return err
+	}
+	if err := img.embed(payload, watermarkStrength()); err != nil {
+		return err
+	}
+	return img.write(ctx, input, output)
+}
+
+func (blockWatermarker) Extract(ctx context.Context, path string) ([]byte, error) {
+	img, err := readPixels(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return img.extract(watermarkStrength())
+}
+
+// watermarkStrength returns the lattice step of MEDIAX.WatermarkStrength,
+// between 2 and 32 levels.
+func watermarkStrength() float64 {
+	return float64(min(max(settings.Get("MEDIAX.WatermarkStrength", 8).Int(), 2), 32))
+}
+
+// blockSize returns the largest block edge at which the message fits
+// blockRepeats times in a width x height image, failing that once, or 0.
+func blockSize(width, height int) int {
+	for _, repeats := range []int{blockRepeats, 1} {
+		for _, size := range blockSizes {
+			if (width/size)*(height/size) >= repeats*blockPayloadBits {
+				return size
+			}
+		}
+	}
+	return 0
+}
+
+// pixels are the 8-bit samples of an image, RGB or RGBA row by row.
+type pixels struct {
+	width, height, channels int
+	data                    []byte
+}
+
+// block is the top-left corner and edge of a square block of pixels.
+type block struct{ x, y, size int }
+
+// readPixels decodes the first frame of the image at path as 8-bit RGB, or
+// RGBA when it has transparency.
+func readPixels(ctx context.Context, path string) (*pixels, error) {
+	out, err := command(ctx, "identify", "-ping", "-format", "%w %h %A", path+"[0]").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("identify error: %w\noutput: %s", err, truncateOutput(out))
+	}
+	img := &pixels{channels: 3}
+	var alpha string
+	if _, err := fmt.Sscanf(string(out), "%d %d %s", &img.width, &img.height, &alpha); err != nil || img.width <= 0 || img.height <= 0 {
+		return nil, fmt.Errorf("cannot read image dimensions: %q", truncateOutput(out))
+	}
+	format := "rgb"
+	if !strings.EqualFold(alpha, "False") && !strings.EqualFold(alpha, "Undefined") {
+		img.channels, format = 4, "rgba"
+	}
+	img.data, err = command(ctx, "convert", path+"[0]", "-depth", "8", format+":-").Output()
+	if err != nil {
+		return nil, fmt.Errorf("convert error: %w", err)
+	}
+	if len(img.data) != img.width*img.height*img.channels {
+		return nil, fmt.Errorf("convert returned %d bytes of pixels, expected %d", len(img.data), img.width*img.height*img.channels)
+	}
+	return img, nil
+}
+
+// embed hides payload and its CRC-32 in the blocks of img, on lattices of
+// the given step.
+func (img *pixels) embed(payload []byte, step float64) error {
+	size := blockSize(img.width, img.height)
+	if size == 0 {
+		return ErrImageTooSmall // below about 80x80 pixels
+	}
+	message := binary.BigEndian.AppendUint32(payload, crc32.ChecksumIEEE(payload))
+	for i, b := range img.blocks(size) {
+		j := i % blockPayloadBits
+		bit := float64(message[j/8] >> (7 - j%8) & 1)
+		mean := img.meanLuma(b)
+		target := math.Round((mean-bit*step/2)/step)*step + bit*step/2
+		if target < 0 {
+			target += step
+		} else if target > 255 {
+			target -= step
+		}
+		img.shift(b, int(math.Round(target-mean)))
+	}
+	return nil
+}
+
+// extract returns the payload embed hid in img, or ErrNoWatermark when its
+// CRC-32 does not match.
+func (img *pixels) extract(step float64) ([]byte, error) {
+	size := blockSize(img.width, img.height)
+	if size == 0 {
+		return nil, ErrNoWatermark
+	}
+	var votes [blockPayloadBits]float64
+	for i, b := range img.blocks(size) {
+		r := math.Mod(img.meanLuma(b), step)
+		toZero := math.Min(r, step-r)
+		toOne := math.Abs(r - step/2)
+		votes[i%blockPayloadBits] += toZero - toOne
+	}
+	message := make([]byte, blockPayloadBits/8)
+	for i, v := range votes {
+		if v > 0 {
+			message[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	payload, sum := message[:8], message[8:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(sum) {
+		return nil, ErrNoWatermark
+	}
+	return payload, nil
+}
+
+// blocks returns the whole blocks of edge size, row by row.
+func (img *pixels) blocks(size int) []block {
+	var blocks []block
+	for y := 0; y+size <= img.height; y += size {
+		for x := 0; x+size <= img.width; x += size {
+			blocks = append(blocks, block{x, y, size})
+		}
+	}
+	return blocks
+}
+
+// meanLuma returns the mean brightness (Rec. 601 luma) of b.
+func (img *pixels) meanLuma(b block) float64 {
+	var sum float64
+	for y := b.y; y < b.y+b.size; y++ {
+		row := img.data[(y*img.width+b.x)*img.channels:]
+		for x := 0; x < b.size; x++ {
+			p := row[x*img.channels:]
+			sum += 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		}
+	}
+	return sum / float64(b.size*b.size)
+}
+
+// shift adds delta to the colour samples of b, which shifts its brightness
+// by delta without changing its hue.
+func (img *pixels) shift(b block, delta int) {
+	if delta == 0 {
+		return
+	}
+	for y := b.y; y < b.y+b.size; y++ {
+		row := img.data[(y*img.width+b.x)*img.channels:]
+		for x := 0; x < b.size; x++ {
+			p := row[x*img.channels:]
+			for c := range 3 {
+				p[c] = byte(min(max(int(p[c])+delta, 0), 255))
+			}
+		}
+	}
+}
+
+// write writes the pixels to output, copying them onto the image at source
+// so the output keeps its format, quality, profiles and metadata.
+func (img *pixels) write(ctx context.Context, source, output string) error {
+	raw, err := os.CreateTemp(filepath.Dir(output), "pixels-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(raw.Name())
+	_, err = raw.Write(img.data)
+	if closeErr := raw.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	format := map[int]string{3: "rgb", 4: "rgba"}[img.channels]
+	out, err := command(ctx, "convert", source+"[0]",
+		"(", "-size", fmt.Sprintf("%dx%d", img.width, img.height), "-depth", "8", format+":"+raw.Name(), ")",
+		"-compose", "Copy", "-composite", output).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("convert error: %w\noutput: %s", err, truncateOutput(out))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package encoders
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"mediax/apps/media"
+)
+
+// xmpArrays are the XMP properties whose value is an array, by array type.
+// Their value is written as its single item; language alternatives as the
+// x-default one.
+var xmpArrays = map[string]string{
+	"dc:creator":                        "Seq",
+	"dc:rights":                         "Alt",
+	"dc:title":                          "Alt",
+	"dc:description":                    "Alt",
+	"dc:subject":                        "Bag",
+	"xmpRights:Owner":                   "Bag",
+	"xmpRights:UsageTerms":              "Alt",
+	"photoshop:SupplementalCategories":  "Bag",
+	"Iptc4xmpCore:Scene":                "Bag",
+	"Iptc4xmpCore:SubjectCode":          "Bag",
+	"Iptc4xmpCore:AltTextAccessibility": "Alt",
+}
+
+// xmpPacket returns the XMP packet holding fields.
+func xmpPacket(fields []media.MetadataField) []byte {
+	var prefixes []string
+	for _, f := range fields {
+		prefix, _, _ := strings.Cut(f.Name, ":")
+		if !slices.Contains(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	slices.Sort(prefixes)
+
+	var b bytes.Buffer
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"")
+	for _, prefix := range prefixes {
+		b.WriteString("\n    xmlns:" + prefix + "=\"" + media.XMPNamespaces[prefix] + "\"")
+	}
+	b.WriteString(">\n")
+	for _, f := range fields {
+		var value bytes.Buffer
+		xml.EscapeText(&value, []byte(f.Value)) //nolint:errcheck
+		switch kind := xmpArrays[f.Name]; kind {
+		case "":
+			b.WriteString("   <" + f.Name + ">" + value.String() + "</" + f.Name + ">\n")
+		case "Alt":
+			b.WriteString("   <" + f.Name + "><rdf:Alt><rdf:li xml:lang=\"x-default\">" + value.String() + "</rdf:li></rdf:Alt></" + f.Name + ">\n")
+		default:
+			b.WriteString("   <" + f.Name + "><rdf:" + kind + "><rdf:li>" + value.String() + "</rdf:li></rdf:" + kind + "></" + f.Name + ">\n")
+		}
+	}
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return b.Bytes()
+}
+
+// embedMetadataArgs writes the XMP packet of the project's image metadata
+// next to output and returns the ImageMagick arguments embedding it, with
+// a cleanup removing the packet once the output is written. It returns no
+// arguments for projects without image metadata.
+func embedMetadataArgs(fields []media.MetadataField, output string) ([]string, func(), error) {
+	if len(fields) == 0 {
+		return nil, func() {}, nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(output), filepath.Base(output)+"-*.xmp")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+	_, err = f.Write(xmpPacket(fields))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	// The packet replaces the XMP of the source, if any.
+	return []string{"-profile", "xmp:" + f.Name()}, cleanup, nil
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/getevo/evo/v2/lib/application"
 	"github.com/getevo/restify"
 	"mediax/apps/mediax"
+	"os"
 	"time"
 )
 
@@ -25,6 +26,12 @@ func main() {
 		time.Sleep(wait)
 	}
 
+	// CLI subcommands (mediax convert, prewarm, purge, validate-config) run
+	// the pipeline once and exit without starting the HTTP server.
+	if len(os.Args) > 1 && mediax.IsCommand(os.Args[1]) {
+		os.Exit(mediax.RunCommand(os.Args[1:]))
+	}
+
 	var apps = application.GetInstance()
 	// Register all application modules
 	apps.Register( // Authentication follows
@@ -0,0 +1,417 @@
+// Package mediaurl maps transformation options onto MediaX query strings and
+// signs them. The server snaps sizes and qualities and verifies signatures
+// with the same code, so URLs built here hit the same cache entries as the
+// server would produce for them.
+package mediaurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxDimension is the largest width or height a client may request.
+// Prevents runaway ImageMagick memory allocations on malicious inputs (#9).
+const MaxDimension = 7680 // 8K UHD
+
+// MinDPI and MaxDPI bound the dpi of print output. At 1200 DPI an A4 page
+// is rasterized to about 10000 x 14000 pixels.
+const (
+	MinDPI = 72
+	MaxDPI = 1200
+)
+
+var (
+	// Sizes are the widths and heights requests are snapped down to.
+	Sizes = []int{
+		3840, // 4K UHD
+		2560, // QHD (1440p)
+		1920, // Full HD (1080p)
+		1600, // HD+ / UXGA
+		1280, // HD (720p)
+		1024,
+		960, // SD+
+		854, // 480p (16:9)
+		800, // SVGA
+		720, // HD (alternative)
+		640, // VGA
+		512,
+		480, // nHD
+		360, // LD
+		320, // QVGA
+		240, // QQVGA
+		160, // HQVGA
+		128, // Tiny thumbnails
+		96,  // Very small
+		64,  // Icons
+		32,  // Very small icons
+	}
+
+	// Qualities are the quality levels requests are snapped down to.
+	Qualities = []int{
+		100,
+		90,
+		85,
+		80,
+		75,
+		60,
+		50,
+	}
+)
+
+var (
+	// ErrInvalidSignature is returned by Verify for missing or wrong signatures.
+	ErrInvalidSignature = errors.New("invalid url signature")
+	// ErrExpired is returned by Verify for signed URLs past their expires time.
+	ErrExpired = errors.New("url signature expired")
+)
+
+// TilePattern matches a Deep Zoom tile address: level/col_row.
+var TilePattern = regexp.MustCompile(`^\d{1,2}/\d{1,6}_\d{1,6}$`)
+
+// LangPattern matches the Tesseract languages of ocr: names such as eng or
+// chi_sim, joined by '+'.
+var LangPattern = regexp.MustCompile(`^[a-zA-Z_]{2,30}(\+[a-zA-Z_]{2,30}){0,4}$`)
+
+// PagesPattern matches a page selection: page numbers and ranges such as
+// 1-3,5.
+var PagesPattern = regexp.MustCompile(`^\d{1,5}(-\d{1,5})?(,\d{1,5}(-\d{1,5})?){0,49}$`)
+
+// BitratePattern matches a bitrate of vb and ab: a number of bits per
+// second with an optional k or M suffix, such as 2500k.
+var BitratePattern = regexp.MustCompile(`^\d{1,9}(\.\d{1,3})?[kKmM]?$`)
+
+// TiffCompressions are the compression values of TIFF output.
+var TiffCompressions = map[string]bool{"g4": true, "lzw": true, "none": true}
+
+// ColorPattern matches a colour accepted by bg_remove: an ImageMagick colour
+// name or a hex colour, with or without the leading '#'.
+var ColorPattern = regexp.MustCompile(`^([a-zA-Z]{3,20}|#?[0-9a-fA-F]{6}|#?[0-9a-fA-F]{8}|#[0-9a-fA-F]{3})$`)
+
+// Snap returns the largest value in values that is ≤ in.
+// values must be sorted descending (largest first).
+// Values larger than values[0] are clamped to values[0].
+// Values smaller than values[len-1] are clamped to values[len-1].
+func Snap(in int, values []int) int {
+	if len(values) == 0 {
+		return in
+	}
+	for _, v := range values {
+		if in >= v {
+			return v
+		}
+	}
+	return values[len(values)-1]
+}
+
+// Options describes a transformation. Zero values are omitted from the URL,
+// so the server applies its defaults.
+type Options struct {
+	Width      int
+	Height     int
+	Quality    int
+	Format     string // output format, e.g. "webp"; defaults to the source format
+	Crop       bool   // crop to Width x Height instead of keeping the aspect ratio
+	Ratio      string // aspect ratio, e.g. "16:9", deriving the missing one of Width and Height
+	Pad        bool   // letterbox into Width x Height instead of cropping
+	Fit        bool   // fit inside Width x Height, keeping the aspect ratio, instead of cropping
+	Scale      int    // percentage (1-100) of the source dimensions, instead of Width and Height
+	Direction  string // crop direction: top, bottom, left, right
+	Preview    string // video preview: "true", "480p", "720p", "1080p", "4k" or WxH
+	Thumbnail  string // thumbnail size, e.g. "720p" or "800x600"
+	SS         int    // thumbnail timestamp in seconds
+	Profile    string // video profile name
+	Detail     bool   // return JSON metadata instead of the file
+	Loudness   bool   // with Detail, measure the loudness of audio
+	PHash      bool   // return the perceptual hash of an image or video as JSON
+	OCR        bool   // return the text of an image or PDF as JSON
+	Lang       string // Tesseract languages for OCR, e.g. "eng+deu"
+	Download   bool   // serve as an attachment
+	DZI        bool   // return the Deep Zoom descriptor
+	Tile       string // Deep Zoom tile address "level/col_row"
+	Frame      int    // single frame (1-based) of an animated image
+	Strip      bool   // remove EXIF and other metadata from images
+	DPI        int    // resolution of print output: image metadata and PDF rasterization
+	MaxBytes   int64  // largest size in bytes of a lossy image output; the quality is lowered to fit
+	Trim       bool   // remove uniform borders from images before resizing
+	BgRemove   string // colour of the background made transparent, e.g. "white" or "#f0f0f0"
+	Fuzz       int    // colour distance in percent for Trim and BgRemove; 0 uses the default
+	Cutout     bool   // remove the background with the background removal service (bg=remove)
+	Flatten    bool   // render PDF annotations and form fields into the pages
+	Attachment int    // single attachment (1-based) of an email message
+	Chapter    int    // single chapter (1-based) of an audiobook
+
+	// Pages selects pages of a PDF or TIFF converted to TIFF or PDF, e.g.
+	// "1-3,5"; Compression is the TIFF compression: g4, lzw or none.
+	Pages       string
+	Compression string
+	// VideoBitrate and AudioBitrate ("2500k", "128k") and TwoPass control
+	// the encoding of a Profile transcode.
+	VideoBitrate string
+	AudioBitrate string
+	TwoPass      bool
+	// HLS asks for the HTTP Live Streaming playlist of audio, and with
+	// Segment (1-based) for one of its segments.
+	HLS     bool
+	Segment int
+	// Filename is the name a browser saves the file as, and Disposition
+	// ("inline" or "attachment") how it presents it.
+	Filename    string
+	Disposition string
+	// Raw asks for the original object unchanged; the server ignores every
+	// other option, so Query leaves them out.
+	Raw bool
+	// User is recorded as the recipient of forensic watermarks on projects
+	// that embed them; sign the URL so it cannot be changed.
+	User string
+	// Expires limits the lifetime of a signed URL. Ignored for unsigned URLs.
+	Expires time.Time
+}
+
+// Validate reports option values the server would reject.
+func (o Options) Validate() error {
+	if o.Width < 0 || o.Width > MaxDimension {
+		return fmt.Errorf("width %d out of range 0-%d", o.Width, MaxDimension)
+	}
+	if o.Height < 0 || o.Height > MaxDimension {
+		return fmt.Errorf("height %d out of range 0-%d", o.Height, MaxDimension)
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		return fmt.Errorf("quality %d out of range 1-100", o.Quality)
+	}
+	if o.SS < 0 {
+		return fmt.Errorf("invalid thumbnail timestamp %d", o.SS)
+	}
+	if o.Frame < 0 {
+		return fmt.Errorf("invalid frame %d", o.Frame)
+	}
+	if o.Attachment < 0 {
+		return fmt.Errorf("invalid attachment %d", o.Attachment)
+	}
+	if o.Tile != "" && !TilePattern.MatchString(o.Tile) {
+		return fmt.Errorf("invalid tile %q: expected level/col_row", o.Tile)
+	}
+	if o.BgRemove != "" && !ColorPattern.MatchString(o.BgRemove) {
+		return fmt.Errorf("invalid bg_remove colour %q", o.BgRemove)
+	}
+	if o.DPI != 0 && (o.DPI < MinDPI || o.DPI > MaxDPI) {
+		return fmt.Errorf("dpi %d out of range %d-%d", o.DPI, MinDPI, MaxDPI)
+	}
+	if o.MaxBytes < 0 || o.MaxBytes > 0 && o.MaxBytes < 1024 {
+		return fmt.Errorf("maxbytes %d below 1024", o.MaxBytes)
+	}
+	if o.Pages != "" && !PagesPattern.MatchString(o.Pages) {
+		return fmt.Errorf("invalid pages %q", o.Pages)
+	}
+	if o.Compression != "" && !TiffCompressions[o.Compression] {
+		return fmt.Errorf("invalid compression %q", o.Compression)
+	}
+	if o.VideoBitrate != "" && !BitratePattern.MatchString(o.VideoBitrate) {
+		return fmt.Errorf("invalid video bitrate %q", o.VideoBitrate)
+	}
+	if o.AudioBitrate != "" && !BitratePattern.MatchString(o.AudioBitrate) {
+		return fmt.Errorf("invalid audio bitrate %q", o.AudioBitrate)
+	}
+	if (o.VideoBitrate != "" || o.AudioBitrate != "" || o.TwoPass) && o.Profile == "" {
+		return errors.New("video and audio bitrates and two-pass need a profile")
+	}
+	if o.Segment < 0 || o.Segment > 0 && !o.HLS {
+		return fmt.Errorf("invalid segment %d: segments are numbered from 1 and need HLS", o.Segment)
+	}
+	switch o.Disposition {
+	case "", "inline", "attachment":
+	default:
+		return fmt.Errorf("invalid disposition %q", o.Disposition)
+	}
+	if len(o.User) > 255 {
+		return fmt.Errorf("user of %d bytes: at most 255", len(o.User))
+	}
+	if strings.ContainsAny(o.Filename, "/\\") || len(o.Filename) > 255 {
+		return fmt.Errorf("invalid filename %q", o.Filename)
+	}
+	if o.Fuzz < 0 || o.Fuzz > 100 {
+		return fmt.Errorf("fuzz %d out of range 0-100", o.Fuzz)
+	}
+	switch o.Direction {
+	case "", "top", "bottom", "left", "right", "center":
+	default:
+		return fmt.Errorf("invalid crop direction %q", o.Direction)
+	}
+	return nil
+}
+
+// Normalize returns o with width, height and quality snapped the way the
+// server snaps them, and the format lower-cased.
+func (o Options) Normalize() Options {
+	if o.Width > 0 {
+		o.Width = Snap(o.Width, Sizes)
+	}
+	if o.Height > 0 {
+		o.Height = Snap(o.Height, Sizes)
+	}
+	if o.Quality > 0 {
+		o.Quality = Snap(o.Quality, Qualities)
+	}
+	o.Format = strings.ToLower(o.Format)
+	return o
+}
+
+// Query returns the canonical query parameters of the normalized options.
+func (o Options) Query() url.Values {
+	if o.Raw {
+		return url.Values{"raw": {"true"}}
+	}
+	o = o.Normalize()
+	q := url.Values{}
+	setInt := func(k string, v int) {
+		if v > 0 {
+			q.Set(k, strconv.Itoa(v))
+		}
+	}
+	setStr := func(k, v string) {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	setBool := func(k string, v bool) {
+		if v {
+			q.Set(k, "true")
+		}
+	}
+	setInt("w", o.Width)
+	setInt("h", o.Height)
+	setInt("q", o.Quality)
+	setStr("f", o.Format)
+	setBool("crop", o.Crop)
+	setStr("ar", o.Ratio)
+	setBool("pad", o.Pad)
+	setBool("fit", o.Fit)
+	setInt("scale", o.Scale)
+	setStr("dir", o.Direction)
+	setStr("preview", o.Preview)
+	setStr("thumbnail", o.Thumbnail)
+	setInt("ss", o.SS)
+	setStr("profile", o.Profile)
+	setStr("vb", o.VideoBitrate)
+	setStr("ab", o.AudioBitrate)
+	setBool("twopass", o.TwoPass)
+	setBool("detail", o.Detail)
+	setBool("loudness", o.Loudness)
+	setBool("phash", o.PHash)
+	setBool("ocr", o.OCR)
+	setStr("lang", o.Lang)
+	setBool("download", o.Download)
+	setStr("disposition", o.Disposition)
+	setStr("filename", o.Filename)
+	setBool("dzi", o.DZI)
+	setStr("tile", o.Tile)
+	setInt("frame", o.Frame)
+	setBool("strip", o.Strip)
+	setInt("dpi", o.DPI)
+	if o.MaxBytes > 0 {
+		q.Set("maxbytes", strconv.FormatInt(o.MaxBytes, 10))
+	}
+	setBool("trim", o.Trim)
+	setStr("bg_remove", o.BgRemove)
+	setInt("fuzz", o.Fuzz)
+	if o.Cutout {
+		q.Set("bg", "remove")
+	}
+	setBool("flatten", o.Flatten)
+	setInt("attachment", o.Attachment)
+	setStr("pages", o.Pages)
+	setStr("compression", o.Compression)
+	setInt("chapter", o.Chapter)
+	setBool("hls", o.HLS)
+	setInt("segment", o.Segment)
+	setStr("uid", o.User)
+	return q
+}
+
+// Build returns base (scheme, host and optional prefix path) joined with
+// path and the query of o. With a key the URL carries an s= signature, and
+// expires= when o.Expires is set.
+func Build(base, path string, o Options, key string) (string, error) {
+	if err := o.Validate(); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid base url: %w", err)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + strings.TrimLeft(path, "/")
+	u.RawPath, u.Fragment = "", ""
+	query := o.Query()
+	if key != "" {
+		if !o.Expires.IsZero() {
+			query.Set("expires", strconv.FormatInt(o.Expires.Unix(), 10))
+		}
+		query.Set("s", Sign(key, u.Path, query))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// ZipPath and ListPath are the paths of the ZIP and directory listing
+// endpoints, served on every media host. Listing URLs are signed with Sign.
+const (
+	ZipPath  = "/zip"
+	ListPath = "/list"
+)
+
+// SignZip returns the query for POST ZipPath with the JSON manifest body on
+// an origin with a signing key: the sha256= of the body, expires= unless
+// expires is zero, and the s= signature of both.
+func SignZip(key string, body []byte, expires time.Time) url.Values {
+	sum := sha256.Sum256(body)
+	query := url.Values{}
+	query.Set("sha256", hex.EncodeToString(sum[:]))
+	if !expires.IsZero() {
+		query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	}
+	query.Set("s", Sign(key, ZipPath, query))
+	return query
+}
+
+// Sign returns the s= signature of path with query (any s= in query is
+// ignored): the unpadded URL-safe base64 HMAC-SHA256 of path, "?" and the
+// query sorted by key.
+func Sign(key, path string, query url.Values) string {
+	return base64.RawURLEncoding.EncodeToString(signature(key, path, query))
+}
+
+// Verify checks the s= parameter of query against path, and the expires=
+// parameter against now when present.
+func Verify(key, path string, query url.Values, now time.Time) error {
+	given, err := base64.RawURLEncoding.DecodeString(query.Get("s"))
+	if err != nil || len(given) == 0 || !hmac.Equal(given, signature(key, path, query)) {
+		return ErrInvalidSignature
+	}
+	if exp := query.Get("expires"); exp != "" {
+		ts, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil || now.Unix() > ts {
+			return ErrExpired
+		}
+	}
+	return nil
+}
+
+func signature(key, path string, query url.Values) []byte {
+	unsigned := url.Values{}
+	for k, v := range query {
+		if k != "s" {
+			unsigned[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(path + "?" + unsigned.Encode()))
+	return mac.Sum(nil)
+}
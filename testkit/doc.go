@@ -0,0 +1,23 @@
+// Package testkit is a harness for end-to-end tests of storages, staging and
+// encoders without external services:
+//
+//   - MemFS is an in-memory filesystem.Interface to use as a Storage backend;
+//   - S3Stub is an httptest S3 endpoint the real s3 storage can talk to;
+//   - NewOrigin and Process run a file through staging and the encoder the
+//     server would pick for a query, with the origin's default and forced
+//     options applied;
+//   - Golden compares outputs with files under testdata/golden, rewritten
+//     when MEDIAX_UPDATE_GOLDEN=1.
+//
+// A test that converts an image through an S3 storage:
+//
+//	stub := testkit.NewS3Stub(t, "media")
+//	stub.Put("photos/cat.jpg", catJPEG)
+//	origin := testkit.NewOrigin(t, testkit.S3Storage(t, stub))
+//	req, err := testkit.Process(t, origin, "photos/cat.jpg", "w=320&f=webp")
+//	...
+//	testkit.Golden(t, "cat-320.webp", testkit.Output(t, req))
+//
+// Encoders shell out to ffmpeg, ImageMagick and friends; tests needing one
+// should call RequireCommand so they skip where it is not installed.
+package testkit
@@ -0,0 +1,48 @@
+package testkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// GoldenDir holds golden files, relative to the test's package directory.
+var GoldenDir = filepath.Join("testdata", "golden")
+
+// Golden compares got with GoldenDir/name. With MEDIAX_UPDATE_GOLDEN=1 it
+// writes got instead, so an intended change is recorded by rerunning the
+// tests and reviewing the diff.
+func Golden(t testing.TB, name string, got []byte) {
+	t.Helper()
+	file := filepath.Join(GoldenDir, name)
+	if os.Getenv("MEDIAX_UPDATE_GOLDEN") == "1" {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("read golden %s: %v (run with MEDIAX_UPDATE_GOLDEN=1 to create it)", name, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from golden: got %d bytes, want %d", name, len(got), len(want))
+	}
+}
+
+// GoldenJSON compares v, marshalled as indented JSON, with GoldenDir/name.
+// Use it for metadata and detail output, which is stable across tool
+// versions where encoded bytes are not.
+func GoldenJSON(t testing.TB, name string, v any) {
+	t.Helper()
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Golden(t, name, append(data, '\n'))
+}
@@ -0,0 +1,208 @@
+package testkit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is an in-memory filesystem.Interface. Paths are slash-separated and
+// relative to its root; directories exist implicitly.
+type MemFS struct {
+	mu    sync.RWMutex
+	files map[string]memFile
+}
+
+type memFile struct {
+	data []byte
+	mod  time.Time
+}
+
+// NewMemFS returns a MemFS holding files, keyed by path.
+func NewMemFS(files map[string][]byte) *MemFS {
+	m := &MemFS{files: map[string]memFile{}}
+	for p, data := range files {
+		m.Write(p, data) //nolint:errcheck
+	}
+	return m
+}
+
+func clean(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+}
+
+func (m *MemFS) Setup(string) error { return nil }
+
+func (m *MemFS) Touch(p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.files[clean(p)]
+	f.mod = time.Now()
+	m.files[clean(p)] = f
+	return nil
+}
+
+func (m *MemFS) Delete(p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[clean(p)]; !ok {
+		return fmt.Errorf("delete %s: %w", p, fs.ErrNotExist)
+	}
+	delete(m.files, clean(p))
+	return nil
+}
+
+// List returns the names of the files and directories directly below p.
+func (m *MemFS) List(p string) ([]string, error) {
+	prefix := clean(p)
+	if prefix != "" {
+		prefix += "/"
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	seen := map[string]bool{}
+	for name := range m.files {
+		if rest, ok := strings.CutPrefix(name, prefix); ok {
+			first, _, _ := strings.Cut(rest, "/")
+			seen[first] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *MemFS) Walk(p string, fn func(path string, info fs.FileInfo, err error) error) error {
+	prefix := clean(p)
+	m.mu.RLock()
+	var names []string
+	for name := range m.files {
+		if prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/") {
+			names = append(names, name)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		info, err := m.Stat(name)
+		if err := fn(name, info, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Read(p string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[clean(p)]
+	if !ok {
+		return nil, fmt.Errorf("read %s: %w", p, fs.ErrNotExist)
+	}
+	return bytes.Clone(f.data), nil
+}
+
+func (m *MemFS) IsDir(p string) (bool, error) {
+	names, _ := m.List(p)
+	isFile, _ := m.IsFile(p)
+	return len(names) > 0 && !isFile, nil
+}
+
+func (m *MemFS) IsFile(p string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.files[clean(p)]
+	return ok, nil
+}
+
+func (m *MemFS) Mkdir(string) error { return nil }
+
+func (m *MemFS) Write(p string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[clean(p)] = memFile{data: bytes.Clone(data), mod: time.Now()}
+	return nil
+}
+
+func (m *MemFS) WriteBuffer(p string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return m.Write(p, data)
+}
+
+func (m *MemFS) Exists(p string) (bool, error) {
+	if ok, _ := m.IsFile(p); ok {
+		return true, nil
+	}
+	return m.IsDir(p)
+}
+
+func (m *MemFS) Stat(p string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[clean(p)]
+	if !ok {
+		return nil, fmt.Errorf("stat %s: %w", p, fs.ErrNotExist)
+	}
+	return memInfo{name: path.Base(clean(p)), size: int64(len(f.data)), mod: f.mod}, nil
+}
+
+func (m *MemFS) Copy(src, dst string) error {
+	data, err := m.Read(src)
+	if err != nil {
+		return err
+	}
+	return m.Write(dst, data)
+}
+
+func (m *MemFS) Move(src, dst string) error {
+	if err := m.Copy(src, dst); err != nil {
+		return err
+	}
+	return m.Delete(src)
+}
+
+func (m *MemFS) DiskToStorage(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return m.Write(dst, data)
+}
+
+func (m *MemFS) StorageToDisk(src, dst string) error {
+	data, err := m.Read(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}
+
+type memInfo struct {
+	name string
+	size int64
+	mod  time.Time
+}
+
+func (fi memInfo) Name() string       { return fi.name }
+func (fi memInfo) Size() int64        { return fi.size }
+func (fi memInfo) Mode() fs.FileMode  { return 0444 }
+func (fi memInfo) ModTime() time.Time { return fi.mod }
+func (fi memInfo) IsDir() bool        { return false }
+func (fi memInfo) Sys() any           { return nil }
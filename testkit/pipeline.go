@@ -0,0 +1,101 @@
+package testkit
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/getevo/filesystem"
+	"mediax/apps/media"
+	"mediax/apps/mediax"
+)
+
+// S3Storage returns an s3 storage connected to stub.
+func S3Storage(t testing.TB, stub *S3Stub) *media.Storage {
+	t.Helper()
+	s := &media.Storage{Type: "s3", ConfigString: stub.ConfigString()}
+	if err := s.Init(); err != nil {
+		t.Fatalf("connect s3 stub: %v", err)
+	}
+	return s
+}
+
+// Storage returns a storage backed by fs, e.g. a MemFS.
+func Storage(fs filesystem.Interface) *media.Storage {
+	return &media.Storage{Type: "mem", FS: fs}
+}
+
+// NewOrigin returns an origin serving storages in order, with its project
+// cache in a temporary directory of the test.
+func NewOrigin(t testing.TB, storages ...*media.Storage) *media.Origin {
+	t.Helper()
+	project := &media.Project{Name: "testkit", CacheDir: t.TempDir()}
+	return &media.Origin{Project: project, Storages: storages}
+}
+
+// Process stages path from origin and runs the encoder query selects, like
+// a request for path?query would: options go through mediax.ParseOptions, so
+// the origin's default and forced options and allow lists apply and requests
+// for the unmodified file run no encoder. The result is in
+// req.ProcessedFilePath, or req.StagedFilePath when no encoder ran; see
+// Output.
+func Process(t testing.TB, origin *media.Origin, path, query string) (*media.Request, error) {
+	t.Helper()
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	mediaType, ok := mediax.MediaTypes[extension]
+	if !ok {
+		return nil, fmt.Errorf("unsupported media type: %s", extension)
+	}
+	options, err := mediax.ParseOptions(mediaType, media.QueryValues(values), origin)
+	if err != nil {
+		return nil, err
+	}
+	req := &media.Request{
+		Origin:           origin,
+		Extension:        extension,
+		MediaType:        mediaType,
+		Options:          options,
+		OriginalFilePath: path,
+	}
+	if err := req.StageFile(); err != nil {
+		return req, err
+	}
+	if options.Encoder != nil && options.Encoder.Processor != nil {
+		if err := options.Encoder.Processor(req); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// Output returns the bytes a processed request would serve.
+func Output(t testing.TB, req *media.Request) []byte {
+	t.Helper()
+	file := req.ProcessedFilePath
+	if file == "" {
+		file = req.StagedFilePath
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	return data
+}
+
+// RequireCommand skips the test unless every named binary is on PATH.
+func RequireCommand(t testing.TB, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not installed", name)
+		}
+	}
+}
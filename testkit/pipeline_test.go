@@ -0,0 +1,118 @@
+package testkit_test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mediax/apps/media"
+	"mediax/testkit"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Requests without options serve the original and run no encoder.
+func TestProcessPassthrough(t *testing.T) {
+	fs := testkit.NewMemFS(map[string][]byte{"photos/cat.jpg": readFixture(t, "cat.jpg")})
+	origin := testkit.NewOrigin(t, testkit.Storage(fs))
+	req, err := testkit.Process(t, origin, "photos/cat.jpg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ProcessedFilePath != "" {
+		t.Fatalf("passthrough ran an encoder: %s", req.ProcessedFilePath)
+	}
+	testkit.Golden(t, "cat.jpg", testkit.Output(t, req))
+}
+
+func TestProcessS3(t *testing.T) {
+	cat := readFixture(t, "cat.jpg")
+	stub := testkit.NewS3Stub(t, "media")
+	stub.Put("photos/cat.jpg", cat)
+	origin := testkit.NewOrigin(t, testkit.S3Storage(t, stub))
+	req, err := testkit.Process(t, origin, "photos/cat.jpg", "f=jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(testkit.Output(t, req), cat) {
+		t.Fatal("output differs from the stored object")
+	}
+	if stub.Requests["GET"] == 0 {
+		t.Fatal("original was not fetched from the stub")
+	}
+}
+
+func TestProcessOriginOptions(t *testing.T) {
+	fs := testkit.NewMemFS(map[string][]byte{"photos/cat.jpg": readFixture(t, "cat.jpg")})
+
+	origin := testkit.NewOrigin(t, testkit.Storage(fs))
+	origin.ForcedOptions, origin.DeniedFormats = "f=gif", "gif"
+	if _, err := testkit.Process(t, origin, "photos/cat.jpg", "f=webp"); !errors.Is(err, media.ErrFormatNotAllowed) {
+		t.Fatalf("forced format: got %v, want %v", err, media.ErrFormatNotAllowed)
+	}
+
+	origin = testkit.NewOrigin(t, testkit.Storage(fs))
+	origin.Project.DisabledEncoders = "image"
+	if _, err := testkit.Process(t, origin, "photos/cat.jpg", "w=8"); err == nil {
+		t.Fatal("resize ran although image processing is disabled")
+	}
+	if _, err := testkit.Process(t, origin, "photos/cat.jpg", ""); err != nil {
+		t.Fatalf("passthrough with image processing disabled: %v", err)
+	}
+}
+
+// encodedImage is what the golden files of resized images record: encoded
+// bytes differ between ImageMagick versions, format and size do not.
+type encodedImage struct {
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+func decodeOutput(t *testing.T, req *media.Request) encodedImage {
+	t.Helper()
+	if req.ProcessedFilePath == "" {
+		t.Fatal("no encoder ran")
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(testkit.Output(t, req)))
+	if err != nil {
+		t.Fatalf("decode output: %v", err)
+	}
+	return encodedImage{Format: format, Width: config.Width, Height: config.Height}
+}
+
+// The 64x48 fixture resized to 32 wide keeps its aspect ratio.
+func TestProcessResize(t *testing.T) {
+	testkit.RequireCommand(t, "convert")
+	fs := testkit.NewMemFS(map[string][]byte{"photos/cat.jpg": readFixture(t, "cat.jpg")})
+	origin := testkit.NewOrigin(t, testkit.Storage(fs))
+	req, err := testkit.Process(t, origin, "photos/cat.jpg", "w=32&f=png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testkit.GoldenJSON(t, "cat-w32.png.json", decodeOutput(t, req))
+}
+
+// Default options turn an option-less request into the same resize.
+func TestProcessDefaultOptions(t *testing.T) {
+	testkit.RequireCommand(t, "convert")
+	fs := testkit.NewMemFS(map[string][]byte{"photos/cat.jpg": readFixture(t, "cat.jpg")})
+	origin := testkit.NewOrigin(t, testkit.Storage(fs))
+	origin.DefaultOptions = "w=32&f=png"
+	req, err := testkit.Process(t, origin, "photos/cat.jpg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testkit.GoldenJSON(t, "cat-w32.png.json", decodeOutput(t, req))
+}
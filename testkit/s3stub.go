@@ -0,0 +1,361 @@
+package testkit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// S3Stub is a single-bucket S3 endpoint covering the calls the s3 storage
+// makes: bucket checks, object HEAD/GET (with ranges), PUT, multipart
+// uploads, server-side copy, DELETE and ListObjectsV2. Signatures are not
+// verified.
+type S3Stub struct {
+	Bucket string
+	Server *httptest.Server
+
+	mu      sync.RWMutex
+	objects map[string]memFile
+	// uploads holds the parts of unfinished multipart uploads by upload ID.
+	uploads map[string]map[int][]byte
+	nextID  int
+	// Requests counts requests by method, e.g. Requests["GET"].
+	Requests map[string]int
+}
+
+// NewS3Stub starts a stub serving bucket; it is closed with the test.
+func NewS3Stub(t testing.TB, bucket string) *S3Stub {
+	t.Helper()
+	s := &S3Stub{Bucket: bucket, objects: map[string]memFile{}, uploads: map[string]map[int][]byte{}, Requests: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Server.Close)
+	return s
+}
+
+// ConfigString returns the s3 storage config_string pointing at the stub.
+func (s *S3Stub) ConfigString() string {
+	return "s3://test:test@" + strings.TrimPrefix(s.Server.URL, "http://") + "/" + s.Bucket + "?IgnoreSSL=true&Region=us-east-1"
+}
+
+// Put stores an object directly, bypassing HTTP.
+func (s *S3Stub) Put(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[clean(key)] = memFile{data: bytes.Clone(data), mod: time.Now().UTC().Truncate(time.Second)}
+}
+
+// Get returns an object and whether it exists.
+func (s *S3Stub) Get(key string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.objects[clean(key)]
+	return bytes.Clone(f.data), ok
+}
+
+// Keys returns the stored object keys in order.
+func (s *S3Stub) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *S3Stub) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.Requests[r.Method]++
+	s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.Bucket {
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodGet && r.URL.Query().Has("location"):
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Region  string   `xml:",chardata"`
+			}{Region: "us-east-1"})
+		case r.Method == http.MethodGet:
+			s.list(w, r)
+		default:
+			s3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+
+	if q := r.URL.Query(); q.Has("uploads") || q.Has("uploadId") {
+		s.multipart(w, r, key)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		s.mu.RLock()
+		f, ok := s.objects[key]
+		s.mu.RUnlock()
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(f.data))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, key, f.mod, bytes.NewReader(f.data))
+	case http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			s.copy(w, r, src, key)
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			s3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.Put(key, data)
+		w.Header().Set("ETag", etag(data))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// multipart serves CreateMultipartUpload, UploadPart,
+// CompleteMultipartUpload and AbortMultipartUpload, which PutObject uses for
+// streams of unknown size.
+func (s *S3Stub) multipart(w http.ResponseWriter, r *http.Request, key string) {
+	q := r.URL.Query()
+	id := q.Get("uploadId")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts, ok := s.uploads[id]
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		s.nextID++
+		id = strconv.Itoa(s.nextID)
+		s.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: s.Bucket, Key: key, UploadId: id})
+	case !ok:
+		s3Error(w, r, http.StatusNotFound, "NoSuchUpload")
+	case r.Method == http.MethodPut:
+		n, err := strconv.Atoi(q.Get("partNumber"))
+		data, bodyErr := readBody(r)
+		if err != nil || bodyErr != nil {
+			s3Error(w, r, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		parts[n] = data
+		w.Header().Set("ETag", etag(data))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPost:
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		delete(s.uploads, id)
+		s.objects[key] = memFile{data: data, mod: time.Now().UTC().Truncate(time.Second)}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: s.Bucket, Key: key, ETag: etag(data)})
+	case r.Method == http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *S3Stub) copy(w http.ResponseWriter, r *http.Request, src, dst string) {
+	src, _ = url.PathUnescape(src)
+	_, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+	data, ok := s.Get(srcKey)
+	if !ok {
+		s3Error(w, r, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	s.Put(dst, data)
+	writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: etag(data), LastModified: time.Now().UTC().Format(time.RFC3339)})
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+func (s *S3Stub) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	after := q.Get("start-after")
+	if token := q.Get("continuation-token"); token != "" {
+		after = token
+	}
+	maxKeys := 1000
+	if n, err := strconv.Atoi(q.Get("max-keys")); err == nil && n > 0 {
+		maxKeys = n
+	}
+
+	var contents []s3Object
+	var prefixes []s3Prefix
+	seen := map[string]bool{}
+	truncated, last := false, ""
+	keys := s.Keys()
+	s.mu.RLock()
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		if len(contents)+len(prefixes) == maxKeys {
+			truncated = true
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					prefixes = append(prefixes, s3Prefix{Prefix: p})
+				}
+				last = key
+				continue
+			}
+		}
+		f, ok := s.objects[key]
+		if !ok {
+			continue
+		}
+		contents = append(contents, s3Object{
+			Key:          key,
+			LastModified: f.mod.Format(time.RFC3339),
+			ETag:         etag(f.data),
+			Size:         int64(len(f.data)),
+			StorageClass: "STANDARD",
+		})
+		last = key
+	}
+	s.mu.RUnlock()
+
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []s3Object
+		CommonPrefixes        []s3Prefix
+	}{
+		Name: s.Bucket, Prefix: prefix, Delimiter: delimiter,
+		KeyCount: len(contents) + len(prefixes), MaxKeys: maxKeys,
+		IsTruncated: truncated, Contents: contents, CommonPrefixes: prefixes,
+	}
+	if truncated {
+		result.NextContinuationToken = last
+	}
+	writeXML(w, result)
+}
+
+// readBody returns the object payload, decoding aws-chunked uploads which
+// the client uses over plain HTTP.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var out bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return out.Bytes(), nil
+		}
+		if _, err := io.CopyN(&out, br, size); err != nil {
+			return nil, err
+		}
+		if _, err := br.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: code, Message: fmt.Sprintf("%s: %s", code, r.URL.Path), Resource: r.URL.Path})
+}
@@ -0,0 +1,145 @@
+package testkit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getevo/filesystem"
+)
+
+// storageFiles are the objects RunStorageSuite expects seeded, covering
+// nested keys and a name with a space.
+var storageFiles = map[string][]byte{
+	"top.txt":             []byte("top"),
+	"photos/cat.jpg":      []byte("not really a jpeg"),
+	"photos/2024/dog.png": []byte("not really a png"),
+	"docs/read me.txt":    []byte("spaced"),
+}
+
+// RunStorageSuite checks a storage backend against the behaviour staging
+// and the admin tools rely on, so every backend is held to the same
+// contract. seed must store data under key in the backend behind fsys; it
+// is called before the checks. Backends that are not writable only run the
+// read checks.
+func RunStorageSuite(t *testing.T, fsys filesystem.Interface, seed func(key string, data []byte), writable bool) {
+	t.Helper()
+	for key, data := range storageFiles {
+		seed(key, data)
+	}
+
+	t.Run("read", func(t *testing.T) {
+		for key, want := range storageFiles {
+			got, err := fsys.Read(key)
+			if err != nil {
+				t.Fatalf("Read(%q): %v", key, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("Read(%q) = %q, want %q", key, got, want)
+			}
+		}
+		if _, err := fsys.Read("photos/missing.jpg"); err == nil {
+			t.Fatal("Read of a missing key succeeded")
+		}
+	})
+
+	t.Run("exists", func(t *testing.T) {
+		for key := range storageFiles {
+			if ok, err := fsys.Exists(key); err != nil || !ok {
+				t.Fatalf("Exists(%q) = %v, %v", key, ok, err)
+			}
+			if ok, err := fsys.IsFile(key); err != nil || !ok {
+				t.Fatalf("IsFile(%q) = %v, %v", key, ok, err)
+			}
+		}
+		if ok, _ := fsys.Exists("photos/missing.jpg"); ok {
+			t.Fatal("Exists reports a missing key")
+		}
+		if ok, _ := fsys.Exists("photos/cat"); ok {
+			t.Fatal("Exists matches a key prefix")
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		for key, data := range storageFiles {
+			info, err := fsys.Stat(key)
+			if err != nil {
+				t.Fatalf("Stat(%q): %v", key, err)
+			}
+			if info.Size() != int64(len(data)) || info.Name() != filepath.Base(key) {
+				t.Fatalf("Stat(%q) = %s, %d bytes", key, info.Name(), info.Size())
+			}
+		}
+		if _, err := fsys.Stat("photos/missing.jpg"); err == nil {
+			t.Fatal("Stat of a missing key succeeded")
+		}
+	})
+
+	t.Run("storage to disk", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "nested", "dog.png")
+		if err := fsys.StorageToDisk("photos/2024/dog.png", dst); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(dst)
+		if err != nil || !bytes.Equal(got, storageFiles["photos/2024/dog.png"]) {
+			t.Fatalf("downloaded %q, %v", got, err)
+		}
+	})
+
+	if !writable {
+		return
+	}
+
+	t.Run("write", func(t *testing.T) {
+		if err := fsys.Write("new/deep/file.txt", []byte("written")); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := fsys.Read("new/deep/file.txt"); err != nil || string(got) != "written" {
+			t.Fatalf("read back %q, %v", got, err)
+		}
+		if err := fsys.WriteBuffer("new/buffer.txt", bytes.NewReader([]byte("buffered"))); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := fsys.Read("new/buffer.txt"); err != nil || string(got) != "buffered" {
+			t.Fatalf("read back %q, %v", got, err)
+		}
+	})
+
+	t.Run("disk to storage", func(t *testing.T) {
+		src := filepath.Join(t.TempDir(), "upload.bin")
+		if err := os.WriteFile(src, []byte("uploaded"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := fsys.DiskToStorage(src, "uploads/2024/upload.bin"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := fsys.Read("uploads/2024/upload.bin"); err != nil || string(got) != "uploaded" {
+			t.Fatalf("read back %q, %v", got, err)
+		}
+	})
+
+	t.Run("copy move delete", func(t *testing.T) {
+		if err := fsys.Copy("top.txt", "copies/top.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := fsys.Read("copies/top.txt"); err != nil || string(got) != "top" {
+			t.Fatalf("copy read back %q, %v", got, err)
+		}
+		if err := fsys.Move("copies/top.txt", "moved/top.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := fsys.Exists("copies/top.txt"); ok {
+			t.Fatal("Move kept the source")
+		}
+		if err := fsys.Delete("moved/top.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := fsys.Exists("moved/top.txt"); ok {
+			t.Fatal("Delete kept the key")
+		}
+		if ok, _ := fsys.Exists("top.txt"); !ok {
+			t.Fatal("Copy or Move removed the original")
+		}
+	})
+}
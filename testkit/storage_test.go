@@ -0,0 +1,69 @@
+package testkit_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mediax/apps/media/httpfs"
+	"mediax/apps/media/localfs"
+	"mediax/testkit"
+)
+
+// The storage backends share one suite, so a fix to how one of them joins
+// or resolves keys is checked against all of them.
+
+func TestMemFSStorage(t *testing.T) {
+	fsys := testkit.NewMemFS(nil)
+	testkit.RunStorageSuite(t, fsys, func(key string, data []byte) {
+		if err := fsys.Write(key, data); err != nil {
+			t.Fatal(err)
+		}
+	}, true)
+}
+
+func TestLocalStorage(t *testing.T) {
+	root := t.TempDir()
+	fsys := &localfs.FileSystem{Path: filepath.Join(root, "storage")}
+	testkit.RunStorageSuite(t, fsys, writeFile(t, fsys.Path), true)
+
+	writeFile(t, root)("secret.txt", []byte("outside"))
+	for _, key := range []string{"../secret.txt", "../storage-other/x"} {
+		if _, err := fsys.Read(key); err == nil {
+			t.Fatalf("Read(%q) left the storage directory", key)
+		}
+	}
+	if err := fsys.Delete(".."); err == nil {
+		t.Fatal("Delete(\"..\") left the storage directory")
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	stub := testkit.NewS3Stub(t, "media")
+	testkit.RunStorageSuite(t, testkit.S3Storage(t, stub).FS, stub.Put, true)
+}
+
+func TestHTTPStorage(t *testing.T) {
+	root := t.TempDir()
+	server := httptest.NewServer(http.FileServer(http.Dir(root)))
+	t.Cleanup(server.Close)
+	fsys, err := httpfs.New(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testkit.RunStorageSuite(t, fsys, writeFile(t, root), false)
+}
+
+func writeFile(t *testing.T, root string) func(key string, data []byte) {
+	return func(key string, data []byte) {
+		file := filepath.Join(root, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}